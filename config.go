@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A flag setting read from a -config file
+type configSetting struct {
+	name  string
+	value string
+	line  int
+}
+
+// Read a -config file: flag settings in a small subset of TOML, one
+// "name = value" per line with the flag's name as the key, e.g.
+//
+//	# server settings
+//	i = "0.0.0.0:8080"
+//	psk-file = "/etc/shadowx/psk"
+//	idle-timeout = "10m"
+//	no-clobber = true
+//
+// Values are quoted strings, booleans or numbers. Blank lines and comments
+// starting with # are skipped; tables and repeated keys are errors.
+func readConfig(path string) ([]configSetting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings []configSetting
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: tables aren't supported, put every setting at the top level", path, n)
+		}
+		name, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want name = value", path, n)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t\"'") {
+			return nil, fmt.Errorf("%s:%d: invalid name %q", path, n, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, name)
+		}
+		seen[name] = true
+		value, err := configValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, name, err)
+		}
+		settings = append(settings, configSetting{name: name, value: value, line: n})
+	}
+	return settings, scanner.Err()
+}
+
+// Decode a TOML value into the string its flag would be given, dropping a
+// trailing comment
+func configValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		// The closing quote is the first one not escaped
+		end := 1
+		for ; end < len(raw); end++ {
+			if raw[end] == '\\' {
+				end++
+			} else if raw[end] == '"' {
+				break
+			}
+		}
+		if end >= len(raw) {
+			return "", errors.New("unterminated string")
+		}
+		if err := checkTrailing(raw[end+1:]); err != nil {
+			return "", err
+		}
+		return strconv.Unquote(raw[:end+1])
+	case strings.HasPrefix(raw, "'"):
+		value, rest, ok := strings.Cut(raw[1:], "'")
+		if !ok {
+			return "", errors.New("unterminated string")
+		}
+		return value, checkTrailing(rest)
+	}
+	value, _, _ := strings.Cut(raw, "#")
+	value = strings.TrimSpace(value)
+	if value == "true" || value == "false" {
+		return value, nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); err != nil {
+		return "", fmt.Errorf("%q isn't a string, boolean or number; quote strings, as in \"30s\"", value)
+	}
+	return strings.ReplaceAll(value, "_", ""), nil
+}
+
+// Only a comment may follow a quoted value
+func checkTrailing(rest string) error {
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after the value", rest)
+	}
+	return nil
+}
+
+// Set the flags named in the -config file at path, except those given on the
+// command line, which take precedence. Names that aren't flags are errors.
+func applyConfig(flags *flag.FlagSet, path string) error {
+	settings, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	// Keyed by value so that setting -o on the command line also keeps the
+	// file's out or output from overriding it
+	explicit := make(map[flag.Value]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Value] = true })
+	for _, s := range settings {
+		if s.name == "config" {
+			return fmt.Errorf("%s:%d: a config file can't name another", path, s.line)
+		}
+		f := flags.Lookup(s.name)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, s.line, s.name)
+		}
+		if explicit[f.Value] {
+			continue
+		}
+		if err := flags.Set(s.name, s.value); err != nil {
+			return fmt.Errorf("%s:%d: %s: %w", path, s.line, s.name, err)
+		}
+	}
+	return nil
+}
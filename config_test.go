@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bhanunamikaze/ShadowX/shadowx"
+)
+
+func TestConfigValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{`"0.0.0.0:8080"`, "0.0.0.0:8080", true},
+		{`"C:\\keys\\psk" # Windows`, `C:\keys\psk`, true},
+		{`"say \"hi\""`, `say "hi"`, true},
+		{`'C:\keys\psk'`, `C:\keys\psk`, true},
+		{"true", "true", true},
+		{"false # default", "false", true},
+		{"8", "8", true},
+		{"1_000", "1000", true},
+		{"2.5", "2.5", true},
+		{"30s", "", false},
+		{`"unterminated`, "", false},
+		{`'unterminated`, "", false},
+		{`"a" "b"`, "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := configValue(tt.raw)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("configValue(%q) = %q, %v; want %q, ok %v", tt.raw, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// Test flags, with out aliased as o like the real -out
+func testFlags() (*flag.FlagSet, *string, *bool, *time.Duration, *int) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	out := flags.String("out", "received", "")
+	flags.StringVar(out, "o", "received", "")
+	noClobber := flags.Bool("no-clobber", false, "")
+	idle := flags.Duration("idle-timeout", 5*time.Minute, "")
+	parallel := flags.Int("parallel", 1, "")
+	flags.String("config", "", "")
+	return flags, out, noClobber, idle, parallel
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "shadowx.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyConfig(t *testing.T) {
+	path := writeConfig(t, "# server\n\nout = \"/srv/incoming\"\nno-clobber = true\nidle-timeout = \"10m\"\nparallel = 4\n")
+
+	flags, out, noClobber, idle, parallel := testFlags()
+	flags.Parse([]string{"-o", "elsewhere", "-parallel", "2"})
+	if err := applyConfig(flags, path); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+	if *out != "elsewhere" || *parallel != 2 {
+		t.Errorf("command-line flags were overridden: out %q, parallel %d", *out, *parallel)
+	}
+	if !*noClobber || *idle != 10*time.Minute {
+		t.Errorf("file settings not applied: no-clobber %v, idle-timeout %v", *noClobber, *idle)
+	}
+
+	flags, out, _, _, _ = testFlags()
+	flags.Parse(nil)
+	if err := applyConfig(flags, path); err != nil || *out != "/srv/incoming" {
+		t.Errorf("applyConfig without flags: out %q, %v", *out, err)
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown setting", "outdir = \"x\"\n", `:1: unknown setting "outdir"`},
+		{"repeated setting", "parallel = 2\nparallel = 3\n", ":2: parallel is set twice"},
+		{"table", "[server]\nout = \"x\"\n", ":1: tables aren't supported"},
+		{"no value", "no-clobber\n", ":1: want name = value"},
+		{"bad flag value", "parallel = \"many\"\n", ":1: parallel: parse error"},
+		{"unquoted string", "idle-timeout = 10m\n", ":1: idle-timeout:"},
+		{"nested config", "config = \"other.toml\"\n", ":1: a config file can't name another"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags, _, _, _, _ := testFlags()
+			flags.Parse(nil)
+			err := applyConfig(flags, writeConfig(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("applyConfig = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+	flags, _, _, _, _ := testFlags()
+	if err := applyConfig(flags, filepath.Join(t.TempDir(), "missing.toml")); !os.IsNotExist(err) {
+		t.Errorf("applyConfig of a missing file = %v, want not-exist", err)
+	}
+}
+
+// List flags take repeated and comma-separated values alike, so a config
+// file can set several in one string
+func TestListFlag(t *testing.T) {
+	tests := []struct {
+		args   []string
+		config string
+		want   string
+	}{
+		{[]string{"-allow", "10.0.0.0/8"}, "", "10.0.0.0/8"},
+		{[]string{"-allow", "10.0.0.0/8", "-allow", "192.168.1.0/24, 2001:db8::/32"}, "", "10.0.0.0/8,192.168.1.0/24,2001:db8::/32"},
+		{[]string{"-allow", "10.0.0.0/8,,"}, "", "10.0.0.0/8"},
+		{nil, `allow = "10.0.0.0/8,192.0.2.1"`, "10.0.0.0/8,192.0.2.1"},
+		{[]string{"-allow", "10.0.0.0/8"}, `allow = "192.0.2.1"`, "10.0.0.0/8"},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		var allow listFlag
+		flags.Var(&allow, "allow", "")
+		flags.String("config", "", "")
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if tt.config != "" {
+			if err := applyConfig(flags, writeConfig(t, tt.config)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := allow.String(); got != tt.want {
+			t.Errorf("%q with config %q = %q, want %q", tt.args, tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestPrintListing(t *testing.T) {
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	var out bytes.Buffer
+	printListing(&out, []shadowx.RemoteFile{
+		{Name: "a.txt", Type: "file", Size: 1234, ModTime: mtime},
+		{Name: "docs", Type: "dir", ModTime: mtime},
+		{Name: "alias", Type: "link", ModTime: mtime},
+		{Name: "broken", Type: "file", Size: -1, ModTime: mtime},
+	})
+	want := "TYPE  SIZE  MODIFIED             NAME\n" +
+		"file  1234  2026-01-02 03:04:05  a.txt\n" +
+		"dir   -     2026-01-02 03:04:05  docs/\n" +
+		"link  -     2026-01-02 03:04:05  alias\n" +
+		"file  ?     2026-01-02 03:04:05  broken\n"
+	if out.String() != want {
+		t.Errorf("printed\n%s\nwant\n%s", out.String(), want)
+	}
+}
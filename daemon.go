@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variable marking the re-executed, detached server process
+const daemonEnv = "SHADOWX_DAEMON"
+
+// The detached child reports on this descriptor, the write end of a pipe
+// its parent waits on, either daemonReady once it's listening or why it
+// couldn't start
+const (
+	daemonReadyFD = 3
+	daemonReady   = "ready"
+)
+
+var reportOnce sync.Once
+
+// Whether this process is the detached child started by -daemon
+func isDaemonChild() bool {
+	return os.Getenv(daemonEnv) == "1"
+}
+
+// Write the current process ID to path, refusing to replace the PID file
+// of a server that is still running
+func writePIDFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("%s belongs to running process %d", path, pid)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Tell the parent waiting in spawnDaemon that the detached child is
+// listening, when err is nil, or why it's exiting. Only the first report
+// counts, and outside the child it does nothing.
+func reportStarted(err error) {
+	if !isDaemonChild() {
+		return
+	}
+	reportOnce.Do(func() {
+		pipe := os.NewFile(daemonReadyFD, "daemon-ready")
+		defer pipe.Close()
+		if err != nil {
+			fmt.Fprintln(pipe, err)
+			return
+		}
+		fmt.Fprintln(pipe, daemonReady)
+	})
+}
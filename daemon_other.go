@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// Detaching from the terminal is not supported on this platform
+func spawnDaemon(logPath string) (int, error) {
+	return 0, errors.New("-daemon is not supported on this platform")
+}
+
+// Without a portable way to probe a process, assume a recorded PID is stale
+func processRunning(pid int) bool {
+	return false
+}
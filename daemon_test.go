@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shadowx.pid")
+
+	// A stale PID file is replaced
+	if err := os.WriteFile(path, []byte("999999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Fatalf("writePIDFile over a stale file: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("PID file holds %q, want %d", got, os.Getpid())
+	}
+
+	// Our own PID file can be rewritten
+	if err := writePIDFile(path); err != nil {
+		t.Errorf("writePIDFile over our own file: %v", err)
+	}
+
+	// Another live process keeps its PID file
+	parent := os.Getppid()
+	if !processRunning(parent) {
+		t.Skip("can't probe processes on this platform")
+	}
+	os.WriteFile(path, []byte(strconv.Itoa(parent)+"\n"), 0644)
+	if err := writePIDFile(path); err == nil {
+		t.Error("writePIDFile replaced the PID file of a running process")
+	}
+}
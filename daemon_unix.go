@@ -0,0 +1,63 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Re-execute the server detached from the terminal in a new session, with
+// output appended to logPath, and wait until it's listening. Returns the PID
+// of the background process, or why it failed to start.
+func spawnDaemon(logPath string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	ready, started, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	cmd.ExtraFiles = []*os.File{started}
+	err = cmd.Start()
+	// Only the child holds the write end now, so reading ends once it
+	// reports or exits
+	started.Close()
+	if err != nil {
+		return 0, err
+	}
+	report, _ := io.ReadAll(ready)
+	if status := strings.TrimSpace(string(report)); status != daemonReady {
+		cmd.Wait()
+		if status == "" {
+			status = "exited before it was listening"
+		}
+		return 0, fmt.Errorf("%s, see %s", status, logPath)
+	}
+	pid := cmd.Process.Pid
+	cmd.Process.Release()
+	return pid, nil
+}
+
+// Whether a process with this PID exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
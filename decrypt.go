@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bhanunamikaze/ShadowX/shadowx"
+)
+
+// Decrypt a file a server stored with -encrypt-at-rest:
+//
+//	ShadowX decrypt [-storage-key key | -p psk | -psk-file file] <file> [<output>]
+//
+// writing to standard output when output is missing or -
+func runDecrypt(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	password := flags.String("p", "", "Pre-Shared Key the server encrypted with, when it had no -storage-key; $"+shadowx.PSKEnv+" works too")
+	pskFile := flags.String("psk-file", "", "Read the PSK from this file, less a trailing newline")
+	storageKey := flags.String("storage-key", "", "Storage key the server encrypted with")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decrypt [flags] <file> [<output>]\n\nDecrypt a file stored with -encrypt-at-rest, to standard output when output is missing or -.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	key := *storageKey
+	if key == "" {
+		var err error
+		if key, err = shadowx.LoadKey(*password, *pskFile); err != nil {
+			return err
+		}
+	}
+	src, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dest := flags.Arg(1)
+	if dest == "" || dest == "-" {
+		if err := shadowx.DecryptFile(os.Stdout, src, key); err != nil {
+			return fmt.Errorf("decrypting %s: %w", flags.Arg(0), err)
+		}
+		return nil
+	}
+	// Never overwrite, and don't leave part of a file that failed to decrypt
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = shadowx.DecryptFile(out, src, key)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("decrypting %s: %w", flags.Arg(0), err)
+	}
+	return nil
+}
@@ -1,3 +1,14 @@
-module main
+module github.com/bhanunamikaze/ShadowX
 
 go 1.24.1
+
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/term v0.40.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
@@ -1,321 +1,510 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"math/big"
-	"net"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
+
+	"github.com/bhanunamikaze/ShadowX/shadowx"
 )
 
-const bufferSize = 4096
+// Exit status when the server rejects the pre-shared key; 1 is any other
+// failure and 2 a usage error
+const exitAuthFailed = 3
 
-// Generate a self-signed TLS certificate
-func generateTLSCert(certFile, keyFile string) error {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+// Main function; exits with status 1 when anything fails, so scripts can
+// tell a failed transfer from a successful one, or exitAuthFailed when the
+// key was wrong
+func main() {
+	err := run()
 	if err != nil {
-		return err
+		// A detached server that couldn't start tells the parent waiting on it why
+		reportStarted(err)
+	}
+	var sendErr *shadowx.SendError
+	var logged loggedError
+	switch {
+	case errors.As(err, &logged):
+		// Already logged, ahead of the summary that ends the output
+	case errors.As(err, &sendErr):
+		slog.Error("Failed to send paths", "failed", len(sendErr.Failed))
+		for _, f := range sendErr.Failed {
+			slog.Error("Failed to send", "path", f.Path, "err", f.Err)
+		}
+	case err != nil:
+		slog.Error(err.Error())
+	default:
+		return
+	}
+	if errors.Is(err, shadowx.ErrAuthFailed) {
+		os.Exit(exitAuthFailed)
 	}
+	os.Exit(1)
+}
 
-	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour)
+// A failure that was logged as it happened, so main only sets the exit status
+type loggedError struct{ error }
 
-	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-	if err != nil {
-		return err
-	}
+func (e loggedError) Unwrap() error { return e.error }
 
-	tmpl := x509.Certificate{
-		SerialNumber: sn,
-		Subject:      pkix.Name{Organization: []string{"ShadowX Secure File Transfer"}},
-		NotBefore:    notBefore,
-		NotAfter:     notAfter,
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IsCA:         true,
+// With -quiet-success each failed path was logged when it failed and the
+// summary line comes last, so the failures aren't listed again after it
+func quietFailures(quietSuccess bool, err error) error {
+	var sendErr *shadowx.SendError
+	if quietSuccess && errors.As(err, &sendErr) {
+		return loggedError{err}
 	}
+	return err
+}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
-	if err != nil {
-		return err
+// Run the client or server the flags ask for, or the decrypt command
+func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		return runDecrypt(os.Args[2:])
 	}
+	ip := flag.String("i", "127.0.0.1:8080", "Address to listen on (server) or connect to (client) as host:port, e.g. 0.0.0.0:8080, [::]:8080 or example.com:8080, or a Unix socket as unix:/run/shadowx.sock")
+	socketTLS := flag.Bool("socket-tls", false, "Use TLS on a Unix socket given with -i unix:<path> too; both sides must agree")
+	noTLS := flag.Bool("no-tls", false, "Use plain TCP without TLS, so data and the PSK cross the network unencrypted; only for trusted networks, and both sides must agree")
+	password := flag.String("p", "", "Pre-Shared Key (PSK) for authentication; visible in ps output, so prefer $"+shadowx.PSKEnv+" or -psk-file")
+	pskFile := flag.String("psk-file", "", "Read the PSK from this file, less a trailing newline; -p and $"+shadowx.PSKEnv+" take precedence")
+	pskHash := flag.String("psk-hash", "", "Check clients' keys against this hash from -hash-psk, so the server never holds the key; replaces -p, -psk-file and $"+shadowx.PSKEnv+" (server mode)")
+	hashPSK := flag.Bool("hash-psk", false, "Print the hash of the PSK for a server's -psk-hash and exit")
+	pskDirs := flag.String("psk-dirs", "", "File of further keys, one key:dir per line, whose uploads are stored under their own directory instead of -o (server mode)")
+	filePath := flag.String("f", "", "File or directory to send, - for standard input, or an http:// or https:// URL to fetch and send")
+	fromList := flag.String("from-list", "", "Send the files and directories listed in this file, one path per line, skipping blank lines and # comments (client mode)")
+	name := flag.String("name", "stdin", "Name the server stores data sent with -f - under (client mode)")
+	as := flag.String("as", "", "Name the server stores a single file under instead of its own, without any directory (client mode)")
+	downloadPath := flag.String("d", "", "File to download from the server into the current directory")
+	listDir := flag.String("list", "", "Directory on the server to list, . for its root (client mode)")
+	device := flag.String("dev", "", "Write received data to this existing device instead of a file (server mode)")
+	hashNames := flag.Bool("hash-names", false, "Store received files as <HMAC-SHA256 of name>.dat and record real names in the -manifest (server mode)")
+	outDir := flag.String("out", shadowx.DefaultOutDir, "Directory received files are written under, or - to write a single upload to standard output and exit (server mode)")
+	flag.StringVar(outDir, "o", shadowx.DefaultOutDir, "Same as -out")
+	flag.StringVar(outDir, "output", shadowx.DefaultOutDir, "Same as -out")
+	createDest := flag.Bool("create-dest", false, "Create the -out directory at startup if it doesn't exist; the default one always is (server mode)")
+	manifestPath := flag.String("manifest", "", "Append a JSON record of every received file to this file (server mode)")
+	denyHashes := flag.String("deny-hashes", "", "Reject files whose SHA-256 is listed in this file (server mode)")
+	newerThan := flag.String("newer-than", "", "Only send files modified after this duration ago, timestamp or file's modification time, e.g. 24h (client mode)")
+	olderThan := flag.String("older-than", "", "Only send files modified before this duration ago, timestamp or file's modification time (client mode)")
+	maxSize := flag.String("max-size", "", "Skip files larger than this size, e.g. 500M (client mode)")
+	dane := flag.Bool("dane", false, "Verify the server certificate against its DNSSEC-signed TLSA record; -i must use a hostname (client mode)")
+	checksumCachePath := flag.String("checksum-cache", "", "Cache SHA-256 digests of unchanged files in this file instead of rehashing them (client mode)")
+	resume := flag.Bool("resume", false, "Resume interrupted uploads using the tokens the server assigned (client mode)")
+	resumeDirs := flag.Bool("resume-dir", false, "With -resume, send directories as sessions the server keeps, so a run started again after being killed skips the files already stored (client mode)")
+	resumeStatePath := flag.String("resume-state", ".shadowx-resume.json", "File that keeps upload tokens for -resume (client mode)")
+	requireStrongKey := flag.Bool("require-strong-key", false, "Refuse to run with a PSK shorter than -min-key-length or weaker than -min-key-entropy (otherwise only warn)")
+	minKeyLength := flag.Int("min-key-length", 16, "Minimum PSK length in characters for the strength check")
+	minKeyEntropy := flag.Float64("min-key-entropy", 64, "Minimum estimated PSK entropy in bits for the strength check")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve, such as one from Let's Encrypt, instead of the generated server.crt; never overwritten (server mode)")
+	tlsKey := flag.String("tls-key", "", "Private key for -tls-cert (server mode)")
+	certHost := flag.String("cert-host", "", "Comma-separated hostnames and IP addresses the generated certificate is valid for; defaults to the -i host, or this machine's hostname and loopback when listening on all interfaces (server mode)")
+	clientCA := flag.String("client-ca", "", "Require clients to present a certificate signed by a CA in this PEM bundle (server mode)")
+	pin := flag.String("pin", "", "Only accept a server whose public key has this SHA-256 fingerprint, as printed by the server (client mode)")
+	caFile := flag.String("ca", "", "Verify the server certificate against the CAs in this PEM bundle (client mode)")
+	knownHosts := flag.String("known-hosts", "", "Trust each server on first use: record its fingerprint in this file and refuse it if the fingerprint changes (client mode)")
+	certFile := flag.String("cert", "", "Client certificate to present to a server started with -client-ca (client mode)")
+	keyFile := flag.String("key", "", "Private key for -cert (client mode)")
+	immutable := flag.Bool("immutable", false, "Make received files write-once: set the immutable attribute, or read-only permissions where that fails, and refuse to overwrite them (server mode)")
+	allowDelete := flag.Bool("allow-delete", false, "Delete received files when a client watching with -watch-deletes reports them removed (server mode)")
+	noClobber := flag.Bool("no-clobber", false, "Never overwrite a received file: store uploads of a name that's taken as <name>.1, <name>.2 and so on (server mode)")
+	httpAddr := flag.String("http-addr", "", "Also serve the -out directory read-only over HTTPS on this address, authenticated with the PSK (server mode)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics at /metrics over plain HTTP on this address (server mode)")
+	daemon := flag.Bool("daemon", false, "Run the server in the background, detached from the terminal (server mode)")
+	pidFile := flag.String("pidfile", "", "Write the server's process ID to this file (server mode)")
+	logFile := flag.String("log-file", "shadowx.log", "File the output of a -daemon server is appended to (server mode)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "On SIGINT/SIGTERM, wait this long for running transfers before closing their connections, 0 to wait indefinitely (server mode)")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "Drop clients that take longer than this for the TLS handshake, and again for sending the key and request, 0 for no limit (server mode)")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "Drop transfers that receive no data for this long, 0 for no limit (server mode)")
+	maxAuthFailures := flag.Int("max-auth-failures", 10, "Refuse connections from an IP address for a growing time after this many failed authentications, 0 for no limit (server mode)")
+	maxConns := flag.Int("max-conns", 256, "Maximum number of connections served at once; further ones are closed when accepted, 0 for no limit (server mode)")
+	maxFileSize := flag.String("max-file-size", "", "Refuse uploads larger than this, e.g. 1GB, cutting off and deleting those that don't say their size up front (server mode)")
+	maxDisk := flag.String("max-disk", "", "Most bytes a client may store over one connection, a single upload or a session of many, e.g. 10GB (server mode)")
+	reserve := flag.String("reserve", "", "Free space to keep on the output volume, refusing uploads that would eat into it, e.g. 10GB (server mode)")
+	encryptAtRest := flag.Bool("encrypt-at-rest", false, "Encrypt received files on disk with AES-256-GCM under a key derived from the PSK; recover them with the decrypt command (server mode)")
+	storageKey := flag.String("storage-key", "", "Encrypt received files on disk with this key instead of the PSK; implies -encrypt-at-rest (server mode)")
+	var allow, deny listFlag
+	flag.Var(&allow, "allow", "Only let clients in these comma-separated CIDR ranges or IP addresses connect; repeatable (server mode)")
+	flag.Var(&deny, "deny", "Refuse clients in these comma-separated CIDR ranges or IP addresses, even if -allow lets them in; repeatable (server mode)")
+	buffer := flag.String("buffer", "64KB", "Size of the buffers file data is read and written with, e.g. 256KB or 1MB")
+	rate := flag.String("rate", "", "Maximum rate to send and to receive per connection in bytes/s, e.g. 5MB or 500KB; -up-limit and -down-limit override it")
+	upLimit := flag.String("up-limit", "", "Maximum rate to send per connection in bytes/s, with optional K, M or G suffix, e.g. 10M")
+	downLimit := flag.String("down-limit", "", "Maximum rate to receive per connection in bytes/s, with optional K, M or G suffix")
+	jsonEvents := flag.Bool("json", false, "Write progress as JSON events to standard error, one object per line, instead of the live counter (client mode)")
+	preserveSymlinks := flag.Bool("preserve-symlinks", false, "Send symbolic links inside directories as links for the server to recreate, instead of what they point to (client mode)")
+	appendFiles := flag.Bool("append", false, "Append to the server's copy of each file, sending only the bytes past its end, for files such as logs that grow between runs (client mode)")
+	move := flag.Bool("move", false, "Delete each file once the server has confirmed storing it with a matching digest; failed files are kept (client mode)")
+	watch := flag.Bool("watch", false, "Keep watching the -f directory and send each file created or changed in it, until interrupted (client mode)")
+	watchDelay := flag.Duration("watch-delay", shadowx.DefaultWatchDelay, "With -watch, wait until a file has gone this long without changing before sending it (client mode)")
+	watchDeletes := flag.Bool("watch-deletes", false, "With -watch, delete the server's copy of each file removed from the directory; the server needs -allow-delete (client mode)")
+	skipExisting := flag.Bool("skip-existing", false, "Hash the files first and skip those the server already stores with the same size and SHA-256 (client mode)")
+	dryRun := flag.Bool("dry-run", false, "List the files -f would send, with their sizes and a total, without connecting (client mode)")
+	selfTestFlag := flag.Bool("selftest", false, "Check the install and key end to end: send a generated file to a server on a loopback port, compare the stored copy and print PASS or FAIL")
+	verifyOnly := flag.Bool("verify-only", false, "Check that the server's copies of the files -f would send match them, without sending anything (client mode)")
+	runRetries := flag.Int("run-retries", 0, "Resend the files that failed up to this many more times after the run (client mode)")
+	runRetryDelay := flag.Duration("run-retry-delay", 30*time.Second, "Wait this long before each -run-retries pass (client mode)")
+	retries := flag.Int("retries", 0, "Retry a connection that's refused, reset or times out up to this many times, and with -resume an interrupted transfer too (client mode)")
+	httpTimeout := flag.Duration("http-timeout", 30*time.Second, "Fail sending a URL given with -f once it sends no data for this long, 0 for no limit (client mode)")
+	retryDelay := flag.Duration("retry-delay", shadowx.DefaultRetryDelay, "Wait this long before the first -retries attempt, doubling for each further one up to a minute (client mode)")
+	parallel := flag.Int("parallel", 1, "Send up to this many files of a directory at once, each worker on its own connection (client mode)")
+	mux := flag.Bool("mux", false, "Send the files of a directory as interleaved streams of one connection instead of a connection per -parallel worker (client mode)")
+	streams := flag.Int("streams", 1, "Send each file of 2MiB or more over up to this many connections at once, each carrying a byte range (client mode)")
+	batchSize := flag.Int("batch-size", 0, "Send directories in batches of this many files, checkpointing after each so an interrupted run can resume (client mode)")
+	checkpointPath := flag.String("checkpoint", ".shadowx-checkpoint.json", "File that records -batch-size progress (client mode)")
+	var compress compressFlag
+	flag.Var(&compress, "compress", "Compress file data on the wire, for slow links; -compress=zstd picks zstd over gzip (client mode)")
+	preserve := flag.Bool("preserve", false, "Send each file's permission bits, modification time and owner for the server to restore (client mode)")
+	preserveOwner := flag.Bool("preserve-owner", false, "Restore the owner and group IDs clients send with -preserve; needs root, and files it can't change keep the server's (server mode)")
+	preserveBtime := flag.Bool("preserve-btime", false, "Send each file's creation time, where the platform records it, for the server to restore (client mode)")
+	diff := flag.Bool("diff", false, "Send changed text files as a diff against the server's current copy when smaller (client mode)")
+	verify := flag.Bool("verify", false, "Send each file's SHA-256 for the server to check before storing it; mismatches are discarded (client mode)")
+	checksumAlgo := flag.String("checksum-algo", "sha256", "Algorithm file digests are checked with: sha256, sha512 or blake3 (client mode)")
+	verifyRoundtrip := flag.Bool("verify-roundtrip", false, "After each upload, have the server re-read its stored copy and confirm the checksum (client mode)")
+	traceID := flag.String("trace-id", "", "Trace ID recorded with each upload for correlation, defaults to $"+shadowx.TraceIDEnv+" (client mode)")
+	maxHandshakes := flag.Int("max-handshakes", 0, "Maximum number of TLS handshakes in progress at once, 0 for no limit (client mode)")
+	minTLS := flag.String("min-tls", "1.2", "Oldest TLS version to accept, 1.2 or 1.3")
+	ciphers := flag.String("ciphers", "", "Comma-separated TLS 1.2 cipher suites to allow, by Go name, e.g. TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384; empty for Go's secure defaults")
+	configPath := flag.String("config", "", "Read flag settings from this file, one name = value per line; flags on the command line take precedence")
+	verbose := flag.Bool("verbose", false, "Also log debug lines: connections opening and closing, session frames and byte offsets")
+	quiet := flag.Bool("quiet", false, "Only log errors, without progress counters")
+	quietSuccess := flag.Bool("quiet-success", false, "Only log the files that failed, then a line with the totals (client mode)")
 
-	certFileHandle, err := os.Create(certFile)
-	if err != nil {
-		return err
+	flag.Usage = func() {
+		fmt.Println("ShadowX - Secure File Transfer")
+		fmt.Println("\nUsage:")
+		fmt.Println("  Server Mode (default):")
+		fmt.Println("    ./ShadowX -i 0.0.0.0:8080 -p mysecretkey")
+		fmt.Println("    ./ShadowX -i [::]:8080 -p mysecretkey   (all IPv6 interfaces)")
+		fmt.Println("    SHADOWX_PSK=mysecretkey ./ShadowX -i 0.0.0.0:8080   (or -psk-file, keeping the key out of ps)")
+		fmt.Println("\n  Client Mode (send file):")
+		fmt.Println("    ./ShadowX -i 192.168.1.100:8080 -p mysecretkey -f myfile.txt")
+		fmt.Println("    ./ShadowX -i [2001:db8::5]:8080 -p mysecretkey -f myfile.txt")
+		fmt.Println("    (send SIGUSR1 to pause a running transfer, SIGUSR2 to resume it)")
+		fmt.Println("\n  Disk cloning (send a block device, write it to a device on the server):")
+		fmt.Println("    ./ShadowX -i 0.0.0.0:8080 -p mysecretkey -dev /dev/sdc")
+		fmt.Println("    ./ShadowX -i 192.168.1.100:8080 -p mysecretkey -f /dev/sdb")
+		fmt.Println("\n  Self-test (check the install and key over loopback):")
+		fmt.Println("    ./ShadowX -p mysecretkey -selftest")
 	}
-	defer certFileHandle.Close()
-	pem.Encode(certFileHandle, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 
-	keyFileHandle, err := os.Create(keyFile)
-	if err != nil {
-		return err
+	flag.Parse()
+	if *configPath != "" {
+		if err := applyConfig(flag.CommandLine, *configPath); err != nil {
+			return fmt.Errorf("-config: %w", err)
+		}
 	}
-	defer keyFileHandle.Close()
-	pem.Encode(keyFileHandle, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-
-	return nil
-}
 
-// Start the server
-func startServer(address, secretKey string) {
-	// Generate TLS certificate if it doesn't exist
-	if _, err := os.Stat("server.crt"); os.IsNotExist(err) {
-		if err := generateTLSCert("server.crt", "server.key"); err != nil {
-			fmt.Println("Error generating TLS certificate:", err)
-			return
+	if *verbose && *quiet {
+		return errors.New("-verbose and -quiet can't be combined")
+	}
+	if *verbose && *quietSuccess {
+		return errors.New("-verbose and -quiet-success can't be combined")
+	}
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	} else if *quiet || *quietSuccess || *selfTestFlag {
+		// The self-test prints its verdict, and logs only what led to a failure
+		level = slog.LevelError
+	}
+	// With -o -, standard output carries the data
+	logOut := os.Stdout
+	if *outDir == "-" {
+		logOut = os.Stderr
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOut, &slog.HandlerOptions{Level: level})))
+
+	clientMode := *filePath != "" || *fromList != "" || *downloadPath != "" || *listDir != ""
+	key, err := shadowx.LoadKey(*password, *pskFile)
+	if *pskHash != "" {
+		// The server checks the keys clients present against the hash alone
+		switch {
+		case clientMode || *selfTestFlag || *hashPSK:
+			return errors.New("-psk-hash is for server mode")
+		case err == nil:
+			return errors.New("-psk-hash replaces the key, so -p, -psk-file and $" + shadowx.PSKEnv + " can't be given with it")
+		case errors.Is(err, shadowx.ErrNoKey):
+			err = nil
 		}
 	}
-
-	// Load the certificate
-	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	if errors.Is(err, shadowx.ErrNoKey) {
+		flag.Usage()
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
 	if err != nil {
-		fmt.Println("Error loading certificate:", err)
-		return
+		return err
 	}
-
-	// Configure TLS
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if key != "" {
+		if err := shadowx.CheckKeyStrength(key, *minKeyLength, *minKeyEntropy); err != nil {
+			if *requireStrongKey {
+				return fmt.Errorf("weak pre-shared key: %w", err)
+			}
+			slog.Warn("Weak pre-shared key", "err", err)
+		}
 	}
-
-	// Start the TLS listener
-	listener, err := tls.Listen("tcp", address, tlsConfig)
-	if err != nil {
-		fmt.Println("Error starting server:", err)
-		return
+	if *selfTestFlag {
+		return runSelfTest(os.Stdout, key)
 	}
-	defer listener.Close()
-	fmt.Println("ShadowX Server listening on", address)
-
-	// Accept incoming connections
-	for {
-		conn, err := listener.Accept()
+	if *hashPSK {
+		hash, err := shadowx.HashKey(key)
 		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
+			return err
 		}
-		go handleConnection(conn, secretKey)
+		fmt.Println(hash)
+		return nil
 	}
-}
-
-// Handle client connections
-func handleConnection(conn net.Conn, secretKey string) {
-	defer conn.Close()
-	fmt.Println("Client connected:", conn.RemoteAddr())
-
-	buf := make([]byte, bufferSize)
-	n, err := conn.Read(buf)
+	bufferSize, err := shadowx.ParseSize(*buffer)
 	if err != nil {
-		fmt.Println("Error reading authentication key:", err)
-		return
+		return fmt.Errorf("-buffer: %w", err)
 	}
-	authKey := strings.TrimSpace(string(buf[:n]))
-
-	if authKey != secretKey {
-		fmt.Println("Invalid authentication key! Disconnecting client:", conn.RemoteAddr())
-		conn.Write([]byte("Authentication failed\n"))
-		return
+	if bufferSize <= 0 || bufferSize > math.MaxInt32 {
+		return errors.New("-buffer must be positive and under 2GB")
 	}
-	conn.Write([]byte("Authentication successful\n"))
-	fmt.Println("Client authenticated successfully")
-
-	n, err = conn.Read(buf)
+	minVersion, err := shadowx.ParseTLSVersion(*minTLS)
 	if err != nil {
-		fmt.Println("Error reading file metadata:", err)
-		return
-	}
-	metadata := strings.TrimSpace(string(buf[:n]))
-	parts := strings.SplitN(metadata, " ", 2)
-	if len(parts) != 2 || parts[0] != "upload" {
-		fmt.Println("Invalid transfer request")
-		return
+		return fmt.Errorf("-min-tls: %w", err)
 	}
-	filename := parts[1]
-	fmt.Println("Receiving:", filename)
-
-	receiveFile(conn, filename)
-}
-
-// Receive a file from the client
-func receiveFile(conn net.Conn, filename string) {
-	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
-		fmt.Println("Error creating directories:", err)
-		return
+	cipherSuites, err := shadowx.ParseCipherSuites(*ciphers)
+	if err != nil {
+		return fmt.Errorf("-ciphers: %w", err)
 	}
-
-	file, err := os.Create(filename)
+	limit, err := shadowx.ParseRate(*rate)
 	if err != nil {
-		fmt.Println("Error creating file:", err)
-		return
+		return fmt.Errorf("-rate: %w", err)
 	}
-	defer file.Close()
-
-	buffer := make([]byte, bufferSize)
-	var received int64
-	for {
-		n, err := conn.Read(buffer)
-		if n > 0 {
-			_, writeErr := file.Write(buffer[:n])
-			if writeErr != nil {
-				fmt.Println("Error writing to file:", writeErr)
-				return
-			}
-			received += int64(n)
-			fmt.Printf("\rReceived: %d bytes", received)
+	upRate, downRate := limit, limit
+	if *upLimit != "" {
+		if upRate, err = shadowx.ParseRate(*upLimit); err != nil {
+			return fmt.Errorf("-up-limit: %w", err)
 		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			fmt.Println("Error receiving file:", err)
-			return
+	}
+	if *downLimit != "" {
+		if downRate, err = shadowx.ParseRate(*downLimit); err != nil {
+			return fmt.Errorf("-down-limit: %w", err)
 		}
 	}
-	fmt.Printf("\nFile received successfully: %s\n", filename)
-}
 
-// Send files to the server
-func sendFile(serverAddress, path, secretKey string) {
-	// Check if the path is a directory or a single file
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		fmt.Println("Error accessing file or directory:", err)
-		return
+	if *filePath != "" && *downloadPath != "" {
+		return errors.New("-f and -d can't be combined")
 	}
-
-	if fileInfo.IsDir() {
-		// If it's a directory, walk through all files
-		filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
-			if err != nil {
-				fmt.Println("Error accessing file:", err)
-				return nil
+	if *listDir != "" && (*filePath != "" || *downloadPath != "") {
+		return errors.New("-list can't be combined with -f or -d")
+	}
+	if *fromList != "" && (*filePath != "" || *downloadPath != "" || *listDir != "" || *dryRun || *verifyOnly) {
+		return errors.New("-from-list can't be combined with -f, -d, -list, -dry-run or -verify-only")
+	}
+	if *dryRun && *filePath == "" {
+		return errors.New("-dry-run needs -f")
+	}
+	if *verifyOnly && (*filePath == "" || *dryRun) {
+		return errors.New("-verify-only needs -f and can't be combined with -dry-run")
+	}
+	if *watch && (*filePath == "" || *dryRun || *verifyOnly) {
+		return errors.New("-watch needs -f and can't be combined with -dry-run or -verify-only")
+	}
+	if clientMode {
+		// Client mode: Send file(s), download one or list a directory
+		shadowx.WatchPauseSignals()
+		client := &shadowx.Client{Addr: *ip, Key: key, CertFile: *certFile, KeyFile: *keyFile, Pin: *pin, CAFile: *caFile, DANE: *dane, KnownHosts: *knownHosts,
+			MaxHandshakes: *maxHandshakes, TraceID: *traceID, UpLimit: upRate, DownLimit: downRate,
+			Verify: *verify, ChecksumAlgo: *checksumAlgo, VerifyRoundtrip: *verifyRoundtrip, Diff: *diff, Preserve: *preserve, PreserveBtime: *preserveBtime, Compress: compress != "", Compression: string(compress),
+			Parallel: *parallel, Mux: *mux, Streams: *streams, BatchSize: *batchSize, CheckpointPath: *checkpointPath, ChecksumCache: *checksumCachePath, Resume: *resume, ResumeState: *resumeStatePath, ResumeDirs: *resumeDirs,
+			RunRetries: *runRetries, RunRetryDelay: *runRetryDelay, Retries: *retries, RetryDelay: *retryDelay, DryRun: *dryRun, VerifyOnly: *verifyOnly, SkipExisting: *skipExisting, PreserveSymlinks: *preserveSymlinks, Move: *move, WatchDelay: *watchDelay, WatchDeletes: *watchDeletes, Append: *appendFiles, Name: *name, As: *as, HTTPTimeout: *httpTimeout, BufferSize: int(bufferSize), QuietSuccess: *quietSuccess,
+			MinTLS: minVersion, CipherSuites: cipherSuites, SocketTLS: *socketTLS, NoTLS: *noTLS}
+		if *jsonEvents {
+			client.Events = os.Stderr
+		}
+		if client.TraceID == "" {
+			client.TraceID = os.Getenv(shadowx.TraceIDEnv)
+		}
+		client.NewerThan, client.OlderThan, err = shadowx.ParseTimeWindow(*newerThan, *olderThan, time.Now())
+		if err != nil {
+			return err
+		}
+		if *maxSize != "" {
+			if client.MaxSize, err = shadowx.ParseSize(*maxSize); err != nil {
+				return fmt.Errorf("-max-size: %w", err)
 			}
-			if !info.IsDir() {
-				fmt.Println("Sending:", filePath)
-				sendSingleFile(serverAddress, filePath, secretKey)
+		}
+		if *downloadPath != "" {
+			if err := client.Download(*downloadPath, filepath.Base(*downloadPath)); err != nil {
+				return fmt.Errorf("downloading file: %w", err)
 			}
 			return nil
-		})
-	} else {
-		// If it's a single file, send it directly
-		fmt.Println("Sending:", path)
-		sendSingleFile(serverAddress, path, secretKey)
+		}
+		if *listDir != "" {
+			files, err := client.List(*listDir)
+			if err != nil {
+				return fmt.Errorf("listing directory: %w", err)
+			}
+			return printListing(os.Stdout, files)
+		}
+		if *fromList != "" {
+			return quietFailures(*quietSuccess, client.SendList(*fromList))
+		}
+		if *watch {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			return client.Watch(ctx, *filePath)
+		}
+		err := client.Send(*filePath)
+		// Each file that drifted was logged as it was checked
+		var sendErr *shadowx.SendError
+		if *verifyOnly && errors.As(err, &sendErr) {
+			return fmt.Errorf("%d file(s) failed verification against the server", len(sendErr.Failed))
+		}
+		return quietFailures(*quietSuccess, err)
 	}
-}
 
-// Send a single file to the server
-func sendSingleFile(serverAddress, filename, secretKey string) {
-	// Validate file existence
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		fmt.Println("File does not exist:", filename)
-		return
+	// Server mode: Start server
+	var maxFileBytes, maxDiskBytes, reserveBytes int64
+	if *maxFileSize != "" {
+		if maxFileBytes, err = shadowx.ParseSize(*maxFileSize); err != nil {
+			return fmt.Errorf("-max-file-size: %w", err)
+		}
 	}
-
-	// Connect to the server
-	tlsConfig := &tls.Config{InsecureSkipVerify: true}
-	conn, err := tls.Dial("tcp", serverAddress, tlsConfig)
-	if err != nil {
-		fmt.Println("Error connecting to server:", err)
-		return
+	if *maxDisk != "" {
+		if maxDiskBytes, err = shadowx.ParseSize(*maxDisk); err != nil {
+			return fmt.Errorf("-max-disk: %w", err)
+		}
 	}
-	defer conn.Close()
-
-	// Send authentication key
-	_, err = conn.Write([]byte(secretKey + "\n"))
-	if err != nil {
-		fmt.Println("Error sending authentication key:", err)
-		return
+	if *reserve != "" {
+		if reserveBytes, err = shadowx.ParseSize(*reserve); err != nil {
+			return fmt.Errorf("-reserve: %w", err)
+		}
 	}
-
-	// Read server response
-	buf := make([]byte, bufferSize)
-	n, err := conn.Read(buf)
-	if err != nil || !strings.Contains(string(buf[:n]), "Authentication successful") {
-		fmt.Println("Authentication failed. Server response:", string(buf[:n]))
-		return
+	var keyDirs map[string]string
+	if *pskDirs != "" {
+		if keyDirs, err = shadowx.LoadKeyDirs(*pskDirs); err != nil {
+			return err
+		}
+		for dirKey, dir := range keyDirs {
+			// The key isn't logged, so name the directory it stores files under
+			if err := shadowx.CheckKeyStrength(dirKey, *minKeyLength, *minKeyEntropy); err != nil {
+				if *requireStrongKey {
+					return fmt.Errorf("weak pre-shared key for %s: %w", dir, err)
+				}
+				slog.Warn("Weak pre-shared key", "dir", dir, "err", err)
+			}
+		}
 	}
-
-	// Send file metadata
-	_, err = fmt.Fprintf(conn, "upload %s\n", filename)
-	if err != nil {
-		fmt.Println("Error sending file metadata:", err)
-		return
+	srv := &shadowx.Server{Addr: *ip, Key: key, KeyHash: *pskHash, KeyDirs: keyDirs, OutDir: *outDir, CreateOutDir: *createDest, Device: *device, HashNames: *hashNames,
+		ManifestPath: *manifestPath, DenyHashes: *denyHashes, UpLimit: upRate, DownLimit: downRate, HTTPAddr: *httpAddr, MetricsAddr: *metricsAddr,
+		Immutable: *immutable, NoClobber: *noClobber, AllowDelete: *allowDelete, PreserveOwner: *preserveOwner, ClientCA: *clientCA, ShutdownTimeout: *shutdownTimeout, ReadTimeout: *readTimeout, IdleTimeout: *idleTimeout, MaxAuthFailures: *maxAuthFailures, MaxConns: *maxConns, MaxFileSize: maxFileBytes, MaxDisk: maxDiskBytes, Reserve: reserveBytes, Allow: allow, Deny: deny, EncryptAtRest: *encryptAtRest, StorageKey: *storageKey, BufferSize: int(bufferSize),
+		MinTLS: minVersion, CipherSuites: cipherSuites, TLSCert: *tlsCert, TLSKey: *tlsKey, SocketTLS: *socketTLS, NoTLS: *noTLS}
+	if *certHost != "" {
+		for _, host := range strings.Split(*certHost, ",") {
+			srv.CertHosts = append(srv.CertHosts, strings.TrimSpace(host))
+		}
 	}
-
-	// Open the file
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return
+	if *outDir == "-" {
+		if *daemon {
+			return errors.New("-o - can't be combined with -daemon")
+		}
+		// Progress counters go to standard error along with the log
+		srv.OutDir = ""
+		srv.Output = os.Stdout
+		os.Stdout = os.Stderr
 	}
-	defer file.Close()
-
-	// Send file content
-	fileInfo, _ := file.Stat()
-	totalSize := fileInfo.Size()
-	buffer := make([]byte, bufferSize)
-	var sent int64
-
-	for {
-		n, err := file.Read(buffer)
-		if n > 0 {
-			_, writeErr := conn.Write(buffer[:n])
-			if writeErr != nil {
-				fmt.Println("Error sending file data:", writeErr)
-				return
-			}
-			sent += int64(n)
-			fmt.Printf("\rSent: %d/%d bytes (%.2f%%)", sent, totalSize, (float64(sent)/float64(totalSize))*100)
+	if *daemon && !isDaemonChild() {
+		pid, err := spawnDaemon(*logFile)
+		if err != nil {
+			return fmt.Errorf("starting daemon: %w", err)
 		}
-		if err == io.EOF {
-			break
+		slog.Info("ShadowX Server started in the background", "pid", pid, "log", *logFile)
+		return nil
+	}
+	if isDaemonChild() {
+		srv.ReadyFunc = func() { reportStarted(nil) }
+	}
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile); err != nil {
+			return fmt.Errorf("writing PID file: %w", err)
 		}
-		if err != nil {
-			fmt.Println("Error reading file:", err)
-			return
+		defer os.Remove(*pidFile)
+	}
+
+	// Stop accepting on SIGINT/SIGTERM and let running transfers finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		slog.Info("Finishing active transfers", "signal", sig.String())
+		srv.Shutdown()
+	}()
+	return srv.ListenAndServe()
+}
+
+// Print a server directory listing as a table
+func printListing(w io.Writer, files []shadowx.RemoteFile) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TYPE\tSIZE\tMODIFIED\tNAME")
+	for _, f := range files {
+		size, name := strconv.FormatInt(f.Size, 10), f.Name
+		switch {
+		case f.Type == "dir":
+			size, name = "-", name+"/"
+		case f.Type != "file":
+			size = "-"
+		case f.Size < 0:
+			size = "?"
 		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", f.Type, size, f.ModTime.Local().Format("2006-01-02 15:04:05"), name)
 	}
-	fmt.Printf("\nFile sent successfully: %s\n", filename)
+	return table.Flush()
 }
 
-// Main function
-func main() {
-	ip := flag.String("i", "127.0.0.1:8080", "IP and port to bind/listen")
-	password := flag.String("p", "", "Pre-Shared Key (PSK) for authentication")
-	filePath := flag.String("f", "", "File or directory to send")
+// The -compress flag: the codec to compress with, gzip when given bare,
+// empty when off
+type compressFlag string
 
-	flag.Usage = func() {
-		fmt.Println("ShadowX - Secure File Transfer")
-		fmt.Println("\nUsage:")
-		fmt.Println("  Server Mode (default):")
-		fmt.Println("    ./ShadowX -i 0.0.0.0:8080 -p mysecretkey")
-		fmt.Println("\n  Client Mode (send file):")
-		fmt.Println("    ./ShadowX -i 192.168.1.100:8080 -p mysecretkey -f myfile.txt")
+func (c *compressFlag) String() string {
+	return string(*c)
+}
+
+func (c *compressFlag) Set(value string) error {
+	switch value {
+	case "true":
+		*c = "gzip"
+	case "false", "none":
+		*c = ""
+	case "gzip", "zstd":
+		*c = compressFlag(value)
+	default:
+		return fmt.Errorf("unknown codec %q, want gzip or zstd", value)
 	}
+	return nil
+}
 
-	flag.Parse()
+func (c *compressFlag) IsBoolFlag() bool {
+	return true
+}
 
-	if *password == "" {
-		flag.Usage()
-		return
-	}
+// A flag that may be given more than once, each time with one or more
+// comma-separated values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
 
-	if *filePath != "" {
-		// Client mode: Send file(s)
-		sendFile(*ip, *filePath, *password)
-	} else {
-		// Server mode: Start server
-		startServer(*ip, *password)
-	}
-}
\ No newline at end of file
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
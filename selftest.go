@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bhanunamikaze/ShadowX/shadowx"
+)
+
+// Size of the file the self-test sends
+const selfTestSize = 1 << 20
+
+// Check the install and key end to end: run a server on a loopback port,
+// send it a generated file over TLS with the key, and compare the copy it
+// stored. Prints PASS or FAIL to w, and leaves no files or listeners behind.
+func runSelfTest(w io.Writer, key string) error {
+	if err := selfTest(key); err != nil {
+		fmt.Fprintf(w, "FAIL: %v\n", err)
+		return fmt.Errorf("self-test failed: %w", err)
+	}
+	fmt.Fprintln(w, "PASS")
+	return nil
+}
+
+func selfTest(key string) error {
+	dir, err := os.MkdirTemp("", "shadowx-selftest-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// The server keeps its certificate in the working directory, so it
+	// gets a fresh one that's removed with the rest
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("finding a free port: %w", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	srv := &shadowx.Server{Addr: addr, Key: key, OutDir: "received", CreateOutDir: true}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	stop := sync.OnceValue(func() error {
+		srv.Shutdown()
+		return <-served
+	})
+	defer stop()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			if err := stop(); err != nil {
+				return fmt.Errorf("starting server: %w", err)
+			}
+			return errors.New("server didn't start listening")
+		}
+	}
+
+	// Pin the certificate the server generated, so the client verifies it
+	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	if err != nil {
+		return fmt.Errorf("loading the server certificate: %w", err)
+	}
+	pin := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+
+	content := make([]byte, selfTestSize)
+	rand.Read(content)
+	if err := os.WriteFile("selftest.bin", content, 0600); err != nil {
+		return err
+	}
+	client := &shadowx.Client{Addr: addr, Key: key, Pin: hex.EncodeToString(pin[:]), Verify: true}
+	if err := client.Send("selftest.bin"); err != nil {
+		return fmt.Errorf("sending: %w", err)
+	}
+	received, err := os.ReadFile(filepath.Join("received", "selftest.bin"))
+	if err != nil {
+		return fmt.Errorf("reading the received copy: %w", err)
+	}
+	if !bytes.Equal(received, content) {
+		return fmt.Errorf("the received copy differs: %d of %d bytes", len(received), len(content))
+	}
+	return stop()
+}
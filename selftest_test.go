@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// The self-test passes with any key, restores the working directory and
+// leaves nothing in the temporary directory
+func TestSelfTest(t *testing.T) {
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	wd := t.TempDir()
+	t.Chdir(wd)
+
+	var out strings.Builder
+	if err := runSelfTest(&out, "self-test-key"); err != nil || out.String() != "PASS\n" {
+		t.Fatalf("runSelfTest = %v, printed %q", err, out.String())
+	}
+	if got, _ := os.Getwd(); got != wd {
+		t.Errorf("working directory %s, want %s", got, wd)
+	}
+	for _, dir := range []string{tmp, wd} {
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s holds %d entries after the self-test, want none", dir, len(entries))
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// The client addresses a server lets connect: none in deny and, when allow
+// isn't empty, only those in allow. The zero value lets every client in.
+type addressFilter struct {
+	allow, deny []netip.Prefix
+}
+
+// Parse the CIDR ranges given with flag, where a single address stands for
+// itself
+func parsePrefixes(flag string, ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if !strings.Contains(r, "/") {
+			addr, err := netip.ParseAddr(r)
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: want a CIDR range such as 10.0.0.0/8, or an IP address", flag, r)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q: want a CIDR range such as 10.0.0.0/8, or an IP address", flag, r)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Why connections from addr are refused, or "" when they're let in. Unix
+// socket clients have no IP address; the socket's permissions decide who
+// reaches them.
+func (f addressFilter) refuses(addr net.Addr) string {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return ""
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	ip := addrPort.Addr().Unmap().WithZone("")
+	for _, prefix := range f.deny {
+		if prefix.Contains(ip) {
+			return "denied by -deny " + prefix.String()
+		}
+	}
+	if len(f.allow) == 0 {
+		return ""
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(ip) {
+			return ""
+		}
+	}
+	return "not in -allow"
+}
+
+// Listener that closes the connections of clients its filter refuses as
+// soon as they're accepted, before reading anything from them
+type filterListener struct {
+	net.Listener
+	clients addressFilter
+}
+
+func (l filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if reason := l.clients.refuses(conn.RemoteAddr()); reason != "" {
+			slog.Warn("Refused connection", "remote", conn.RemoteAddr().String(), "reason", reason)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,112 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		ranges []string
+		want   string
+		ok     bool
+	}{
+		{[]string{"10.0.0.0/8"}, "[10.0.0.0/8]", true},
+		{[]string{"10.1.2.3/8"}, "[10.0.0.0/8]", true},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "[192.0.2.1/32 2001:db8::1/128]", true},
+		{[]string{"::ffff:192.0.2.1"}, "[192.0.2.1/32]", true},
+		{[]string{" 2001:db8::/32 "}, "[2001:db8::/32]", true},
+		{[]string{"10.0.0.0/33"}, "", false},
+		{[]string{"example.com"}, "", false},
+		{[]string{""}, "", false},
+	}
+	for _, tt := range tests {
+		got, err := parsePrefixes("-allow", tt.ranges)
+		if (err == nil) != tt.ok || err == nil && fmt.Sprint(got) != tt.want {
+			t.Errorf("parsePrefixes(%q) = %v, %v; want %s, ok %v", tt.ranges, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAddressFilter(t *testing.T) {
+	parse := func(ranges ...string) []netip.Prefix {
+		prefixes, err := parsePrefixes("-test", ranges)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prefixes
+	}
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}
+	}
+	unix := &net.UnixAddr{Name: "", Net: "unix"}
+	tests := []struct {
+		name    string
+		filter  addressFilter
+		addr    net.Addr
+		refused bool
+	}{
+		{"no lists", addressFilter{}, tcp("192.0.2.1"), false},
+		{"allowed", addressFilter{allow: parse("192.0.2.0/24")}, tcp("192.0.2.1"), false},
+		{"not allowed", addressFilter{allow: parse("192.0.2.0/24")}, tcp("198.51.100.1"), true},
+		{"denied", addressFilter{deny: parse("192.0.2.0/24")}, tcp("192.0.2.1"), true},
+		{"not denied", addressFilter{deny: parse("192.0.2.0/24")}, tcp("198.51.100.1"), false},
+		{"deny wins", addressFilter{allow: parse("192.0.2.0/24"), deny: parse("192.0.2.1")}, tcp("192.0.2.1"), true},
+		{"rest of allow", addressFilter{allow: parse("192.0.2.0/24"), deny: parse("192.0.2.1")}, tcp("192.0.2.2"), false},
+		{"IPv6", addressFilter{allow: parse("2001:db8::/32")}, tcp("2001:db8::1"), false},
+		{"IPv4-mapped", addressFilter{allow: parse("192.0.2.0/24")}, tcp("::ffff:192.0.2.1"), false},
+		{"zoned", addressFilter{deny: parse("fe80::/10")}, &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5000, Zone: "eth0"}, true},
+		{"Unix socket", addressFilter{allow: parse("192.0.2.0/24")}, unix, false},
+	}
+	for _, tt := range tests {
+		if reason := tt.filter.refuses(tt.addr); (reason != "") != tt.refused {
+			t.Errorf("%s: refuses(%v) = %q, want refused %v", tt.name, tt.addr, reason, tt.refused)
+		}
+	}
+}
+
+// Refused clients are disconnected and logged before they can authenticate,
+// while allowed ones send as usual
+func TestServerAllowDeny(t *testing.T) {
+	tests := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		refused bool
+	}{
+		{"allowed", []string{"127.0.0.0/8"}, nil, false},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, true},
+		{"denied", nil, []string{"127.0.0.1"}, true},
+		{"deny wins", []string{"127.0.0.0/8"}, []string{"127.0.0.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			logged := captureLog(t, slog.LevelInfo)
+			if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, Allow: tt.allow, Deny: tt.deny}
+			startTestServer(t, srv)
+			client := &Client{Addr: srv.Addr, Key: srv.Key}
+			err := client.Send("a.txt")
+			if (err != nil) != tt.refused {
+				t.Fatalf("Send = %v, want refused %v", err, tt.refused)
+			}
+			_, statErr := os.Stat(filepath.Join(DefaultOutDir, "a.txt"))
+			if (statErr != nil) != tt.refused {
+				t.Errorf("file stored: %v, want %v", statErr == nil, !tt.refused)
+			}
+			refusedLog := strings.Contains(logged.String(), `msg="Refused connection" remote=127.0.0.1:`)
+			if refusedLog != tt.refused || strings.Contains(logged.String(), "Invalid authentication key") {
+				t.Errorf("server log doesn't match refused %v:\n%s", tt.refused, logged)
+			}
+		})
+	}
+}
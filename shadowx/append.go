@@ -0,0 +1,89 @@
+package shadowx
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Stored files being appended to, so two uploads can't interleave their
+// data in one
+type appendLocks struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+// Claim stored for an append, reporting false when another upload holds it
+func (a *appendLocks) claim(stored string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.paths[stored] {
+		return false
+	}
+	if a.paths == nil {
+		a.paths = make(map[string]bool)
+	}
+	a.paths[stored] = true
+	return true
+}
+
+func (a *appendLocks) release(stored string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.paths, stored)
+}
+
+// Why an upload can't be appended to the file it names, empty when it can.
+// The whole file's digest is checked before the append is kept, so it has to
+// be declared, and in SHA-256 since that's what the stored part is hashed in.
+func appendRejection(cfg *serverConfig, r *checkedRequest) string {
+	switch {
+	case cfg.storage != nil:
+		return "append is not supported with encryption at rest"
+	case cfg.immutable || cfg.noClobber:
+		return "append is not supported on a write-once or no-clobber server"
+	case r.attrs["resume"] != "":
+		return "an upload can't be both resumed and appended"
+	case r.algorithm != defaultChecksum || r.declared == "":
+		return "appending requires the file's sha256"
+	}
+	return ""
+}
+
+// Open the stored file to append an upload to, creating it and its
+// directories when missing, and feed what it holds already to hasher.
+// Returns the file and its size, where the appended data starts.
+func openAppend(stored string, hasher hash.Hash) (*os.File, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(stored), os.ModePerm); err != nil {
+		return nil, 0, fmt.Errorf("creating directories: %w", err)
+	}
+	if info, err := os.Lstat(stored); err == nil && !info.Mode().IsRegular() {
+		return nil, 0, fmt.Errorf("%s is not a regular file", stored)
+	}
+	file, err := os.OpenFile(stored, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset, err := io.Copy(hasher, file)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("reading file: %w", err)
+	}
+	return file, offset, nil
+}
+
+// Cut a stored file back to the size it had before an append that failed
+// or was rejected, removing it when it was empty
+func undoAppend(log *slog.Logger, stored string, offset int64) {
+	undo := func() error { return os.Truncate(stored, offset) }
+	if offset == 0 {
+		undo = func() error { return os.Remove(stored) }
+	}
+	if err := undo(); err != nil {
+		log.Error("Error removing rejected appended data", "file", stored, "err", err)
+	}
+}
@@ -0,0 +1,85 @@
+package shadowx
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each run with -append sends only what the log gained since the last one,
+// and a server copy that isn't a prefix of the log is left as it was
+func TestClientSendAppend(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Append: true}
+	stored := filepath.Join(DefaultOutDir, "app.log")
+
+	first := strings.Repeat("first run\n", 1000)
+	if err := os.WriteFile("app.log", []byte(first), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("app.log"); err != nil {
+		t.Fatalf("first Send: %v", err)
+	}
+	if got, _ := os.ReadFile(stored); string(got) != first {
+		t.Fatalf("after the first run the server holds %d bytes, want %d", len(got), len(first))
+	}
+
+	second := "second run\n"
+	f, err := os.OpenFile("app.log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(second)
+	f.Close()
+	if err := client.Send("app.log"); err != nil {
+		t.Fatalf("second Send: %v", err)
+	}
+	if got, _ := os.ReadFile(stored); string(got) != first+second {
+		t.Errorf("after the second run the server holds %q..., want the whole log", got[len(got)-20:])
+	}
+	if !strings.Contains(logs.String(), "offset=10000") {
+		t.Error("second run didn't start from the end of the server's copy")
+	}
+
+	// A rotated log that's grown past the server's copy no longer matches
+	rotated := strings.Repeat("rotated\n", 2000)
+	if err := os.WriteFile("app.log", []byte(rotated), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("app.log"); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("Send of a rotated log = %v, want a checksum mismatch", err)
+	}
+	// And one that's shorter than it is refused before sending anything
+	if err := os.WriteFile("app.log", []byte("short\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Send("app.log"); err == nil || !strings.Contains(err.Error(), "without -append") {
+		t.Errorf("Send of a truncated log = %v, want it refused", err)
+	}
+	if got, _ := os.ReadFile(stored); string(got) != first+second {
+		t.Errorf("failed appends changed the server's copy to %d bytes", len(got))
+	}
+}
+
+// A stored file is only appended to by one upload at a time, and an append
+// that can't be checked against the whole file's digest is refused
+func TestHandleConnectionAppend(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	if replies := testSession(t, cfg, "upload log.txt\tappend=1\n"); !strings.Contains(replies, "REJECTED appending requires the file's sha256") {
+		t.Errorf("append without a digest: replies %q", replies)
+	}
+	cfg.appending.claim(filepath.Join(dir, "log.txt"))
+	request := "upload log.txt\tappend=1\tsha256=" + strings.Repeat("0", 64) + "\n"
+	if replies := testSession(t, cfg, request); !strings.Contains(replies, "REJECTED file is being appended to") {
+		t.Errorf("append to a file being appended to: replies %q", replies)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "log.txt")); !os.IsNotExist(err) {
+		t.Errorf("refused appends created the file: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A file encrypted at rest starts with a header:
+//
+//	8 bytes  "SXAES256"
+//	16 bytes random salt the file's AES-256 key is derived with, by HKDF-SHA256 from the storage key
+//	uint32   plaintext bytes per chunk
+//
+// followed by the chunks, each a uint32 length and that many bytes sealed
+// with AES-GCM. A chunk's nonce is its index as a uint64 and a final byte of
+// 1 on the last chunk, 0 otherwise, and the header is its additional data,
+// so chunks can't be reordered, dropped or moved between files. Integers
+// are big-endian.
+var atRestMagic = []byte("SXAES256")
+
+const (
+	atRestSaltLen   = 16
+	atRestHeaderLen = 8 + atRestSaltLen + 4
+	atRestChunk     = 64 << 10 // plaintext bytes per chunk written
+	atRestMaxChunk  = 16 << 20 // largest chunk size accepted when reading
+	atRestOverhead  = 4 + 16   // length and GCM tag of each chunk
+	atRestInfo      = "shadowx storage v1"
+)
+
+// The secret stored files are encrypted with, nil when they aren't
+type storageKey []byte
+
+// The AEAD of a file whose header holds salt
+func (k storageKey) aead(salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, k, salt, atRestInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The nonce of chunk index
+func atRestNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypts what's written to it into w in the at-rest format. Close seals
+// the last chunk; it doesn't close w.
+type sealWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	plain  []byte // the chunk being filled
+	index  uint64
+}
+
+// Start an encrypted file in w, writing its header
+func newSealWriter(w io.Writer, key storageKey) (*sealWriter, error) {
+	header := make([]byte, 0, atRestHeaderLen)
+	header = append(header, atRestMagic...)
+	salt := make([]byte, atRestSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, atRestChunk)
+	aead, err := key.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, header: header, plain: make([]byte, 0, atRestChunk)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk waits for more data, so Close knows which is last
+		if len(s.plain) == atRestChunk {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.plain[len(s.plain):atRestChunk], p)
+		s.plain = s.plain[:len(s.plain)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Seal the last chunk, which may be empty
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+func (s *sealWriter) seal(last bool) error {
+	chunk := make([]byte, 4, atRestOverhead+len(s.plain))
+	chunk = s.aead.Seal(chunk, atRestNonce(s.index, last), s.plain, s.header)
+	binary.BigEndian.PutUint32(chunk, uint32(len(chunk)-4))
+	s.index++
+	s.plain = s.plain[:0]
+	_, err := s.w.Write(chunk)
+	return err
+}
+
+// Decrypts a file in the at-rest format as it's read, failing if it was
+// altered, cut short or encrypted with another key
+type openReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  int    // plaintext bytes per chunk
+	plain  []byte // the opened chunk not yet read
+	index  uint64
+	done   bool // the last chunk has been opened
+}
+
+// Read the header of an encrypted file from r
+func newOpenReader(r io.Reader, key storageKey) (*openReader, error) {
+	header, chunk, err := readAtRestHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := key.aead(header[len(atRestMagic) : len(atRestMagic)+atRestSaltLen])
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: r, aead: aead, header: header, chunk: chunk}, nil
+}
+
+// Read and check the header of an encrypted file, returning it and its
+// chunk size
+func readAtRestHeader(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, atRestHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, atRestMagic) {
+		return nil, 0, errors.New("not a file encrypted at rest by ShadowX")
+	}
+	chunk := binary.BigEndian.Uint32(header[atRestHeaderLen-4:])
+	if chunk == 0 || chunk > atRestMaxChunk {
+		return nil, 0, fmt.Errorf("invalid chunk size %d", chunk)
+	}
+	return header, int(chunk), nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// Open the next chunk
+func (o *openReader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(o.r, length[:]); err != nil {
+		return fmt.Errorf("encrypted file ends early: %w", io.ErrUnexpectedEOF)
+	}
+	n := int(binary.BigEndian.Uint32(length[:]))
+	if n < 16 || n > o.chunk+16 {
+		return fmt.Errorf("invalid chunk length %d", n)
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return fmt.Errorf("encrypted file ends early: %w", io.ErrUnexpectedEOF)
+	}
+	// Only a full chunk can be followed by more. A failed Open clears its
+	// output, so the first try doesn't open in place.
+	var err error
+	if n == o.chunk+16 {
+		o.plain, err = o.aead.Open(nil, atRestNonce(o.index, false), sealed, o.header)
+	}
+	if n < o.chunk+16 || err != nil {
+		if o.plain, err = o.aead.Open(sealed[:0], atRestNonce(o.index, true), sealed, o.header); err != nil {
+			return errors.New("decryption failed: wrong key, or the file was altered")
+		}
+		o.done = true
+		var extra [1]byte
+		if n, _ := o.r.Read(extra[:]); n > 0 {
+			return errors.New("data follows the last chunk of the encrypted file")
+		}
+	}
+	o.index++
+	return nil
+}
+
+// The plaintext size of an encrypted file of size bytes in chunks of chunk
+// bytes, worked out from the framing
+func atRestPlainSize(size int64, chunk int) (int64, error) {
+	body := size - atRestHeaderLen
+	if body < atRestOverhead {
+		return 0, errors.New("encrypted file ends early")
+	}
+	chunks := (body + int64(chunk) + atRestOverhead - 1) / (int64(chunk) + atRestOverhead)
+	return body - chunks*atRestOverhead, nil
+}
+
+// Decrypt a file the server stored with encryption at rest from src into
+// dst. key is the server's storage key, or its PSK when it had none. Data
+// is written as each chunk is verified, so on an error dst may hold the
+// start of the file.
+func DecryptFile(dst io.Writer, src io.Reader, key string) error {
+	r, err := newOpenReader(src, storageKey(key))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// Where received data for file goes: file itself, or a writer encrypting
+// into it when files are encrypted at rest. seal finishes the file.
+func (cfg *serverConfig) storageWriter(file *os.File) (w io.Writer, seal func() error, err error) {
+	if cfg.storage == nil {
+		return file, func() error { return nil }, nil
+	}
+	s, err := newSealWriter(file, cfg.storage)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypting file: %w", err)
+	}
+	return s, s.Close, nil
+}
+
+// Open a stored file to read its content, decrypting it when files are
+// encrypted at rest, with the size of that content
+func openStored(cfg *serverConfig, path string) (io.ReadCloser, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if cfg.storage == nil {
+		return file, info.Size(), nil
+	}
+	r, err := newOpenReader(file, cfg.storage)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	size, err := atRestPlainSize(info.Size(), r.chunk)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, file}, size, nil
+}
+
+// Read the whole content of a stored file, decrypting it when files are
+// encrypted at rest
+func readStored(cfg *serverConfig, path string) ([]byte, error) {
+	file, _, err := openStored(cfg, path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
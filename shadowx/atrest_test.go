@@ -0,0 +1,167 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Seal data with key, writing it in pieces of step bytes
+func sealBytes(t *testing.T, key string, data []byte, step int) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := newSealWriter(&sealed, storageKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(step, len(rest))
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// Encrypted files decrypt byte for byte, whatever their size against the
+// chunk size, and their plaintext size follows from the framing
+func TestSealRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, atRestChunk - 1, atRestChunk, atRestChunk + 1, 3*atRestChunk + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+		sealed := sealBytes(t, "secret", data, 1000)
+		if size > 16 && bytes.Contains(sealed, data[:16]) {
+			t.Errorf("size %d: plaintext appears in the sealed file", size)
+		}
+		var opened bytes.Buffer
+		if err := DecryptFile(&opened, bytes.NewReader(sealed), "secret"); err != nil {
+			t.Fatalf("size %d: DecryptFile: %v", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), data) {
+			t.Errorf("size %d: decrypted %d bytes that differ from the original", size, opened.Len())
+		}
+		if got, err := atRestPlainSize(int64(len(sealed)), atRestChunk); err != nil || got != int64(size) {
+			t.Errorf("size %d: atRestPlainSize = %d, %v", size, got, err)
+		}
+	}
+}
+
+// Files altered, cut at a chunk boundary or encrypted with another key fail
+// to decrypt
+func TestDecryptFileRejects(t *testing.T) {
+	data := make([]byte, 2*atRestChunk+10)
+	rand.Read(data)
+	sealed := sealBytes(t, "secret", data, len(data))
+	fullChunk := atRestHeaderLen + atRestChunk + atRestOverhead
+	flipped := bytes.Clone(sealed)
+	flipped[fullChunk+100] ^= 1
+	swapped := bytes.Clone(sealed)
+	copy(swapped[atRestHeaderLen:], sealed[fullChunk:2*fullChunk-atRestHeaderLen])
+	copy(swapped[fullChunk:], sealed[atRestHeaderLen:fullChunk])
+	otherFile := sealBytes(t, "secret", data, len(data))
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		key    string
+	}{
+		{"wrong key", sealed, "other"},
+		{"flipped bit", flipped, "secret"},
+		{"last chunk dropped", sealed[:2*fullChunk-atRestHeaderLen], "secret"},
+		{"cut inside a chunk", sealed[:fullChunk+50], "secret"},
+		{"data appended", append(bytes.Clone(sealed), 0), "secret"},
+		{"chunks swapped", swapped, "secret"},
+		{"chunk from another file", append(bytes.Clone(sealed[:fullChunk]), otherFile[fullChunk:]...), "secret"},
+		{"not encrypted", data, "secret"},
+		{"empty", nil, "secret"},
+	}
+	for _, tt := range tests {
+		if err := DecryptFile(&bytes.Buffer{}, bytes.NewReader(tt.sealed), tt.key); err == nil {
+			t.Errorf("%s: DecryptFile succeeded", tt.name)
+		}
+	}
+}
+
+// With encryption at rest, what's on disk is ciphertext, while checks,
+// downloads, manifests and diffs all see the original
+func TestServerEncryptAtRest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	original := strings.Repeat("line of text\n", 10000)
+	if err := os.WriteFile("a.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, StorageKey: "storage-key"}
+	startTestServer(t, srv)
+	stored := filepath.Join(DefaultOutDir, "a.txt")
+	decrypt := func() string {
+		t.Helper()
+		f, err := os.Open(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var b bytes.Buffer
+		if err := DecryptFile(&b, f, srv.StorageKey); err != nil {
+			t.Fatalf("DecryptFile: %v", err)
+		}
+		return b.String()
+	}
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key, VerifyRoundtrip: true}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	onDisk, _ := os.ReadFile(stored)
+	if !bytes.HasPrefix(onDisk, atRestMagic) || bytes.Contains(onDisk, []byte("line of text")) {
+		t.Errorf("stored file isn't encrypted: %.40q", onDisk)
+	}
+	if got := decrypt(); got != original {
+		t.Errorf("decrypted %d bytes that differ from the %d sent", len(got), len(original))
+	}
+
+	if err := client.Download("a.txt", "copy.txt"); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got, _ := os.ReadFile("copy.txt"); string(got) != original {
+		t.Errorf("downloaded %d bytes that differ from the %d sent", len(got), len(original))
+	}
+
+	var events bytes.Buffer
+	skipper := &Client{Addr: srv.Addr, Key: srv.Key, SkipExisting: true, Events: &events}
+	if err := skipper.Send("a.txt"); err != nil {
+		t.Fatalf("Send with SkipExisting: %v", err)
+	}
+	if !strings.Contains(events.String(), `"event":"skipped"`) {
+		t.Errorf("unchanged file wasn't skipped: %s", events.String())
+	}
+
+	edited := strings.Replace(original, "line of text", "edited line", 1)
+	if err := os.WriteFile("a.txt", []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	differ := &Client{Addr: srv.Addr, Key: srv.Key, Diff: true}
+	logged := captureLog(t, slog.LevelInfo)
+	if err := differ.Send("a.txt"); err != nil {
+		t.Fatalf("Send with Diff: %v", err)
+	}
+	if !strings.Contains(logged.String(), `msg="Sent as a diff"`) {
+		t.Errorf("edit wasn't sent as a diff:\n%s", logged)
+	}
+	if got := decrypt(); got != edited {
+		t.Error("decrypted file doesn't hold the edit")
+	}
+
+	resumer := &Client{Addr: srv.Addr, Key: srv.Key, Resume: true, ResumeState: "resume.json"}
+	if err := resumer.Send("a.txt"); err == nil || !strings.Contains(err.Error(), "resume is not supported with encryption at rest") {
+		t.Errorf("Send with Resume = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,136 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// Errors a verification reports for a file whose server copy differs from
+// it, or that the server doesn't have
+var (
+	ErrStoredMismatch = errors.New("server copy differs")
+	ErrNotStored      = errors.New("not on the server")
+)
+
+// Answer a "verify <name>\tsha256=<hex>" request, which audits a stored
+// copy without sending it again: hash the stored file and answer "MATCH",
+// or "MISMATCH <hex>" with the digest found. BYE follows.
+func verifyStored(conn net.Conn, log *slog.Logger, cfg *serverConfig, stored, declared string) error {
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "verification is not supported when writing to the "+cfg.sink())
+		return nil
+	}
+	if declared == "" {
+		rejectUpload(conn, log, "verify needs a sha256")
+		return nil
+	}
+	sum, err := hashStored(cfg, stored, -1)
+	if errors.Is(err, os.ErrNotExist) {
+		rejectUpload(conn, log, "no such file")
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not read stored file\n")
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+	if sum != declared {
+		log.Warn("Stored file doesn't match the client's", "file", stored, "sha256", sum, "client_sha256", declared)
+		fmt.Fprintf(conn, "MISMATCH %s\n", sum)
+		return nil
+	}
+	log.Info("Verified stored file", "file", stored, "sha256", sum)
+	fmt.Fprintf(conn, "MATCH\n")
+	return nil
+}
+
+// Check the server's copies of the files sendFile would send from path
+// against them, without sending anything. Files whose copies differ or are
+// missing come back as failures.
+func auditFiles(cfg *clientConfig, path string) (failed []SendFailure) {
+	var files, matched int
+	var drifted []SendFailure
+	check := func(filePath string) {
+		if isDir(filePath) {
+			// Empty directories have no content to compare
+			return
+		}
+		files++
+		err := auditFile(cfg, filePath)
+		switch {
+		case err == nil:
+			matched++
+			slog.Info("Matches the server copy", "file", filePath)
+			return
+		case errors.Is(err, ErrStoredMismatch) || errors.Is(err, ErrNotStored):
+			slog.Warn("Drifted from the server copy", "file", filePath, "err", err)
+		default:
+			slog.Error("Error verifying file", "file", filePath, "err", err)
+		}
+		drifted = append(drifted, SendFailure{Path: filePath, Err: err})
+	}
+
+	if fileInfo, err := os.Stat(path); err != nil {
+		return []SendFailure{{Path: path, Err: fmt.Errorf("accessing file or directory: %w", err)}}
+	} else if fileInfo.IsDir() {
+		failed = walkFiles(cfg, path, check)
+	} else if reason := cfg.filtered(fileInfo); reason == "" {
+		check(path)
+	} else {
+		slog.Info("Skipping", "file", path, "reason", reason)
+	}
+
+	failed = append(failed, drifted...)
+	slog.Info("Verified against the server", "files", files, "matched", matched, "failed", len(failed))
+	return failed
+}
+
+// Ask the server whether its copy of a local file matches it
+func auditFile(cfg *clientConfig, filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("accessing file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	name := cfg.remoteName(filename)
+	if err := validRequestName(name); err != nil {
+		return err
+	}
+	sum, err := localDigest(cfg, filename, info)
+	if err != nil {
+		return fmt.Errorf("hashing file: %w", err)
+	}
+
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	req := request{verb: "verify", name: name, attrs: map[string]string{"sha256": sum}}
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return fmt.Errorf("sending verify request: %w", err)
+	}
+	status, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed before the server answered")
+	}
+	status = strings.TrimSpace(status)
+	if status == "MATCH" {
+		return nil
+	}
+	if storedSum, ok := strings.CutPrefix(status, "MISMATCH "); ok {
+		return fmt.Errorf("%w: stored copy has SHA-256 %s, local %s", ErrStoredMismatch, storedSum, sum)
+	}
+	if reason, ok := strings.CutPrefix(status, "REJECTED "); ok {
+		if reason == "no such file" {
+			return ErrNotStored
+		}
+		return errors.New(reason)
+	}
+	return fmt.Errorf("unexpected server status %q", status)
+}
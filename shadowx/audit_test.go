@@ -0,0 +1,79 @@
+package shadowx
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifying reports the files whose server copies changed or went missing,
+// and sends nothing
+func TestVerifyOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		storageKey string
+	}{
+		{"plain", ""},
+		{"encrypted at rest", "storage-key"},
+	}
+	for _, tt := range tests {
+		storageKey := tt.storageKey
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			captureLog(t, slog.LevelInfo)
+			for name, content := range map[string]string{"dir/a.txt": "hello", "dir/b.txt": "world", "dir/sub/c.txt": "again"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, StorageKey: storageKey}
+			startTestServer(t, srv)
+			if err := (&Client{Addr: srv.Addr, Key: srv.Key}).Send("dir"); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			auditor := &Client{Addr: srv.Addr, Key: srv.Key, VerifyOnly: true}
+			if err := auditor.Send("dir"); err != nil {
+				t.Fatalf("verifying unchanged copies: %v", err)
+			}
+
+			stored := filepath.Join(DefaultOutDir, "dir")
+			if storageKey == "" {
+				if err := os.WriteFile(filepath.Join(stored, "a.txt"), []byte("jello"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile("dir/a.txt", []byte("jello"), 0644); err != nil {
+				t.Fatal(err) // can't edit the ciphertext meaningfully, so change the original
+			}
+			if err := os.Remove(filepath.Join(stored, "sub", "c.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile("dir/new.txt", []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := auditor.Send("dir")
+			var sendErr *SendError
+			if !errors.As(err, &sendErr) || len(sendErr.Failed) != 3 {
+				t.Fatalf("Send with VerifyOnly = %v, want 3 failures", err)
+			}
+			want := map[string]error{
+				filepath.Join("dir", "a.txt"):        ErrStoredMismatch,
+				filepath.Join("dir", "new.txt"):      ErrNotStored,
+				filepath.Join("dir", "sub", "c.txt"): ErrNotStored,
+			}
+			for _, f := range sendErr.Failed {
+				if !errors.Is(f.Err, want[f.Path]) {
+					t.Errorf("%s: %v, want %v", f.Path, f.Err, want[f.Path])
+				}
+			}
+			if _, err := os.Stat(filepath.Join(stored, "new.txt")); err == nil {
+				t.Error("verifying sent a file")
+			}
+		})
+	}
+}
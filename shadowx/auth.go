@@ -0,0 +1,173 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned, wrapped, when the server rejects the pre-shared key. Once it
+// has, the rest of a Send fails with it too, without connecting again. An
+// Authenticator returns it, wrapped or not, to turn a client away.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Checks the credentials of connecting clients for Server.Authenticator, in
+// place of the pre-shared key. Authenticate is called once the protocol
+// versions have been exchanged and reads what it needs from conn; the
+// ShadowX client sends its Key as a single line, which ReadKey reads. It
+// returns who the client is, which the connection is logged under, or an
+// error wrapping ErrAuthFailed to reject the client as the server does a
+// wrong key, counting it towards MaxAuthFailures. Any other error is taken
+// as the connection failing, and ends it without counting.
+//
+// Authenticate is called from a goroutine per connection, within the
+// ReadTimeout.
+type Authenticator interface {
+	Authenticate(conn net.Conn) (identity string, err error)
+}
+
+// Read the line the ShadowX client sends its Key in from the connection
+// given to Authenticator.Authenticate, without reading past it into the
+// request that follows
+func ReadKey(conn net.Conn) (string, error) {
+	if lines, ok := conn.(*lineConn); ok {
+		line, err := lines.readLine()
+		return strings.TrimSpace(line), err
+	}
+	// Anything else is read a byte at a time, so nothing is buffered away
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSpace(string(line)), nil
+		}
+		if line = append(line, b[0]); len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+	}
+}
+
+// The default Authenticator, which checks the key against the server's own
+// and those of -psk-dirs. The identity is the directory of the key that
+// matched, which the connection then works within.
+type keyAuthenticator struct {
+	cfg *serverConfig
+}
+
+func (a keyAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	key, err := ReadKey(conn)
+	if err != nil {
+		return "", fmt.Errorf("reading authentication key: %w", err)
+	}
+	tenant := a.cfg.authenticate(key)
+	if tenant == nil {
+		return "", ErrAuthFailed
+	}
+	return tenant.outDir, nil
+}
+
+// Addresses tracked before the counts start over, so a scan from many
+// addresses can't grow the table without bound
+const maxAuthFailureIPs = 10000
+
+// How long an address is refused once it reaches the failure limit; each
+// further failure doubles it, up to maxAuthBlock
+const (
+	authBlock    = 10 * time.Second
+	maxAuthBlock = time.Hour
+)
+
+// Failed authentications by client IP address, so repeated failures stand
+// out in the log and addresses guessing keys can be refused for a while.
+// The zero value is ready to use.
+type authFailures struct {
+	mu      sync.Mutex
+	clients map[string]*authRecord
+}
+
+// The failed authentications of one address since its last success
+type authRecord struct {
+	failures     int
+	blockedUntil time.Time
+}
+
+// The IP address connections from addr are counted under. Unix socket
+// clients share an empty one.
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Record a failed authentication from ip at now and return how many it has
+// had. Once that reaches limit, 0 for no limit, the address is refused for
+// a window that doubles with each further failure, which is returned. Unix
+// socket clients share an address, so they're counted but never refused.
+func (f *authFailures) add(ip string, limit int, now time.Time) (failures int, block time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record := f.clients[ip]
+	if record == nil {
+		f.makeRoom(now)
+		record = &authRecord{}
+		f.clients[ip] = record
+	}
+	record.failures++
+	if limit > 0 && record.failures >= limit && net.ParseIP(ip) != nil {
+		block = authBlock
+		for range record.failures - limit {
+			if block *= 2; block >= maxAuthBlock {
+				block = maxAuthBlock
+				break
+			}
+		}
+		record.blockedUntil = now.Add(block)
+	}
+	return record.failures, block
+}
+
+// Make room for another address, dropping those that aren't refused when
+// the table is full and starting over if that isn't enough
+func (f *authFailures) makeRoom(now time.Time) {
+	if f.clients == nil {
+		f.clients = make(map[string]*authRecord)
+	}
+	if len(f.clients) < maxAuthFailureIPs {
+		return
+	}
+	for ip, record := range f.clients {
+		if !now.Before(record.blockedUntil) {
+			delete(f.clients, ip)
+		}
+	}
+	if len(f.clients) >= maxAuthFailureIPs {
+		f.clients = make(map[string]*authRecord)
+	}
+}
+
+// Whether connections from ip are refused at now
+func (f *authFailures) blocked(ip string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record := f.clients[ip]
+	return record != nil && now.Before(record.blockedUntil)
+}
+
+// Forget the failures of ip once it authenticates
+func (f *authFailures) clear(ip string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.clients, ip)
+}
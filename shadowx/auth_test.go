@@ -0,0 +1,248 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A rejected key fails the whole send after one connection, without retries,
+// and the server counts the failure against the client's address
+func TestClientSendWrongKey(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logged := captureLog(t, slog.LevelInfo)
+	for _, name := range []string{"docs/a.txt", "docs/b.txt", "docs/c.txt"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	stop := startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: "wrong-key", RunRetries: 2}
+	err := client.Send("docs")
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("Send = %v, want ErrAuthFailed", err)
+	}
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Failed) != 3 {
+		t.Errorf("Send = %v, want all 3 files failed", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+
+	if n := strings.Count(logged.String(), `msg="Invalid authentication key, disconnected client"`); n != 1 {
+		t.Errorf("server rejected %d connections, want 1:\n%s", n, logged)
+	}
+	if !strings.Contains(logged.String(), "level=WARN") || !strings.Contains(logged.String(), "failures=1") {
+		t.Errorf("server didn't warn with the failure count:\n%s", logged)
+	}
+	if strings.Contains(logged.String(), "retrying") {
+		t.Errorf("client retried after the key was rejected:\n%s", logged)
+	}
+}
+
+// Repeated bad keys from one address get it refused for a growing window,
+// which a success clears, while other addresses go on as before
+func TestServerBlocksRepeatedFailures(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logged := captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MaxAuthFailures: 2}
+	startTestServer(t, srv)
+	wrongKey := &Client{Addr: srv.Addr, Key: "wrong-key"}
+	for range 2 {
+		if err := wrongKey.Send("a.txt"); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("Send with the wrong key = %v, want ErrAuthFailed", err)
+		}
+	}
+	if !strings.Contains(logged.String(), `msg="Refusing connections from the address after repeated authentication failures" remote=127.0.0.1`) {
+		t.Errorf("server didn't report the block:\n%s", logged)
+	}
+	// Even the right key is refused while the address is blocked
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("a.txt"); err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Send from a blocked address = %v, want the connection refused", err)
+	}
+	if _, err := os.Stat(filepath.Join(DefaultOutDir, "a.txt")); err == nil {
+		t.Error("server stored a file sent from a blocked address")
+	}
+}
+
+// Failures count per IP address, whatever the port, and past the limit each
+// one doubles the time the address is refused
+func TestAuthFailures(t *testing.T) {
+	var failures authFailures
+	start := time.Now()
+	tests := []struct {
+		ip        string
+		at        time.Duration // since start
+		failures  int
+		block     time.Duration
+		blockedAt time.Duration // when blocked is checked, and should hold
+	}{
+		{"192.0.2.1", 0, 1, 0, 0},
+		{"192.0.2.1", time.Second, 2, 0, 0},
+		{"2001:db8::1", time.Second, 1, 0, 0},
+		{"192.0.2.1", 2 * time.Second, 3, authBlock, 3 * time.Second},
+		{"192.0.2.1", time.Minute, 4, 2 * authBlock, time.Minute + 15*time.Second},
+		{"192.0.2.1", 2 * time.Minute, 5, 4 * authBlock, 2*time.Minute + 39*time.Second},
+		{"", 0, 1, 0, 0},
+		{"", 0, 2, 0, 0},
+		{"", 0, 3, 0, 0}, // Unix socket clients share an address and are never refused
+	}
+	for _, tt := range tests {
+		got, block := failures.add(tt.ip, 3, start.Add(tt.at))
+		if got != tt.failures || block != tt.block {
+			t.Errorf("add(%q) at %v = %d, %v; want %d, %v", tt.ip, tt.at, got, block, tt.failures, tt.block)
+		}
+		if blocked := failures.blocked(tt.ip, start.Add(tt.blockedAt)); blocked != (tt.block > 0) {
+			t.Errorf("blocked(%q) at %v = %v, want %v", tt.ip, tt.blockedAt, blocked, tt.block > 0)
+		}
+	}
+	if failures.blocked("192.0.2.1", start.Add(2*time.Minute+4*authBlock)) {
+		t.Error("address still refused after its window")
+	}
+	if got, _ := failures.add("192.0.2.1", 0, start); got != 6 {
+		t.Errorf("failures with no limit = %d, want 6", got)
+	}
+	failures.clear("192.0.2.1")
+	if got, block := failures.add("192.0.2.1", 3, start); got != 1 || block != 0 {
+		t.Errorf("add after clear = %d, %v; want 1, 0", got, block)
+	}
+}
+
+// The backoff stops doubling at maxAuthBlock
+func TestAuthFailuresMaxBlock(t *testing.T) {
+	var failures authFailures
+	var block time.Duration
+	for range 100 {
+		_, block = failures.add("192.0.2.1", 1, time.Now())
+	}
+	if block != maxAuthBlock {
+		t.Errorf("block after 100 failures = %v, want %v", block, maxAuthBlock)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := clientIP(tt.addr); got != tt.want {
+			t.Errorf("clientIP(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// Accepts the tokens it knows, as the identities they map to
+type tokenAuthenticator map[string]string
+
+func (a tokenAuthenticator) Authenticate(conn net.Conn) (string, error) {
+	token, err := ReadKey(conn)
+	if err != nil {
+		return "", err
+	}
+	identity, ok := a[token]
+	if !ok {
+		return "", fmt.Errorf("unknown token: %w", ErrAuthFailed)
+	}
+	return identity, nil
+}
+
+// A custom Authenticator replaces the key: the connections it accepts are
+// logged under their identity, and those it rejects are counted as failures
+func TestServerAuthenticator(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logged := captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{OutDir: DefaultOutDir, Authenticator: tokenAuthenticator{"alice-token": "alice"}}
+	startTestServer(t, srv)
+
+	client := &Client{Addr: srv.Addr, Key: "alice-token"}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send with a known token: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "a.txt")); err != nil || string(got) != "hello" {
+		t.Errorf("a.txt stored as %q, %v", got, err)
+	}
+	if !strings.Contains(logged.String(), `msg="File received successfully" remote=127.0.0.1`) || !strings.Contains(logged.String(), "identity=alice") {
+		t.Errorf("server didn't log the upload under the client's identity:\n%s", logged)
+	}
+
+	stranger := &Client{Addr: srv.Addr, Key: "mallory-token"}
+	if err := stranger.Send("a.txt"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Send with an unknown token = %v, want ErrAuthFailed", err)
+	}
+	if !strings.Contains(logged.String(), `failures=1 reason="unknown token: authentication failed"`) {
+		t.Errorf("server didn't count the rejection with the authenticator's reason:\n%s", logged)
+	}
+}
+
+func TestServerAuthenticatorConflicts(t *testing.T) {
+	auth := tokenAuthenticator{}
+	tests := []struct {
+		name string
+		srv  *Server
+		want string
+	}{
+		{"key", &Server{Key: "test-key"}, "leave Key, KeyHash and KeyDirs empty"},
+		{"key hash", &Server{KeyHash: "scrypt$2$1$1$c2FsdA$aGFzaGhhc2hoYXNoaGFzaA"}, "leave Key, KeyHash and KeyDirs empty"},
+		{"key dirs", &Server{KeyDirs: map[string]string{"red": "red"}}, "leave Key, KeyHash and KeyDirs empty"},
+		{"hashed names", &Server{HashNames: true, ManifestPath: "manifest.jsonl"}, "can't be combined with -hash-names"},
+		{"https", &Server{HTTPAddr: "127.0.0.1:0"}, "can't be combined with -hash-names, -http-addr"},
+		{"encryption", &Server{EncryptAtRest: true}, "-encrypt-at-rest without -storage-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			tt.srv.Addr, tt.srv.Authenticator = "127.0.0.1:0", auth
+			if err := tt.srv.ListenAndServe(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("ListenAndServe = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// ReadKey stops at the end of the key, leaving the request to whatever
+// reads the connection next, however it's wrapped
+func TestReadKey(t *testing.T) {
+	for _, wrap := range []bool{false, true} {
+		client, server := net.Pipe()
+		go func() {
+			client.Write([]byte(" token \nupload a.txt\n"))
+			client.Close()
+		}()
+		var conn net.Conn = server
+		if wrap {
+			conn = newLineConn(server, 0)
+		}
+		key, err := ReadKey(conn)
+		if err != nil || key != "token" {
+			t.Errorf("ReadKey = %q, %v; want token", key, err)
+		}
+		if rest, err := io.ReadAll(conn); err != nil || string(rest) != "upload a.txt\n" {
+			t.Errorf("left %q, %v after the key, want the request", rest, err)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,6 @@
+package shadowx
+
+import "errors"
+
+// Returned where the platform or filesystem doesn't track or can't set file creation times
+var errBtimeUnsupported = errors.New("file creation time is not supported on this platform")
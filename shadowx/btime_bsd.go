@@ -0,0 +1,23 @@
+//go:build freebsd || netbsd
+
+package shadowx
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Get a file's creation time from stat
+func birthTime(path string) (time.Time, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(st.Btim.Unix()), nil
+}
+
+// Setting creation times isn't supported here
+func setBirthTime(path string, t time.Time) error {
+	return errBtimeUnsupported
+}
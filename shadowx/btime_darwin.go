@@ -0,0 +1,27 @@
+//go:build darwin
+
+package shadowx
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Get a file's creation time from stat
+func birthTime(path string) (time.Time, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(st.Btim.Unix()), nil
+}
+
+// Set a file's creation time with setattrlist
+func setBirthTime(path string, t time.Time) error {
+	ts := unix.NsecToTimespec(t.UnixNano())
+	attrs := unix.Attrlist{Bitmapcount: unix.ATTR_BIT_MAP_COUNT, Commonattr: unix.ATTR_CMN_CRTIME}
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&ts)), unsafe.Sizeof(ts))
+	return unix.Setattrlist(path, &attrs, buf, 0)
+}
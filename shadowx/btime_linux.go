@@ -0,0 +1,26 @@
+//go:build linux
+
+package shadowx
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Get a file's creation time via statx, where the filesystem records it
+func birthTime(path string) (time.Time, error) {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_BTIME, &stx); err != nil {
+		return time.Time{}, err
+	}
+	if stx.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, errBtimeUnsupported
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), nil
+}
+
+// Linux has no call to set a file's creation time
+func setBirthTime(path string, t time.Time) error {
+	return errBtimeUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !windows
+
+package shadowx
+
+import "time"
+
+// Creation times are not available on this platform
+func birthTime(path string) (time.Time, error) {
+	return time.Time{}, errBtimeUnsupported
+}
+
+// Creation times are not available on this platform
+func setBirthTime(path string, t time.Time) error {
+	return errBtimeUnsupported
+}
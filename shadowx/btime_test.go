@@ -0,0 +1,37 @@
+package shadowx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBirthTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	before := time.Now().Add(-time.Second)
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	btime, err := birthTime(path)
+	if errors.Is(err, errBtimeUnsupported) {
+		t.Skip("creation times aren't recorded here")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if btime.Before(before) || btime.After(time.Now().Add(time.Second)) {
+		t.Errorf("birthTime = %s, want about now", btime)
+	}
+
+	want := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := setBirthTime(path, want); errors.Is(err, errBtimeUnsupported) {
+		return
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := birthTime(path); err != nil || !got.Equal(want) {
+		t.Errorf("after setBirthTime, birthTime = %s, %v; want %s", got, err, want)
+	}
+}
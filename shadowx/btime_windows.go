@@ -0,0 +1,38 @@
+//go:build windows
+
+package shadowx
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// Get a file's creation time
+func birthTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, errBtimeUnsupported
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), nil
+}
+
+// Set a file's creation time, leaving its access and modification times alone
+func setBirthTime(path string, t time.Time) error {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	handle, err := syscall.CreateFile(name, syscall.FILE_WRITE_ATTRIBUTES, syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+	created := syscall.NsecToFiletime(t.UnixNano())
+	return syscall.SetFileTime(handle, &created, nil, nil)
+}
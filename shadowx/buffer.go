@@ -0,0 +1,134 @@
+package shadowx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+)
+
+// Size of the buffers file data is read and written with unless configured
+const DefaultBufferSize = 64 << 10
+
+// Buffers beyond this are allowed but only cost memory; each transfer
+// allocates its own
+const largeBufferSize = 16 << 20
+
+// Check a configured buffer size, returning DefaultBufferSize for 0 and
+// warning about sizes past largeBufferSize
+func checkBufferSize(size int) (int, error) {
+	switch {
+	case size == 0:
+		return DefaultBufferSize, nil
+	case size < 0:
+		return 0, errors.New("-buffer must be positive")
+	case size > largeBufferSize:
+		slog.Warn("-buffer is very large; every transfer allocates it and beyond a few MB it rarely helps", "bytes", size)
+	}
+	return size, nil
+}
+
+// Parse a size in bytes with an optional K, M or G suffix (powers of 1024),
+// e.g. "64K" or "1MB"
+func ParseSize(value string) (int64, error) {
+	n, err := parseByteCount(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q, want bytes like 64KB or 1MB", value)
+	}
+	return n, nil
+}
+
+// The buffer length to use for a configured size, DefaultBufferSize for 0
+func bufferLen(size int) int {
+	if size <= 0 {
+		return DefaultBufferSize
+	}
+	return size
+}
+
+// Passes file data on to w, counting it and feeding it to hasher, so every
+// transfer copies with io.CopyBuffer and keeps its bookkeeping here
+type countingWriter struct {
+	w       io.Writer
+	hasher  hash.Hash         // fed what was written, nil for none
+	before  func() error      // runs ahead of each write, nil for none; its error stops the copy
+	written func(count int64) // reports the count after each write, nil for none
+	count   int64             // bytes written, plus any the count started from
+
+	// Holds each write while gate is paused, until ctx is done; nil gate to
+	// never wait. Uploads set keepalive to send a byte of the held data
+	// every pauseKeepalive meanwhile, flushing w when it can be, so the
+	// server doesn't drop the connection for being idle.
+	gate      *pauseGate
+	ctx       context.Context
+	keepalive bool
+
+	writeErr error // why w failed, to tell it from the reader failing
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.before != nil {
+		if err := c.before(); err != nil {
+			return 0, err
+		}
+	}
+	var n int // bytes of p the keepalive sent
+	if c.gate != nil {
+		var keepalive func() bool
+		if c.keepalive {
+			keepalive = func() bool {
+				if n == len(p) {
+					return false
+				}
+				if _, err := c.send(p[n:n+1], true); err != nil {
+					return false
+				}
+				n++
+				return true
+			}
+		}
+		if err := c.gate.wait(c.ctx, keepalive); err != nil {
+			return n, err
+		}
+		if c.writeErr != nil {
+			return n, c.writeErr
+		}
+	}
+	if n == len(p) {
+		return n, nil
+	}
+	sent, err := c.send(p[n:], false)
+	return n + sent, err
+}
+
+// Write p to w, flushing w afterwards when flush is set and it has a Flush
+// method, and account for what was written
+func (c *countingWriter) send(p []byte, flush bool) (int, error) {
+	n, err := c.w.Write(p)
+	if err == nil && flush {
+		if f, ok := c.w.(interface{ Flush() error }); ok {
+			err = f.Flush()
+		}
+	}
+	if err != nil {
+		c.writeErr = err
+		return n, err
+	}
+	if c.hasher != nil {
+		c.hasher.Write(p)
+	}
+	c.count += int64(n)
+	if c.written != nil {
+		c.written(c.count)
+	}
+	return n, nil
+}
+
+// Copy src to dst bufferSize bytes at a time until src ends. src is hidden
+// behind a plain io.Reader, since io.WriterTo would pick its own buffer.
+func copyBuffered(dst *countingWriter, src io.Reader, bufferSize int) error {
+	_, err := io.CopyBuffer(dst, struct{ io.Reader }{src}, make([]byte, bufferLen(bufferSize)))
+	return err
+}
@@ -0,0 +1,227 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCheckBufferSize(t *testing.T) {
+	tests := []struct {
+		size    int
+		want    int
+		wantErr bool
+	}{
+		{size: 0, want: DefaultBufferSize},
+		{size: 4 << 10, want: 4 << 10},
+		{size: 1, want: 1},
+		{size: largeBufferSize + 1, want: largeBufferSize + 1},
+		{size: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := checkBufferSize(tt.size)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkBufferSize(%d) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("checkBufferSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "4096", want: 4096},
+		{value: "64KB", want: 64 << 10},
+		{value: "1M", want: 1 << 20},
+		{value: "", wantErr: true},
+		{value: "big", wantErr: true},
+		{value: "-1K", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSize(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+// Writes the sizes it's given
+type writeSizes struct{ sizes []int }
+
+func (w *writeSizes) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return len(p), nil
+}
+
+func TestCopyBuffered(t *testing.T) {
+	stop := errors.New("stopped")
+	closed, pipe := io.Pipe()
+	closed.Close()
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, bytes.Repeat([]byte("x"), 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		src        func() io.Reader
+		dst        io.Writer
+		before     func() error
+		start      int64
+		wantCount  int64
+		wantSizes  string
+		wantErr    bool
+		wantWriter bool // the error is the destination's
+	}{
+		{"empty", func() io.Reader { return strings.NewReader("") }, &writeSizes{}, nil, 0, 0, "[]", false, false},
+		{"chunks of the buffer", func() io.Reader { return strings.NewReader("0123456789") }, &writeSizes{}, nil, 0, 10, "[4 4 2]", false, false},
+		{"file keeps the buffer", func() io.Reader { f, _ := os.Open(file); return f }, &writeSizes{}, nil, 0, 10, "[4 4 2]", false, false},
+		{"count from an offset", func() io.Reader { return strings.NewReader("0123") }, &writeSizes{}, nil, 100, 104, "[4]", false, false},
+		{"reader fails", func() io.Reader { return iotest.TimeoutReader(strings.NewReader("0123456789")) }, &writeSizes{}, nil, 0, 4, "[4]", true, false},
+		{"writer fails", func() io.Reader { return strings.NewReader("0123") }, pipe, nil, 0, 0, "", true, true},
+		{"before stops", func() io.Reader { return strings.NewReader("0123") }, &writeSizes{}, func() error { return stop }, 0, 0, "[]", true, false},
+	}
+	for _, tt := range tests {
+		hasher := sha256.New()
+		var reported []int64
+		counter := &countingWriter{w: tt.dst, hasher: hasher, before: tt.before, count: tt.start,
+			written: func(count int64) { reported = append(reported, count) }}
+		src := tt.src()
+		err := copyBuffered(counter, src, 4)
+		if c, ok := src.(io.Closer); ok {
+			c.Close()
+		}
+		if (err != nil) != tt.wantErr || (counter.writeErr != nil) != tt.wantWriter {
+			t.Errorf("%s: error %v, writer error %v", tt.name, err, counter.writeErr)
+		}
+		if counter.count != tt.wantCount {
+			t.Errorf("%s: counted %d, want %d", tt.name, counter.count, tt.wantCount)
+		}
+		if w, ok := tt.dst.(*writeSizes); ok && fmt.Sprint(w.sizes) != tt.wantSizes {
+			t.Errorf("%s: wrote %v, want %s", tt.name, w.sizes, tt.wantSizes)
+		}
+		if len(reported) > 0 && reported[len(reported)-1] != tt.wantCount {
+			t.Errorf("%s: last reported %d, want %d", tt.name, reported[len(reported)-1], tt.wantCount)
+		}
+	}
+}
+
+// An empty file is sent, stored and reported like any other
+func TestZeroByteTransfer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("empty", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	reports := make(map[string]string)
+	report := func(side string) func(string, int64, int64) {
+		return func(file string, done, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports[side] = fmt.Sprintf("%s %d/%d", filepath.Base(file), done, total)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ProgressFunc: report("server")}
+	stop := startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, ProgressFunc: report("client")}
+	if err := client.Send("empty"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := client.Download("empty", "copy"); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+
+	for _, name := range []string{filepath.Join(DefaultOutDir, "empty"), "copy"} {
+		if info, err := os.Stat(name); err != nil || info.Size() != 0 {
+			t.Errorf("%s: %v, want an empty file", name, err)
+		}
+	}
+	// An empty regular file might be a pseudo-file with content, so its size
+	// goes undeclared
+	for side, want := range map[string]string{"client": "empty 0/0", "server": "empty 0/-1"} {
+		if reports[side] != want {
+			t.Errorf("%s reported %q, want %q", side, reports[side], want)
+		}
+	}
+	sum := sha256.Sum256(nil)
+	if got, err := hashStored(&serverConfig{}, filepath.Join(DefaultOutDir, "empty"), 0); err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Errorf("stored digest %s, %v", got, err)
+	}
+}
+
+// Receive 64MB over loopback TCP into a file with each buffer size
+func BenchmarkReceiveFile(b *testing.B) {
+	const size = 64 << 20
+	for _, bench := range []struct {
+		name string
+		size int
+	}{
+		{"4KB", 4 << 10},
+		{"64KB", 64 << 10},
+		{"1MB", 1 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			stdout := os.Stdout
+			os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0) // receiveFile reports progress on every read
+			defer func() { os.Stdout.Close(); os.Stdout = stdout }()
+			dest := filepath.Join(b.TempDir(), "out")
+			b.SetBytes(size)
+			for b.Loop() {
+				benchmarkReceive(b, dest, size, bench.size)
+			}
+		})
+	}
+}
+
+func benchmarkReceive(b *testing.B, dest string, size int64, bufferSize int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, io.LimitReader(zeroReader{}, size))
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	file, err := os.Create(dest)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	if n, err := receiveFile(conn, file, sha256.New(), bufferSize, nil, nil, 0); err != nil || n != size {
+		b.Fatalf("received %d bytes, %v; want %d", n, err, size)
+	}
+}
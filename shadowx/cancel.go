@@ -0,0 +1,45 @@
+package shadowx
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// A connection that's reset when its context is canceled, so reads and
+// writes blocked on it return at once and the server sees the transfer
+// fail rather than end
+type ctxConn struct {
+	net.Conn
+	stop func() bool
+}
+
+// Tie conn to ctx: give it ctx's deadline, and reset it when ctx is
+// canceled before it's closed
+func withContext(ctx context.Context, conn net.Conn) net.Conn {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return conn
+	}
+	stop := context.AfterFunc(ctx, func() {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+		conn.Close()
+	})
+	return &ctxConn{Conn: conn, stop: stop}
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+func (c *ctxConn) CloseWrite() error {
+	if w, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return w.CloseWrite()
+	}
+	return errors.New("connection can't be half-closed")
+}
@@ -0,0 +1,135 @@
+package shadowx
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A canceled context resets the connection, and a deadline becomes the
+// connection's
+func TestWithContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	conn := withContext(ctx, client)
+	if _, ok := conn.(*ctxConn); !ok {
+		t.Fatalf("withContext returned %T, want *ctxConn", conn)
+	}
+	cancel()
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Error("Write succeeded after the context was canceled")
+	}
+
+	plain, other := net.Pipe()
+	defer other.Close()
+	if conn := withContext(context.Background(), plain); conn != plain {
+		t.Errorf("withContext wrapped a connection whose context is never done: %T", conn)
+	}
+}
+
+// Canceling mid-file returns the context's error at once, and the server
+// drops what it received
+func TestSendContextCanceled(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.bin", make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	stop := startTestServer(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &Client{Addr: srv.Addr, Key: srv.Key, UpLimit: 256 << 10, RunRetries: 2, RunRetryDelay: time.Hour,
+		ProgressFunc: func(string, int64, int64) { cancel() }}
+	start := time.Now()
+	err := client.SendContext(ctx, "a.bin")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendContext = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("SendContext took %v to return after being canceled", elapsed)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(DefaultOutDir, "a.bin")); err == nil {
+		t.Error("server stored the canceled file")
+	}
+
+	// The Client still sends once its context is gone
+	srv = &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	client = &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("a.bin"); err != nil {
+		t.Fatalf("Send after a canceled SendContext: %v", err)
+	}
+}
+
+// A context whose deadline passed fails the Send with it before connecting
+func TestSendContextDeadline(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.SendContext(ctx, "a.txt"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SendContext = %v, want context.DeadlineExceeded", err)
+	}
+	if err := client.SendContext(context.Background(), "a.txt"); err != nil {
+		t.Errorf("SendContext with a live context: %v", err)
+	}
+}
+
+// Calls on one Client each have their own context: canceling one leaves
+// another running alongside it to finish
+func TestSendContextOverlapping(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err := os.WriteFile(name, make([]byte, 1<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	var once sync.Once
+	client := &Client{Addr: srv.Addr, Key: srv.Key, UpLimit: 2 << 20,
+		ProgressFunc: func(file string, done, total int64) {
+			switch {
+			case file == "b.bin" && done > 0:
+				once.Do(func() { close(started) })
+			case file == "a.bin":
+				cancel()
+			}
+		}}
+	other := make(chan error, 1)
+	go func() { other <- client.Send("b.bin") }()
+	<-started
+	if err := client.SendContext(ctx, "a.bin"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendContext = %v, want context.Canceled", err)
+	}
+	if err := <-other; err != nil {
+		t.Errorf("Send alongside a canceled SendContext: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(DefaultOutDir, "b.bin")); err != nil || info.Size() != 1<<20 {
+		t.Errorf("server's copy of the other file: %v", err)
+	}
+}
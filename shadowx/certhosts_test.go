@@ -0,0 +1,129 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDefaultCertHosts(t *testing.T) {
+	hostname, _ := os.Hostname()
+	wildcard := []string{hostname, "localhost", "127.0.0.1", "::1"}
+	if hostname == "" {
+		wildcard = wildcard[1:]
+	}
+	tests := []struct {
+		addr string
+		want []string
+	}{
+		{"192.168.1.100:8080", []string{"192.168.1.100"}},
+		{"[2001:db8::5]:8080", []string{"2001:db8::5"}},
+		{"files.example.com:8080", []string{"files.example.com"}},
+		{"0.0.0.0:8080", wildcard},
+		{"[::]:8080", wildcard},
+		{":8080", wildcard},
+		{"8080", nil},
+	}
+	for _, tt := range tests {
+		if got := defaultCertHosts(tt.addr); !slices.Equal(got, tt.want) {
+			t.Errorf("defaultCertHosts(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCertHost(t *testing.T) {
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"files.example.com", true},
+		{"10.0.0.5", true},
+		{"2001:db8::5", true},
+		{"files.example.com:8080", false},
+		{"[2001:db8::5]", false},
+		{"https://files.example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := checkCertHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("checkCertHost(%q) = %v, want ok %v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+// The generated certificate is a leaf valid for the listening address, so a
+// client trusting it with -ca verifies the server instead of skipping checks
+func TestGeneratedCertVerifies(t *testing.T) {
+	t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+	srv := &Server{Key: "test-key", OutDir: t.TempDir(), CertHosts: []string{"127.0.0.1", "files.example.com"}}
+	startTestServer(t, srv)
+
+	cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf.IsCA {
+		t.Error("generated certificate is a CA")
+	}
+	if !slices.Equal(cert.Leaf.DNSNames, []string{"files.example.com"}) || len(cert.Leaf.IPAddresses) != 1 {
+		t.Errorf("SANs = %q %v, want files.example.com and 127.0.0.1", cert.Leaf.DNSNames, cert.Leaf.IPAddresses)
+	}
+
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, CAFile: "server.crt"}
+	if err := client.Send("a.txt"); err != nil {
+		t.Errorf("Send verifying the generated certificate: %v", err)
+	}
+}
+
+// A certificate given with TLSCert is served as it is, and nothing is
+// generated in its place when it's missing
+func TestProvidedCert(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("certs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join("certs", "a.crt"), filepath.Join("certs", "a.key")
+	if err := generateTLSCert(certFile, keyFile, []string{"127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	certPEM, _ := os.ReadFile(certFile)
+	keyPEM, _ := os.ReadFile(keyFile)
+	srv := &Server{Key: "test-key", OutDir: t.TempDir(), TLSCert: certFile, TLSKey: keyFile}
+	startTestServer(t, srv)
+
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, CAFile: certFile}
+	if err := client.Send("a.txt"); err != nil {
+		t.Errorf("Send verifying the provided certificate: %v", err)
+	}
+	if _, err := os.Stat("server.crt"); !os.IsNotExist(err) {
+		t.Errorf("server.crt generated alongside the provided certificate: %v", err)
+	}
+	if got, _ := os.ReadFile(certFile); !bytes.Equal(got, certPEM) {
+		t.Error("provided certificate overwritten")
+	}
+	if got, _ := os.ReadFile(keyFile); !bytes.Equal(got, keyPEM) {
+		t.Error("provided key overwritten")
+	}
+
+	missing := &Server{Addr: "127.0.0.1:0", Key: "test-key", OutDir: t.TempDir(), TLSCert: "missing.crt", TLSKey: "missing.key"}
+	if err := missing.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "loading certificate") {
+		t.Errorf("ListenAndServe with a missing -tls-cert = %v, want it refused", err)
+	}
+	if _, err := os.Stat("missing.crt"); !os.IsNotExist(err) {
+		t.Errorf("missing -tls-cert was generated: %v", err)
+	}
+	half := &Server{Addr: "127.0.0.1:0", Key: "test-key", OutDir: t.TempDir(), TLSCert: certFile}
+	if err := half.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "must be given together") {
+		t.Errorf("ListenAndServe with -tls-cert alone = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,85 @@
+package shadowx
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Progress of a batched directory send
+type checkpoint struct {
+	path   string
+	Root   string       `json:"root"`   // absolute path of the directory being sent
+	Files  []string     `json:"files"`  // files to send, in order, as found by the walk
+	Done   int          `json:"done"`   // files covered by completed batches
+	Failed []failedPath `json:"failed"` // files that couldn't be read or sent so far
+}
+
+// A file recorded as failed, with the error as text so it survives a restart
+type failedPath struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// Start an empty checkpoint for root
+func newCheckpoint(path, root string) *checkpoint {
+	return &checkpoint{path: path, Root: cacheKey(root)}
+}
+
+// Load the checkpoint at path if it belongs to a send of root; returns nil
+// when there is none to resume
+func loadCheckpoint(path, root string) (*checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &checkpoint{path: path}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	if cp.Root != cacheKey(root) || cp.Done < 0 || cp.Done > len(cp.Files) {
+		return nil, nil
+	}
+	return cp, nil
+}
+
+// Write the checkpoint to disk
+func (c *checkpoint) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(c.path), "."+filepath.Base(c.path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Record files that failed
+func (c *checkpoint) addFailures(failures []SendFailure) {
+	for _, f := range failures {
+		c.Failed = append(c.Failed, failedPath{Path: f.Path, Error: f.Err.Error()})
+	}
+}
+
+// The recorded failures, including those of earlier runs
+func (c *checkpoint) failures() []SendFailure {
+	var failures []SendFailure
+	for _, f := range c.Failed {
+		failures = append(failures, SendFailure{Path: f.Path, Err: errors.New(f.Error)})
+	}
+	return failures
+}
+
+// Delete the checkpoint once the run has finished
+func (c *checkpoint) remove() error {
+	if err := os.Remove(c.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package shadowx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.json")
+
+	if cp, err := loadCheckpoint(path, "src"); cp != nil || err != nil {
+		t.Fatalf("loadCheckpoint without a file = %v, %v", cp, err)
+	}
+
+	cp := newCheckpoint(path, "src")
+	cp.Files = []string{"src/a", "src/b", "src/c"}
+	cp.Done = 2
+	cp.addFailures([]SendFailure{{Path: "src/b", Err: errors.New("connection reset")}})
+	if err := cp.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadCheckpoint(path, "src")
+	if err != nil || got == nil {
+		t.Fatalf("loadCheckpoint = %v, %v", got, err)
+	}
+	if !reflect.DeepEqual(got, cp) {
+		t.Errorf("loadCheckpoint = %+v, want %+v", got, cp)
+	}
+	if failures := got.failures(); len(failures) != 1 || failures[0].Path != "src/b" || failures[0].Err.Error() != "connection reset" {
+		t.Errorf("failures() = %v, want src/b: connection reset", failures)
+	}
+	if other, err := loadCheckpoint(path, "elsewhere"); other != nil || err != nil {
+		t.Errorf("checkpoint of another root was resumed: %v, %v", other, err)
+	}
+
+	os.WriteFile(path, []byte(`{"root":"`+cacheKey("src")+`","files":["a"],"done":5}`), 0600)
+	if bad, _ := loadCheckpoint(path, "src"); bad != nil {
+		t.Error("resumed a checkpoint with an impossible done count")
+	}
+	os.WriteFile(path, []byte("{"), 0600)
+	if _, err := loadCheckpoint(path, "src"); err == nil {
+		t.Error("loaded a corrupt checkpoint")
+	}
+
+	if err := cp.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cp.remove(); err != nil {
+		t.Errorf("removing a missing checkpoint: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package shadowx
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+
+	"lukechampine.com/blake3"
+)
+
+// Algorithm uploads are checked with unless the client picks another
+const defaultChecksum = "sha256"
+
+// Checksum algorithms a client can pick with the checksum attribute. The
+// server records and matches stored files by SHA-256 whichever is picked.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// Whether s is a hex digest of the length algorithm produces
+func validDigest(algorithm, s string) bool {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok || len(s) != 2*newHash().Size() {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Hash the first limit bytes of filename with algorithm, which must be known
+func checksumFile(filename string, limit int64, algorithm string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := checksumAlgorithms[algorithm]()
+	if _, err := io.Copy(hasher, io.LimitReader(f, limit)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
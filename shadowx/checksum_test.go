@@ -0,0 +1,96 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidDigest(t *testing.T) {
+	tests := []struct {
+		algorithm, digest string
+		want              bool
+	}{
+		{"sha256", strings.Repeat("ab", 32), true},
+		{"sha512", strings.Repeat("ab", 64), true},
+		{"blake3", strings.Repeat("ab", 32), true},
+		{"sha512", strings.Repeat("ab", 32), false},
+		{"sha256", strings.Repeat("zz", 32), false},
+		{"md5", strings.Repeat("ab", 16), false},
+		{"sha256", "", false},
+	}
+	for _, tt := range tests {
+		if got := validDigest(tt.algorithm, tt.digest); got != tt.want {
+			t.Errorf("validDigest(%q, %q) = %v, want %v", tt.algorithm, tt.digest, got, tt.want)
+		}
+	}
+}
+
+// The server hashes an upload with the algorithm the client names, checks
+// a declared digest with it and names it in the status
+func TestHandleConnectionChecksumAlgorithm(t *testing.T) {
+	data := "checked with another algorithm"
+	sum := fmt.Sprintf("%x", sha512.Sum512([]byte(data)))
+	tests := []struct {
+		attrs string
+		reply string
+	}{
+		{"checksum=sha512", "OK " + sum + "\tchecksum=sha512\n"},
+		{"checksum=sha512\tsha512=" + sum, "OK " + sum + "\tchecksum=sha512\n"},
+		{"checksum=sha512\tsha512=" + strings.Repeat("0", 128), "MISMATCH " + sum + "\n"},
+		{"checksum=sha512\tsha512=" + strings.Repeat("0", 64), "REJECTED malformed sha512\n"},
+		{"checksum=md5", "REJECTED unsupported checksum algorithm\n"},
+		{"checksum=sha512\tresume=" + strings.Repeat("0", 32), "REJECTED resume only supports sha256 checksums\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+		replies := testSession(t, cfg, fmt.Sprintf("upload data.txt\tsize=%d\t%s\n%s", len(data), tt.attrs, data))
+		if !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("%s: replies %q, want %q", tt.attrs, replies, tt.reply)
+		}
+	}
+}
+
+// Files sent with each algorithm round-trip, with and without declaring
+// the digest up front
+func TestClientSendChecksumAlgorithms(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	data := bytes.Repeat([]byte("digest me\n"), 100000)
+	if err := os.WriteFile("data.bin", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	for _, algorithm := range []string{"", "sha256", "sha512", "blake3"} {
+		for _, verify := range []bool{false, true} {
+			os.RemoveAll(DefaultOutDir)
+			client := &Client{Addr: srv.Addr, Key: srv.Key, ChecksumAlgo: algorithm, Verify: verify}
+			if err := client.Send("data.bin"); err != nil {
+				t.Errorf("%q, verify %v: Send: %v", algorithm, verify, err)
+				continue
+			}
+			if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "data.bin")); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%q, verify %v: stored copy differs (%d of %d bytes, %v)", algorithm, verify, len(got), len(data), err)
+			}
+		}
+	}
+
+	for _, client := range []*Client{
+		{ChecksumAlgo: "md5"},
+		{ChecksumAlgo: "blake3", Resume: true},
+		{ChecksumAlgo: "sha512", Streams: 4},
+		{ChecksumAlgo: "sha512", VerifyRoundtrip: true},
+	} {
+		if _, err := client.newConfig(); err == nil {
+			t.Errorf("newConfig accepted %+v", client)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package shadowx
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Local cache of file SHA-256 digests, reused while a file's size and mtime are unchanged
+type checksumCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]cacheEntry
+	dirty   bool
+}
+
+// Fingerprint of a file at the time it was hashed
+type cacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	SHA256  string `json:"sha256"`
+}
+
+// Load the checksum cache from path; a missing file yields an empty cache
+func loadChecksumCache(path string) (*checksumCache, error) {
+	c := &checksumCache{path: path, entries: make(map[string]cacheEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Cache key for a file
+func cacheKey(filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filename
+}
+
+// Return the cached digest of filename if it hasn't changed since it was hashed
+func (c *checksumCache) lookup(filename string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[cacheKey(filename)]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return entry.SHA256, true
+}
+
+// Remember the digest of filename
+func (c *checksumCache) store(filename string, info os.FileInfo, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey(filename)] = cacheEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), SHA256: sum}
+	c.dirty = true
+}
+
+// Drop the cached digest of filename
+func (c *checksumCache) forget(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(filename)
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.dirty = true
+	}
+}
+
+// Write the cache back to disk if anything changed
+func (c *checksumCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Compute the hex SHA-256 of the first limit bytes of a file
+func hashFile(filename string, limit int64) (string, error) {
+	return checksumFile(filename, limit, defaultChecksum)
+}
@@ -0,0 +1,105 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksumCacheLookup(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := loadChecksumCache(filepath.Join(dir, "cache.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.lookup(file, info); ok {
+		t.Fatal("lookup hit on an empty cache")
+	}
+	cache.store(file, info, "digest")
+
+	later := info.ModTime().Add(time.Second)
+	tests := []struct {
+		name   string
+		size   int64
+		mtime  time.Time
+		wantOK bool
+	}{
+		{"unchanged", info.Size(), info.ModTime(), true},
+		{"size changed", info.Size() + 1, info.ModTime(), false},
+		{"mtime changed", info.Size(), later, false},
+		{"both changed", 0, later, false},
+	}
+	for _, tt := range tests {
+		sum, ok := cache.lookup(file, fakeInfo{info, tt.size, tt.mtime})
+		if ok != tt.wantOK || (ok && sum != "digest") {
+			t.Errorf("%s: lookup = %q, %v; want hit %v", tt.name, sum, ok, tt.wantOK)
+		}
+	}
+
+	cache.forget(file)
+	if _, ok := cache.lookup(file, info); ok {
+		t.Error("lookup hit after forget")
+	}
+}
+
+func TestChecksumCacheSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	file := filepath.Join(dir, "data.txt")
+	if err := os.WriteFile(file, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := loadChecksumCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.store(file, info, "digest")
+	if err := cache.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadChecksumCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, ok := reloaded.lookup(file, info); !ok || sum != "digest" {
+		t.Errorf("reloaded lookup = %q, %v; want digest, true", sum, ok)
+	}
+}
+
+func TestHashFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "data.txt")
+	if err := os.WriteFile(file, []byte("hello\nextra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// sha256 of "hello\n"
+	const want = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	if got, err := hashFile(file, 6); err != nil || got != want {
+		t.Errorf("hashFile = %q, %v; want %q", got, err, want)
+	}
+}
+
+// FileInfo with overridden size and modification time
+type fakeInfo struct {
+	os.FileInfo
+	size  int64
+	mtime time.Time
+}
+
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) ModTime() time.Time { return f.mtime }
@@ -0,0 +1,529 @@
+package shadowx
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ShadowX client, sending files to a server and downloading them back.
+// Set the fields before the first Send or Download. Calls may then run at
+// once from several goroutines, each with its own context and totals, as
+// long as they don't send the same files or share a checkpoint.
+type Client struct {
+	Addr string // server address, host:port
+	Key  string // pre-shared key
+
+	CertFile string // certificate to present to servers that require one
+	KeyFile  string // private key for CertFile
+	Pin      string // only accept a server whose public key has this SHA-256 fingerprint, in hex
+	CAFile   string // verify the server certificate against the CAs in this PEM bundle
+	DANE     bool   // verify the server certificate against its DNSSEC-signed TLSA record
+
+	// Trust each server on first use: record its fingerprint in this file
+	// and refuse it, with ErrServerChanged, when the fingerprint changes
+	// later. Empty to disable.
+	KnownHosts string
+
+	// Use TLS when Addr is a Unix socket, "unix:<path>", too; it's plain
+	// otherwise
+	SocketTLS bool
+
+	// Connect without TLS, so file data and the key cross the network in
+	// the clear; only for trusted networks. The server must set NoTLS too.
+	NoTLS bool
+
+	NewerThan time.Time // only send files modified after this, when set
+	OlderThan time.Time // only send files modified before this, when set
+	MaxSize   int64     // skip files larger than this many bytes, 0 for no limit
+
+	MaxHandshakes int      // TLS handshakes in progress at once, 0 for no limit
+	TraceID       string   // trace ID recorded with each upload, empty to let the server assign one
+	UpLimit       int64    // bytes per second sent on each connection, 0 for no limit
+	DownLimit     int64    // bytes per second received on each connection, 0 for no limit
+	BufferSize    int      // bytes read and written at a time, 0 for DefaultBufferSize
+	MinTLS        uint16   // oldest TLS version the server may use, tls.VersionTLS12 when 0
+	CipherSuites  []uint16 // TLS 1.2 cipher suites to offer, nil for Go's defaults
+
+	Verify          bool // have the server check each file's SHA-256 before storing it
+	VerifyRoundtrip bool // have the server re-read its stored copy after each upload
+	Diff            bool // send changed text files as diffs when smaller
+	Preserve        bool // send permission bits and modification times
+	PreserveBtime   bool // send file creation times
+	Compress        bool // compress file data on the wire
+
+	// Algorithm the server checks uploads with: "sha256", the default,
+	// "sha512" or "blake3"
+	ChecksumAlgo string
+
+	// Codec Compress uses: "gzip", the default, or "zstd". A server that
+	// doesn't support zstd picks the codec itself, down to none.
+	Compression string
+
+	Name string // name data sent from standard input ("-") is stored under, "stdin" when empty
+	As   string // name a single file is stored under instead of its own, a bare name without directories
+
+	// How long an http:// or https:// URL given to Send may go without
+	// sending data, its headers or its body, before the fetch fails; 0 for
+	// no limit
+	HTTPTimeout time.Duration
+
+	Parallel       int    // files of a directory sent at once, each on its own connection unless Mux is set; 0 or 1 for one at a time
+	Mux            bool   // send the files of a directory as streams of one multiplexed connection, falling back to a session per worker when the server doesn't take it
+	Streams        int    // send each file of 2MiB or more over up to this many connections at once, each carrying a byte range; 0 or 1 for one
+	BatchSize      int    // send directories in checkpointed batches of this many files, 0 to disable
+	CheckpointPath string // file that records batch progress
+
+	ChecksumCache string // reuse digests of unchanged files kept in this file, empty to disable
+	Resume        bool   // resume interrupted uploads with the tokens the server assigned
+	ResumeState   string // file that keeps upload tokens for Resume
+
+	// With Resume, send each directory as a session the server keeps, so a
+	// run that's killed and started again skips the files the session
+	// stored and resumes those it had started
+	ResumeDirs bool
+
+	// Append to the server's copy of each file instead of replacing it,
+	// sending only the bytes past its end, for files that grow between
+	// runs such as logs. The server keeps the new bytes only if the whole
+	// copy then matches the file's SHA-256.
+	Append bool
+
+	RunRetries    int           // resend the files that failed up to this many more times
+	RunRetryDelay time.Duration // wait before each retry pass
+
+	// Retry a connection that's refused, reset or times out up to Retries
+	// times, and with Resume an interrupted transfer too, waiting RetryDelay
+	// (DefaultRetryDelay when 0) before the first retry and twice as long
+	// before each further one. Rejected keys aren't retried.
+	Retries    int
+	RetryDelay time.Duration
+
+	DryRun     bool // list what Send would send instead of connecting
+	VerifyOnly bool // check the server's copies of what Send would send against the local files instead of sending
+
+	// Hash the files first and skip those the server already stores with
+	// the same size and SHA-256
+	SkipExisting bool
+
+	// Send symbolic links inside directories as links, for the server to
+	// recreate, instead of what they point to
+	PreserveSymlinks bool
+
+	// Delete each regular file once the server has stored it and confirmed
+	// its digest matches, as long as it didn't change while being sent.
+	// Failed files, links and directories are kept.
+	Move bool
+
+	// With Watch, how long a file has to go without changing before it's
+	// sent, so a burst of writes goes as one upload; DefaultWatchDelay
+	// when 0
+	WatchDelay time.Duration
+
+	// With Watch, have the server delete its copy of each file removed
+	// from the directory; the server must be started with AllowDelete
+	WatchDeletes bool
+
+	// Write JSON progress events here, one object per line, instead of the
+	// live progress counter; nil to disable
+	Events io.Writer
+
+	// Log the summary line that ends each Send even when the logger's level
+	// hides info lines. The command sets it for -quiet-success along with a
+	// level that only lets errors through, so a run prints the files that
+	// failed and then its totals.
+	QuietSuccess bool
+
+	// Called with the bytes of a file sent or downloaded so far, and its
+	// size or -1 when unknown, in place of the live progress counter. It's
+	// called at most every 100ms during a transfer and once when it ends,
+	// from several goroutines at once when Parallel sends files together.
+	ProgressFunc func(file string, done, total int64)
+
+	once    sync.Once
+	cfg     *clientConfig
+	initErr error
+}
+
+// A file or directory that couldn't be sent, and why
+type SendFailure struct {
+	Path string
+	Err  error
+}
+
+func (f SendFailure) Error() string {
+	return f.Path + ": " + f.Err.Error()
+}
+
+// The paths a Send couldn't transfer
+type SendError struct {
+	Failed []SendFailure
+}
+
+func (e *SendError) Error() string {
+	if len(e.Failed) == 1 {
+		return "sending " + e.Failed[0].Error()
+	}
+	return fmt.Sprintf("failed to send %d path(s)", len(e.Failed))
+}
+
+// The individual failures, for errors.Is and errors.As
+func (e *SendError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Send a file or directory, retrying failed files as configured. Returns a
+// *SendError listing the paths that still failed.
+func (c *Client) Send(path string) error {
+	return c.SendContext(context.Background(), path)
+}
+
+// Send like Send, but stop once ctx is done: the file being sent is cut off
+// between chunks, its connection reset, and ctx.Err() returned. Connections
+// also take ctx's deadline. Files already sent stay on the server. A canceled
+// upload may leave a partial file on the server unless Resume is set, in which
+// case the next Send continues from it.
+func (c *Client) SendContext(ctx context.Context, path string) error {
+	shared, err := c.config()
+	if err != nil {
+		return err
+	}
+	if err := c.checkSource(path); err != nil {
+		return err
+	}
+	cfg := shared.forCall(ctx, path)
+	if c.DryRun {
+		if failed := listFiles(cfg, path); len(failed) > 0 {
+			return &SendError{Failed: failed}
+		}
+		return nil
+	}
+	if c.VerifyOnly {
+		if path == stdinPath {
+			return errors.New("-verify-only can't check standard input, which isn't stored under a known name")
+		}
+		if isURL(path) {
+			return errors.New("-verify-only can't check a URL, which would have to be fetched to compare")
+		}
+		if failed := auditFiles(cfg, path); len(failed) > 0 {
+			return &SendError{Failed: failed}
+		}
+		return nil
+	}
+	return c.finishSend(ctx, cfg, []sendRoot{{path: path, failed: sendFile(cfg, path)}}, nil)
+}
+
+// Refuse a path given to Send that the settings can't apply to
+func (c *Client) checkSource(path string) error {
+	if path == stdinPath && c.RunRetries > 0 {
+		return errors.New("-run-retries can't resend standard input, which is read only once")
+	}
+	if (path == stdinPath || isURL(path)) && c.Move {
+		return errors.New("-move only deletes local files, not standard input or a URL")
+	}
+	if (path == stdinPath || isURL(path)) && c.Append {
+		return errors.New("-append needs local files, not standard input or a URL, to skip what the server holds")
+	}
+	if c.As != "" && isDir(path) {
+		return errors.New("-as names a single file, a directory keeps its own name")
+	}
+	return nil
+}
+
+// A file or directory given to Send, and its paths that failed
+type sendRoot struct {
+	path   string
+	failed []SendFailure
+}
+
+// Retry the paths of roots that failed, as configured, then save the
+// checksum cache and report the totals. Paths in rejected couldn't be
+// tried at all and are reported as failed without retrying them.
+func (c *Client) finishSend(ctx context.Context, cfg *clientConfig, roots []sendRoot, rejected []SendFailure) error {
+	pending := func() (n int) {
+		for _, r := range roots {
+			n += len(r.failed)
+		}
+		return n
+	}
+	// Retrying can't help when the server rejected the key
+	for attempt := 1; attempt <= c.RunRetries && pending() > 0 && !cfg.keyRejected.Load(); attempt++ {
+		slog.Warn("Paths failed, retrying them", "failed", pending(), "delay", c.RunRetryDelay, "attempt", attempt, "of", c.RunRetries)
+		select {
+		case <-time.After(c.RunRetryDelay):
+		case <-ctx.Done():
+		}
+		for i, r := range roots {
+			// Remote names are relative to the root each path was found under
+			cfg.root = r.path
+			var still []SendFailure
+			for _, f := range r.failed {
+				still = append(still, sendFile(cfg, f.Path)...)
+			}
+			roots[i].failed = still
+		}
+	}
+	if cfg.cache != nil {
+		if err := cfg.cache.save(); err != nil {
+			slog.Error("Error saving checksum cache", "err", err)
+		}
+	}
+	failed := rejected
+	for _, r := range roots {
+		failed = append(failed, r.failed...)
+	}
+	cfg.stats.report(cfg.events, len(failed), cfg.quietSuccess)
+	if len(failed) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return &SendError{Failed: failed}
+	}
+	return nil
+}
+
+// Download the file the server stores as name into dest, which must not exist
+func (c *Client) Download(name, dest string) error {
+	shared, err := c.config()
+	if err != nil {
+		return err
+	}
+	cfg := shared.forCall(context.Background(), "")
+	err = downloadFile(cfg, sendName(name), dest)
+	cfg.events.finish(sendName(name), err)
+	return err
+}
+
+// List the directory the server stores as dir, "." for its root
+func (c *Client) List(dir string) ([]RemoteFile, error) {
+	cfg, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	if dir = sendName(dir); dir == "" {
+		dir = "."
+	}
+	return listRemote(cfg.forCall(context.Background(), ""), dir)
+}
+
+// Build the transfer settings on first use
+func (c *Client) config() (*clientConfig, error) {
+	c.once.Do(func() {
+		c.cfg, c.initErr = c.newConfig()
+	})
+	return c.cfg, c.initErr
+}
+
+// The settings for one call, sending root or nothing, canceled by ctx. The
+// Client's settings are shared by every call, so each gets a copy with a
+// context, root and totals of its own.
+func (cfg *clientConfig) forCall(ctx context.Context, root string) *clientConfig {
+	call := *cfg
+	call.ctx, call.root = ctx, root
+	call.keyRejected, call.fingerprint = new(atomic.Bool), new(atomic.Bool)
+	call.stats = &transferStats{}
+	call.stats.reset()
+	return &call
+}
+
+func (c *Client) newConfig() (*clientConfig, error) {
+	if c.Key == "" {
+		return nil, errors.New("a pre-shared key is required")
+	}
+	if err := validServerAddress(c.Addr); err != nil {
+		return nil, err
+	}
+	if c.Retries < 0 || c.RetryDelay < 0 {
+		return nil, errors.New("-retries and -retry-delay can't be negative")
+	}
+	if c.MaxSize < 0 {
+		return nil, errors.New("-max-size can't be negative")
+	}
+	cfg := &clientConfig{address: c.Addr, secretKey: c.Key, upLimit: c.UpLimit, downLimit: c.DownLimit,
+		newerThan: c.NewerThan, olderThan: c.OlderThan, maxSize: c.MaxSize, traceID: c.TraceID, events: newEventWriter(c.Events), ctx: context.Background(),
+		keyRejected: new(atomic.Bool), fingerprint: new(atomic.Bool), stats: &transferStats{},
+		retries: c.Retries, retryDelay: c.RetryDelay}
+	var err error
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := loadClientCert(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.clientCert = []tls.Certificate{cert}
+	}
+	cfg.verify = c.Verify
+	cfg.verifyRoundtrip = c.VerifyRoundtrip
+	cfg.diff = c.Diff
+	cfg.preserveBtime = c.PreserveBtime
+	cfg.preserve = c.Preserve
+	cfg.checksum = c.ChecksumAlgo
+	if cfg.checksum == "" {
+		cfg.checksum = defaultChecksum
+	}
+	if checksumAlgorithms[cfg.checksum] == nil {
+		return nil, fmt.Errorf("unknown checksum algorithm %q, want sha256, sha512 or blake3", cfg.checksum)
+	}
+	if cfg.checksum != defaultChecksum && (c.Resume || c.Streams > 1 || c.VerifyRoundtrip) {
+		return nil, errors.New("-checksum-algo other than sha256 can't be combined with -resume, -streams or -verify-roundtrip")
+	}
+	if c.Compress {
+		cfg.compress = c.Compression
+		if cfg.compress == "" {
+			cfg.compress = "gzip"
+		}
+		if !knownCompression[cfg.compress] {
+			return nil, fmt.Errorf("unknown compression %q, want gzip or zstd", cfg.compress)
+		}
+	}
+	cfg.skipStored = c.SkipExisting
+	cfg.preserveSymlinks = c.PreserveSymlinks
+	cfg.move = c.Move
+	if c.Append && (c.Resume || c.Streams > 1 || c.Diff || cfg.checksum != defaultChecksum) {
+		return nil, errors.New("-append can't be combined with -resume, -streams, -diff or -checksum-algo other than sha256")
+	}
+	cfg.appending = c.Append
+	cfg.progress = c.ProgressFunc
+	cfg.quietSuccess = c.QuietSuccess
+	cfg.socketTLS = c.SocketTLS
+	cfg.noTLS = c.NoTLS
+	if c.NoTLS {
+		if c.SocketTLS || c.Pin != "" || c.CAFile != "" || c.DANE || c.CertFile != "" || c.KnownHosts != "" {
+			return nil, errors.New("-no-tls can't be combined with -socket-tls, -pin, -ca, -dane, -known-hosts or -cert")
+		}
+		slog.Warn("TLS IS OFF: file data and the pre-shared key cross the network unencrypted; only use -no-tls on a trusted network")
+	}
+	plain := plainSocket(c.Addr, c.SocketTLS)
+	if plain && (c.Pin != "" || c.CAFile != "" || c.DANE || c.CertFile != "" || c.KnownHosts != "") {
+		return nil, errors.New("-pin, -ca, -dane, -known-hosts and -cert need TLS on the Unix socket, add -socket-tls")
+	}
+	if cfg.minTLS, err = checkTLSPolicy(c.MinTLS, c.CipherSuites); err != nil {
+		return nil, err
+	}
+	cfg.ciphers = c.CipherSuites
+	if cfg.bufferSize, err = checkBufferSize(c.BufferSize); err != nil {
+		return nil, err
+	}
+	cfg.stdinName = c.Name
+	if cfg.stdinName == "" {
+		cfg.stdinName = "stdin"
+	}
+	if c.HTTPTimeout < 0 {
+		return nil, errors.New("-http-timeout can't be negative")
+	}
+	cfg.httpTimeout = c.HTTPTimeout
+	if err := validRequestName(cfg.stdinName); err != nil {
+		return nil, fmt.Errorf("-name: %w", err)
+	}
+	if err := validStoredName(cfg.stdinName); err != nil {
+		return nil, fmt.Errorf("-name: %w", err)
+	}
+	if c.As != "" {
+		if strings.ContainsAny(c.As, `/\`) {
+			return nil, errors.New("-as must be a file name, without path separators")
+		}
+		if err := validRequestName(c.As); err != nil {
+			return nil, fmt.Errorf("-as: %w", err)
+		}
+		if err := validStoredName(c.As); err != nil {
+			return nil, fmt.Errorf("-as: %w", err)
+		}
+	}
+	cfg.as = c.As
+	if c.BatchSize < 0 {
+		return nil, errors.New("-batch-size must not be negative")
+	}
+	cfg.batchSize = c.BatchSize
+	if c.Parallel < 0 {
+		return nil, errors.New("-parallel must not be negative")
+	}
+	cfg.parallel = c.Parallel
+	if c.Mux && c.Parallel > maxMuxStreams {
+		return nil, fmt.Errorf("-mux carries at most %d files at once, so -parallel must not exceed it", maxMuxStreams)
+	}
+	cfg.mux = c.Mux
+	if c.Streams < 0 {
+		return nil, errors.New("-streams must not be negative")
+	}
+	if c.Streams > 1 && (c.Compress || c.Resume) {
+		return nil, errors.New("-streams can't be combined with -compress or -resume")
+	}
+	cfg.streams = c.Streams
+	cfg.checkpointPath = c.CheckpointPath
+	if cfg.checkpointPath == "" {
+		cfg.checkpointPath = ".shadowx-checkpoint.json"
+	}
+	if cfg.traceID != "" && !validTraceID(cfg.traceID) {
+		return nil, errors.New("trace ID may only contain letters, digits, '-', '_', '.' and ':' (at most 128 characters)")
+	}
+	if c.MaxHandshakes < 0 {
+		return nil, errors.New("-max-handshakes must not be negative")
+	}
+	if c.MaxHandshakes > 0 {
+		cfg.handshakes = make(chan struct{}, c.MaxHandshakes)
+	}
+	if c.DANE {
+		host, port, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return nil, errors.New("-dane needs the server's hostname in -i, not an IP address")
+		}
+		if cfg.tlsa, err = lookupTLSA(host, port); err != nil {
+			return nil, err
+		}
+		cfg.tlsaHost = host
+	}
+	if c.Pin != "" {
+		if cfg.pin, err = parsePin(c.Pin); err != nil {
+			return nil, err
+		}
+	}
+	if c.CAFile != "" {
+		if cfg.rootCAs, err = loadCertPool(c.CAFile); err != nil {
+			return nil, fmt.Errorf("loading CA: %w", err)
+		}
+	}
+	if c.KnownHosts != "" {
+		if cfg.knownHosts, err = loadKnownHosts(c.KnownHosts); err != nil {
+			return nil, fmt.Errorf("loading known hosts: %w", err)
+		}
+	}
+	if !verifiesServer(cfg) && !plain {
+		slog.Warn("The server's certificate is NOT verified, so anyone able to intercept the connection can impersonate it and capture the PSK. Use -pin or -ca.")
+	}
+	if c.ChecksumCache != "" {
+		if cfg.cache, err = loadChecksumCache(c.ChecksumCache); err != nil {
+			return nil, fmt.Errorf("loading checksum cache: %w", err)
+		}
+	}
+	if c.ResumeDirs && (!c.Resume || c.BatchSize > 0) {
+		return nil, errors.New("-resume-dir needs -resume and can't be combined with -batch-size")
+	}
+	cfg.resumeDirs = c.ResumeDirs
+	if c.Resume {
+		statePath := c.ResumeState
+		if statePath == "" {
+			statePath = ".shadowx-resume.json"
+		}
+		if cfg.resume, err = loadResumeState(statePath); err != nil {
+			return nil, fmt.Errorf("loading resume state: %w", err)
+		}
+	}
+	if cfg.mux && !cfg.sessions() {
+		return nil, errors.New("-mux can't be combined with -diff, -resume, -append, -verify-roundtrip, -compress, -streams or -checksum-algo other than sha256")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,151 @@
+package shadowx
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientSend(t *testing.T) {
+	t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	if err := os.Mkdir("docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("docs", "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("docs"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(DefaultOutDir, "docs", "a.txt"))
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("stored file = %q, %v; want %q", got, err, "hello")
+	}
+
+	if err := client.Download("docs/a.txt", "copy.txt"); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got, err := os.ReadFile("copy.txt"); err != nil || string(got) != "hello" {
+		t.Fatalf("downloaded file = %q, %v; want %q", got, err, "hello")
+	}
+
+	err = client.Send("missing.txt")
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Failed) != 1 || sendErr.Failed[0].Path != "missing.txt" {
+		t.Fatalf("Send of a missing file = %v, want a SendError listing it", err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Send of a missing file = %v, want it to wrap os.ErrNotExist", err)
+	}
+}
+
+// -as stores a single file under the name given instead of its own, and only
+// ever as a bare name
+func TestClientSendAs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	if err := os.MkdirAll("tmp/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("tmp/a1b2.bin", []byte("report"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, As: "report.pdf"}
+	if err := client.Send("tmp/a1b2.bin"); err != nil {
+		t.Fatalf("Send with -as: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "report.pdf")); err != nil || string(got) != "report" {
+		t.Errorf("stored file = %q, %v; want %q", got, err, "report")
+	}
+	if _, err := os.Stat(filepath.Join(DefaultOutDir, "a1b2.bin")); !os.IsNotExist(err) {
+		t.Errorf("file also stored under its own name: %v", err)
+	}
+	if err := client.Send("tmp/docs"); err == nil || !strings.Contains(err.Error(), "-as names a single file") {
+		t.Errorf("Send of a directory with -as = %v, want it refused", err)
+	}
+
+	for _, as := range []string{"sub/report.pdf", `sub\report.pdf`, "../report.pdf", "/etc/passwd", ".."} {
+		client := &Client{Addr: srv.Addr, Key: srv.Key, As: as}
+		if err := client.Send("tmp/a1b2.bin"); err == nil {
+			t.Errorf("Send with -as %q succeeded, want it refused", as)
+		}
+	}
+}
+
+func TestClientConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *Client
+	}{
+		{"no key", &Client{Addr: "127.0.0.1:1"}},
+		{"negative batch size", &Client{Addr: "127.0.0.1:1", Key: "k", BatchSize: -1}},
+		{"negative handshakes", &Client{Addr: "127.0.0.1:1", Key: "k", MaxHandshakes: -1}},
+		{"negative parallel", &Client{Addr: "127.0.0.1:1", Key: "k", Parallel: -1}},
+		{"bad trace ID", &Client{Addr: "127.0.0.1:1", Key: "k", TraceID: "bad id"}},
+		{"bad pin", &Client{Addr: "127.0.0.1:1", Key: "k", Pin: "zz"}},
+		{"bad name", &Client{Addr: "127.0.0.1:1", Key: "k", Name: "../escape"}},
+		{"no address", &Client{Key: "k"}},
+		{"no port", &Client{Addr: "example.com", Key: "k"}},
+		{"IPv6 without brackets", &Client{Addr: "::1:8080", Key: "k"}},
+	}
+	for _, tt := range tests {
+		if err := tt.client.Send("unused"); err == nil {
+			t.Errorf("%s: Send succeeded, want a configuration error", tt.name)
+		}
+	}
+}
+
+// The server binds IPv4, IPv6 and all-interface addresses, and the client
+// reaches it by address or hostname
+func TestClientSendAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string // server address, port 0 for a free one
+		dial   string // host the client connects to
+	}{
+		{"IPv4", "127.0.0.1:0", "127.0.0.1"},
+		{"IPv6 loopback", "[::1]:0", "::1"},
+		{"IPv6 all interfaces", "[::]:0", "::1"},
+		{"hostname", "127.0.0.1:0", "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if listener, err := net.Listen("tcp", tt.listen); err != nil {
+				t.Skipf("can't listen on %s: %v", tt.listen, err)
+			} else {
+				listener.Close()
+			}
+			t.Chdir(t.TempDir())
+			srv := &Server{Addr: tt.listen, Key: "test-key", OutDir: DefaultOutDir}
+			startTestServer(t, srv)
+			_, port, _ := net.SplitHostPort(srv.Addr)
+
+			if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{Addr: net.JoinHostPort(tt.dial, port), Key: srv.Key}
+			if err := client.Send("a.txt"); err != nil {
+				t.Fatalf("Send to %s: %v", client.Addr, err)
+			}
+			if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "a.txt")); err != nil || string(got) != "hello" {
+				t.Errorf("stored file = %q, %v; want %q", got, err, "hello")
+			}
+		})
+	}
+}
+
+// Standard input is read once, so there is nothing to resend
+func TestClientSendStdinRetries(t *testing.T) {
+	client := &Client{Addr: "127.0.0.1:1", Key: "k", RunRetries: 1}
+	if err := client.Send("-"); err == nil || !strings.Contains(err.Error(), "-run-retries") {
+		t.Errorf("Send(\"-\") with retries = %v, want a -run-retries error", err)
+	}
+}
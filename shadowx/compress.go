@@ -0,0 +1,116 @@
+package shadowx
+
+import (
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression schemes a client can ask for with the compress attribute
+var knownCompression = map[string]bool{
+	"gzip": true,
+	"zstd": true,
+}
+
+// Codecs a client offers in the codecs attribute, best first. A server that
+// doesn't know the one asked for picks the first of these it knows, or none.
+var offeredCompression = []string{"zstd", "gzip", "none"}
+
+// Largest zstd window a server will decode with, so a client can't make it
+// allocate more than that per upload
+const maxZstdWindow = 32 << 20
+
+// Pick the codec for an upload that asks for requested and offers the
+// comma-separated codecs: requested when the server knows it, otherwise the
+// first offered one it knows, otherwise none
+func negotiateCompression(requested, offered string) string {
+	if knownCompression[requested] {
+		return requested
+	}
+	for _, codec := range strings.Split(offered, ",") {
+		if knownCompression[codec] {
+			return codec
+		}
+	}
+	return "none"
+}
+
+// Wrap w to compress what's written with codec, which must be known. Close
+// flushes the compressed stream without closing w. Empty files still get a
+// zstd frame, so the server can tell them from a sender that stopped early.
+func compressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	if codec == "zstd" {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithZeroFrames(true))
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// Wrap r to decompress data sent with codec; none reads it as is
+func decompressReader(codec string, r io.Reader) io.Reader {
+	switch codec {
+	case "gzip":
+		return &gzipSource{r: r}
+	case "zstd":
+		return &zstdSource{r: &countingReader{r: r}}
+	}
+	return r
+}
+
+// Inflates a gzip stream, reading its header on the first Read so that a
+// missing or broken stream is reported where the data is read
+type gzipSource struct {
+	r  io.Reader
+	gz *gzip.Reader
+}
+
+func (g *gzipSource) Read(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewReader(g.r)
+		if err == io.EOF {
+			// Even an empty file has a header, so the sender stopped early
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		g.gz = gz
+	}
+	return g.gz.Read(p)
+}
+
+// Decompresses a zstd stream. The decoder runs synchronously, so it holds
+// no goroutines and needn't be closed.
+type zstdSource struct {
+	r    *countingReader
+	zstd *zstd.Decoder
+}
+
+func (z *zstdSource) Read(p []byte) (int, error) {
+	if z.zstd == nil {
+		d, err := zstd.NewReader(z.r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(maxZstdWindow))
+		if err != nil {
+			return 0, err
+		}
+		z.zstd = d
+	}
+	n, err := z.zstd.Read(p)
+	if err == io.EOF && z.r.count == 0 {
+		// Even an empty file has a frame, so the sender stopped early
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Counts the bytes read through it
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
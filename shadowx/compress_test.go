@@ -0,0 +1,207 @@
+package shadowx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipSource(t *testing.T) {
+	text := bytes.Repeat([]byte("2024-01-31 12:00:00 INFO request served\n"), 4096)
+	random := make([]byte, 64<<10)
+	rand.Read(random)
+
+	tests := []struct {
+		name    string
+		wire    []byte
+		want    []byte
+		wantErr error
+	}{
+		{"compressible", gzipped(t, text), text, nil},
+		{"already compressed", gzipped(t, random), random, nil},
+		{"empty file", gzipped(t, nil), []byte{}, nil},
+		{"nothing sent", nil, nil, io.ErrUnexpectedEOF},
+		{"cut short", gzipped(t, text)[:100], nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		got, err := io.ReadAll(&gzipSource{r: bytes.NewReader(tt.wire)})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr == nil && !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %d bytes, want %d", tt.name, len(got), len(tt.want))
+		}
+	}
+	if wire := len(gzipped(t, text)); wire > len(text)/20 {
+		t.Errorf("compressible data went over the wire as %d of %d bytes", wire, len(text))
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		requested, offered, want string
+	}{
+		{"zstd", "zstd,gzip,none", "zstd"},
+		{"gzip", "", "gzip"},
+		{"brotli", "brotli,zstd,gzip,none", "zstd"},
+		{"brotli", "brotli,gzip", "gzip"},
+		{"brotli", "brotli,none", "none"},
+		{"brotli", "", "none"},
+	}
+	for _, tt := range tests {
+		if got := negotiateCompression(tt.requested, tt.offered); got != tt.want {
+			t.Errorf("negotiateCompression(%q, %q) = %q, want %q", tt.requested, tt.offered, got, tt.want)
+		}
+	}
+}
+
+// Each codec's stream decompresses to what went in, and a stream that's
+// missing or cut short is an error rather than a shorter file
+func TestCompressionRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("2024-01-31 12:00:00 INFO request served\n"), 4096)
+	random := make([]byte, 64<<10)
+	rand.Read(random)
+	for _, codec := range []string{"none", "gzip", "zstd"} {
+		for _, data := range [][]byte{text, random, {}} {
+			var wire bytes.Buffer
+			if codec == "none" {
+				wire.Write(data)
+			} else {
+				w, err := compressWriter(codec, &wire)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := w.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := io.ReadAll(decompressReader(codec, bytes.NewReader(wire.Bytes())))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%s: got %d of %d bytes, error %v", codec, len(got), len(data), err)
+			}
+			if codec == "none" || len(data) == 0 {
+				continue
+			}
+			if _, err := io.ReadAll(decompressReader(codec, bytes.NewReader(wire.Bytes()[:wire.Len()/2]))); err == nil {
+				t.Errorf("%s: stream cut short read without an error", codec)
+			}
+		}
+		if codec != "none" {
+			if _, err := io.ReadAll(decompressReader(codec, bytes.NewReader(nil))); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%s: nothing sent: error = %v, want %v", codec, err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+// A client offering codecs hears which one the server picked before
+// sending, down to none when the server knows none of them
+func TestHandleConnectionNegotiatedCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("negotiated "), 1000)
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		attrs string
+		wire  []byte
+		reply string
+	}{
+		{"compress=gzip\tcodecs=zstd,gzip,none", gzipped(t, data), "COMPRESS gzip\nOK "},
+		{"compress=brotli\tcodecs=brotli,gzip,none", gzipped(t, data), "COMPRESS gzip\nOK "},
+		{"compress=brotli\tcodecs=brotli,none", data, "COMPRESS none\nOK "},
+		{"compress=brotli", data, "REJECTED unsupported compression\n"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+		request := fmt.Sprintf("upload data.txt\tsize=%d\t%s\n", len(data), tt.attrs)
+		replies := testSession(t, cfg, request+string(tt.wire))
+		if !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("%s: replies %q, want %q", tt.attrs, replies, tt.reply)
+			continue
+		}
+		if strings.HasSuffix(tt.reply, "OK ") && !strings.HasPrefix(replies, fmt.Sprintf("%sOK %x\n", strings.TrimSuffix(tt.reply, "OK "), sum)) {
+			t.Errorf("%s: replies %q don't confirm the original data", tt.attrs, replies)
+		}
+	}
+}
+
+// Files sent with each codec arrive intact, and a server that doesn't
+// support the one asked for picks another instead of refusing the upload
+func TestClientSendCompressed(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	data := bytes.Repeat([]byte("compressed on the wire\n"), 50000)
+	if err := os.WriteFile("app.log", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("empty.log", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	for _, codec := range []string{"", "gzip", "zstd"} {
+		client := &Client{Addr: srv.Addr, Key: srv.Key, Compress: true, Compression: codec, Verify: true}
+		for _, name := range []string{"app.log", "empty.log"} {
+			os.Remove(filepath.Join(DefaultOutDir, name))
+			if err := client.Send(name); err != nil {
+				t.Fatalf("%q: Send %s: %v", codec, name, err)
+			}
+			want, _ := os.ReadFile(name)
+			if got, err := os.ReadFile(filepath.Join(DefaultOutDir, name)); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%q: stored %s differs (%d of %d bytes, %v)", codec, name, len(got), len(want), err)
+			}
+		}
+	}
+	if strings.Contains(logs.String(), "using another") {
+		t.Errorf("fell back to another codec with a server supporting all:\n%s", logs)
+	}
+
+	if _, err := (&Client{Compress: true, Compression: "brotli"}).newConfig(); err == nil {
+		t.Error("newConfig accepted an unknown codec")
+	}
+
+	// The client is configured while zstd is known, then the server stops
+	// knowing it
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Compress: true, Compression: "zstd"}
+	if _, err := client.config(); err != nil {
+		t.Fatal(err)
+	}
+	delete(knownCompression, "zstd")
+	t.Cleanup(func() { knownCompression["zstd"] = true })
+	os.Remove(filepath.Join(DefaultOutDir, "app.log"))
+	if err := client.Send("app.log"); err != nil {
+		t.Fatalf("Send to a server without zstd: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "app.log")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("stored copy differs (%d of %d bytes, %v)", len(got), len(data), err)
+	}
+	if !strings.Contains(logs.String(), "Server doesn't support the compression") {
+		t.Errorf("fallback not logged:\n%s", logs)
+	}
+}
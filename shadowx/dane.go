@@ -0,0 +1,339 @@
+package shadowx
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DNS constants used by the TLSA lookup
+const (
+	dnsTypeTLSA = 52
+	dnsTypeOPT  = 41
+	dnsClassIN  = 1
+
+	dnsFlagRD = 1 << 8 // recursion desired
+	dnsFlagAD = 1 << 5 // authentic data (DNSSEC validated)
+	dnsFlagTC = 1 << 9 // truncated
+
+	dnsTimeout = 5 * time.Second
+)
+
+// TLSA certificate usages (RFC 6698)
+const (
+	tlsaPKIXTA = 0
+	tlsaPKIXEE = 1
+	tlsaDANETA = 2
+	tlsaDANEEE = 3
+)
+
+// A TLSA resource record
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// Look up the DNSSEC-validated TLSA records for a TCP service. The answer is
+// only trusted when the system resolver sets the AD bit, so the resolver must
+// be a validating one reached over a trusted path (usually localhost).
+func lookupTLSA(host, port string) ([]tlsaRecord, error) {
+	name := fmt.Sprintf("_%s._tcp.%s", port, strings.TrimSuffix(host, "."))
+	servers := systemNameservers()
+	var lastErr error
+	for _, server := range servers {
+		records, err := queryTLSA(server, name)
+		if err == nil {
+			return records, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("TLSA lookup for %s failed: %w", name, lastErr)
+}
+
+// Nameservers from /etc/resolv.conf, falling back to localhost
+func systemNameservers() []string {
+	var servers []string
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+		f.Close()
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// Query one nameserver for TLSA records, retrying over TCP if the UDP answer is truncated
+func queryTLSA(server, name string) ([]tlsaRecord, error) {
+	query, id, err := buildTLSAQuery(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeUDP(server, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) >= 4 && binary.BigEndian.Uint16(resp[2:])&dnsFlagTC != 0 {
+		if resp, err = exchangeTCP(server, query); err != nil {
+			return nil, err
+		}
+	}
+	return parseTLSAResponse(resp, id)
+}
+
+// Build a TLSA query with the DO bit set so the resolver performs DNSSEC validation
+func buildTLSAQuery(name string) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	var msg bytes.Buffer
+	// Header: ID, flags (RD + AD), 1 question, 0 answers, 0 authority, 1 additional
+	binary.Write(&msg, binary.BigEndian, [6]uint16{id, dnsFlagRD | dnsFlagAD, 1, 0, 0, 1})
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg.WriteByte(byte(len(label)))
+		msg.WriteString(label)
+	}
+	msg.WriteByte(0)
+	binary.Write(&msg, binary.BigEndian, [2]uint16{dnsTypeTLSA, dnsClassIN})
+	// EDNS0 OPT record: root name, 4096 byte UDP payload, DO flag, no options
+	msg.WriteByte(0)
+	binary.Write(&msg, binary.BigEndian, [2]uint16{dnsTypeOPT, 4096})
+	binary.Write(&msg, binary.BigEndian, uint32(0x8000))
+	binary.Write(&msg, binary.BigEndian, uint16(0))
+	return msg.Bytes(), id, nil
+}
+
+// Send a DNS query over UDP
+func exchangeUDP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
+
+// Send a DNS query over TCP
+func exchangeTCP(server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+var errShortDNSMessage = errors.New("truncated DNS message")
+
+// Parse the TLSA answers from a DNS response, insisting on a validated answer
+func parseTLSAResponse(resp []byte, id uint16) ([]tlsaRecord, error) {
+	if len(resp) < 12 {
+		return nil, errShortDNSMessage
+	}
+	if binary.BigEndian.Uint16(resp) != id {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if rcode := flags & 0xf; rcode != 0 {
+		return nil, fmt.Errorf("DNS error (rcode %d)", rcode)
+	}
+	if flags&dnsFlagAD == 0 {
+		return nil, errors.New("answer is not DNSSEC-validated (AD bit not set by resolver)")
+	}
+	questions := int(binary.BigEndian.Uint16(resp[4:]))
+	answers := int(binary.BigEndian.Uint16(resp[6:]))
+
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+
+	var records []tlsaRecord
+	for i := 0; i < answers; i++ {
+		if off, err = skipDNSName(resp, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(resp) {
+			return nil, errShortDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(resp[off:])
+		rdLen := int(binary.BigEndian.Uint16(resp[off+8:]))
+		off += 10
+		if off+rdLen > len(resp) {
+			return nil, errShortDNSMessage
+		}
+		if rrType == dnsTypeTLSA && rdLen > 3 {
+			rdata := resp[off : off+rdLen]
+			records = append(records, tlsaRecord{
+				Usage:        rdata[0],
+				Selector:     rdata[1],
+				MatchingType: rdata[2],
+				Data:         append([]byte(nil), rdata[3:]...),
+			})
+		}
+		off += rdLen
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no TLSA records found")
+	}
+	return records, nil
+}
+
+// Skip over a possibly compressed DNS name, returning the offset after it
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errShortDNSMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + length
+		}
+	}
+}
+
+// Check whether a certificate matches a TLSA record's selector and matching type
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case 0:
+		return bytes.Equal(data, r.Data)
+	case 1:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], r.Data)
+	case 2:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], r.Data)
+	}
+	return false
+}
+
+// Build a VerifyPeerCertificate callback that authenticates the server against its TLSA records
+func verifyDANE(serverName string, records []tlsaRecord) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("DANE: server presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("DANE: parsing server certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+		leaf := certs[0]
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		for _, record := range records {
+			switch record.Usage {
+			case tlsaDANEEE:
+				if record.matches(leaf) {
+					return nil
+				}
+			case tlsaPKIXEE:
+				if record.matches(leaf) && verifyChain(leaf, serverName, nil, intermediates) == nil {
+					return nil
+				}
+			case tlsaDANETA:
+				for _, cert := range certs[1:] {
+					if !record.matches(cert) {
+						continue
+					}
+					roots := x509.NewCertPool()
+					roots.AddCert(cert)
+					if verifyChain(leaf, serverName, roots, intermediates) == nil {
+						return nil
+					}
+				}
+			case tlsaPKIXTA:
+				chains, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Intermediates: intermediates})
+				if err != nil {
+					continue
+				}
+				for _, chain := range chains {
+					for _, cert := range chain[1:] {
+						if record.matches(cert) {
+							return nil
+						}
+					}
+				}
+			}
+		}
+		return fmt.Errorf("DANE: server certificate for %s matches none of its %d TLSA record(s)", serverName, len(records))
+	}
+}
+
+// Verify a certificate chain for serverName; nil roots means the system pool
+func verifyChain(leaf *x509.Certificate, serverName string, roots, intermediates *x509.CertPool) error {
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: intermediates})
+	return err
+}
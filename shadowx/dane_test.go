@@ -0,0 +1,173 @@
+package shadowx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// Build a DNS response to query carrying the given TLSA records
+func tlsaResponse(query []byte, authentic bool, records ...tlsaRecord) []byte {
+	// Copy the header and question, skipping the query's OPT record
+	end, _ := skipDNSName(query, 12)
+	resp := append([]byte(nil), query[:end+4]...)
+	flags := uint16(1<<15 | dnsFlagRD | 1<<7)
+	if authentic {
+		flags |= dnsFlagAD
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	for _, r := range records {
+		resp = append(resp, 0xc0, 12) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeTLSA)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(3+len(r.Data)))
+		resp = append(resp, r.Usage, r.Selector, r.MatchingType)
+		resp = append(resp, r.Data...)
+	}
+	return resp
+}
+
+// Serve a single DNS answer over UDP and return the server address
+func fakeResolver(t *testing.T, authentic bool, records ...tlsaRecord) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(tlsaResponse(buf[:n], authentic, records...), addr)
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestQueryTLSA(t *testing.T) {
+	want := tlsaRecord{Usage: tlsaDANEEE, Selector: 1, MatchingType: 1, Data: make([]byte, 32)}
+
+	records, err := queryTLSA(fakeResolver(t, true, want), "_8080._tcp.files.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Usage != want.Usage || records[0].Selector != want.Selector ||
+		records[0].MatchingType != want.MatchingType || len(records[0].Data) != 32 {
+		t.Errorf("queryTLSA = %+v, want [%+v]", records, want)
+	}
+
+	if _, err := queryTLSA(fakeResolver(t, false, want), "_8080._tcp.files.example.com"); err == nil {
+		t.Error("queryTLSA accepted an answer without the AD bit")
+	}
+	if _, err := queryTLSA(fakeResolver(t, true), "_8080._tcp.files.example.com"); err == nil {
+		t.Error("queryTLSA accepted an answer without TLSA records")
+	}
+}
+
+func TestParseTLSAResponseRejectsBadMessages(t *testing.T) {
+	query, id, err := buildTLSAQuery("_443._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := tlsaResponse(query, true, tlsaRecord{Usage: 3, Selector: 1, MatchingType: 1, Data: make([]byte, 32)})
+	if _, err := parseTLSAResponse(good, id); err != nil {
+		t.Fatalf("parseTLSAResponse(good) = %v", err)
+	}
+	if _, err := parseTLSAResponse(good, id+1); err == nil {
+		t.Error("accepted a response with the wrong ID")
+	}
+	if _, err := parseTLSAResponse(good[:len(good)-5], id); err == nil {
+		t.Error("accepted a truncated response")
+	}
+	nxdomain := append([]byte(nil), good...)
+	nxdomain[3] |= 3
+	if _, err := parseTLSAResponse(nxdomain, id); err == nil {
+		t.Error("accepted an NXDOMAIN response")
+	}
+}
+
+// Create a self-signed certificate for host
+func testCertificate(t *testing.T, host string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTLSAMatches(t *testing.T) {
+	cert := testCertificate(t, "files.example.com")
+	spki256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	full512 := sha512.Sum512(cert.Raw)
+	tests := []struct {
+		name   string
+		record tlsaRecord
+		want   bool
+	}{
+		{"full cert exact", tlsaRecord{Selector: 0, MatchingType: 0, Data: cert.Raw}, true},
+		{"spki sha256", tlsaRecord{Selector: 1, MatchingType: 1, Data: spki256[:]}, true},
+		{"full cert sha512", tlsaRecord{Selector: 0, MatchingType: 2, Data: full512[:]}, true},
+		{"wrong selector for digest", tlsaRecord{Selector: 0, MatchingType: 1, Data: spki256[:]}, false},
+		{"unknown selector", tlsaRecord{Selector: 7, MatchingType: 0, Data: cert.Raw}, false},
+		{"unknown matching type", tlsaRecord{Selector: 1, MatchingType: 9, Data: spki256[:]}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.record.matches(cert); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyDANE(t *testing.T) {
+	cert := testCertificate(t, "files.example.com")
+	other := testCertificate(t, "files.example.com")
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	records := []tlsaRecord{{Usage: tlsaDANEEE, Selector: 1, MatchingType: 1, Data: spki[:]}}
+
+	verify := verifyDANE("files.example.com", records)
+	if err := verify([][]byte{cert.Raw}, nil); err != nil {
+		t.Errorf("matching certificate rejected: %v", err)
+	}
+	if err := verify([][]byte{other.Raw}, nil); err == nil {
+		t.Error("certificate with a different key accepted")
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Error("empty certificate chain accepted")
+	}
+
+	// A PKIX-EE record also requires a chain to a trusted root, which a self-signed cert lacks
+	pkixVerify := verifyDANE("files.example.com", []tlsaRecord{{Usage: tlsaPKIXEE, Selector: 1, MatchingType: 1, Data: spki[:]}})
+	if err := pkixVerify([][]byte{cert.Raw}, nil); err == nil {
+		t.Error("PKIX-EE accepted a self-signed certificate")
+	}
+}
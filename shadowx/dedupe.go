@@ -0,0 +1,213 @@
+package shadowx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Before sending, a client can ask which files the server already has with
+// a "manifest <version>" request. The server accepts with
+// "MANIFEST <version>", then the client sends one entry per file and an
+// empty line:
+//
+//	have <name>\tsha256=<hex>\tsize=<bytes>
+//
+// The server answers "SAME <name>" for every entry it stores with the same
+// size and SHA-256, then BYE once the entries end. It answers while the
+// client is still sending, so neither holds the whole manifest.
+const manifestVersion = "1"
+
+// Answer the entries of a manifest until the client ends it
+func receiveManifest(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	if req.name != manifestVersion {
+		rejectUpload(conn, log, "unsupported manifest version")
+		return nil
+	}
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "manifests are not supported when writing to the "+cfg.sink())
+		return nil
+	}
+	fmt.Fprintf(conn, "MANIFEST %s\n", manifestVersion)
+
+	entries, same := 0, 0
+	for {
+		line, err := conn.readLine()
+		if err != nil {
+			return fmt.Errorf("reading manifest: %w", err)
+		}
+		if line == "" {
+			break
+		}
+		entry, err := parseRequest(line)
+		if err != nil || entry.verb != "have" {
+			return fmt.Errorf("invalid manifest entry %q", line)
+		}
+		entries++
+		if storedIdentically(log, cfg, entry) {
+			same++
+			if _, err := fmt.Fprintf(conn, "SAME %s\n", entry.name); err != nil {
+				return fmt.Errorf("answering manifest: %w", err)
+			}
+		}
+	}
+
+	stats := sessionStats{Duration: time.Since(start).Round(time.Millisecond)}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return fmt.Errorf("sending goodbye: %w", err)
+	}
+	log.Info("Compared manifest", "entries", entries, "stored", same)
+	return nil
+}
+
+// Whether the file a manifest entry names is stored with its size and
+// digest. Names the server would refuse to read back never match.
+func storedIdentically(log *slog.Logger, cfg *serverConfig, entry request) bool {
+	checked, reason := checkRequest(log, cfg, entry)
+	if reason != "" || checked.size < 0 || checked.declared == "" {
+		return false
+	}
+	// Encrypted files only have their stored size checked as they're hashed
+	info, err := os.Lstat(checked.stored)
+	if err != nil || !info.Mode().IsRegular() || cfg.storage == nil && info.Size() != checked.size {
+		return false
+	}
+	sum, err := hashStored(cfg, checked.stored, checked.size)
+	return err == nil && sum == checked.declared
+}
+
+// Return the files the server doesn't already store identically, after
+// hashing them, with the checksum cache when there is one. Every file is
+// returned when the server can't compare them.
+func skipStored(cfg *clientConfig, files []string) []string {
+	var entries []request
+	paths := make(map[string]string) // local path by the name it's sent under
+	for _, filename := range files {
+		if entry, ok := haveEntry(cfg, filename); ok {
+			entries = append(entries, entry)
+			paths[entry.name] = filename
+		}
+	}
+	if len(entries) == 0 {
+		return files
+	}
+	same, err := compareManifest(cfg, entries)
+	if err != nil {
+		slog.Warn("Sending every file, the server couldn't compare them", "err", err)
+		return files
+	}
+
+	stored := make(map[string]bool)
+	for name := range same {
+		stored[paths[name]] = true
+	}
+	var remaining []string
+	for _, filename := range files {
+		if stored[filename] {
+			slog.Info("Already on the server, skipping", "file", filename)
+			cfg.events.emit("skipped", filename, nil)
+			continue
+		}
+		remaining = append(remaining, filename)
+	}
+	slog.Info("Compared with the server", "files", len(files), "skipped", len(files)-len(remaining))
+	return remaining
+}
+
+// The manifest entry of a file, or false for files that can't be compared:
+// those that aren't regular, and empty ones, which may be pseudo-files whose
+// content only shows when read and cost nothing to send anyway
+func haveEntry(cfg *clientConfig, filename string) (request, bool) {
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return request{}, false
+	}
+	name := cfg.remoteName(filename)
+	if validRequestName(name) != nil {
+		return request{}, false
+	}
+	sum, err := localDigest(cfg, filename, info)
+	if err != nil {
+		slog.Warn("Error hashing file, sending it", "file", filename, "err", err)
+		return request{}, false
+	}
+	attrs := map[string]string{"size": strconv.FormatInt(info.Size(), 10), "sha256": sum}
+	return request{verb: "have", name: name, attrs: attrs}, true
+}
+
+// The SHA-256 of a local file, from the checksum cache while it's unchanged
+func localDigest(cfg *clientConfig, filename string, info os.FileInfo) (string, error) {
+	if cfg.cache != nil {
+		if sum, ok := cfg.cache.lookup(filename, info); ok {
+			return sum, nil
+		}
+	}
+	sum, err := hashFile(filename, info.Size())
+	if err != nil {
+		return "", err
+	}
+	if cfg.cache != nil {
+		cfg.cache.store(filename, info, sum)
+	}
+	return sum, nil
+}
+
+// Send entries to the server as a manifest and return the names it stores
+// identically
+func compareManifest(cfg *clientConfig, entries []request) (map[string]bool, error) {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "manifest", name: manifestVersion}); err != nil {
+		return nil, fmt.Errorf("sending manifest request: %w", err)
+	}
+	reader := conn.reader
+	line, _ := reader.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "MANIFEST "+manifestVersion {
+		// Servers that predate manifests close the connection without a word
+		reason, ok := strings.CutPrefix(line, "REJECTED ")
+		if !ok {
+			reason = "the server doesn't support them"
+		}
+		return nil, fmt.Errorf("manifests are unavailable: %s", reason)
+	}
+
+	// Send the entries while reading the answers, so neither side blocks on
+	// a full buffer; closing the connection ends the writer early
+	written := make(chan error, 1)
+	go func() {
+		w := bufio.NewWriter(conn)
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\n", entry)
+		}
+		w.WriteString("\n")
+		written <- w.Flush()
+	}()
+	same := make(map[string]bool)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("connection closed before the server compared the manifest")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if name, ok := strings.CutPrefix(line, "SAME "); ok {
+			same[name] = true
+			continue
+		}
+		if _, err := parseBye(line); err != nil {
+			return nil, err
+		}
+		break
+	}
+	if err := <-written; err != nil {
+		return nil, fmt.Errorf("sending manifest: %w", err)
+	}
+	return same, nil
+}
@@ -0,0 +1,128 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Sending a directory again with -skip-existing sends no file data, and
+// after a change only the changed file
+func TestClientSendSkipExisting(t *testing.T) {
+	tests := []struct {
+		name          string
+		parallel      int
+		batchSize     int
+		checksumCache string
+	}{
+		{"session", 0, 0, ""},
+		{"parallel", 2, 0, ""},
+		{"batches", 0, 2, ""},
+		{"cached digests", 0, 0, "sums.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			captureLog(t, slog.LevelInfo)
+			for name, data := range map[string]string{"docs/a.txt": "hello", "docs/sub/b.txt": "abc", "docs/c.txt": "xyz"} {
+				if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+			startTestServer(t, srv)
+
+			// Each run gets a fresh client, as a new invocation would
+			send := func() (started, skipped int) {
+				t.Helper()
+				var events bytes.Buffer
+				client := &Client{Addr: srv.Addr, Key: srv.Key, SkipExisting: true, Events: &events,
+					Parallel: tt.parallel, BatchSize: tt.batchSize, ChecksumCache: tt.checksumCache}
+				if err := client.Send("docs"); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				return strings.Count(events.String(), `"event":"start"`), strings.Count(events.String(), `"event":"skipped"`)
+			}
+			if started, skipped := send(); started != 3 || skipped != 0 {
+				t.Errorf("first run sent %d files and skipped %d, want 3 and 0", started, skipped)
+			}
+			if started, skipped := send(); started != 0 || skipped != 3 {
+				t.Errorf("second run sent %d files and skipped %d, want 0 and 3", started, skipped)
+			}
+			if err := os.WriteFile("docs/c.txt", []byte("changed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if started, skipped := send(); started != 1 || skipped != 2 {
+				t.Errorf("run after a change sent %d files and skipped %d, want 1 and 2", started, skipped)
+			}
+			if data, _ := os.ReadFile(filepath.Join(DefaultOutDir, "docs", "c.txt")); string(data) != "changed" {
+				t.Errorf("server holds %q, want the changed file", data)
+			}
+		})
+	}
+}
+
+// A server that can't compare manifests gets every file
+func TestClientSendSkipExistingUnsupported(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logged := captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	srv := &Server{Key: "test-key", Output: &out}
+	startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, SkipExisting: true}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if !strings.Contains(logged.String(), `msg="Sending every file, the server couldn't compare them"`) {
+		t.Errorf("client didn't report the fallback:\n%s", logged)
+	}
+}
+
+func TestStoredIdentically(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	for name, data := range map[string]string{"a.txt": "hello", ".hidden": "hello"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	hello := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name   string
+		size   int64
+		sha256 string
+		want   bool
+	}{
+		{"a.txt", 5, hello, true},
+		{"a.txt", 6, hello, false},
+		{"a.txt", 5, strings.Repeat("0", 64), false},
+		{"a.txt", 5, "", false},
+		{"missing.txt", 5, hello, false},
+		{".hidden", 5, hello, false},
+		{"../a.txt", 5, hello, false},
+	}
+	for _, tt := range tests {
+		entry := request{verb: "have", name: tt.name, attrs: map[string]string{"size": strconv.FormatInt(tt.size, 10)}}
+		if tt.sha256 != "" {
+			entry.attrs["sha256"] = tt.sha256
+		}
+		log := slog.New(slog.NewTextHandler(io.Discard, nil))
+		if got := storedIdentically(log, cfg, entry); got != tt.want {
+			t.Errorf("storedIdentically(%s size=%d sha256=%.8s) = %v, want %v", tt.name, tt.size, tt.sha256, got, tt.want)
+		}
+	}
+}
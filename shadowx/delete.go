@@ -0,0 +1,92 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Ask the server to delete its copy of filename, which is gone locally
+func sendDelete(cfg *clientConfig, filename string) error {
+	name := cfg.remoteName(filename)
+	if err := validRequestName(name); err != nil {
+		return err
+	}
+	req := request{verb: "delete", name: name}
+	if cfg.traceID != "" {
+		req.attrs = map[string]string{"trace": cfg.traceID}
+	}
+	stats, err := sendRecord(cfg, req)
+	if err != nil {
+		return err
+	}
+	slog.Info("Deletion sent", "file", filename, "trace", stats.Trace)
+	return nil
+}
+
+// Answer a "delete <name>" request by removing the stored file, replying OK
+// and BYE. Only a server started with -allow-delete honors it. A file that's
+// gone already is fine; directories are left alone.
+func receiveDelete(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	if !cfg.allowDelete {
+		rejectUpload(conn, log, "deleting files is not allowed")
+		return nil
+	}
+	checked, reason := checkRequest(log, cfg, req)
+	if reason == "" && cfg.sink() != "" {
+		reason = "deleting files is not supported when writing to the " + cfg.sink()
+	}
+	var err error
+	if reason == "" {
+		reason, err = removeStored(cfg, checked.stored)
+	}
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return err
+	}
+	log.Info("File deleted", "file", checked.stored, "trace", checked.trace)
+	fmt.Fprintf(conn, "OK\n")
+	stats := sessionStats{Duration: time.Since(start).Round(time.Millisecond), Trace: checked.trace}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return fmt.Errorf("sending goodbye: %w", err)
+	}
+	return nil
+}
+
+// Remove the file stored, or the link stored there rather than what it
+// points to. Returns the reason to refuse it, and the error behind that when
+// the server is at fault.
+func removeStored(cfg *serverConfig, stored string) (string, error) {
+	root, err := filepath.EvalSymlinks(cfg.outDir)
+	if err != nil {
+		return "could not delete file", err
+	}
+	rel, err := filepath.Rel(cfg.outDir, stored)
+	if err != nil {
+		return "could not delete file", err
+	}
+	// The name may lead through links sent before, which must stay inside
+	path := filepath.Join(resolveLink(root, filepath.Dir(rel)), filepath.Base(rel))
+	if !isWithin(root, path) {
+		return "file name escapes the output directory", nil
+	}
+	if isWithinOrAt(realPath(cfg.uploads.dir), path) || cfg.isTLSFile(path) {
+		return "file name is reserved", nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "could not delete file", err
+	}
+	if info.IsDir() {
+		return "file is a directory", nil
+	}
+	if err := os.Remove(path); err != nil {
+		return "could not delete file", fmt.Errorf("deleting file: %w", err)
+	}
+	return "", nil
+}
@@ -0,0 +1,37 @@
+package shadowx
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Load a set of SHA-256 hashes, one per line. Blank lines and # comments are
+// ignored, and anything after the hash (e.g. sha256sum's filename column) is skipped.
+func loadHashList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash := strings.ToLower(strings.Fields(line)[0])
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("%s:%d: not a SHA-256 hash: %q", path, lineNo, hash)
+		}
+		hashes[hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
@@ -0,0 +1,55 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHashList(t *testing.T) {
+	const (
+		hashA = "801c2dbcf98c4c7d0cb8a34540e5d253a7d41456ded0ca94fa58159f4ea2f3c5"
+		hashB = "e258d248fda94c63753607f7c4494ee0fcbe92f1a76bfdac795c9d84101eb317"
+	)
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", content: hashA + "\n" + hashB + "\n", want: []string{hashA, hashB}},
+		{name: "comments and blanks", content: "# known bad\n\n  " + hashA + "  \n", want: []string{hashA}},
+		{name: "sha256sum output", content: hashA + "  sample.exe\n", want: []string{hashA}},
+		{name: "uppercase", content: "801C2DBCF98C4C7D0CB8A34540E5D253A7D41456DED0CA94FA58159F4EA2F3C5\n", want: []string{hashA}},
+		{name: "too short", content: hashA[:40] + "\n", wantErr: true},
+		{name: "not hex", content: "zz" + hashA[2:] + "\n", wantErr: true},
+		{name: "md5", content: "d41d8cd98f00b204e9800998ecf8427e\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "deny.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadHashList(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadHashList error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("loadHashList = %v, want %v", got, tt.want)
+			}
+			for _, hash := range tt.want {
+				if !got[hash] {
+					t.Errorf("loadHashList missing %s", hash)
+				}
+			}
+		})
+	}
+
+	if _, err := loadHashList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("loadHashList succeeded on a missing file")
+	}
+}
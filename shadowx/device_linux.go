@@ -0,0 +1,24 @@
+//go:build linux
+
+package shadowx
+
+import (
+	"errors"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Get the size of a block device via the BLKGETSIZE64 ioctl
+func blockDeviceSize(f *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	if size == 0 {
+		return 0, errors.New("device reports a size of 0")
+	}
+	return int64(size), nil
+}
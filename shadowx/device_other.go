@@ -0,0 +1,25 @@
+//go:build !linux
+
+package shadowx
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// Get the size of a block device by seeking to its end
+func blockDeviceSize(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	// Some systems (e.g. macOS and the BSDs) report 0 for disks
+	if size == 0 {
+		return 0, errors.New("device reports a size of 0")
+	}
+	return size, nil
+}
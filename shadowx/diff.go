@@ -0,0 +1,296 @@
+package shadowx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Largest file sent as a diff; bigger files always go in full
+const maxDiffFileSize = 8 << 20
+
+// Most changed lines a diff is computed for before a full transfer is used instead
+const maxDiffEdits = 1000
+
+// Lines of unchanged context around each hunk
+const diffContext = 3
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// One line of an edit script turning the old text into the new one
+type lineEdit struct {
+	op   diffOp
+	line string
+}
+
+// Whether data looks like text that can be diffed line by line
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) < 0
+}
+
+// Split data into lines, each keeping its "\n" except possibly the last
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data))
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// Compute a shortest edit script from a to b with Myers' algorithm. Gives up
+// and returns false when more than maxEdits lines differ.
+func diffLines(a, b []string, maxEdits int) ([]lineEdit, bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+	off := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace[d] holds the furthest x on diagonals -(d-1)..d-1 before round d
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		if d == 0 {
+			trace = append(trace, nil)
+		} else {
+			trace = append(trace, append([]int(nil), v[off-(d-1):off+d]...))
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrackEdits(a, b, trace, d), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Walk the Myers trace back from (len(a), len(b)) to build the edit script
+func backtrackEdits(a, b []string, trace [][]int, d int) []lineEdit {
+	var edits []lineEdit
+	x, y := len(a), len(b)
+	for ; d > 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, lineEdit{diffEqual, a[x]})
+		}
+		if x == prevX {
+			edits = append(edits, lineEdit{diffInsert, b[prevY]})
+		} else {
+			edits = append(edits, lineEdit{diffDelete, a[prevX]})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, lineEdit{diffEqual, a[x]})
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// Render an edit script as unified diff hunks
+func unifiedDiff(edits []lineEdit, context int) []byte {
+	var out bytes.Buffer
+	out.WriteString("--- base\n+++ new\n")
+
+	// Line offsets in the old and new text before each edit
+	aPos := make([]int, len(edits)+1)
+	bPos := make([]int, len(edits)+1)
+	for i, e := range edits {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if e.op != diffInsert {
+			aPos[i+1]++
+		}
+		if e.op != diffDelete {
+			bPos[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		for i < len(edits) && edits[i].op == diffEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		start := max(i-context, 0)
+		end := i
+		for end < len(edits) {
+			if edits[end].op != diffEqual {
+				end++
+				continue
+			}
+			run := 0
+			for end+run < len(edits) && edits[end+run].op == diffEqual {
+				run++
+			}
+			if end+run == len(edits) || run > 2*context {
+				end += min(run, context)
+				break
+			}
+			end += run
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[end]-aPos[start]), hunkRange(bPos[start], bPos[end]-bPos[start]))
+		for _, e := range edits[start:end] {
+			out.WriteByte(" -+"[e.op])
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.Bytes()
+}
+
+// Format the range of a hunk header from a 0-based start and a line count
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Parse a hunk header range such as "12,3" or "12" into a 0-based start and a count
+func parseHunkRange(s string) (start, count int, err error) {
+	startStr, countStr, hasCount := strings.Cut(s, ",")
+	if start, err = strconv.Atoi(startStr); err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("bad hunk range %q", s)
+	}
+	count = 1
+	if hasCount {
+		if count, err = strconv.Atoi(countStr); err != nil || count < 0 {
+			return 0, 0, fmt.Errorf("bad hunk range %q", s)
+		}
+	}
+	if count > 0 {
+		if start == 0 {
+			return 0, 0, fmt.Errorf("bad hunk range %q", s)
+		}
+		start--
+	}
+	return start, count, nil
+}
+
+// Apply a unified diff to base, checking every context and removed line
+func applyPatch(base, patch []byte) ([]byte, error) {
+	old := splitLines(base)
+	lines := splitLines(patch)
+	var out bytes.Buffer
+	cur := 0
+
+	// Read a body line, folding in a following "no newline" marker
+	next := func(i int) (string, int) {
+		line := lines[i]
+		if i+1 < len(lines) && strings.HasPrefix(lines[i+1], `\`) {
+			return strings.TrimSuffix(line, "\n"), i + 2
+		}
+		return line, i + 1
+	}
+
+	i := 0
+	for i < len(lines) && (strings.HasPrefix(lines[i], "--- ") || strings.HasPrefix(lines[i], "+++ ")) {
+		i++
+	}
+	for i < len(lines) {
+		header := strings.TrimSuffix(lines[i], "\n")
+		fields := strings.Fields(header)
+		if len(fields) < 4 || fields[0] != "@@" || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+			return nil, fmt.Errorf("expected a hunk header, got %q", header)
+		}
+		aStart, aCount, err := parseHunkRange(fields[1][1:])
+		if err != nil {
+			return nil, err
+		}
+		_, bCount, err := parseHunkRange(fields[2][1:])
+		if err != nil {
+			return nil, err
+		}
+		if aStart < cur || aStart > len(old) {
+			return nil, fmt.Errorf("hunk %q out of order", header)
+		}
+		for ; cur < aStart; cur++ {
+			out.WriteString(old[cur])
+		}
+		i++
+
+		for aCount > 0 || bCount > 0 {
+			if i >= len(lines) || lines[i] == "" {
+				return nil, errors.New("truncated hunk")
+			}
+			op := lines[i][0]
+			var line string
+			line, i = next(i)
+			line = line[1:]
+			switch op {
+			case ' ', '-':
+				if aCount == 0 || cur >= len(old) || old[cur] != line {
+					return nil, fmt.Errorf("patch does not match the base at line %d", cur+1)
+				}
+				cur++
+				aCount--
+				if op == ' ' {
+					if bCount == 0 {
+						return nil, errors.New("hunk is longer than its header says")
+					}
+					out.WriteString(line)
+					bCount--
+				}
+			case '+':
+				if bCount == 0 {
+					return nil, errors.New("hunk is longer than its header says")
+				}
+				out.WriteString(line)
+				bCount--
+			default:
+				return nil, fmt.Errorf("unexpected line %q in hunk", strings.TrimSuffix(lines[i-1], "\n"))
+			}
+		}
+	}
+	for ; cur < len(old); cur++ {
+		out.WriteString(old[cur])
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,115 @@
+package shadowx
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDiffAndPatchRoundTrip(t *testing.T) {
+	long := strings.Repeat("line\n", 20)
+	tests := []struct {
+		name, a, b string
+	}{
+		{"identical", "a\nb\nc\n", "a\nb\nc\n"},
+		{"empty to text", "", "a\nb\n"},
+		{"text to empty", "a\nb\n", ""},
+		{"change middle", "a\nb\nc\nd\ne\n", "a\nb\nX\nd\ne\n"},
+		{"insert at start", "b\nc\n", "a\nb\nc\n"},
+		{"delete at end", "a\nb\nc\n", "a\nb\n"},
+		{"separate hunks", "start\n" + long + "end\n", "START\n" + long + "END\n"},
+		{"add missing newline", "a\nb", "a\nb\n"},
+		{"drop final newline", "a\nb\n", "a\nb"},
+		{"no newline both", "a\nold", "a\nnew"},
+		{"crlf lines", "a\r\nb\r\n", "a\r\nc\r\n"},
+	}
+	for _, tt := range tests {
+		edits, ok := diffLines(splitLines([]byte(tt.a)), splitLines([]byte(tt.b)), maxDiffEdits)
+		if !ok {
+			t.Errorf("%s: diffLines gave up", tt.name)
+			continue
+		}
+		patch := unifiedDiff(edits, diffContext)
+		got, err := applyPatch([]byte(tt.a), patch)
+		if err != nil {
+			t.Errorf("%s: applyPatch: %v\n%s", tt.name, err, patch)
+			continue
+		}
+		if string(got) != tt.b {
+			t.Errorf("%s: applyPatch = %q, want %q\n%s", tt.name, got, tt.b, patch)
+		}
+	}
+}
+
+func TestUnifiedDiffFormat(t *testing.T) {
+	a := splitLines([]byte("1\n2\n3\n4\n5\n6\n7\n8\n"))
+	b := splitLines([]byte("1\n2\n3\n4\nfive\n6\n7\n8\n"))
+	edits, _ := diffLines(a, b, maxDiffEdits)
+	want := "--- base\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+	if got := string(unifiedDiff(edits, diffContext)); got != want {
+		t.Errorf("unifiedDiff =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiffLinesLimit(t *testing.T) {
+	a := splitLines([]byte(strings.Repeat("a\n", 50)))
+	b := splitLines([]byte(strings.Repeat("b\n", 50)))
+	if _, ok := diffLines(a, b, 10); ok {
+		t.Error("diffLines didn't give up after 10 edits")
+	}
+	if _, ok := diffLines(a, b, 100); !ok {
+		t.Error("diffLines gave up within its limit")
+	}
+}
+
+func TestApplyPatchRejectsMismatches(t *testing.T) {
+	base := []byte("a\nb\nc\n")
+	tests := []struct {
+		name, patch string
+	}{
+		{"wrong context", "@@ -1,2 +1,2 @@\n a\n-x\n+y\n"},
+		{"beyond base", "@@ -9,1 +9,1 @@\n-a\n+b\n"},
+		{"truncated hunk", "@@ -1,3 +1,3 @@\n a\n"},
+		{"garbage header", "hello\n"},
+		{"bad line", "@@ -1,1 +1,1 @@\n*a\n"},
+		{"overlapping hunks", "@@ -2,1 +2,1 @@\n-b\n+B\n@@ -1,1 +1,1 @@\n-a\n+A\n"},
+	}
+	for _, tt := range tests {
+		if _, err := applyPatch(base, []byte(tt.patch)); err == nil {
+			t.Errorf("%s: applyPatch succeeded", tt.name)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	if !isText([]byte("héllo\n")) || isText([]byte("a\x00b")) || isText([]byte{0xff, 0xfe}) {
+		t.Error("isText misclassified input")
+	}
+	if !bytes.Equal([]byte(strings.Join(splitLines([]byte("a\nb")), "")), []byte("a\nb")) {
+		t.Error("splitLines lost data")
+	}
+}
+
+func TestDiffRandomEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"a\n", "b\n", "c\n", "d\n", "e"}
+	randomText := func() string {
+		var b strings.Builder
+		for n := rng.Intn(30); n > 0; n-- {
+			b.WriteString(words[rng.Intn(len(words))])
+		}
+		return b.String()
+	}
+	for i := 0; i < 500; i++ {
+		a, b := randomText(), randomText()
+		edits, ok := diffLines(splitLines([]byte(a)), splitLines([]byte(b)), maxDiffEdits)
+		if !ok {
+			t.Fatalf("diffLines gave up on %q -> %q", a, b)
+		}
+		got, err := applyPatch([]byte(a), unifiedDiff(edits, diffContext))
+		if err != nil || string(got) != b {
+			t.Fatalf("round trip of %q -> %q gave %q, %v", a, b, got, err)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package shadowx
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A directory sent with -resume-dir is announced with a "dirsession <id>"
+// request, where the client generated the ID on its first run and keeps it
+// until the directory is complete. The server accepts with
+// "DIRSESSION <id>", then the client sends one entry per file and an empty
+// line:
+//
+//	file <name>\tsha256=<hex>\tsize=<bytes>
+//
+// The server records the entries under the ID and answers "DONE <name>" for
+// each file an upload of the session stored, and
+// "PARTIAL <name>\toffset=<bytes>\ttoken=<token>" for each it holds part of,
+// then BYE. Uploads carry the ID in a dirsession attribute so the server can
+// note their tokens and completion. Once every file is sent the client ends
+// the session with "dirsession <id>\tfinish=1", which the server answers
+// with OK and BYE after forgetting it.
+
+// What the server holds of a file of a directory session
+type dirSessionStatus struct {
+	done   bool
+	token  string // resumable upload holding part of it, empty when none
+	offset int64  // bytes the upload holds
+}
+
+// Send the directory dir as a session the server keeps under an ID saved
+// with the resume state, so a run that was killed picks up where it
+// stopped: files the session stored are skipped and partial ones resumed.
+// Returns the paths that failed.
+func sendDirSession(cfg *clientConfig, dir string) []SendFailure {
+	var files []string
+	failed := walkFiles(cfg, dir, func(filePath string) {
+		files = append(files, filePath)
+	})
+	id, err := cfg.resume.session(dir)
+	if err != nil {
+		slog.Error("Error saving resume state", "err", err)
+	}
+	var entries []request
+	sums := make(map[string]string) // digest by the name the file is sent under
+	for _, filename := range files {
+		if entry, ok := haveEntry(cfg, filename); ok {
+			entry.verb = "file"
+			entries = append(entries, entry)
+			sums[entry.name] = entry.attrs["sha256"]
+		}
+	}
+	statuses, err := openDirSession(cfg, id, entries)
+	if err != nil {
+		slog.Warn("Sending every file, the server couldn't resume the directory", "err", err)
+	} else {
+		cfg.dirSession = id
+		defer func() { cfg.dirSession = "" }()
+	}
+
+	pool := newSendPool(cfg)
+	done, partial := 0, 0
+	for _, filename := range files {
+		name := cfg.remoteName(filename)
+		status := statuses[name]
+		if status.done {
+			slog.Info("Sent in an earlier run, skipping", "file", filename)
+			cfg.events.emit("skipped", filename, nil)
+			done++
+			continue
+		}
+		if status.token != "" {
+			// The upload picks up the token like any interrupted one
+			if err := cfg.resume.remember(filename, sums[name], status.token); err != nil {
+				slog.Error("Error saving resume state", "err", err)
+			}
+			partial++
+		}
+		pool.send(filename)
+	}
+	if done > 0 || partial > 0 {
+		slog.Info("Resumed directory", "dir", dir, "session", id, "skipped", done, "partial", partial)
+	}
+	failed = append(failed, pool.close()...)
+	if len(failed) > 0 {
+		return failed
+	}
+	if err == nil {
+		finish := request{verb: "dirsession", name: id, attrs: map[string]string{"finish": "1"}}
+		if _, err := sendRecord(cfg, finish); err != nil {
+			slog.Warn("Error ending directory session", "session", id, "err", err)
+		}
+	}
+	if err := cfg.resume.forget(dir); err != nil {
+		slog.Error("Error saving resume state", "err", err)
+	}
+	return nil
+}
+
+// Announce directory session id with its entries, and return what the
+// server holds of each by name
+func openDirSession(cfg *clientConfig, id string, entries []request) (map[string]dirSessionStatus, error) {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "dirsession", name: id}); err != nil {
+		return nil, fmt.Errorf("sending session request: %w", err)
+	}
+	reader := conn.reader
+	line, _ := reader.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "DIRSESSION "+id {
+		// Servers that predate directory sessions close the connection without a word
+		reason, ok := strings.CutPrefix(line, "REJECTED ")
+		if !ok {
+			reason = "the server doesn't support them"
+		}
+		return nil, fmt.Errorf("directory sessions are unavailable: %s", reason)
+	}
+	// The server reads every entry before it answers
+	w := bufio.NewWriter(conn)
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\n", entry)
+	}
+	w.WriteString("\n")
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("sending session entries: %w", err)
+	}
+
+	statuses := make(map[string]dirSessionStatus)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("connection closed before the server answered the session")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if name, ok := strings.CutPrefix(line, "DONE "); ok {
+			statuses[name] = dirSessionStatus{done: true}
+			continue
+		}
+		if strings.HasPrefix(line, "PARTIAL ") {
+			answer, err := parseRequest(line)
+			offset, offsetErr := strconv.ParseInt(answer.attrs["offset"], 10, 64)
+			if err != nil || offsetErr != nil || !validUploadToken(answer.attrs["token"]) {
+				return nil, fmt.Errorf("unexpected server reply %q", line)
+			}
+			statuses[answer.name] = dirSessionStatus{token: answer.attrs["token"], offset: offset}
+			continue
+		}
+		if _, err := parseBye(line); err != nil {
+			return nil, err
+		}
+		return statuses, nil
+	}
+}
+
+// The ID of the session to send the directory dir in: the one an earlier
+// run saved, or a new one that's saved right away
+func (r *resumeState) session(dir string) (string, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[cacheKey(dir)]
+	r.mu.Unlock()
+	if ok && entry.SHA256 == "" && validUploadToken(entry.Token) {
+		return entry.Token, nil
+	}
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	id := hex.EncodeToString(raw)
+	return id, r.remember(dir, "", id)
+}
+
+// Answer a "dirsession <id>" request with what the server holds of the
+// files of the session, recording the entries for its uploads to update,
+// or forget the session when the client finishes it
+func receiveDirSession(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	id := req.name
+	switch {
+	case !validUploadToken(id):
+		rejectUpload(conn, log, "malformed session ID")
+		return nil
+	case cfg.sink() != "":
+		rejectUpload(conn, log, "directory sessions are not supported when writing to the "+cfg.sink())
+		return nil
+	case cfg.storage != nil:
+		rejectUpload(conn, log, "directory sessions are not supported with encryption at rest")
+		return nil
+	}
+	stats := sessionStats{Duration: time.Since(start).Round(time.Millisecond)}
+	if req.attrs["finish"] != "" {
+		if err := cfg.uploads.removeSession(id); err != nil {
+			rejectUpload(conn, log, "could not end session")
+			return fmt.Errorf("removing directory session: %w", err)
+		}
+		log.Info("Directory session finished", "session", id)
+		fmt.Fprintf(conn, "OK\n")
+		if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+			return fmt.Errorf("sending goodbye: %w", err)
+		}
+		return nil
+	}
+	fmt.Fprintf(conn, "DIRSESSION %s\n", id)
+
+	var entries []*checkedRequest
+	for {
+		line, err := conn.readLine()
+		if err != nil {
+			return fmt.Errorf("reading session entries: %w", err)
+		}
+		if line == "" {
+			break
+		}
+		entry, err := parseRequest(line)
+		if err != nil || entry.verb != "file" {
+			return fmt.Errorf("invalid session entry %q", line)
+		}
+		// Names the server would refuse are left for their uploads to refuse
+		if checked, reason := checkRequest(log, cfg, entry); reason == "" && checked.size >= 0 && checked.declared != "" {
+			entries = append(entries, checked)
+		}
+	}
+
+	var answers []string
+	done, partial := 0, 0
+	err := cfg.uploads.updateSession(id, func(state dirSessionState) dirSessionState {
+		if state == nil {
+			state = make(dirSessionState)
+		}
+		for _, entry := range entries {
+			f := state[entry.name]
+			if f == nil || f.Size != entry.size || f.SHA256 != entry.declared {
+				// A file that changed since starts over
+				state[entry.name] = &dirSessionFile{Size: entry.size, SHA256: entry.declared}
+				continue
+			}
+			if f.Done {
+				if _, err := os.Lstat(entry.stored); err == nil {
+					answers = append(answers, "DONE "+entry.name)
+					done++
+					continue
+				}
+				f.Done = false
+			}
+			if f.Token == "" {
+				continue
+			}
+			info, err := os.Stat(cfg.uploads.partPath(f.Token))
+			if err != nil {
+				f.Token = ""
+				continue
+			}
+			offset := strconv.FormatInt(info.Size(), 10)
+			answers = append(answers, request{verb: "PARTIAL", name: entry.name, attrs: map[string]string{"token": f.Token, "offset": offset}}.String())
+			partial++
+		}
+		return state
+	})
+	if err != nil {
+		return fmt.Errorf("saving directory session: %w", err)
+	}
+	w := bufio.NewWriter(conn)
+	for _, answer := range answers {
+		fmt.Fprintf(w, "%s\n", answer)
+	}
+	fmt.Fprintf(w, "BYE %s\n", stats)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("answering session: %w", err)
+	}
+	log.Info("Directory session", "session", id, "files", len(entries), "done", done, "partial", partial)
+	return nil
+}
+
+// Server record of a directory session: the files of its entries by name
+type dirSessionState map[string]*dirSessionFile
+
+// A file of a directory session, and what its uploads got done
+type dirSessionFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Token  string `json:"token,omitempty"` // resumable upload holding part of it
+	Done   bool   `json:"done,omitempty"`  // an upload of the session stored it
+}
+
+// Path of the record of directory session id
+func (s *uploadStore) sessionPath(id string) string {
+	return filepath.Join(s.dir, id+".dir.json")
+}
+
+// Pass the record of directory session id, nil when there's none, to
+// update and save what it returns unless that's nil
+func (s *uploadStore) updateSession(id string, update func(dirSessionState) dirSessionState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var state dirSessionState
+	data, err := os.ReadFile(s.sessionPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("corrupt directory session: %w", err)
+		}
+	}
+	if state = update(state); state == nil {
+		return nil
+	}
+	if data, err = json.Marshal(state); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	tmp := s.sessionPath(id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.sessionPath(id))
+}
+
+// Note that the upload of name with digest sum in session id goes by token,
+// or with an empty token that it's stored
+func (s *uploadStore) sessionUpload(id, name, sum, token string) error {
+	return s.updateSession(id, func(state dirSessionState) dirSessionState {
+		f := state[name]
+		if f == nil || f.SHA256 != sum {
+			return nil
+		}
+		if token == "" {
+			f.Token, f.Done = "", true
+		} else {
+			f.Token = token
+		}
+		return state
+	})
+}
+
+// Forget directory session id
+func (s *uploadStore) removeSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(s.sessionPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
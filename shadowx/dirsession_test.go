@@ -0,0 +1,102 @@
+package shadowx
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A directory send killed part way through a file is finished by a new
+// client with the same resume state: the files the session stored are
+// skipped and the one it was sending resumes where the server's copy ends
+func TestClientSendResumeDir(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	large := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+	files := map[string][]byte{"src/a.txt": []byte("alpha"), "src/b.txt": []byte("bravo"), "src/c.bin": large, "src/d.txt": []byte("delta")}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	// The first run is slowed down and killed a third of the way into c.bin
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := &Client{Addr: srv.Addr, Key: srv.Key, Resume: true, ResumeDirs: true, ResumeState: "state.json", UpLimit: 1 << 20,
+		ProgressFunc: func(file string, done, total int64) {
+			if filepath.Base(file) == "c.bin" && done > total/3 {
+				cancel()
+			}
+		}}
+	if err := first.SendContext(ctx, "src"); err == nil {
+		t.Fatal("SendContext finished although it was canceled")
+	}
+	for name, want := range map[string]bool{"src/a.txt": true, "src/b.txt": true, "src/c.bin": false, "src/d.txt": false} {
+		if _, err := os.Stat(filepath.Join(DefaultOutDir, name)); (err == nil) != want {
+			t.Fatalf("after the killed run %s stored: %v, want %v", name, err == nil, want)
+		}
+	}
+
+	var mu sync.Mutex
+	sent := make(map[string]bool)
+	second := &Client{Addr: srv.Addr, Key: srv.Key, Resume: true, ResumeDirs: true, ResumeState: "state.json",
+		ProgressFunc: func(file string, done, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent[filepath.Base(file)] = true
+		}}
+	if err := second.Send("src"); err != nil {
+		t.Fatalf("Send after the restart: %v", err)
+	}
+	for name, want := range files {
+		if got, err := os.ReadFile(filepath.Join(DefaultOutDir, name)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s stored as %d bytes, %v; want %d", name, len(got), err, len(want))
+		}
+	}
+	if sent["a.txt"] || sent["b.txt"] || !sent["c.bin"] || !sent["d.txt"] {
+		t.Errorf("second run sent %v, want only c.bin and d.txt", sent)
+	}
+	if !strings.Contains(logs.String(), "skipped=2 partial=1") {
+		t.Error("server didn't report the stored and the partial file")
+	}
+	if strings.Contains(logs.String(), `msg=Resuming file=src/c.bin offset=0 `) || !strings.Contains(logs.String(), "msg=Resuming file=src/c.bin") {
+		t.Error("c.bin wasn't resumed from the server's partial copy")
+	}
+
+	// Finishing forgets the session on both sides
+	if state, _ := os.ReadFile("state.json"); string(state) != "{}" {
+		t.Errorf("resume state %s after the directory finished, want it empty", state)
+	}
+	if sessions, _ := filepath.Glob(filepath.Join(DefaultOutDir, uploadStateDir, "*.dir.json")); len(sessions) != 0 {
+		t.Errorf("server kept %v after the directory finished", sessions)
+	}
+}
+
+func TestResumeDirNeedsResume(t *testing.T) {
+	client := &Client{Addr: "127.0.0.1:8080", Key: "test-key", ResumeDirs: true}
+	if err := client.Send("src"); err == nil || !strings.Contains(err.Error(), "-resume-dir needs -resume") {
+		t.Errorf("Send with -resume-dir alone = %v, want it refused", err)
+	}
+}
+
+func TestReceiveDirSessionRejects(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	if replies := testSession(t, cfg, "dirsession ../x\n"); !strings.Contains(replies, "REJECTED malformed session ID") {
+		t.Errorf("malformed session ID: replies %q", replies)
+	}
+	if replies := testSession(t, cfg, "upload a.txt\tdirsession=nope\tsize=1\nx"); !strings.Contains(replies, "REJECTED malformed session ID") {
+		t.Errorf("upload with a malformed session ID: replies %q", replies)
+	}
+}
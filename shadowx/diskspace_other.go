@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package shadowx
+
+import "errors"
+
+// Free space isn't checked on this platform, so uploads are never refused for it
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
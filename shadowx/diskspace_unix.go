@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package shadowx
+
+import "golang.org/x/sys/unix"
+
+// Bytes that can still be written to the volume holding dir, without the
+// blocks only root may use
+func freeSpace(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package shadowx
+
+import "golang.org/x/sys/windows"
+
+// Bytes that can still be written to the volume holding dir, within the
+// user's quota
+func freeSpace(dir string) (int64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return int64(available), nil
+}
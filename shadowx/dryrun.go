@@ -0,0 +1,73 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// List what sendFile would send from path, with the names the server would
+// get, the sizes and a total, without connecting to the server. Directories
+// go through the same walk, so ignore files and the time window apply as
+// they would in the real run.
+func listFiles(cfg *clientConfig, path string) (failed []SendFailure) {
+	var files, total, unknown int64 // unknown counts the files whose size isn't known up front
+	list := func(filePath string) {
+		if isDir(filePath) {
+			slog.Info("Would create directory", "dir", filePath, "as", cfg.remoteName(filePath))
+			return
+		}
+		size, err := plannedSize(filePath)
+		if err != nil {
+			failed = append(failed, SendFailure{Path: filePath, Err: err})
+			return
+		}
+		files++
+		if size < 0 {
+			unknown++
+			slog.Info("Would send", "file", filePath, "as", cfg.remoteName(filePath), "bytes", "unknown")
+			return
+		}
+		total += size
+		slog.Info("Would send", "file", filePath, "as", cfg.remoteName(filePath), "bytes", size)
+	}
+
+	if path == stdinPath {
+		files, unknown = 1, 1
+		slog.Info("Would send", "file", "standard input", "as", cfg.stdinName, "bytes", "unknown")
+	} else if isURL(path) {
+		// Finding the size would mean fetching it
+		name, err := urlName(path)
+		if err != nil {
+			return []SendFailure{{Path: path, Err: err}}
+		}
+		files, unknown = 1, 1
+		slog.Info("Would send", "file", path, "as", name, "bytes", "unknown")
+	} else if fileInfo, err := os.Stat(path); err != nil {
+		return []SendFailure{{Path: path, Err: fmt.Errorf("accessing file or directory: %w", err)}}
+	} else if fileInfo.IsDir() {
+		failed = walkFiles(cfg, path, list)
+	} else if reason := cfg.filtered(fileInfo); reason == "" {
+		list(path)
+	} else {
+		slog.Info("Skipping", "file", path, "reason", reason)
+	}
+
+	slog.Info("Dry run, nothing sent", "files", files, "bytes", total, "unknown_size", unknown)
+	return failed
+}
+
+// The size a file would be sent with, -1 when it's only known by reading it
+// to the end; opening it also finds files the real run couldn't read
+func plannedSize(filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("reading file info: %w", err)
+	}
+	return sourceSize(file, fileInfo), nil
+}
@@ -0,0 +1,69 @@
+package shadowx
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// A dry run connects to nothing and lists exactly the files a real run
+// then sends, after ignore rules
+func TestClientSendDryRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for name, data := range map[string]string{
+		"docs/a.txt":          "hello",
+		"docs/sub/b.txt":      "abc",
+		"docs/skip.log":       "ignored",
+		"docs/.shadowxignore": "*.log\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logged := captureLog(t, slog.LevelInfo)
+	dry := &Client{Addr: "127.0.0.1:1", Key: "test-key", DryRun: true}
+	if err := dry.Send("docs"); err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	var listed []string
+	for _, m := range regexp.MustCompile(`msg="Would send" file=\S+ as=(\S+) bytes=\d+`).FindAllStringSubmatch(logged.String(), -1) {
+		listed = append(listed, m[1])
+	}
+	if !strings.Contains(logged.String(), `msg="Dry run, nothing sent" files=3 bytes=14 unknown_size=0`) {
+		t.Errorf("log lacks the summary of 3 files and 14 bytes:\n%s", logged)
+	}
+
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("docs"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var sent []string
+	filepath.WalkDir(DefaultOutDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(DefaultOutDir, path)
+			sent = append(sent, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	slices.Sort(listed)
+	slices.Sort(sent)
+	if !slices.Equal(listed, sent) {
+		t.Errorf("dry run listed %q, the real run sent %q", listed, sent)
+	}
+
+	var sendErr *SendError
+	if err := dry.Send("missing"); !errors.As(err, &sendErr) {
+		t.Errorf("dry run of a missing path = %v, want a SendError", err)
+	}
+}
@@ -0,0 +1,88 @@
+package shadowx
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// How often a transfer reports progress as a JSON event
+const eventInterval = 500 * time.Millisecond
+
+// Writes transfer events as JSON objects, one per line, for programs that
+// drive the client:
+//
+//	{"event":"start","file":"a.txt","size":1024}
+//	{"event":"progress","file":"a.txt","sent":512,"total":1024}
+//	{"event":"done","file":"a.txt"}
+//	{"event":"error","file":"a.txt","error":"..."}
+//	{"event":"skipped","file":"b.txt"}
+//	{"event":"summary","files":1,"failed":0,"bytes":1024,"elapsed_ms":12,"bytes_per_second":85333}
+//
+// Downloads report "received" instead of "sent", and files the server
+// already has are reported skipped. Sizes are -1 when unknown. A send ends
+// with a summary of the whole run, which names no file.
+// A nil writer emits nothing.
+type eventWriter struct {
+	mu  sync.Mutex // files sent in parallel share the writer
+	enc *json.Encoder
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	if w == nil {
+		return nil
+	}
+	return &eventWriter{enc: json.NewEncoder(w)}
+}
+
+// Write an event about file with the given fields
+func (w *eventWriter) emit(event, file string, fields map[string]any) {
+	if w == nil {
+		return
+	}
+	record := map[string]any{"event": event}
+	if file != "" {
+		record["file"] = file
+	}
+	for key, value := range fields {
+		record[key] = value
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enc.Encode(record)
+}
+
+// Write done, or error when err is set
+func (w *eventWriter) finish(file string, err error) {
+	if err != nil {
+		w.emit("error", file, map[string]any{"error": err.Error()})
+	} else {
+		w.emit("done", file, nil)
+	}
+}
+
+// Reports the progress of one transfer at most every eventInterval
+type progressEvents struct {
+	w     *eventWriter
+	file  string
+	key   string // "sent" or "received"
+	total int64
+	last  time.Time
+}
+
+// Start reporting a transfer of total bytes, -1 when unknown
+func (w *eventWriter) start(file, key string, total int64) *progressEvents {
+	w.emit("start", file, map[string]any{"size": total})
+	return &progressEvents{w: w, file: file, key: key, total: total, last: time.Now()}
+}
+
+// Report done bytes when the interval has passed since the last report, or
+// always when final
+func (p *progressEvents) update(done int64, final bool) {
+	if p.w == nil || !final && time.Since(p.last) < eventInterval {
+		return
+	}
+	p.last = time.Now()
+	p.w.emit("progress", p.file, map[string]any{p.key: done, "total": p.total})
+}
@@ -0,0 +1,80 @@
+package shadowx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestEventWriter(t *testing.T) {
+	var nilWriter *eventWriter
+	nilWriter.finish("a.txt", nil)
+	nilWriter.start("a.txt", "sent", 5).update(5, true)
+
+	var b bytes.Buffer
+	w := newEventWriter(&b)
+	progress := w.start("a.txt", "sent", 5)
+	progress.update(2, false) // within the interval, so not reported
+	progress.update(5, true)
+	w.finish("a.txt", nil)
+	w.finish("b.txt", errors.New("refused"))
+	want := `{"event":"start","file":"a.txt","size":5}
+{"event":"progress","file":"a.txt","sent":5,"total":5}
+{"event":"done","file":"a.txt"}
+{"error":"refused","event":"error","file":"b.txt"}
+`
+	if b.String() != want {
+		t.Errorf("events:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+// Sends and downloads report each file's start, final progress and outcome,
+// and sends end with their totals
+func TestClientSendEvents(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Events: &b}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	client.Send("missing.txt")
+	if err := client.Download("a.txt", "copy.txt"); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %q isn't JSON: %v", line, err)
+		}
+		file, _ := event["file"].(string)
+		summary := strings.TrimSpace(event["event"].(string) + " " + file)
+		for _, key := range []string{"size", "sent", "received", "files", "failed", "bytes"} {
+			if value, ok := event[key]; ok {
+				summary += fmt.Sprintf(" %s=%v", key, value)
+			}
+		}
+		got = append(got, summary)
+	}
+	want := []string{
+		"start a.txt size=5", "progress a.txt sent=5", "done a.txt",
+		"summary files=1 failed=0 bytes=5",
+		"error missing.txt",
+		"summary files=0 failed=1 bytes=0",
+		"start a.txt size=5", "progress a.txt received=5", "done a.txt",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
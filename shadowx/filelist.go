@@ -0,0 +1,92 @@
+package shadowx
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// A path named in a -from-list file, with the line it's on
+type listEntry struct {
+	line int
+	path string
+}
+
+// Read a -from-list file: one path per line, relative to the working
+// directory or absolute, skipping blank lines and lines starting with #.
+// Surrounding whitespace is trimmed, so paths can't start or end with it.
+func readFileList(listPath string) ([]listEntry, error) {
+	file, err := os.Open(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening file list: %w", err)
+	}
+	defer file.Close()
+	var entries []listEntry
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, listEntry{line: n, path: line})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading file list: %w", err)
+	}
+	return entries, nil
+}
+
+// Send each file or directory listed in the file at listPath, in order, as
+// Send would send it on its own. An entry that fails is logged with its line
+// and doesn't stop the rest; the *SendError returned lists every path that
+// still failed after retrying.
+func (c *Client) SendList(listPath string) error {
+	return c.SendListContext(context.Background(), listPath)
+}
+
+// Send a list like SendList, but stop once ctx is done, as SendContext does
+func (c *Client) SendListContext(ctx context.Context, listPath string) error {
+	shared, err := c.config()
+	if err != nil {
+		return err
+	}
+	if c.DryRun || c.VerifyOnly || c.As != "" {
+		return errors.New("-from-list can't be combined with -dry-run, -verify-only or -as")
+	}
+	entries, err := readFileList(listPath)
+	if err != nil {
+		return err
+	}
+	cfg := shared.forCall(ctx, "")
+
+	var roots []sendRoot
+	var rejected []SendFailure
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		err := c.checkSource(entry.path)
+		if err == nil && entry.path == stdinPath {
+			err = errors.New("standard input can't be sent from a list")
+		}
+		if err != nil {
+			slog.Error("Error sending list entry", "list", listPath, "line", entry.line, "path", entry.path, "err", err)
+			rejected = append(rejected, SendFailure{Path: entry.path, Err: err})
+			continue
+		}
+		cfg.root = entry.path
+		failed := sendFile(cfg, entry.path)
+		for _, f := range failed {
+			// Failures below a listed directory were logged as they happened
+			if f.Path == entry.path {
+				slog.Error("Error sending list entry", "list", listPath, "line", entry.line, "path", entry.path, "err", f.Err)
+			}
+		}
+		roots = append(roots, sendRoot{path: entry.path, failed: failed})
+	}
+	return c.finishSend(ctx, cfg, roots, rejected)
+}
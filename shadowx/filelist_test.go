@@ -0,0 +1,120 @@
+package shadowx
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestReadFileList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "files.txt")
+	list := "# reports\na.txt\n\n  /tmp/b.txt  \n\t# indented comment\ndir/c.txt\n"
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readFileList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []listEntry{{2, "a.txt"}, {4, "/tmp/b.txt"}, {6, "dir/c.txt"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readFileList = %v, want %v", got, want)
+	}
+	if _, err := readFileList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("readFileList of a missing file succeeded")
+	}
+}
+
+// The listed paths that exist are sent in full and the missing ones are
+// reported without stopping the rest
+func TestClientSendList(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	for name, data := range map[string]string{"a.txt": "alpha", "dir/b.txt": "bravo", "docs/c.txt": "charlie"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	abs, err := filepath.Abs("dir/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := "# nightly\nmissing.txt\na.txt\n\n" + abs + "\ngone/\ndocs\n-\n"
+	if err := os.WriteFile("files.txt", []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	err = (&Client{Addr: srv.Addr, Key: srv.Key}).SendList("files.txt")
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("SendList = %v, want a *SendError", err)
+	}
+	var failed []string
+	for _, f := range sendErr.Failed {
+		failed = append(failed, f.Path)
+	}
+	if want := []string{"-", "missing.txt", "gone/"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed paths %q, want %q", failed, want)
+	}
+	for name, want := range map[string]string{"a.txt": "alpha", "b.txt": "bravo", "docs/c.txt": "charlie"} {
+		if got, err := os.ReadFile(filepath.Join(DefaultOutDir, name)); err != nil || string(got) != want {
+			t.Errorf("%s stored as %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+// Canceling a list leaves another list being sent alongside it on the same
+// Client to finish
+func TestSendListContextOverlapping(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	for _, name := range []string{"a.bin", "b.bin"} {
+		if err := os.WriteFile(name, make([]byte, 1<<20), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("list.txt", []byte("a.bin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("other.txt", []byte("b.bin\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	var once sync.Once
+	client := &Client{Addr: srv.Addr, Key: srv.Key, UpLimit: 2 << 20,
+		ProgressFunc: func(file string, done, total int64) {
+			switch {
+			case file == "b.bin" && done > 0:
+				once.Do(func() { close(started) })
+			case file == "a.bin":
+				cancel()
+			}
+		}}
+	other := make(chan error, 1)
+	go func() { other <- client.SendList("other.txt") }()
+	<-started
+	if err := client.SendListContext(ctx, "list.txt"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SendListContext = %v, want context.Canceled", err)
+	}
+	if err := <-other; err != nil {
+		t.Errorf("SendList alongside a canceled SendListContext: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(DefaultOutDir, "b.bin")); err != nil || info.Size() != 1<<20 {
+		t.Errorf("server's copy of the other file: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package shadowx
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Parse a time bound given as a duration before now (e.g. "24h"), as an
+// RFC 3339 timestamp or date, or as a reference file whose modification
+// time it is, such as one touched at the end of the last backup
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if info, err := os.Stat(value); err == nil {
+		return info.ModTime(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: want a duration like 24h, a timestamp like 2006-01-02T15:04:05Z or an existing file", value)
+}
+
+// Parse the -newer-than/-older-than bounds, either of which may be empty
+func ParseTimeWindow(newerThan, olderThan string, now time.Time) (newer, older time.Time, err error) {
+	if newerThan != "" {
+		if newer, err = parseTimeBound(newerThan, now); err != nil {
+			return newer, older, err
+		}
+	}
+	if olderThan != "" {
+		if older, err = parseTimeBound(olderThan, now); err != nil {
+			return newer, older, err
+		}
+	}
+	if !newer.IsZero() && !older.IsZero() && !newer.Before(older) {
+		return newer, older, fmt.Errorf("empty time window: -newer-than %s is not before -older-than %s", newer.Format(time.RFC3339), older.Format(time.RFC3339))
+	}
+	return newer, older, nil
+}
+
+// Why -newer-than/-older-than or -max-size leave a file out, empty when it's sent
+func (cfg *clientConfig) filtered(info os.FileInfo) string {
+	if !cfg.inTimeWindow(info) {
+		return "modified outside the time window"
+	}
+	if cfg.maxSize > 0 && info.Mode().IsRegular() && info.Size() > cfg.maxSize {
+		return "larger than -max-size"
+	}
+	return ""
+}
+
+// Report whether a file's modification time falls inside the configured window
+func (cfg *clientConfig) inTimeWindow(info os.FileInfo) bool {
+	mtime := info.ModTime()
+	if !cfg.newerThan.IsZero() && !mtime.After(cfg.newerThan) {
+		return false
+	}
+	if !cfg.olderThan.IsZero() && !mtime.Before(cfg.olderThan) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseTimeBound(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	// A reference file stands for its modification time
+	stamp := filepath.Join(t.TempDir(), "last-backup.stamp")
+	stampTime := time.Date(2024, 2, 1, 9, 0, 0, 0, time.UTC)
+	if err := os.WriteFile(stamp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(stamp, stampTime, stampTime); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "24h", want: now.Add(-24 * time.Hour)},
+		{value: "90m", want: now.Add(-90 * time.Minute)},
+		{value: "2024-01-31T08:30:00Z", want: time.Date(2024, 1, 31, 8, 30, 0, 0, time.UTC)},
+		{value: "2024-01-31T08:30:00+02:00", want: time.Date(2024, 1, 31, 6, 30, 0, 0, time.UTC)},
+		{value: "2024-01-31T08:30:00", want: time.Date(2024, 1, 31, 8, 30, 0, 0, time.Local)},
+		{value: "2024-01-31", want: time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)},
+		{value: "yesterday", wantErr: true},
+		{value: "24", wantErr: true},
+		{value: "2024-13-01", wantErr: true},
+		{value: stamp, want: stampTime},
+		{value: stamp + ".missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeBound(tt.value, now)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimeBound(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !got.Equal(tt.want) {
+			t.Errorf("parseTimeBound(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		newer, older string
+		wantErr      bool
+	}{
+		{"", "", false},
+		{"48h", "", false},
+		{"", "24h", false},
+		{"48h", "24h", false},
+		{"24h", "48h", true},
+		{"24h", "24h", true},
+		{"2024-03-01", "2024-02-01", true},
+		{"bogus", "", true},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseTimeWindow(tt.newer, tt.older, now); (err != nil) != tt.wantErr {
+			t.Errorf("ParseTimeWindow(%q, %q) error = %v, wantErr %v", tt.newer, tt.older, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInTimeWindow(t *testing.T) {
+	base := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	cfg := &clientConfig{newerThan: base.Add(-time.Hour), olderThan: base.Add(time.Hour)}
+	tests := []struct {
+		mtime time.Time
+		want  bool
+	}{
+		{base, true},
+		{base.Add(-2 * time.Hour), false},
+		{base.Add(2 * time.Hour), false},
+		{cfg.newerThan, false},
+		{cfg.olderThan, false},
+	}
+	for _, tt := range tests {
+		if got := cfg.inTimeWindow(fakeInfo{mtime: tt.mtime}); got != tt.want {
+			t.Errorf("inTimeWindow(%v) = %v, want %v", tt.mtime, got, tt.want)
+		}
+	}
+}
+
+// -max-size and -newer-than each leave files out of a directory walk, and
+// together only what passes both and .shadowxignore is sent
+func TestWalkFilesFilters(t *testing.T) {
+	t.Chdir(t.TempDir())
+	old := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name  string
+		size  int
+		mtime time.Time
+	}{
+		{"src/old-small.txt", 10, old},
+		{"src/old-large.bin", 1000, old},
+		{"src/new-small.txt", 10, recent},
+		{"src/new-large.bin", 1000, recent},
+		{"src/new-small.log", 10, recent},
+	}
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := os.WriteFile(f.name, make([]byte, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f.name, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("src/.shadowxignore", []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes("src/.shadowxignore", old, old)
+	stamp := "last-backup.stamp"
+	if err := os.WriteFile(stamp, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	middle := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(stamp, middle, middle); err != nil {
+		t.Fatal(err)
+	}
+	newer, _, err := ParseTimeWindow(stamp, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  *clientConfig
+		want []string
+	}{
+		{"max size", &clientConfig{maxSize: 100}, []string{".shadowxignore", "new-small.txt", "old-small.txt"}},
+		{"newer than", &clientConfig{newerThan: newer}, []string{"new-large.bin", "new-small.txt"}},
+		{"both", &clientConfig{newerThan: newer, maxSize: 100}, []string{"new-small.txt"}},
+		{"size at the limit", &clientConfig{maxSize: 1000}, []string{".shadowxignore", "new-large.bin", "new-small.txt", "old-large.bin", "old-small.txt"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		if failed := walkFiles(tt.cfg, "src", func(filePath string) { got = append(got, filepath.Base(filePath)) }); len(failed) != 0 {
+			t.Fatalf("%s: walk failed: %v", tt.name, failed)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package shadowx
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Serve the output directory read-only over HTTPS on cfg.httpAddr. Returns
+// once listening; the server runs until shut down.
+func startHTTPServer(cfg *serverConfig, tlsConfig *tls.Config) (*http.Server, error) {
+	listener, err := net.Listen("tcp", cfg.httpAddr)
+	if err != nil {
+		return nil, err
+	}
+	certFile, keyFile := cfg.tlsFiles()
+	server := &http.Server{
+		Handler:           requireKey(cfg, http.FileServer(newHidingFS(cfg.outDir, keyFile, certFile))),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	tlsListener := tls.NewListener(throttleListener{filterListener{listener, cfg.clients}, cfg.upLimit, cfg.downLimit}, tlsConfig)
+	go func() {
+		if err := server.Serve(tlsListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving HTTP", "err", err)
+		}
+	}()
+	slog.Info("ShadowX HTTP file server listening", "address", cfg.httpAddr)
+	return server, nil
+}
+
+// Only let requests through that carry a key cfg accepts, as a bearer token
+// or as the password of basic auth. Wrong keys count against the client's
+// address as they do on the native port, and an address that's refused
+// there is refused here before its key is checked.
+func requireKey(cfg *serverConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if cfg.authFailures.blocked(ip, time.Now()) {
+			http.Error(w, "too many failed authentications", http.StatusTooManyRequests)
+			return
+		}
+		var presented string
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			presented = token
+		} else if _, password, ok := r.BasicAuth(); ok {
+			presented = password
+		}
+		// A request without a key, such as a browser's first, isn't a guess
+		if presented == "" || !cfg.keyAccepted(presented) {
+			if presented != "" {
+				cfg.metrics.authFailed()
+				failures, block := cfg.authFailures.add(ip, cfg.maxAuthFailures, time.Now())
+				slog.Warn("Invalid authentication key on the HTTP file server", "remote", r.RemoteAddr, "failures", failures)
+				if block > 0 {
+					slog.Warn("Refusing connections from the address after repeated authentication failures", "ip", ip, "for", block)
+				}
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="ShadowX"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		cfg.authFailures.clear(ip)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// File system that hides dotfiles, such as partial uploads and resume state,
+// and the server's own TLS files when they live under the served directory
+type hidingFS struct {
+	http.FileSystem
+	exclude map[string]bool // slash-separated paths from the root, starting with "/"
+}
+
+// Serve root, hiding the given files wherever they are
+func newHidingFS(root string, hidden ...string) hidingFS {
+	fsys := hidingFS{FileSystem: http.Dir(root), exclude: make(map[string]bool)}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return fsys
+	}
+	for _, name := range hidden {
+		abs, err := filepath.Abs(name)
+		if err != nil || !isWithin(absRoot, abs) {
+			continue
+		}
+		rel, _ := filepath.Rel(absRoot, abs)
+		fsys.exclude["/"+filepath.ToSlash(rel)] = true
+	}
+	return fsys
+}
+
+// Whether a path must not be served
+func (fsys hidingFS) hidden(name string) bool {
+	name = path.Clean("/" + name)
+	if fsys.exclude[name] {
+		return true
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsys hidingFS) Open(name string) (http.File, error) {
+	if fsys.hidden(name) {
+		return nil, fs.ErrNotExist
+	}
+	file, err := fsys.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return hidingFile{File: file, fsys: fsys, name: name}, nil
+}
+
+// Directory listing without hidden entries
+type hidingFile struct {
+	http.File
+	fsys hidingFS
+	name string
+}
+
+func (f hidingFile) Readdir(n int) ([]fs.FileInfo, error) {
+	entries, err := f.File.Readdir(n)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !f.fsys.hidden(path.Join(f.name, entry.Name())) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+// Listener whose connections are throttled like those of the native protocol
+type throttleListener struct {
+	net.Listener
+	up, down int64
+}
+
+func (l throttleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return throttle(conn, l.up, l.down), nil
+}
@@ -0,0 +1,113 @@
+package shadowx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHidingFS(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "sub", ".hidden"), 0755)
+	for _, name := range []string{"a.txt", "server.key", ".partial", "sub/b.txt", "sub/server.key"} {
+		os.WriteFile(filepath.Join(root, name), []byte(name), 0644)
+	}
+	fsys := newHidingFS(root, filepath.Join(root, "server.key"))
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"/a.txt", false},
+		{"/sub/b.txt", false},
+		{"/sub/server.key", false}, // only the configured key is hidden
+		{"/server.key", true},
+		{"/sub/../server.key", true},
+		{"/.partial", true},
+		{"/sub/.hidden", true},
+		{"/sub/.hidden/x", true},
+	}
+	for _, tt := range tests {
+		if got := fsys.hidden(tt.name); got != tt.want {
+			t.Errorf("hidden(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	dir, err := fsys.Open("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := dir.Readdir(-1)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if got := strings.Join(names, ","); strings.Contains(got, "server.key") || strings.Contains(got, ".partial") {
+		t.Errorf("listing shows hidden files: %s", got)
+	}
+}
+
+func TestRequireKey(t *testing.T) {
+	handler := requireKey(&serverConfig{secretKey: "k3y"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name   string
+		method string
+		auth   func(*http.Request)
+		want   int
+	}{
+		{"no credentials", http.MethodGet, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer k3y") }, http.StatusOK},
+		{"wrong bearer", http.MethodGet, func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"basic", http.MethodHead, func(r *http.Request) { r.SetBasicAuth("anyone", "k3y") }, http.StatusOK},
+		{"wrong basic", http.MethodGet, func(r *http.Request) { r.SetBasicAuth("k3y", "nope") }, http.StatusUnauthorized},
+		{"write", http.MethodPut, func(r *http.Request) { r.SetBasicAuth("", "k3y") }, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		tt.auth(req)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+// Wrong keys over HTTP count towards the address's failures, and once it's
+// refused even the right key is turned away without being checked
+func TestRequireKeyCountsFailures(t *testing.T) {
+	cfg := &serverConfig{secretKey: "k3y", maxAuthFailures: 2, metrics: &serverMetrics{}}
+	handler := requireKey(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		if key != "" {
+			req.SetBasicAuth("", key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve(""); code != http.StatusUnauthorized {
+		t.Errorf("no credentials: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve("nope"); code != http.StatusUnauthorized {
+		t.Errorf("first wrong key: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serve("k3y"); code != http.StatusOK {
+		t.Errorf("right key: status %d, want %d", code, http.StatusOK)
+	}
+	for range 2 {
+		serve("nope")
+	}
+	if code := serve("k3y"); code != http.StatusTooManyRequests {
+		t.Errorf("right key from a refused address: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if got := cfg.metrics.authFailures.Load(); got != 3 {
+		t.Errorf("auth failures counted %d, want 3", got)
+	}
+}
@@ -0,0 +1,124 @@
+package shadowx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Whether a path given to Send is an http:// or https:// URL to fetch rather
+// than a local file
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// The name a URL is stored under on the server: the last segment of its path
+func urlName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing URL: %w", err)
+	}
+	name := path.Base(u.Path)
+	if strings.HasSuffix(u.Path, "/") || name == "." || name == "/" {
+		return "", fmt.Errorf("URL %s has no file name to store it under", rawURL)
+	}
+	return name, nil
+}
+
+// Fetch a URL to send, returning its body and what's known of it. When the
+// server gives a Content-Length it's the size; otherwise the size is 0 and
+// the body is read until it ends. With cfg.httpTimeout set, the fetch fails
+// once the server sends nothing for that long, whether headers or body.
+func openURL(cfg *clientConfig, rawURL string) (io.ReadCloser, fs.FileInfo, error) {
+	name, err := urlName(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancelCause(cfg.ctx)
+	body := &urlBody{cancel: cancel, timeout: cfg.httpTimeout}
+	if body.timeout > 0 {
+		body.timer = time.AfterFunc(body.timeout, func() {
+			cancel(fmt.Errorf("no data from %s for %s", rawURL, body.timeout))
+		})
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		body.Close()
+		return nil, nil, fmt.Errorf("fetching URL: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		body.Close()
+		if cause := context.Cause(ctx); cause != nil && cfg.ctx.Err() == nil {
+			err = cause
+		}
+		return nil, nil, fmt.Errorf("fetching URL: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		body.Close()
+		return nil, nil, fmt.Errorf("fetching URL: %s", resp.Status)
+	}
+	body.ctx, body.body = ctx, resp.Body
+	info := urlInfo{name: name, size: max(resp.ContentLength, 0)}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.modTime = modified
+	}
+	return body, info, nil
+}
+
+// The body of a URL being sent, which restarts the timeout with every read
+type urlBody struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	cancel  context.CancelCauseFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *urlBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.timer != nil {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		// Say the server went quiet rather than that the request was canceled
+		if cause := context.Cause(b.ctx); cause != b.ctx.Err() {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *urlBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	var err error
+	if b.body != nil {
+		err = b.body.Close()
+	}
+	b.cancel(nil)
+	return err
+}
+
+// What's known of a URL being sent. It's a regular file as far as its mode
+// goes, though it can't be reopened by name.
+type urlInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i urlInfo) Name() string       { return i.name }
+func (i urlInfo) Size() int64        { return i.size }
+func (i urlInfo) Mode() fs.FileMode  { return 0 }
+func (i urlInfo) ModTime() time.Time { return i.modTime }
+func (i urlInfo) IsDir() bool        { return false }
+func (i urlInfo) Sys() any           { return nil }
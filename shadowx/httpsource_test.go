@@ -0,0 +1,98 @@
+package shadowx
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestURLName(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://example.com/files/report.pdf", "report.pdf"},
+		{"http://example.com/report.pdf?token=abc#top", "report.pdf"},
+		{"https://example.com/files/my%20report.pdf", "my report.pdf"},
+		{"https://example.com/files/", ""},
+		{"https://example.com/", ""},
+		{"https://example.com", ""},
+	}
+	for _, tt := range tests {
+		got, err := urlName(tt.url)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("urlName(%q) = %q, want an error", tt.url, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("urlName(%q) = %q, %v; want %q", tt.url, got, err, tt.want)
+		}
+	}
+}
+
+// A URL is stored under the last segment of its path, sized by its
+// Content-Length when there is one and read to the end when there isn't
+func TestClientSendURL(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/report.bin":
+			w.Header().Set("Content-Length", "100000")
+			w.Write(data)
+		case "/files/stream.bin":
+			// Flushing before the end leaves the length unknown
+			w.Write(data[:10])
+			w.(http.Flusher).Flush()
+			w.Write(data[10:])
+		case "/files/slow.bin":
+			<-r.Context().Done()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer web.Close()
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	var mu sync.Mutex
+	totals := map[string]int64{}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, HTTPTimeout: 200 * time.Millisecond, ProgressFunc: func(file string, done, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		totals[file] = total
+	}}
+	for name, total := range map[string]int64{"report.bin": 100000, "stream.bin": -1} {
+		url := web.URL + "/files/" + name
+		if err := client.Send(url); err != nil {
+			t.Fatalf("Send %s: %v", url, err)
+		}
+		got, err := os.ReadFile(filepath.Join(DefaultOutDir, name))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s stored as %d bytes, %v; want the %d bytes served", name, len(got), err, len(data))
+		}
+		if totals[url] != total {
+			t.Errorf("%s reported a total of %d, want %d", name, totals[url], total)
+		}
+	}
+
+	for name, want := range map[string]string{"missing.bin": "404", "slow.bin": "no data from", "": "no file name"} {
+		err := client.Send(web.URL + "/files/" + name)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Send %s = %v, want an error with %q", name, err, want)
+		}
+	}
+	if entries, _ := os.ReadDir(DefaultOutDir); len(entries) != 2 {
+		t.Errorf("output directory holds %d entries, want the 2 sent", len(entries))
+	}
+}
@@ -0,0 +1,127 @@
+package shadowx
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the per-directory file listing paths the walk skips
+const ignoreFileName = ".shadowxignore"
+
+// A single pattern from a .shadowxignore file
+type ignoreRule struct {
+	base     string // directory holding the ignore file, slash-separated and relative to the walk root
+	pattern  string
+	negate   bool // "!pattern" re-includes a path an earlier rule ignored
+	dirOnly  bool // "pattern/" only matches directories
+	anchored bool // a pattern containing "/" matches from base, otherwise any name below it
+}
+
+// Rules in effect for a directory, parent rules first so later ones take precedence
+type ignoreRules []ignoreRule
+
+// Parse the content of an ignore file found in base, using gitignore syntax:
+// blank lines and lines starting with # are skipped, ! negates, a trailing /
+// restricts the rule to directories and ** matches any number of directories
+func parseIgnoreFile(data []byte, base string) ignoreRules {
+	var rules ignoreRules
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Whether rel, a slash-separated path relative to the walk root, is ignored
+func (rules ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) matches(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.base != "." {
+		var ok bool
+		if rel, ok = strings.CutPrefix(rel, rule.base+"/"); !ok {
+			return false
+		}
+	}
+	if !rule.anchored {
+		ok, _ := path.Match(rule.pattern, path.Base(rel))
+		return ok
+	}
+	return matchSegments(strings.Split(rule.pattern, "/"), strings.Split(rel, "/"))
+}
+
+// Match path segments against pattern segments, where "**" spans any number of segments
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Add the rules of dir's ignore file, if it has one, to the inherited rules
+func loadIgnoreRules(dir, rel string, inherited ignoreRules) (ignoreRules, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return inherited, nil
+	}
+	if err != nil {
+		return inherited, err
+	}
+	own := parseIgnoreFile(data, rel)
+	if len(own) == 0 {
+		return inherited, nil
+	}
+	return append(inherited[:len(inherited):len(inherited)], own...), nil
+}
@@ -0,0 +1,71 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseIgnoreFile(t *testing.T) {
+	data := []byte("# comment\n\n*.log\n!keep.log\nbuild/\n/docs/*.tmp\n\\!literal\ncache/**/obj\r\n")
+	want := ignoreRules{
+		{base: "sub", pattern: "*.log"},
+		{base: "sub", pattern: "keep.log", negate: true},
+		{base: "sub", pattern: "build", dirOnly: true},
+		{base: "sub", pattern: "docs/*.tmp", anchored: true},
+		{base: "sub", pattern: "!literal"},
+		{base: "sub", pattern: "cache/**/obj", anchored: true},
+	}
+	if got := parseIgnoreFile(data, "sub"); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIgnoreFile =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	rules := append(parseIgnoreFile([]byte("*.log\nbuild/\n/top.txt\n"), "."),
+		parseIgnoreFile([]byte("!keep.log\nsrc/**/*.o\n"), "proj")...)
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		{"deep/er/a.log", false, true},
+		{"proj/keep.log", false, false},
+		{"keep.log", false, true}, // the negation only applies under proj
+		{"build", true, true},
+		{"build", false, false}, // dir-only rule
+		{"x/build", true, true},
+		{"top.txt", false, true},
+		{"x/top.txt", false, false}, // anchored to the root
+		{"proj/src/a.o", false, true},
+		{"proj/src/x/y/a.o", false, true},
+		{"src/a.o", false, false},
+		{"proj/a.o", false, false},
+		{"readme.md", false, false},
+	}
+	for _, tt := range tests {
+		if got := rules.ignored(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("ignored(%q, dir=%v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestLoadIgnoreRules(t *testing.T) {
+	dir := t.TempDir()
+	parent := parseIgnoreFile([]byte("*.tmp\n"), ".")
+
+	rules, err := loadIgnoreRules(dir, "sub", parent)
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("without an ignore file: %v, %v", rules, err)
+	}
+	os.WriteFile(filepath.Join(dir, ignoreFileName), []byte("*.bak\n"), 0644)
+	rules, err = loadIgnoreRules(dir, "sub", parent)
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("with an ignore file: %v, %v", rules, err)
+	}
+	if len(parent) != 1 {
+		t.Error("loadIgnoreRules modified the inherited rules")
+	}
+}
@@ -0,0 +1,32 @@
+package shadowx
+
+import (
+	"errors"
+	"os"
+)
+
+// How a stored file was protected against changes, as recorded in the manifest
+const (
+	protectImmutable = "immutable" // filesystem immutable attribute, like chattr +i
+	protectReadOnly  = "read-only" // permissions only
+)
+
+// Protect a stored file against modification and deletion: set the
+// filesystem's immutable attribute where possible, otherwise fall back to
+// read-only permissions. Returns which protection was applied.
+func makeImmutable(path string) (string, error) {
+	if err := os.Chmod(path, 0444); err != nil {
+		return "", err
+	}
+	err := setImmutableFlag(path, true)
+	if err == nil {
+		return protectImmutable, nil
+	}
+	if errors.Is(err, errImmutableUnsupported) || errors.Is(err, os.ErrPermission) {
+		return protectReadOnly, nil
+	}
+	return protectReadOnly, err
+}
+
+// Returned where the platform or filesystem has no immutable attribute
+var errImmutableUnsupported = errors.New("immutable attribute not supported")
@@ -0,0 +1,43 @@
+//go:build linux
+
+package shadowx
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FS_IMMUTABLE_FL from linux/fs.h
+const fsImmutableFlag = 0x00000010
+
+// Set or clear the immutable inode flag, which needs CAP_LINUX_IMMUTABLE
+// and a filesystem that supports it, such as ext4 or XFS
+func setImmutableFlag(path string, on bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetInt(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EOPNOTSUPP) {
+			return errImmutableUnsupported
+		}
+		return err
+	}
+	if on {
+		flags |= fsImmutableFlag
+	} else {
+		flags &^= fsImmutableFlag
+	}
+	err = unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, flags)
+	switch {
+	case errors.Is(err, unix.EPERM):
+		return os.ErrPermission
+	case errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EOPNOTSUPP):
+		return errImmutableUnsupported
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package shadowx
+
+// No immutable attribute is set on this platform; read-only permissions are used instead
+func setImmutableFlag(path string, on bool) error {
+	return errImmutableUnsupported
+}
@@ -0,0 +1,54 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakeImmutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archived")
+	if err := os.WriteFile(path, []byte("audit"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	protection, err := makeImmutable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protection == protectImmutable {
+		t.Cleanup(func() { setImmutableFlag(path, false) })
+		if err := os.Remove(path); err == nil {
+			t.Error("immutable file was removed")
+		}
+	}
+	if protection != protectImmutable && protection != protectReadOnly {
+		t.Errorf("makeImmutable = %q", protection)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0222 != 0 {
+		t.Errorf("file is still writable: %s", info.Mode())
+	}
+}
+
+func TestStorePartialImmutable(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{outDir: dir, immutable: true}
+	stored := filepath.Join(dir, "audit.log")
+	for i, want := range []string{"first", "first"} {
+		partial := filepath.Join(dir, ".partial")
+		if err := os.WriteFile(partial, []byte([]string{"first", "second"}[i]), 0600); err != nil {
+			t.Fatal(err)
+		}
+		err := storePartial(cfg, partial, stored)
+		if (err != nil) != (i > 0) {
+			t.Fatalf("upload %d: storePartial error = %v", i+1, err)
+		}
+		os.Remove(partial)
+		if data, _ := os.ReadFile(stored); string(data) != want {
+			t.Errorf("upload %d: stored %q, want %q", i+1, data, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package shadowx
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"unicode"
+)
+
+// Estimate the entropy of a key in bits, taking the lower of the character
+// pool estimate (length times log2 of the classes used) and the Shannon
+// entropy of its actual character frequencies, so repetitive keys score low
+func keyEntropy(key string) float64 {
+	runes := []rune(key)
+	if len(runes) == 0 {
+		return 0
+	}
+	var lower, upper, digit, other bool
+	counts := make(map[rune]int)
+	for _, r := range runes {
+		counts[r]++
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	poolBits := float64(len(runes)) * math.Log2(float64(pool))
+
+	shannon := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(runes))
+		shannon -= p * math.Log2(p)
+	}
+	return math.Min(poolBits, shannon*float64(len(runes)))
+}
+
+// Check a key against a minimum length and estimated entropy
+func CheckKeyStrength(key string, minLength int, minEntropy float64) error {
+	if n := len([]rune(key)); n < minLength {
+		return fmt.Errorf("key is %d characters, at least %d are required", n, minLength)
+	}
+	if bits := keyEntropy(key); bits < minEntropy {
+		return fmt.Errorf("key has about %.0f bits of entropy, at least %.0f are required", bits, minEntropy)
+	}
+	return nil
+}
+
+// Compare a presented key with the PSK in constant time. Both are hashed
+// first so the time taken doesn't reveal the key's length either.
+func keyMatches(presented, key string) bool {
+	a := sha256.Sum256([]byte(presented))
+	b := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
@@ -0,0 +1,56 @@
+package shadowx
+
+import "testing"
+
+func TestKeyEntropy(t *testing.T) {
+	tests := []struct {
+		key      string
+		min, max float64
+	}{
+		{"", 0, 0},
+		{"aaaaaaaaaaaaaaaa", 0, 0},
+		{"abababababababab", 15, 17},
+		{"abcdefghijklmnop", 63, 65},
+		{"Tr0ub4dor&3xQ9!z", 60, 105},
+	}
+	for _, tt := range tests {
+		if got := keyEntropy(tt.key); got < tt.min || got > tt.max {
+			t.Errorf("keyEntropy(%q) = %.1f, want %.0f..%.0f", tt.key, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestCheckKeyStrength(t *testing.T) {
+	tests := []struct {
+		key     string
+		wantErr bool
+	}{
+		{"short", true},
+		{"aaaaaaaaaaaaaaaaaaaa", true},
+		{"mysecretkey", true},
+		{"kQ7#vN2p!Lx9@mR4wZ", false},
+	}
+	for _, tt := range tests {
+		if err := CheckKeyStrength(tt.key, 16, 64); (err != nil) != tt.wantErr {
+			t.Errorf("CheckKeyStrength(%q) = %v, wantErr %v", tt.key, err, tt.wantErr)
+		}
+	}
+}
+
+func TestKeyMatches(t *testing.T) {
+	tests := []struct {
+		presented, key string
+		want           bool
+	}{
+		{"kQ7#vN2p!Lx9@mR4wZ", "kQ7#vN2p!Lx9@mR4wZ", true},
+		{"kQ7#vN2p!Lx9@mR4wz", "kQ7#vN2p!Lx9@mR4wZ", false},
+		{"kQ7#vN2p", "kQ7#vN2p!Lx9@mR4wZ", false},
+		{"", "kQ7#vN2p!Lx9@mR4wZ", false},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		if got := keyMatches(tt.presented, tt.key); got != tt.want {
+			t.Errorf("keyMatches(%q, %q) = %v, want %v", tt.presented, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package shadowx
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The server presented a different certificate key than the known hosts
+// file recorded for its address
+var ErrServerChanged = errors.New("server certificate changed")
+
+// Servers trusted on first use, kept in a file of "<address> <fingerprint>"
+// lines like SSH's known_hosts. The fingerprint is the SHA-256 of the
+// server's public key, the value -pin takes.
+type knownHosts struct {
+	mu    sync.Mutex
+	path  string
+	hosts map[string]string // fingerprint in hex by address as given to -i
+}
+
+// Load known hosts from path; a missing file has none yet. Blank lines and
+// lines starting with # are skipped.
+func loadKnownHosts(path string) (*knownHosts, error) {
+	k := &knownHosts{path: path, hosts: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Unix socket paths may hold spaces, fingerprints never do
+		sep := strings.LastIndexAny(line, " \t")
+		if sep < 0 {
+			return nil, fmt.Errorf("%s:%d: want \"<address> <fingerprint>\"", path, i+1)
+		}
+		pin, err := parsePin(line[sep+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		k.hosts[strings.TrimSpace(line[:sep])] = hex.EncodeToString(pin)
+	}
+	return k, nil
+}
+
+// Check the public key pin a server at address presented against the one
+// on record, recording it when the address is new
+func (k *knownHosts) check(address string, pin []byte) error {
+	fingerprint := hex.EncodeToString(pin)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if known, ok := k.hosts[address]; ok {
+		if known != fingerprint {
+			return fmt.Errorf("%w: %s presented %s, but %s records %s. Someone may be intercepting the connection; if the server's key was replaced on purpose, remove its line from %s",
+				ErrServerChanged, address, fingerprint, k.path, known, k.path)
+		}
+		return nil
+	}
+	file, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("recording known host: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%s %s\n", address, fingerprint)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("recording known host: %w", err)
+	}
+	k.hosts[address] = fingerprint
+	slog.Warn("Trusting the server on first use, recorded its fingerprint", "server", address, "fingerprint", fingerprint, "known_hosts", k.path)
+	return nil
+}
+
+// Build a VerifyPeerCertificate callback that checks the server at address
+// against the known hosts
+func verifyKnownHost(k *knownHosts, address string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("known hosts: server presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("known hosts: parsing server certificate: %w", err)
+		}
+		return k.check(address, publicKeyPin(cert))
+	}
+}
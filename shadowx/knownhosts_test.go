@@ -0,0 +1,131 @@
+package shadowx
+
+import (
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadKnownHosts(t *testing.T) {
+	pin := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		ok      bool
+	}{
+		{"empty", "", map[string]string{}, true},
+		{"one host", "10.0.0.1:8080 " + pin + "\n", map[string]string{"10.0.0.1:8080": pin}, true},
+		{"comments and blanks", "# servers\n\n  files.example.com:8080\t" + pin + "  \n", map[string]string{"files.example.com:8080": pin}, true},
+		{"colon-separated fingerprint", "h:1 " + strings.TrimSuffix(strings.Repeat("AB:", 32), ":"), map[string]string{"h:1": pin}, true},
+		{"socket path with a space", "unix:/run/my app.sock " + pin, map[string]string{"unix:/run/my app.sock": pin}, true},
+		{"missing fingerprint", "10.0.0.1:8080\n", nil, false},
+		{"bad fingerprint", "10.0.0.1:8080 " + pin[:10], nil, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "known_hosts")
+		if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := loadKnownHosts(path)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: loadKnownHosts error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if len(k.hosts) != len(tt.want) {
+			t.Errorf("%s: hosts = %v, want %v", tt.name, k.hosts, tt.want)
+		}
+		for address, fingerprint := range tt.want {
+			if k.hosts[address] != fingerprint {
+				t.Errorf("%s: hosts[%q] = %q, want %q", tt.name, address, k.hosts[address], fingerprint)
+			}
+		}
+	}
+
+	k, err := loadKnownHosts(filepath.Join(t.TempDir(), "missing"))
+	if err != nil || len(k.hosts) != 0 {
+		t.Errorf("loadKnownHosts of a missing file = %v, %v, want no hosts", k, err)
+	}
+}
+
+// The first certificate seen at an address is recorded and accepted again,
+// while a different one is refused, also after reloading the file
+func TestKnownHostsHandshake(t *testing.T) {
+	captureLog(t, slog.LevelInfo)
+	server := newTestCert(t, "server", nil, false)
+	impostor := newTestCert(t, "server", nil, false)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	k, err := loadKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &clientConfig{address: "files.example.com:8080", knownHosts: k}
+	if !verifiesServer(cfg) {
+		t.Error("verifiesServer = false with known hosts")
+	}
+
+	for i := range 2 {
+		if err := testClientHandshake(t, cfg, server.tlsCertificate()); err != nil {
+			t.Fatalf("handshake %d: %v", i+1, err)
+		}
+	}
+	want := cfg.address + " " + hex.EncodeToString(publicKeyPin(server.cert)) + "\n"
+	if data, _ := os.ReadFile(path); string(data) != want {
+		t.Errorf("known hosts file = %q, want %q", data, want)
+	}
+	if err := testClientHandshake(t, cfg, impostor.tlsCertificate()); !errors.Is(err, ErrServerChanged) {
+		t.Errorf("changed certificate: handshake error = %v, want ErrServerChanged", err)
+	}
+
+	if cfg.knownHosts, err = loadKnownHosts(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := testClientHandshake(t, cfg, impostor.tlsCertificate()); !errors.Is(err, ErrServerChanged) {
+		t.Errorf("changed certificate after reload: handshake error = %v, want ErrServerChanged", err)
+	}
+	other := &clientConfig{address: "backup.example.com:8080", knownHosts: cfg.knownHosts}
+	if err := testClientHandshake(t, other, impostor.tlsCertificate()); err != nil {
+		t.Errorf("new address: handshake error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 2 {
+		t.Errorf("known hosts file = %q, want 2 lines", data)
+	}
+}
+
+// Sending logs the server's fingerprint and records it on first use only
+func TestKnownHostsSend(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key, KnownHosts: "known_hosts"}
+	for i := range 2 {
+		if err := client.Send("a.txt"); err != nil {
+			t.Fatalf("Send %d: %v", i+1, err)
+		}
+	}
+	if n := strings.Count(logs.String(), "Trusting the server on first use"); n != 1 {
+		t.Errorf("first-use warning logged %d times, want 1:\n%s", n, logs)
+	}
+	if n := strings.Count(logs.String(), "Connected to server"); n != 2 {
+		t.Errorf("fingerprint logged %d times, want once per Send:\n%s", n, logs)
+	}
+	if strings.Contains(logs.String(), "NOT verified") {
+		t.Errorf("unverified warning logged with known hosts:\n%s", logs)
+	}
+	data, err := os.ReadFile("known_hosts")
+	if err != nil || !strings.HasPrefix(string(data), srv.Addr+" ") {
+		t.Errorf("known hosts file = %q, %v", data, err)
+	}
+}
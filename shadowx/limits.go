@@ -0,0 +1,85 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Why an upload past the server's limits is refused, which is also the
+// reason the client is given
+var (
+	errFileTooLarge = errors.New("file too large")
+	errOverBudget   = errors.New("session exceeds the server's disk budget")
+)
+
+// Most bytes an upload resuming at offset may bring in a session that has
+// stored used bytes already, and the error for going past it. A negative
+// limit means there's none.
+func (cfg *serverConfig) uploadLimit(offset, used int64) (int64, error) {
+	limit, err := int64(-1), error(nil)
+	if cfg.maxFileSize > 0 {
+		limit, err = max(cfg.maxFileSize-offset, 0), errFileTooLarge
+	}
+	if left := max(cfg.maxDisk-used, 0); cfg.maxDisk > 0 && (limit < 0 || left < limit) {
+		limit, err = left, errOverBudget
+	}
+	return limit, err
+}
+
+// Whether an upload of size bytes is refused before it's received: it
+// declares more than the server's limits leave room for
+func (cfg *serverConfig) exceedsLimit(size, used int64) (bool, error) {
+	limit, err := cfg.uploadLimit(0, used)
+	return limit >= 0 && size > limit, err
+}
+
+// Why an upload of size bytes, -1 when unknown, is refused for lack of room
+// on the output volume: storing what it brings past offset, where a resumed
+// or appended upload starts, would leave less free than the reserve. Empty
+// when it fits, or when the free space can't be told.
+func (cfg *serverConfig) noSpace(size, offset int64) string {
+	if cfg.sink() != "" {
+		return ""
+	}
+	free, err := freeSpace(cfg.outDir)
+	if err != nil {
+		return ""
+	}
+	if need := max(size-offset, 0) + cfg.reserve; free < need {
+		return fmt.Sprintf("NO SPACE: %d bytes needed with the reserve, %d free", need, free)
+	}
+	return ""
+}
+
+// Wrap r to fail with err as soon as it brings more than limit bytes, so an
+// upload that doesn't say how large it is, or says less than it sends, can't
+// fill the disk. A negative limit leaves r as it is.
+func capReader(r io.Reader, limit int64, err error) io.Reader {
+	if limit < 0 {
+		return r
+	}
+	return &cappedReader{r: r, left: limit, err: err}
+}
+
+type cappedReader struct {
+	r    io.Reader
+	left int64
+	err  error
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.left < 0 {
+		return 0, c.err
+	}
+	// One byte past the limit is enough to know it's exceeded
+	if int64(len(p)) > c.left+1 {
+		p = p[:c.left+1]
+	}
+	n, err := c.r.Read(p)
+	c.left -= int64(n)
+	if c.left < 0 {
+		return n - 1, c.err
+	}
+	return n, err
+}
@@ -0,0 +1,238 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCapReader(t *testing.T) {
+	tests := []struct {
+		data  string
+		limit int64
+		err   error
+	}{
+		{"hello", -1, nil},
+		{"hello", 5, nil},
+		{"hello", 10, nil},
+		{"hello", 4, errFileTooLarge},
+		{"hello", 0, errFileTooLarge},
+		{"", 0, nil},
+	}
+	for _, tt := range tests {
+		got, err := io.ReadAll(capReader(strings.NewReader(tt.data), tt.limit, errFileTooLarge))
+		if err != tt.err {
+			t.Errorf("%q capped at %d: err %v, want %v", tt.data, tt.limit, err, tt.err)
+		}
+		if tt.err == nil && string(got) != tt.data {
+			t.Errorf("%q capped at %d: read %q", tt.data, tt.limit, got)
+		}
+		if tt.limit >= 0 && int64(len(got)) > tt.limit {
+			t.Errorf("%q capped at %d: read %d bytes", tt.data, tt.limit, len(got))
+		}
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	tests := []struct {
+		maxFileSize, maxDisk, offset, used int64
+		limit                              int64
+		err                                error
+	}{
+		{0, 0, 0, 0, -1, nil},
+		{100, 0, 0, 0, 100, errFileTooLarge},
+		{100, 0, 40, 0, 60, errFileTooLarge},
+		{100, 0, 140, 0, 0, errFileTooLarge},
+		{0, 100, 0, 30, 70, errOverBudget},
+		{0, 100, 0, 130, 0, errOverBudget},
+		{100, 50, 0, 0, 50, errOverBudget},
+		{100, 500, 0, 450, 50, errOverBudget},
+		{100, 500, 0, 300, 100, errFileTooLarge},
+	}
+	for _, tt := range tests {
+		cfg := &serverConfig{maxFileSize: tt.maxFileSize, maxDisk: tt.maxDisk}
+		if limit, err := cfg.uploadLimit(tt.offset, tt.used); limit != tt.limit || err != tt.err {
+			t.Errorf("%+v: uploadLimit = %d, %v; want %d, %v", tt, limit, err, tt.limit, tt.err)
+		}
+	}
+}
+
+// Uploads past -max-file-size are refused when they declare their size and
+// cut off when they don't, and nothing of them is left on disk
+func TestHandleConnectionMaxFileSize(t *testing.T) {
+	data := strings.Repeat("x", 1000)
+	tests := []struct {
+		name    string
+		payload string
+		reply   string
+		err     error
+	}{
+		{"declared", "upload big.txt\tsize=1000\n" + data, "REJECTED file too large\n", nil},
+		{"undeclared", "upload big.txt\n" + data, "", errFileTooLarge},
+		{"understated", "upload big.txt\tsize=10\n" + data, "", errFileTooLarge},
+		{"resumable", "upload big.txt\tsize=10\tsha256=" + strings.Repeat("0", 64) + "\tresume=new\n" + data, "", errFileTooLarge},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), maxFileSize: 100}
+		replies, err := testSessionErr(t, cfg, tt.payload)
+		if tt.reply != "" && replies != tt.reply {
+			t.Errorf("%s: replies %q, want %q", tt.name, replies, tt.reply)
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: handleConnection = %v, want %v", tt.name, err, tt.err)
+		}
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				t.Errorf("%s: left %s behind", tt.name, path)
+			}
+			return nil
+		})
+	}
+
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), maxFileSize: 100}
+	if replies := testSession(t, cfg, "upload fits.txt\n"+data[:100]); !strings.HasPrefix(replies, "OK ") {
+		t.Errorf("upload at the limit: replies %q", replies)
+	}
+}
+
+// A session stores files until -max-disk is used up and refuses the rest
+func TestHandleConnectionSessionMaxDisk(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), maxDisk: 25}
+	conn, reader, done := dialTestServer(t, cfg)
+
+	var session bytes.Buffer
+	session.WriteString("session 1\n")
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeFrameHeader(&session, request{verb: "upload", name: name}, 10)
+		session.WriteString(strings.Repeat("x", 10))
+	}
+	writeSessionEnd(&session)
+	if _, err := conn.Write(session.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	readLine(t, reader)
+	for _, want := range []string{"OK ", "OK ", "REJECTED session exceeds the server's disk budget"} {
+		if got := readLine(t, reader); !strings.HasPrefix(got, want) {
+			t.Errorf("reply %q, want prefix %q", got, want)
+		}
+	}
+	readLine(t, reader)
+	if err := <-done; err != nil {
+		t.Errorf("handleConnection: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.txt")); err == nil {
+		t.Error("file past the budget was stored")
+	}
+}
+
+// A client sending a file past the limit is told why and the server keeps
+// nothing of it
+func TestClientSendMaxFileSize(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("big.bin", bytes.Repeat([]byte("x"), 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MaxFileSize: 64 << 10}
+	startTestServer(t, srv)
+
+	err := (&Client{Addr: srv.Addr, Key: srv.Key}).Send("big.bin")
+	if err == nil || !strings.Contains(err.Error(), "file too large") {
+		t.Errorf("Send = %v, want a file too large rejection", err)
+	}
+	if entries, _ := os.ReadDir(DefaultOutDir); len(entries) != 0 {
+		t.Errorf("output directory holds %d entries, want none", len(entries))
+	}
+}
+
+// Uploads that would leave less free on the output volume than -reserve are
+// refused before any data is written
+func TestHandleConnectionNoSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("free space unavailable: %v", err)
+	}
+	tests := []struct {
+		name    string
+		reserve int64
+		payload string
+		reply   string
+	}{
+		{"fits", 0, "upload a.txt\tsize=5\nhello", "OK "},
+		{"larger than the disk", 0, "upload a.txt\tsize=" + strconv.FormatInt(free+1<<40, 10) + "\nhello", "REJECTED NO SPACE: "},
+		{"into the reserve", free + 1<<40, "upload a.txt\tsize=5\nhello", "REJECTED NO SPACE: "},
+		{"undeclared into the reserve", free + 1<<40, "upload a.txt\nhello", "REJECTED NO SPACE: "},
+		{"chunked into the reserve", free + 1<<40, "chunked a.txt\tsize=5\n", "REJECTED NO SPACE: "},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), reserve: tt.reserve}
+		if replies := testSession(t, cfg, tt.payload); !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("%s: replies %q, want %q", tt.name, replies, tt.reply)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a.txt")); (err == nil) != (tt.reply == "OK ") {
+			t.Errorf("%s: stored %v", tt.name, err == nil)
+		}
+	}
+}
+
+// An append only needs room for the bytes it adds to the stored file, not
+// for the whole file it declares
+func TestHandleConnectionNoSpaceAppend(t *testing.T) {
+	const existing = 16 << 20
+	tests := []struct {
+		name  string
+		slack int64 // free bytes left above the reserve
+		reply string
+	}{
+		{"fits past the stored part", existing / 2, "OK "},
+		{"doesn't fit", -1 << 40, "REJECTED NO SPACE: "},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		stored := filepath.Join(dir, "log.txt")
+		// Sparse, so the stored part takes no room itself
+		if err := os.WriteFile(stored, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(stored, existing); err != nil {
+			t.Fatal(err)
+		}
+		free, err := freeSpace(dir)
+		if err != nil {
+			t.Skipf("free space unavailable: %v", err)
+		}
+		hasher := sha256.New()
+		hasher.Write(make([]byte, existing))
+		hasher.Write([]byte("hello"))
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), reserve: free - tt.slack}
+		request := "upload log.txt\tappend=1\tsize=" + strconv.Itoa(existing+5) + "\tsha256=" + hex.EncodeToString(hasher.Sum(nil)) + "\nhello"
+		if replies := testSession(t, cfg, request); !strings.Contains(replies, tt.reply) {
+			t.Errorf("%s: replies %q, want %q", tt.name, replies, tt.reply)
+		}
+		want := int64(existing)
+		if tt.reply == "OK " {
+			want += 5
+		}
+		info, err := os.Stat(stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != want {
+			t.Errorf("%s: stored file is %d bytes, want %d", tt.name, info.Size(), want)
+		}
+	}
+}
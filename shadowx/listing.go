@@ -0,0 +1,213 @@
+package shadowx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An entry of a directory listed on the server
+type RemoteFile struct {
+	Name    string
+	Type    string // "file", "dir", "link" or "other"
+	Size    int64  // bytes of a file's content, -1 when unreadable; 0 for other types
+	ModTime time.Time
+}
+
+// Answer a "list <dir>" request, where dir is relative to the root and "."
+// is the root itself, with "OK", then one line per entry, sorted by name,
+// and an empty line:
+//
+//	<type>\t<size>\t<mtime>\t<name>
+//
+// type is file, dir, link or other, size is a file's content in bytes, 0
+// for other types, and
+// mtime is in RFC 3339 with nanoseconds. BYE follows. Entries the server
+// wouldn't hand back, such as dot files, are left out.
+func sendListing(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "listing is not supported when writing to the "+cfg.sink())
+		return nil
+	}
+	if cfg.hashNames {
+		rejectUpload(conn, log, "listing is not supported with hashed names")
+		return nil
+	}
+	dir, reason := listedDir(cfg, req.name)
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not read directory\n")
+		return fmt.Errorf("listing directory: %w", err)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("OK\n")
+	listed := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") || validRequestName(entry.Name()) != nil || isWithin(cfg.uploads.dir, path) || cfg.isTLSFile(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed since the directory was read
+		}
+		file := RemoteFile{Name: entry.Name(), Type: fileType(info.Mode()), Size: info.Size(), ModTime: info.ModTime()}
+		if file.Type != "file" {
+			file.Size = 0
+		} else if cfg.storage != nil {
+			file.Size = storedSize(cfg, path)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", file.Type, file.Size, file.ModTime.UTC().Format(time.RFC3339Nano), file.Name)
+		listed++
+	}
+	w.WriteString("\n")
+	stats := sessionStats{Duration: time.Since(start).Round(time.Millisecond)}
+	fmt.Fprintf(w, "BYE %s\n", stats)
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("sending listing: %w", err)
+	}
+	log.Info("Listed directory", "dir", dir, "entries", listed)
+	return nil
+}
+
+// The directory a list request names, or the reason to refuse it. Symbolic
+// links are followed only while they stay under the root.
+func listedDir(cfg *serverConfig, name string) (string, string) {
+	if err := validStoredName(name); err != nil {
+		return "", "unsafe directory name"
+	}
+	dir := filepath.Join(cfg.outDir, name)
+	if !isWithinOrAt(cfg.outDir, dir) {
+		return "", "directory name escapes the output directory"
+	}
+	for _, part := range strings.FieldsFunc(name, isSeparator) {
+		if strings.HasPrefix(part, ".") && part != "." {
+			return "", "no such directory"
+		}
+	}
+	if isWithin(cfg.uploads.dir, dir) {
+		return "", "no such directory"
+	}
+	root, err := filepath.EvalSymlinks(cfg.outDir)
+	if err != nil {
+		return "", "could not read directory"
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "no such directory"
+	}
+	if err != nil || !isWithinOrAt(root, resolved) {
+		return "", "directory is outside the output directory"
+	}
+	if info, err := os.Stat(resolved); err != nil || !info.IsDir() {
+		return "", "not a directory"
+	}
+	return resolved, ""
+}
+
+// Whether path is root or below it
+func isWithinOrAt(root, path string) bool {
+	return filepath.Clean(root) == filepath.Clean(path) || isWithin(root, path)
+}
+
+// The listed type of a file with mode
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "link"
+	}
+	return "other"
+}
+
+// The size of a stored file's content, -1 when it can't be read
+func storedSize(cfg *serverConfig, path string) int64 {
+	file, size, err := openStored(cfg, path)
+	if err != nil {
+		return -1
+	}
+	file.Close()
+	return size
+}
+
+// List the directory the server stores as dir, "." for its root
+func listRemote(cfg *clientConfig, dir string) ([]RemoteFile, error) {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "list", name: dir}); err != nil {
+		return nil, fmt.Errorf("sending list request: %w", err)
+	}
+	reader := conn.reader
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("connection closed before the server answered")
+	}
+	if status = strings.TrimSpace(status); status != "OK" {
+		// Servers that predate listing close the connection without a word
+		reason, ok := strings.CutPrefix(status, "REJECTED ")
+		if !ok {
+			reason = "the server doesn't support it"
+		}
+		return nil, fmt.Errorf("listing refused: %s", reason)
+	}
+
+	var files []RemoteFile
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, errors.New("connection closed before the listing ended")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		file, err := parseListEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("connection closed without a goodbye from the server")
+	}
+	if _, err := parseBye(strings.TrimSpace(line)); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Parse a line of a listing
+func parseListEntry(line string) (RemoteFile, error) {
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) != 4 || fields[3] == "" {
+		return RemoteFile{}, fmt.Errorf("malformed listing entry %q", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("bad size in listing entry %q", line)
+	}
+	modTime, err := time.Parse(time.RFC3339Nano, fields[2])
+	if err != nil {
+		return RemoteFile{}, fmt.Errorf("bad time in listing entry %q", line)
+	}
+	return RemoteFile{Name: fields[3], Type: fields[0], Size: size, ModTime: modTime}, nil
+}
@@ -0,0 +1,126 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseListEntry(t *testing.T) {
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		line string
+		want RemoteFile
+		ok   bool
+	}{
+		{"file\t12\t2026-01-02T03:04:05.000000006Z\ta.txt", RemoteFile{Name: "a.txt", Type: "file", Size: 12, ModTime: mtime}, true},
+		{"dir\t0\t2026-01-02T03:04:05.000000006Z\tsub dir", RemoteFile{Name: "sub dir", Type: "dir", ModTime: mtime}, true},
+		{"file\t-1\t2026-01-02T03:04:05.000000006Z\tunreadable", RemoteFile{Name: "unreadable", Type: "file", Size: -1, ModTime: mtime}, true},
+		{"file\t12\t2026-01-02T03:04:05Z", RemoteFile{}, false},
+		{"file\t12\t2026-01-02T03:04:05Z\t", RemoteFile{}, false},
+		{"file\tbig\t2026-01-02T03:04:05Z\ta.txt", RemoteFile{}, false},
+		{"file\t12\tyesterday\ta.txt", RemoteFile{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseListEntry(tt.line)
+		if (err == nil) != tt.ok || err == nil && (got.Name != tt.want.Name || got.Type != tt.want.Type || got.Size != tt.want.Size || !got.ModTime.Equal(tt.want.ModTime)) {
+			t.Errorf("parseListEntry(%q) = %+v, %v; want %+v, ok %v", tt.line, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// Listings show what clients could download, and nothing outside the root
+func TestServerList(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	outside := t.TempDir()
+	for _, dir := range []string{"docs/sub", ".hidden"} {
+		if err := os.MkdirAll(filepath.Join(DefaultOutDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{"a.txt": "hello", "docs/b.txt": "hi", ".secret": "s", ".hidden/c.txt": "c"} {
+		if err := os.WriteFile(filepath.Join(DefaultOutDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"alias": "docs", "escape": outside} {
+		if err := os.Symlink(target, filepath.Join(DefaultOutDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+
+	tests := []struct {
+		dir    string
+		want   string
+		reason string
+	}{
+		{".", "a.txt file 5, alias link 0, docs dir 0, escape link 0", ""},
+		{"/", "a.txt file 5, alias link 0, docs dir 0, escape link 0", ""},
+		{"docs", "b.txt file 2, sub dir 0", ""},
+		{"alias", "b.txt file 2, sub dir 0", ""},
+		{"docs/sub", "", ""},
+		{"escape", "", "directory is outside the output directory"},
+		{"../", "", "unsafe directory name"},
+		{".hidden", "", "no such directory"},
+		{"missing", "", "no such directory"},
+		{"a.txt", "", "not a directory"},
+	}
+	for _, tt := range tests {
+		files, err := client.List(tt.dir)
+		if tt.reason != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.reason) {
+				t.Errorf("List(%q) = %v, want refused with %q", tt.dir, err, tt.reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("List(%q): %v", tt.dir, err)
+			continue
+		}
+		var got []string
+		for _, f := range files {
+			got = append(got, fmt.Sprintf("%s %s %d", f.Name, f.Type, f.Size))
+			if time.Since(f.ModTime) > time.Hour {
+				t.Errorf("List(%q): %s modified at %v", tt.dir, f.Name, f.ModTime)
+			}
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("List(%q) = %s, want %s", tt.dir, strings.Join(got, ", "), tt.want)
+		}
+	}
+}
+
+// Encrypted files are listed with the size of their content, and servers
+// without stored names to show refuse to list
+func TestServerListSizes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, StorageKey: "storage-key"}
+	startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	files, err := client.List(".")
+	if err != nil || len(files) != 1 || files[0].Size != 5 {
+		t.Errorf("List = %+v, %v; want a.txt of 5 bytes", files, err)
+	}
+
+	hashed := &Server{Key: "test-key", OutDir: "hashed", CreateOutDir: true, HashNames: true, ManifestPath: "manifest.jsonl"}
+	startTestServer(t, hashed)
+	client = &Client{Addr: hashed.Addr, Key: hashed.Key}
+	if _, err := client.List("."); err == nil || !strings.Contains(err.Error(), "not supported with hashed names") {
+		t.Errorf("List with hashed names = %v, want refused", err)
+	}
+}
@@ -0,0 +1,124 @@
+package shadowx
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// The package logs through slog's default logger, so programs choose the
+// handler and level with slog.SetDefault. Server lines for a connection
+// carry the client's address as "remote".
+
+// Whether live progress counters are shown. They aren't log records, so
+// they follow the level of routine output: hidden when only errors are logged.
+func showProgress() bool {
+	return slog.Default().Enabled(context.Background(), slog.LevelInfo)
+}
+
+// Whether standard output is a terminal, where the live counter redraws its
+// line in place. Redirected to a file or a CI log it prints a line every
+// progressLogInterval instead. A variable so tests can fake either.
+var stdoutIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// End the line of a live progress counter, so the next log line doesn't run
+// into it
+func breakProgress() {
+	if showProgress() && stdoutIsTerminal() {
+		fmt.Println()
+	}
+}
+
+// Whether sends show a live progress counter: files sent in parallel get a
+// summary line instead, which doesn't garble, and a ProgressFunc or JSON
+// events replace it
+func (cfg *clientConfig) liveProgress() bool {
+	return cfg.parallel <= 1 && cfg.progress == nil && cfg.events == nil && showProgress()
+}
+
+// The live progress counter of a transfer, as in "Received: 512/1024 bytes
+// (50.00%) at 1.00 MB/s", leaving out the total when it isn't known
+func progressLine(verb string, done, total int64, rate string) string {
+	if total > 0 {
+		return fmt.Sprintf("\r%s: %d/%d bytes (%.2f%%) at %s", verb, done, total, float64(done)/float64(total)*100, rate)
+	}
+	return fmt.Sprintf("\r%s: %d bytes at %s", verb, done, rate)
+}
+
+// How often a transfer reports progress while it runs
+const progressInterval = 100 * time.Millisecond
+
+// How often the live counter prints a line when standard output isn't a
+// terminal
+const progressLogInterval = 5 * time.Second
+
+// Reports the progress of one transfer to a ProgressFunc, or to the live
+// counter, at most every progressInterval so fast transfers don't spend
+// their time reporting. A nil meter reports nothing.
+type progressMeter struct {
+	fn       func(file string, done, total int64)
+	file     string
+	total    int64
+	last     time.Time
+	interval time.Duration
+	live     bool // fn redraws the live counter's line, which ends with the transfer
+}
+
+// Report a transfer of total bytes, -1 when unknown, to fn, or when fn is
+// nil and live is set, to the live counter labelled verb. offset bytes were
+// delivered earlier and don't count towards the rate.
+func newProgressMeter(fn func(file string, done, total int64), live bool, verb, file string, total, offset int64) *progressMeter {
+	m := &progressMeter{fn: fn, file: file, total: total, last: time.Now(), interval: progressInterval}
+	if fn == nil {
+		if !live {
+			return nil
+		}
+		start := m.last
+		m.live = stdoutIsTerminal()
+		m.fn = func(_ string, done, total int64) {
+			line := progressLine(verb, done, total, throughput(done-offset, start))
+			if m.live {
+				fmt.Print(line)
+			} else {
+				fmt.Println(strings.TrimPrefix(line, "\r"))
+			}
+		}
+		if !m.live {
+			m.interval = progressLogInterval
+		}
+	}
+	return m
+}
+
+// Report done bytes when the interval has passed since the last report
+func (m *progressMeter) update(done int64) {
+	if m == nil || time.Since(m.last) < m.interval {
+		return
+	}
+	m.last = time.Now()
+	m.fn(m.file, done, m.total)
+}
+
+// Report the final count, ending the live counter's line
+func (m *progressMeter) finish(done int64) {
+	if m == nil {
+		return
+	}
+	m.fn(m.file, done, m.total)
+	if m.live {
+		fmt.Println()
+	}
+}
+
+// Report an upload stored as file, of size bytes with offset received
+// earlier, to the server's ProgressFunc or its live counter
+func (cfg *serverConfig) progressMeter(file string, offset, size int64) *progressMeter {
+	return newProgressMeter(cfg.progress, showProgress(), "Received", file, size, offset)
+}
@@ -0,0 +1,246 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Log to a buffer at level for the rest of the test
+func captureLog(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var b bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{Level: level})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &b
+}
+
+// Every line the server logs for a connection names the client, and the
+// level decides which lines appear
+func TestServerLogLevels(t *testing.T) {
+	tests := []struct {
+		level   slog.Level
+		want    []string
+		missing []string
+	}{
+		{slog.LevelDebug, []string{"level=DEBUG", `msg="Client connected"`, `msg="File received successfully"`}, nil},
+		{slog.LevelInfo, []string{`msg="File received successfully"`}, []string{"level=DEBUG"}},
+		{slog.LevelError, nil, []string{"level=DEBUG", "level=INFO"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			logged := captureLog(t, tt.level)
+			dir := t.TempDir()
+			cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+			conn, _, done := dialTestServer(t, cfg)
+			if _, err := conn.Write([]byte("upload a.txt\tsize=5\nhello")); err != nil {
+				t.Fatal(err)
+			}
+			conn.CloseWrite()
+			if err := <-done; err != nil {
+				t.Fatalf("handleConnection: %v", err)
+			}
+
+			remote := "remote=" + conn.LocalAddr().String()
+			for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+				if line != "" && !strings.Contains(line, remote) {
+					t.Errorf("line %q lacks %s", line, remote)
+				}
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logged.String(), want) {
+					t.Errorf("log lacks %s:\n%s", want, logged)
+				}
+			}
+			for _, missing := range tt.missing {
+				if strings.Contains(logged.String(), missing) {
+					t.Errorf("log has %s:\n%s", missing, logged)
+				}
+			}
+		})
+	}
+}
+
+func TestShowProgress(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  bool
+	}{
+		{slog.LevelDebug, true},
+		{slog.LevelInfo, true},
+		{slog.LevelWarn, false},
+		{slog.LevelError, false},
+	}
+	for _, tt := range tests {
+		captureLog(t, tt.level)
+		if got := showProgress(); got != tt.want {
+			t.Errorf("showProgress() at %s = %v, want %v", tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	tests := []struct {
+		done, total int64
+		want        string
+	}{
+		{512, 1024, "\rReceived: 512/1024 bytes (50.00%) at 1.00 KB/s"},
+		{1024, 1024, "\rReceived: 1024/1024 bytes (100.00%) at 1.00 KB/s"},
+		{512, -1, "\rReceived: 512 bytes at 1.00 KB/s"},
+		{0, 0, "\rReceived: 0 bytes at 1.00 KB/s"},
+	}
+	for _, tt := range tests {
+		if got := progressLine("Received", tt.done, tt.total, "1.00 KB/s"); got != tt.want {
+			t.Errorf("progressLine(%d, %d) = %q, want %q", tt.done, tt.total, got, tt.want)
+		}
+	}
+}
+
+// The server's counter shows the declared size, counting what a resumed
+// upload already delivered
+func TestReceiveFileProgress(t *testing.T) {
+	captureLog(t, slog.LevelInfo)
+	fakeTerminal(t, true)
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = saved }()
+
+	var dest bytes.Buffer
+	if _, err := receiveFile(strings.NewReader("world"), &dest, sha256.New(), 0, (&serverConfig{}).progressMeter("a.txt", 6, 11), nil, 6); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = saved
+	printed, _ := os.ReadFile(out.Name())
+	if want := "\rReceived: 11/11 bytes (100.00%) at "; !strings.HasPrefix(string(printed), want) {
+		t.Errorf("progress %q, want prefix %q", printed, want)
+	}
+}
+
+// Make stdoutIsTerminal report tty until the test ends
+func fakeTerminal(t *testing.T, tty bool) {
+	t.Helper()
+	saved := stdoutIsTerminal
+	stdoutIsTerminal = func() bool { return tty }
+	t.Cleanup(func() { stdoutIsTerminal = saved })
+}
+
+// Redirected output gets whole lines every progressLogInterval instead of a
+// counter redrawn with carriage returns
+func TestProgressNotTerminal(t *testing.T) {
+	for _, tty := range []bool{true, false} {
+		captureLog(t, slog.LevelInfo)
+		fakeTerminal(t, tty)
+		out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := os.Stdout
+		os.Stdout = out
+
+		meter := newProgressMeter(nil, true, "Sent", "a.txt", 100, 0)
+		meter.last = time.Now().Add(-progressInterval)
+		meter.update(25) // due on a terminal only
+		meter.last = time.Now().Add(-progressLogInterval)
+		meter.update(50)
+		meter.finish(100)
+		os.Stdout = saved
+		printed, _ := os.ReadFile(out.Name())
+
+		lines := strings.Split(strings.TrimSuffix(string(printed), "\n"), "\n")
+		if tty {
+			if len(lines) != 1 || strings.Count(lines[0], "\r") != 3 {
+				t.Errorf("on a terminal printed %q, want three redraws of one line", printed)
+			}
+			continue
+		}
+		if strings.Contains(string(printed), "\r") || len(lines) != 2 ||
+			!strings.HasPrefix(lines[0], "Sent: 50/100 bytes (50.00%) at ") || !strings.HasPrefix(lines[1], "Sent: 100/100 bytes (100.00%) at ") {
+			t.Errorf("redirected printed %q, want a line at 50 and one at 100 bytes", printed)
+		}
+	}
+}
+
+// However fast the updates come, a meter reports at most every interval,
+// and always the final count
+func TestProgressMeter(t *testing.T) {
+	var calls []int64
+	meter := newProgressMeter(func(file string, done, total int64) {
+		if file != "a.txt" || total != 1000 {
+			t.Errorf("reported %s of %d bytes, want a.txt of 1000", file, total)
+		}
+		calls = append(calls, done)
+	}, false, "Sent", "a.txt", 1000, 0)
+	start := time.Now()
+	for done := int64(1); done <= 1000; done++ {
+		meter.update(done)
+	}
+	meter.finish(1000)
+	if max := int(time.Since(start)/progressInterval) + 1; len(calls) > max {
+		t.Errorf("reported %d times in %v, want at most %d", len(calls), time.Since(start), max)
+	}
+	if len(calls) == 0 || calls[len(calls)-1] != 1000 {
+		t.Errorf("reports %v, want the final count last", calls)
+	}
+
+	if meter := newProgressMeter(nil, false, "Sent", "a.txt", 1000, 0); meter != nil {
+		t.Error("meter without a ProgressFunc or live counter isn't nil")
+	}
+}
+
+// A ProgressFunc on either side hears of the finished transfer and replaces
+// the live counter
+func TestProgressFunc(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = saved }()
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	reports := make(map[string]string)
+	report := func(side string) func(string, int64, int64) {
+		return func(file string, done, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			reports[side] = fmt.Sprintf("%s %d/%d", filepath.Base(file), done, total)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ProgressFunc: report("server")}
+	stop := startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, ProgressFunc: report("client")}
+	if err := client.Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	os.Stdout = saved
+
+	for side, want := range map[string]string{"client": "a.txt 5/5", "server": "a.txt 5/5"} {
+		if reports[side] != want {
+			t.Errorf("%s reported %q, want %q", side, reports[side], want)
+		}
+	}
+	if printed, _ := os.ReadFile(out.Name()); strings.Contains(string(printed), "\r") {
+		t.Errorf("live counter shown alongside the ProgressFunc: %q", printed)
+	}
+}
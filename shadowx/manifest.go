@@ -0,0 +1,54 @@
+package shadowx
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Append-only JSON lines log of received files, readable by the server owner only
+type manifest struct {
+	mu   sync.Mutex
+	path string
+}
+
+// A single manifest record
+type manifestEntry struct {
+	Time      time.Time  `json:"time"`
+	Remote    string     `json:"remote"`
+	Name      string     `json:"name"`
+	Stored    string     `json:"stored"`
+	Bytes     int64      `json:"bytes"`
+	SHA256    string     `json:"sha256"`
+	Trace     string     `json:"trace,omitempty"`
+	Btime     *time.Time `json:"btime,omitempty"`     // creation time on the client, when sent
+	Immutable string     `json:"immutable,omitempty"` // write-once protection applied with -immutable
+}
+
+// Append an entry to the manifest
+func (m *manifest) record(entry manifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Name a file is stored under when filename hashing is enabled. The hash is
+// keyed so likely filenames can't be recovered by hashing guesses.
+func hashedName(key, filename string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(filename))
+	return hex.EncodeToString(mac.Sum(nil)) + ".dat"
+}
@@ -0,0 +1,40 @@
+package shadowx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashedName(t *testing.T) {
+	a := hashedName("key1", "report.pdf")
+	if a != hashedName("key1", "report.pdf") {
+		t.Fatal("hashedName is not deterministic")
+	}
+	if !strings.HasSuffix(a, ".dat") || len(a) != 64+len(".dat") {
+		t.Errorf("hashedName = %q, want 64 hex digits plus .dat", a)
+	}
+	if a == hashedName("key2", "report.pdf") {
+		t.Error("hashedName ignores the key")
+	}
+	if a == hashedName("key1", "report2.pdf") {
+		t.Error("different names map to the same stored name")
+	}
+}
+
+func TestCheckManifestPath(t *testing.T) {
+	tests := []struct {
+		manifest, out string
+		wantErr       bool
+	}{
+		{"", "intake", true},
+		{"intake/manifest.jsonl", "intake", true},
+		{"manifest.jsonl", ".", true},
+		{"manifest.jsonl", "intake", false},
+		{"/root/manifest.jsonl", "/srv/intake", false},
+	}
+	for _, tt := range tests {
+		if err := checkManifestPath(tt.manifest, tt.out); (err != nil) != tt.wantErr {
+			t.Errorf("checkManifestPath(%q, %q) error = %v, wantErr %v", tt.manifest, tt.out, err, tt.wantErr)
+		}
+	}
+}
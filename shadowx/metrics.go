@@ -0,0 +1,143 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in seconds, of the transfer duration histogram's buckets
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600}
+
+// Counters the server exposes on -metrics-addr. A nil *serverMetrics
+// records nothing, so the transfer path only pays for a nil check when
+// metrics are off.
+type serverMetrics struct {
+	connections  atomic.Int64 // connections past any TLS handshake
+	authFailures atomic.Int64
+	bytes        atomic.Int64 // upload and diff bytes received
+	files        atomic.Int64 // files stored
+	active       atomic.Int64 // uploads being received
+
+	mu        sync.Mutex
+	durations []int64 // uploads per bucket of durationBuckets, the last for longer ones
+	sum       float64 // seconds spent receiving uploads
+}
+
+func (m *serverMetrics) connected() {
+	if m != nil {
+		m.connections.Add(1)
+	}
+}
+
+func (m *serverMetrics) authFailed() {
+	if m != nil {
+		m.authFailures.Add(1)
+	}
+}
+
+func (m *serverMetrics) received(bytes int64) {
+	if m != nil {
+		m.bytes.Add(bytes)
+	}
+}
+
+func (m *serverMetrics) stored() {
+	if m != nil {
+		m.files.Add(1)
+	}
+}
+
+// Count an upload as active until the returned function is called, which
+// records how long it took
+func (m *serverMetrics) transferStarted() (done func()) {
+	if m == nil {
+		return func() {}
+	}
+	m.active.Add(1)
+	start := time.Now()
+	return func() {
+		m.active.Add(-1)
+		m.observe(time.Since(start))
+	}
+}
+
+func (m *serverMetrics) observe(d time.Duration) {
+	seconds := d.Seconds()
+	bucket := len(durationBuckets)
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.durations == nil {
+		m.durations = make([]int64, len(durationBuckets)+1)
+	}
+	m.durations[bucket]++
+	m.sum += seconds
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (m *serverMetrics) write(w io.Writer) {
+	for _, c := range []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"shadowx_connections_total", "counter", "Connections handled, after any TLS handshake.", m.connections.Load()},
+		{"shadowx_auth_failures_total", "counter", "Connections that presented a wrong key.", m.authFailures.Load()},
+		{"shadowx_received_bytes_total", "counter", "Bytes of uploads and diffs received.", m.bytes.Load()},
+		{"shadowx_received_files_total", "counter", "Files received and stored.", m.files.Load()},
+		{"shadowx_active_transfers", "gauge", "Uploads being received.", m.active.Load()},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", c.name, c.help, c.name, c.kind, c.name, c.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const name = "shadowx_transfer_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to receive an upload.\n# TYPE %s histogram\n", name, name)
+	var count int64
+	for i, bound := range durationBuckets {
+		if m.durations != nil {
+			count += m.durations[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	if m.durations != nil {
+		count += m.durations[len(durationBuckets)]
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, count, name, strconv.FormatFloat(m.sum, 'g', -1, 64), name, count)
+}
+
+// Serve the metrics over plain HTTP at /metrics on cfg.metricsAddr, to the
+// clients -allow and -deny let in. Returns once listening; the server runs
+// until shut down.
+func startMetricsServer(cfg *serverConfig) (*http.Server, error) {
+	listener, err := net.Listen("tcp", cfg.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		cfg.metrics.write(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(filterListener{listener, cfg.clients}); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving metrics", "err", err)
+		}
+	}()
+	slog.Info("ShadowX metrics listening", "address", listener.Addr().String())
+	return server, nil
+}
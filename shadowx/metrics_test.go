@@ -0,0 +1,91 @@
+package shadowx
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := &serverMetrics{}
+	m.connected()
+	m.received(1024)
+	for _, d := range []time.Duration{50 * time.Millisecond, 2 * time.Second, 2 * time.Hour} {
+		m.observe(d)
+	}
+	var out strings.Builder
+	m.write(&out)
+	for _, want := range []string{
+		"# TYPE shadowx_connections_total counter\nshadowx_connections_total 1\n",
+		"shadowx_auth_failures_total 0\n",
+		"shadowx_received_bytes_total 1024\n",
+		"# TYPE shadowx_active_transfers gauge\nshadowx_active_transfers 0\n",
+		"# TYPE shadowx_transfer_duration_seconds histogram\n",
+		`shadowx_transfer_duration_seconds_bucket{le="0.1"} 1` + "\n",
+		`shadowx_transfer_duration_seconds_bucket{le="1"} 1` + "\n",
+		`shadowx_transfer_duration_seconds_bucket{le="5"} 2` + "\n",
+		`shadowx_transfer_duration_seconds_bucket{le="3600"} 2` + "\n",
+		`shadowx_transfer_duration_seconds_bucket{le="+Inf"} 3` + "\n",
+		"shadowx_transfer_duration_seconds_sum 7202.05\nshadowx_transfer_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, out.String())
+		}
+	}
+
+	var disabled *serverMetrics
+	disabled.connected()
+	disabled.received(1)
+	disabled.transferStarted()()
+}
+
+// Uploads and wrong keys show up on the metrics endpoint
+func TestServerMetrics(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsAddr := listener.Addr().String()
+	listener.Close()
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MetricsAddr: metricsAddr}
+	startTestServer(t, srv)
+
+	if err := (&Client{Addr: srv.Addr, Key: srv.Key}).Send("a.txt"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := (&Client{Addr: srv.Addr, Key: "wrong-key"}).Send("a.txt"); err == nil {
+		t.Fatal("Send with the wrong key succeeded")
+	}
+
+	resp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("GET /metrics: %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"shadowx_connections_total 2\n",
+		"shadowx_auth_failures_total 1\n",
+		"shadowx_received_bytes_total 5\n",
+		"shadowx_received_files_total 1\n",
+		"shadowx_active_transfers 0\n",
+		"shadowx_transfer_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package shadowx
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Whether path is a directory, following a link to one
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// Whether the directory at path holds nothing at all
+func isEmptyDir(path string) (bool, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != io.EOF {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ask the server to create the directory dirname, which sending its files
+// wouldn't because it has none
+func sendMkdir(cfg *clientConfig, dirname string) error {
+	name := cfg.remoteName(dirname)
+	if err := validRequestName(name); err != nil {
+		return err
+	}
+	req := request{verb: "mkdir", name: name}
+	if cfg.traceID != "" {
+		req.attrs = map[string]string{"trace": cfg.traceID}
+	}
+	stats, err := sendRecord(cfg, req)
+	if err != nil {
+		return err
+	}
+	slog.Info("Directory sent", "dir", dirname, "trace", stats.Trace)
+	return nil
+}
+
+// Answer a "mkdir <name>" request by creating the directory and any parents
+// under the output directory, replying OK and BYE. A directory that exists
+// already is fine; a file in its place is refused.
+func receiveMkdir(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	checked, reason := checkRequest(log, cfg, req)
+	switch {
+	case reason != "":
+	case cfg.sink() != "":
+		reason = "directories are not supported when writing to the " + cfg.sink()
+	case cfg.hashNames:
+		reason = "directories are not supported with hashed names"
+	}
+	var err error
+	if reason == "" {
+		reason, err = storeDir(cfg, checked.stored)
+	}
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return err
+	}
+	log.Info("Directory received", "dir", checked.stored, "trace", checked.trace)
+	fmt.Fprintf(conn, "OK\n")
+	stats := sessionStats{Duration: time.Since(start).Round(time.Millisecond), Trace: checked.trace}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return fmt.Errorf("sending goodbye: %w", err)
+	}
+	return nil
+}
+
+// Create the directory stored with its parents. Returns the reason to refuse
+// it, and the error behind that when the server is at fault.
+func storeDir(cfg *serverConfig, stored string) (string, error) {
+	root, err := filepath.EvalSymlinks(cfg.outDir)
+	if err != nil {
+		return "could not create directory", err
+	}
+	rel, err := filepath.Rel(cfg.outDir, stored)
+	if err != nil {
+		return "could not create directory", err
+	}
+	// The name may lead through links sent before, which must stay inside
+	dir := resolveLink(root, rel)
+	if !isWithinOrAt(root, dir) {
+		return "file name escapes the output directory", nil
+	}
+	if isWithinOrAt(realPath(cfg.uploads.dir), dir) || cfg.isTLSFile(dir) {
+		return "file name is reserved", nil
+	}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return "file already exists", nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "could not create directory", fmt.Errorf("creating directory: %w", err)
+	}
+	return "", nil
+}
@@ -0,0 +1,80 @@
+package shadowx
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The server creates directories with their parents, keeps existing ones and
+// refuses to put one in place of a file or outside the output directory
+func TestHandleConnectionMkdir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "up")); err != nil {
+		t.Skipf("can't create symlinks: %v", err)
+	}
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	tests := []struct {
+		request string
+		reply   string
+	}{
+		{"mkdir logs\n", "OK\n"},
+		{"mkdir logs\n", "OK\n"},
+		{"mkdir a/b/c\n", "OK\n"},
+		{"mkdir .cache\n", "OK\n"},
+		{"mkdir file.txt\n", "REJECTED file already exists\n"},
+		{"mkdir file.txt/sub\n", "REJECTED could not create directory\n"},
+		{"mkdir up/escaped\n", "REJECTED file name escapes the output directory\n"},
+		{"mkdir ../escaped\n", "REJECTED unsafe file name\n"},
+	}
+	for _, tt := range tests {
+		if replies := testSession(t, cfg, tt.request); !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("%q: replies %q, want %q", tt.request, replies, tt.reply)
+		}
+	}
+	for _, name := range []string{"logs", "a/b/c", ".cache"} {
+		if !isDir(filepath.Join(dir, name)) {
+			t.Errorf("%s wasn't created", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); err == nil {
+		t.Error("directory created outside the output directory")
+	}
+}
+
+// Empty directories in a tree, and an empty tree, exist on the server after
+// sending it, besides the files
+func TestClientSendEmptyDirs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	for _, d := range []string{"tree/logs", "tree/cache/a/b", "tree/src", "empty"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("tree/src/main.go", []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	for _, path := range []string{"tree", "empty"} {
+		if err := client.Send(path); err != nil {
+			t.Fatalf("Send %s: %v", path, err)
+		}
+	}
+	for _, name := range []string{"tree/logs", "tree/cache/a/b", "empty"} {
+		if !isDir(filepath.Join(DefaultOutDir, filepath.FromSlash(name))) {
+			t.Errorf("%s doesn't exist on the server", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(DefaultOutDir, "tree", "src", "main.go")); err != nil {
+		t.Errorf("file not sent: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package shadowx
+
+import (
+	"log/slog"
+	"os"
+)
+
+// What a file about to be sent with -move looks like, nil when it isn't one
+// that's deleted afterwards: only regular files are, not links, devices or
+// the directories they sit in
+func moveCandidate(filename string) os.FileInfo {
+	info, err := os.Lstat(filename)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return info
+}
+
+// Delete a file the server confirmed storing with a matching digest, unless
+// it changed since before it was sent, in which case the server's copy is
+// only a snapshot of it
+func removeSent(filename string, before os.FileInfo) {
+	after, err := os.Lstat(filename)
+	if err != nil {
+		slog.Error("Error checking sent file before removing it", "file", filename, "err", err)
+		return
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) || !os.SameFile(before, after) {
+		slog.Warn("File changed during transfer, not removing it", "file", filename)
+		return
+	}
+	if err := os.Remove(filename); err != nil {
+		slog.Error("Error removing sent file", "file", filename, "err", err)
+		return
+	}
+	slog.Info("Removed sent file", "file", filename)
+}
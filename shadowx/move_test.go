@@ -0,0 +1,47 @@
+package shadowx
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// With -move the files the server confirmed are deleted and those it
+// rejected are left as they were
+func TestClientSendMove(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	for name, data := range map[string][]byte{"src/small.txt": []byte("hello\n"), "src/big.bin": big} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MaxFileSize: 64 << 10}
+	startTestServer(t, srv)
+
+	err := (&Client{Addr: srv.Addr, Key: srv.Key, Move: true}).Send("src")
+	if err == nil || !strings.Contains(err.Error(), "file too large") {
+		t.Errorf("Send = %v, want a file too large rejection", err)
+	}
+	if _, err := os.Stat("src/small.txt"); !os.IsNotExist(err) {
+		t.Errorf("confirmed file still exists: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "src", "small.txt")); err != nil || string(got) != "hello\n" {
+		t.Errorf("server copy %q, %v", got, err)
+	}
+	if got, err := os.ReadFile("src/big.bin"); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("rejected file holds %d bytes, %v; want it intact", len(got), err)
+	}
+
+	err = (&Client{Addr: srv.Addr, Key: srv.Key, Move: true}).Send(stdinPath)
+	if err == nil || !strings.Contains(err.Error(), "-move") {
+		t.Errorf("Send of standard input = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,40 @@
+package shadowx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// Load a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Make the server require client certificates signed by a CA in caFile
+func requireClientCerts(tlsConfig *tls.Config, caFile string) error {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// Load the certificate a client presents to a server started with -client-ca
+func loadClientCert(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("-cert and -key must be given together")
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
@@ -0,0 +1,128 @@
+package shadowx
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A certificate and its key, signed by parent or self-signed when parent is nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// Write the certificate as PEM and return the file name
+func (c *testCert) writePEM(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCertPool(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	if _, err := loadCertPool(ca.writePEM(t)); err != nil {
+		t.Errorf("loadCertPool(valid bundle) = %v", err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate\n"), 0644)
+	for _, path := range []string{empty, empty + ".missing"} {
+		if _, err := loadCertPool(path); err == nil {
+			t.Errorf("loadCertPool(%s) succeeded", filepath.Base(path))
+		}
+	}
+}
+
+func TestRequireClientCerts(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	server := newTestCert(t, "server", nil, false)
+	trusted := newTestCert(t, "client", ca, false)
+	untrusted := newTestCert(t, "client", newTestCert(t, "other-ca", nil, true), false)
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}}
+	if err := requireClientCerts(serverConfig, ca.writePEM(t)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		wantOK bool
+	}{
+		{"trusted", []tls.Certificate{trusted.tlsCertificate()}, true},
+		{"untrusted", []tls.Certificate{untrusted.tlsCertificate()}, false},
+		{"none", nil, false},
+	}
+	for _, tt := range tests {
+		serverSide, clientSide := net.Pipe()
+		client := tls.Client(clientSide, &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs})
+		go func() {
+			// With TLS 1.3 the client learns of the rejection by reading
+			if client.Handshake() == nil {
+				client.Read(make([]byte, 1))
+			}
+			client.Close()
+		}()
+		err := tls.Server(serverSide, serverConfig).Handshake()
+		serverSide.Close()
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s client certificate: server handshake error = %v, want ok %v", tt.name, err, tt.wantOK)
+		}
+	}
+}
+
+func TestLoadClientCert(t *testing.T) {
+	if _, err := loadClientCert("client.crt", ""); err == nil {
+		t.Error("loadClientCert accepted a certificate without a key")
+	}
+}
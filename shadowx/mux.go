@@ -0,0 +1,493 @@
+package shadowx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A multiplexed connection carries several uploads at once, interleaving
+// their data and the server's replies. The client asks for it with a
+// "mux <version>" request and the server accepts with "MUX <version>".
+// From then on both sides only send frames:
+//
+//	uint8   frame type
+//	uint32  stream ID
+//	uint32  length of the payload
+//	bytes   the payload
+//
+// with integers big-endian. The client starts a stream with an open frame
+// whose payload is the upload request line, which must declare the size,
+// sends the file in data frames and finishes it with an end frame, or
+// gives up on it with a cancel frame, after which the upload is discarded
+// and answered as a failed one. Streams are received concurrently,
+// so the server answers each with ack frames carrying OK, MISMATCH or
+// REJECTED lines as for a single upload, in whichever order the uploads
+// finish. A close frame on stream 0 ends the connection: the server waits
+// for the open streams and answers with a close frame holding BYE and the
+// totals.
+const muxVersion = "1"
+
+// Frame types
+const (
+	frameOpen   byte = 1 // client: start a stream with the request line
+	frameData   byte = 2 // client: file data of a stream
+	frameEnd    byte = 3 // client: no more data on the stream
+	frameCancel byte = 4 // client: abandon the stream, discarding what it sent
+	frameAck    byte = 5 // server: a reply line for the stream
+	frameClose  byte = 6 // either: end the connection, the server's carrying BYE
+)
+
+// Largest frame payload, which bounds what either side buffers per frame
+const maxFramePayload = 1 << 20
+
+// Streams a connection may have open at once
+const maxMuxStreams = 16
+
+// A stream the client canceled; its upload is discarded, but isn't an error
+var errStreamCanceled = errors.New("stream canceled")
+
+// A frame of a multiplexed connection
+type muxFrame struct {
+	typ     byte
+	stream  uint32
+	payload []byte
+}
+
+// Write a frame in a single write
+func writeMuxFrame(w io.Writer, f muxFrame) error {
+	if len(f.payload) > maxFramePayload {
+		return fmt.Errorf("frame payload of %d bytes is over %d", len(f.payload), maxFramePayload)
+	}
+	buf := make([]byte, 0, 9+len(f.payload))
+	buf = append(buf, f.typ)
+	buf = binary.BigEndian.AppendUint32(buf, f.stream)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.payload)))
+	buf = append(buf, f.payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// Read the next frame, refusing payloads over maxFramePayload
+func readMuxFrame(r io.Reader) (muxFrame, error) {
+	var header [9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return muxFrame{}, err
+	}
+	f := muxFrame{typ: header[0], stream: binary.BigEndian.Uint32(header[1:5])}
+	n := binary.BigEndian.Uint32(header[5:])
+	if n > maxFramePayload {
+		return muxFrame{}, fmt.Errorf("frame payload of %d bytes is over %d", n, maxFramePayload)
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return muxFrame{}, io.ErrUnexpectedEOF
+	}
+	return f, nil
+}
+
+// Writes the frames of concurrent streams one whole frame at a time
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (fw *frameWriter) write(f muxFrame) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return writeMuxFrame(fw.w, f)
+}
+
+// The connection as one stream sees it: every write goes out as an ack
+// frame, so replies written for a single upload work unchanged
+type muxStreamConn struct {
+	net.Conn
+	frames *frameWriter
+	id     uint32
+}
+
+func (c *muxStreamConn) Write(p []byte) (int, error) {
+	if err := c.frames.write(muxFrame{typ: frameAck, stream: c.id, payload: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Receive the multiplexed uploads of a connection until the client closes
+// it, then say goodbye with the totals. A stream that fails doesn't end the
+// connection; the errors are returned once it's over.
+func receiveMux(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	if req.name != muxVersion {
+		rejectUpload(conn, log, "unsupported mux version")
+		return nil
+	}
+	// A device or output takes a single upload, which gains nothing from streams
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "multiplexing is not supported when writing to the "+cfg.sink())
+		return nil
+	}
+	fmt.Fprintf(conn, "MUX %s\n", muxVersion)
+
+	frames := &frameWriter{w: conn}
+	streams := make(map[uint32]*io.PipeWriter) // open streams, each fed to the goroutine receiving it
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex // guards the fields below, which streams update as they finish
+		stats sessionStats
+		used  int64 // bytes stored or declared by open streams, which -max-disk limits
+		errs  []error
+	)
+	// Whatever ends the connection, no stream is left waiting for data
+	defer func() {
+		for _, s := range streams {
+			s.CloseWithError(io.ErrUnexpectedEOF)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		f, err := readMuxFrame(conn)
+		if err != nil {
+			return fmt.Errorf("reading frame: %w", err)
+		}
+		s := streams[f.stream]
+		switch f.typ {
+		case frameOpen:
+			if f.stream == 0 || s != nil {
+				return fmt.Errorf("stream %d opened twice", f.stream)
+			}
+			if len(f.payload) > maxLineLength {
+				return errLineTooLong
+			}
+			if len(streams) >= maxMuxStreams {
+				return fmt.Errorf("more than %d streams open", maxMuxStreams)
+			}
+			req, err := parseRequest(string(f.payload))
+			if err != nil || req.verb != "upload" {
+				return fmt.Errorf("invalid stream request %q", f.payload)
+			}
+			size, err := strconv.ParseInt(req.attrs["size"], 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("stream %d doesn't declare its size", f.stream)
+			}
+			pr, pw := io.Pipe()
+			streams[f.stream] = pw
+			mu.Lock()
+			before := used
+			used += size
+			mu.Unlock()
+			log.Debug("Stream opened", "stream", f.stream, "name", req.name, "size", size)
+			wg.Add(1)
+			go func(id uint32) {
+				defer wg.Done()
+				// Data for a stream that's done with is dropped
+				defer pr.CloseWithError(errStreamCanceled)
+				streamConn := &muxStreamConn{Conn: conn, frames: frames, id: id}
+				files, err := receiveFramed(streamConn, log, cfg, req, &io.LimitedReader{R: pr, N: size}, before)
+				mu.Lock()
+				defer mu.Unlock()
+				// Only stored files count, rejected and canceled streams
+				// give their reservation back
+				if files == 0 {
+					used -= size
+				} else {
+					stats.Bytes += size
+				}
+				stats.Files += files
+				if err != nil && !errors.Is(err, errStreamCanceled) {
+					errs = append(errs, err)
+				}
+			}(f.stream)
+		case frameData, frameEnd, frameCancel:
+			if s == nil {
+				return fmt.Errorf("frame for stream %d, which isn't open", f.stream)
+			}
+			switch f.typ {
+			case frameData:
+				s.Write(f.payload)
+			case frameEnd:
+				s.Close()
+				delete(streams, f.stream)
+			case frameCancel:
+				log.Info("Stream canceled by the client", "stream", f.stream)
+				s.CloseWithError(errStreamCanceled)
+				delete(streams, f.stream)
+			}
+		case frameClose:
+			for id, s := range streams {
+				s.CloseWithError(io.ErrUnexpectedEOF)
+				delete(streams, id)
+			}
+			wg.Wait()
+			stats.Duration = time.Since(start).Round(time.Millisecond)
+			if err := frames.write(muxFrame{typ: frameClose, payload: []byte("BYE " + stats.String() + "\n")}); err != nil {
+				errs = append(errs, fmt.Errorf("sending goodbye: %w", err))
+			}
+			log.Info("Multiplexed connection summary", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration, "rate", throughput(stats.Bytes, start))
+			return errors.Join(errs...)
+		default:
+			return fmt.Errorf("unknown frame type %d", f.typ)
+		}
+	}
+}
+
+// Replies a stream may have waiting before the connection is taken to be
+// out of step; an upload gets one, or a few with acknowledgements
+const maxStreamAcks = 16
+
+// The client side of multiplexed connections: the workers sending a
+// directory share one connection, each sending its file as a stream. It's
+// opened on first use and again after a failure breaks it.
+type muxClient struct {
+	mu          sync.Mutex
+	conn        *muxConn
+	unsupported bool // the server doesn't take multiplexed connections, so workers use sessions
+}
+
+// A multiplexed connection and the streams waiting on its replies
+type muxConn struct {
+	conn   *clientConn
+	frames *frameWriter
+	bye    chan string // the server's goodbye, closed once the connection is done
+
+	mu      sync.Mutex
+	done    bool // the connection broke or was closed
+	next    uint32
+	streams map[uint32]*muxStream
+}
+
+// Connect and ask for a multiplexed connection, falling back to sessions
+// when the server doesn't take them
+func (m *muxClient) connect(cfg *clientConfig) error {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	// Servers before protocol 1.2 would take the request for an unknown verb
+	if conn.minor < 2 {
+		conn.Close()
+		slog.Info("Sending files in sessions, multiplexing is unavailable", "reason", "the server doesn't support it")
+		m.unsupported = true
+		return nil
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "mux", name: muxVersion}); err != nil {
+		conn.Close()
+		return fmt.Errorf("starting multiplexed connection: %w", err)
+	}
+	line, _ := conn.reader.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "MUX "+muxVersion {
+		conn.Close()
+		reason, ok := strings.CutPrefix(line, "REJECTED ")
+		if !ok {
+			reason = "the server doesn't support it"
+		}
+		slog.Info("Sending files in sessions, multiplexing is unavailable", "reason", reason)
+		m.unsupported = true
+		return nil
+	}
+	slog.Debug("Multiplexed connection started", "version", muxVersion)
+	m.conn = &muxConn{conn: conn, frames: &frameWriter{w: conn}, bye: make(chan string, 1), streams: make(map[uint32]*muxStream)}
+	go m.conn.readAcks()
+	return nil
+}
+
+// Open a stream for an upload of size bytes, or return nil when the server
+// doesn't take multiplexed connections
+func (m *muxClient) open(cfg *clientConfig, req request, size int64) (*muxStream, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unsupported {
+		return nil, nil
+	}
+	if m.conn != nil && m.conn.closed() {
+		m.conn.conn.Close()
+		m.conn = nil
+	}
+	if m.conn == nil {
+		if err := m.connect(cfg); err != nil || m.unsupported {
+			return nil, err
+		}
+	}
+	req.attrs["size"] = strconv.FormatInt(size, 10)
+	line := req.String()
+	if len(line) > maxLineLength {
+		return nil, errLineTooLong
+	}
+	return m.conn.open(line)
+}
+
+// End the connection once its streams are done and read the server's goodbye
+func (m *muxClient) close() {
+	if m == nil || m.conn == nil {
+		return
+	}
+	c := m.conn
+	m.conn = nil
+	defer c.conn.Close()
+	if c.closed() {
+		return
+	}
+	if err := c.write(muxFrame{typ: frameClose}); err != nil {
+		slog.Error("Error ending multiplexed connection", "err", err)
+		return
+	}
+	line, ok := <-c.bye
+	if !ok {
+		slog.Error("Error ending multiplexed connection", "err", "connection closed without a goodbye from the server")
+		return
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		slog.Error("Error ending multiplexed connection", "err", err)
+		return
+	}
+	slog.Debug("Multiplexed connection closed by server", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+}
+
+// Write a frame, dropping the connection when it can't be written whole,
+// since the server would misread whatever follows
+func (c *muxConn) write(f muxFrame) error {
+	if err := c.frames.write(f); err != nil {
+		abortConnection(c.conn)
+		return err
+	}
+	return nil
+}
+
+func (c *muxConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done
+}
+
+// Start a stream with its upload request line
+func (c *muxConn) open(line string) (*muxStream, error) {
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		return nil, errors.New("multiplexed connection closed")
+	}
+	c.next++
+	s := &muxStream{conn: c, id: c.next, acks: make(chan []byte, maxStreamAcks)}
+	s.reader = bufio.NewReader(s)
+	c.streams[s.id] = s
+	c.mu.Unlock()
+	if err := c.write(muxFrame{typ: frameOpen, stream: s.id, payload: []byte(line)}); err != nil {
+		s.release()
+		return nil, fmt.Errorf("sending file metadata: %w", err)
+	}
+	return s, nil
+}
+
+// Hand the server's replies to the streams they're for until the goodbye
+// or a failure ends the connection, then wake the streams still waiting
+func (c *muxConn) readAcks() {
+	defer func() {
+		c.mu.Lock()
+		c.done = true
+		for id, s := range c.streams {
+			close(s.acks)
+			delete(c.streams, id)
+		}
+		c.mu.Unlock()
+		close(c.bye)
+	}()
+	for {
+		f, err := readMuxFrame(c.conn)
+		if err != nil {
+			slog.Debug("Multiplexed connection ended", "err", err)
+			return
+		}
+		switch f.typ {
+		case frameAck:
+			c.mu.Lock()
+			// Replies for a stream already done with, such as one canceled, are dropped
+			s := c.streams[f.stream]
+			overflow := false
+			if s != nil {
+				select {
+				case s.acks <- f.payload:
+				default:
+					overflow = true
+				}
+			}
+			c.mu.Unlock()
+			if overflow {
+				slog.Debug("Multiplexed connection ended", "err", fmt.Sprintf("too many replies for stream %d", f.stream))
+				abortConnection(c.conn)
+				return
+			}
+		case frameClose:
+			c.bye <- string(f.payload)
+			return
+		default:
+			slog.Debug("Multiplexed connection ended", "err", fmt.Sprintf("unexpected frame type %d", f.typ))
+			abortConnection(c.conn)
+			return
+		}
+	}
+}
+
+// An upload on a multiplexed connection: writes go out as data frames and
+// reads return the server's replies to it
+type muxStream struct {
+	conn    *muxConn
+	id      uint32
+	acks    chan []byte
+	pending []byte
+	reader  *bufio.Reader // the replies, for readUploadStatus
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFramePayload)
+		if err := s.conn.write(muxFrame{typ: frameData, stream: s.id, payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		ack, ok := <-s.acks
+		if !ok {
+			return 0, io.EOF
+		}
+		s.pending = ack
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Tell the server the upload's data is complete
+func (s *muxStream) end() error {
+	return s.conn.write(muxFrame{typ: frameEnd, stream: s.id})
+}
+
+// Give up on the upload, which the server discards; the connection carries on
+func (s *muxStream) cancel() {
+	s.conn.write(muxFrame{typ: frameCancel, stream: s.id})
+}
+
+// Stop waiting on replies to the stream
+func (s *muxStream) release() {
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
+	if s.conn.streams[s.id] == s {
+		delete(s.conn.streams, s.id)
+	}
+}
@@ -0,0 +1,227 @@
+package shadowx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	frames := []muxFrame{
+		{typ: frameOpen, stream: 1, payload: []byte("upload a.txt\tsize=5")},
+		{typ: frameData, stream: 1, payload: []byte("hello")},
+		{typ: frameEnd, stream: 1, payload: []byte{}},
+		{typ: frameAck, stream: 1 << 31, payload: []byte("OK abc\n")},
+		{typ: frameClose, stream: 0, payload: bytes.Repeat([]byte("x"), maxFramePayload)},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		if err := writeMuxFrame(&buf, f); err != nil {
+			t.Fatalf("writeMuxFrame(%d): %v", f.typ, err)
+		}
+	}
+	for _, want := range frames {
+		got, err := readMuxFrame(&buf)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("readMuxFrame = %d/%d with %d bytes, %v; want %d/%d with %d bytes", got.typ, got.stream, len(got.payload), err, want.typ, want.stream, len(want.payload))
+		}
+	}
+	if _, err := readMuxFrame(&buf); err != io.EOF {
+		t.Errorf("readMuxFrame after the last frame = %v, want EOF", err)
+	}
+
+	if err := writeMuxFrame(io.Discard, muxFrame{typ: frameData, stream: 1, payload: make([]byte, maxFramePayload+1)}); err == nil {
+		t.Error("writeMuxFrame accepted a payload over the limit")
+	}
+	header := []byte{frameData, 0, 0, 0, 1}
+	if _, err := readMuxFrame(bytes.NewReader(binary.BigEndian.AppendUint32(header, maxFramePayload+1))); err == nil {
+		t.Error("readMuxFrame accepted a payload over the limit")
+	}
+	if _, err := readMuxFrame(bytes.NewReader(append(binary.BigEndian.AppendUint32(header, 5), "hel"...))); err != io.ErrUnexpectedEOF {
+		t.Errorf("readMuxFrame of a cut-off payload = %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// Start a multiplexed connection to a server with cfg
+func dialMux(t *testing.T, cfg *serverConfig) (*net.TCPConn, *bufio.Reader, chan error) {
+	t.Helper()
+	conn, reader, done := dialTestServer(t, cfg)
+	if _, err := conn.Write([]byte("mux " + muxVersion + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); err != nil || line != "MUX "+muxVersion+"\n" {
+		t.Fatalf("mux reply %q, %v", line, err)
+	}
+	return conn, reader, done
+}
+
+// Read the next ack, failing unless it's for stream with a reply starting
+// with want
+func readAck(t *testing.T, reader *bufio.Reader, stream uint32, want string) {
+	t.Helper()
+	f, err := readMuxFrame(reader)
+	if err != nil {
+		t.Fatalf("reading ack: %v", err)
+	}
+	if f.typ != frameAck || f.stream != stream || !strings.HasPrefix(string(f.payload), want) {
+		t.Fatalf("frame %d for stream %d with %q, want an ack for stream %d starting %q", f.typ, f.stream, f.payload, stream, want)
+	}
+}
+
+// Streams are received concurrently, so a small file finishing while a
+// larger one is still arriving is acknowledged first, and a canceled
+// stream is discarded without ending the connection
+func TestReceiveMuxOutOfOrderAcks(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	conn, reader, done := dialMux(t, cfg)
+	send := func(typ byte, stream uint32, payload string) {
+		t.Helper()
+		if err := writeMuxFrame(conn, muxFrame{typ: typ, stream: stream, payload: []byte(payload)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(frameOpen, 1, "upload large.txt\tsize=11")
+	send(frameData, 1, "hello ")
+	send(frameOpen, 2, "upload small.txt\tsize=3")
+	send(frameData, 2, "abc")
+	send(frameEnd, 2, "")
+	readAck(t, reader, 2, "OK ")
+
+	send(frameOpen, 3, "upload canceled.txt\tsize=8")
+	send(frameData, 3, "half")
+	send(frameCancel, 3, "")
+	readAck(t, reader, 3, "REJECTED ")
+
+	send(frameData, 1, "world")
+	send(frameEnd, 1, "")
+	readAck(t, reader, 1, "OK ")
+
+	send(frameClose, 0, "")
+	f, err := readMuxFrame(reader)
+	if err != nil || f.typ != frameClose || !strings.HasPrefix(string(f.payload), "BYE files=2 bytes=14 ") {
+		t.Fatalf("goodbye frame %d with %q, %v; want a close frame with BYE", f.typ, f.payload, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("handleConnection: %v", err)
+	}
+	for name, want := range map[string]string{"large.txt": "hello world", "small.txt": "abc"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s stored as %q, %v; want %q", name, got, err, want)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("output directory holds %d entries, want the two stored files", len(entries))
+	}
+}
+
+// Frames that break the protocol end the connection, discarding the
+// streams that were open
+func TestReceiveMuxProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []muxFrame
+		want   string
+	}{
+		{"data for an unopened stream", []muxFrame{{typ: frameData, stream: 7, payload: []byte("x")}}, "isn't open"},
+		{"stream 0", []muxFrame{{typ: frameOpen, payload: []byte("upload a.txt\tsize=1")}}, "opened twice"},
+		{"no size", []muxFrame{{typ: frameOpen, stream: 1, payload: []byte("upload a.txt")}}, "doesn't declare its size"},
+		{"not an upload", []muxFrame{{typ: frameOpen, stream: 1, payload: []byte("download a.txt\tsize=1")}}, "invalid stream request"},
+		{"unknown type", []muxFrame{{typ: 99, stream: 1}}, "unknown frame type"},
+		{"dropped mid-stream", []muxFrame{{typ: frameOpen, stream: 1, payload: []byte("upload a.txt\tsize=10")}, {typ: frameData, stream: 1, payload: []byte("part")}}, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+			conn, _, done := dialMux(t, cfg)
+			for _, f := range tt.frames {
+				if err := writeMuxFrame(conn, f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conn.CloseWrite()
+			if err := <-done; err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("handleConnection = %v, want an error with %q", err, tt.want)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("output directory holds %d entries, want none", len(entries))
+			}
+		})
+	}
+}
+
+// With -mux the workers' files go as streams of one connection, one too
+// large for the server failing without disturbing the others
+func TestClientSendMux(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ManifestPath: "manifest.jsonl", MaxFileSize: 2 << 20}
+	startTestServer(t, srv)
+
+	if err := os.Mkdir("files", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Sizes from a byte to several data frames
+	files := map[string][]byte{
+		"large.bin": bytes.Repeat([]byte("0123456789"), maxFramePayload/10*3/2),
+		"huge.bin":  make([]byte, 3<<20),
+	}
+	for i := range 10 {
+		files[fmt.Sprintf("%02d.txt", i)] = bytes.Repeat([]byte{byte('a' + i)}, i*1000+1)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join("files", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Parallel: 4, Mux: true}
+	err := client.Send("files")
+	if err == nil || !strings.Contains(err.Error(), "huge.bin") {
+		t.Fatalf("Send = %v, want the oversized file to fail", err)
+	}
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(DefaultOutDir, "files", name))
+		if name == "huge.bin" {
+			if err == nil {
+				t.Errorf("%s was stored despite exceeding the limit", name)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s = %d bytes, %v; want %d bytes", name, len(got), err, len(data))
+		}
+	}
+	if remotes := manifestRemotes(t, "manifest.jsonl"); len(remotes) != 1 {
+		t.Errorf("files arrived over %d connections, want 1", len(remotes))
+	}
+}
+
+func TestClientMuxOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *Client
+		want   string
+	}{
+		{"too many workers", &Client{Mux: true, Parallel: maxMuxStreams + 1}, "-parallel must not exceed"},
+		{"compressed", &Client{Mux: true, Compress: true}, "-mux can't be combined"},
+		{"streams", &Client{Mux: true, Streams: 4}, "-mux can't be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.client.Addr, tt.client.Key, tt.client.NoTLS = "127.0.0.1:1", "test-key", true
+			if _, err := tt.client.newConfig(); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("config = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package shadowx
+
+import (
+	"bufio"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Three uploads of one name: with -no-clobber each is kept under its own
+// name and the client hears which, otherwise the last one replaces the rest
+// and the server logs the overwrites
+func TestClientSendNoClobber(t *testing.T) {
+	tests := []struct {
+		name      string
+		noClobber bool
+		path      string // sent three times with different content
+		want      map[string]string
+		logged    string
+	}{
+		{"file", true, "report.txt", map[string]string{"report.txt": "first", "report.txt.1": "second", "report.txt.2": "third"}, "as=report.txt.2"},
+		{"session", true, "docs", map[string]string{"docs/report.txt": "first", "docs/report.txt.1": "second", "docs/report.txt.2": "third"}, "as=docs/report.txt.2"},
+		{"overwrite", false, "report.txt", map[string]string{"report.txt": "third"}, `msg="Overwriting existing file"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			logged := captureLog(t, slog.LevelInfo)
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, NoClobber: tt.noClobber}
+			startTestServer(t, srv)
+
+			local := tt.path
+			if tt.path == "docs" {
+				if err := os.Mkdir("docs", 0755); err != nil {
+					t.Fatal(err)
+				}
+				local = filepath.Join("docs", "report.txt")
+			}
+			client := &Client{Addr: srv.Addr, Key: srv.Key}
+			for _, content := range []string{"first", "second", "third"} {
+				if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := client.Send(tt.path); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+			}
+
+			var stored int
+			filepath.WalkDir(DefaultOutDir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					stored++
+				}
+				return err
+			})
+			if stored != len(tt.want) {
+				t.Errorf("%d files stored, want %d", stored, len(tt.want))
+			}
+			for name, want := range tt.want {
+				if got, err := os.ReadFile(filepath.Join(DefaultOutDir, name)); err != nil || string(got) != want {
+					t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+				}
+			}
+			if !strings.Contains(logged.String(), tt.logged) {
+				t.Errorf("log lacks %s:\n%s", tt.logged, logged)
+			}
+		})
+	}
+}
+
+func TestReadUploadStatus(t *testing.T) {
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := []struct {
+		status   string
+		sum      string
+		renamed  string
+		rejected bool
+		err      bool
+	}{
+		{status: "OK " + sum + "\n", sum: sum},
+		{status: "OK " + sum + "\trenamed=docs/a b.txt.1\n", sum: sum, renamed: "docs/a b.txt.1"},
+		{status: "OK " + sum + "\tchecksum=sha256\trenamed=a.txt.1\n", sum: sum, renamed: "a.txt.1"},
+		{status: "OK " + sum + "\tchecksum=blake3\n", err: true},
+		{status: "REJECTED rejected by policy\n", rejected: true, err: true},
+		{status: "MISMATCH " + sum + "\n", rejected: true, err: true},
+		{status: "BYE files=1\n", err: true},
+		{status: "OK " + sum, err: true},
+	}
+	for _, tt := range tests {
+		sum, renamed, rejected, err := readUploadStatus(bufio.NewReader(strings.NewReader(tt.status)), "local", defaultChecksum)
+		if sum != tt.sum || renamed != tt.renamed || rejected != tt.rejected || (err != nil) != tt.err {
+			t.Errorf("readUploadStatus(%q) = %q, %q, %v, %v; want %q, %q, %v, error %v",
+				tt.status, sum, renamed, rejected, err, tt.sum, tt.renamed, tt.rejected, tt.err)
+		}
+	}
+}
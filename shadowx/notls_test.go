@@ -0,0 +1,64 @@
+package shadowx
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// With -no-tls on both ends a directory goes over plain TCP without a
+// certificate, the PSK still guards the server and both sides warn
+func TestNoTLS(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	for name, data := range map[string]string{"src/a.txt": "alpha", "src/sub/b.txt": "bravo"} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, NoTLS: true}
+	stop := startTestServer(t, srv)
+	if _, err := os.Stat("server.crt"); !os.IsNotExist(err) {
+		t.Errorf("certificate generated for a plain server: %v", err)
+	}
+
+	if err := (&Client{Addr: srv.Addr, Key: srv.Key, NoTLS: true, Verify: true}).Send("src"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for name, want := range map[string]string{"src/a.txt": "alpha", "src/sub/b.txt": "bravo"} {
+		if got, err := os.ReadFile(filepath.Join(DefaultOutDir, name)); err != nil || string(got) != want {
+			t.Errorf("%s stored as %q, %v; want %q", name, got, err, want)
+		}
+	}
+	wrongKey := &Client{Addr: srv.Addr, Key: "wrong-key", NoTLS: true}
+	if err := wrongKey.Send("src/a.txt"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Send with the wrong key = %v, want an authentication failure", err)
+	}
+	// A client expecting TLS can't talk to a plain server
+	if err := (&Client{Addr: srv.Addr, Key: srv.Key}).Send("src/a.txt"); err == nil {
+		t.Error("Send with TLS to a plain server succeeded")
+	}
+
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if n := strings.Count(logs.String(), "TLS IS OFF"); n != 3 {
+		t.Errorf("logged %d unencrypted warnings, want one from the server and each plain client", n)
+	}
+}
+
+func TestNoTLSConflicts(t *testing.T) {
+	client := &Client{Addr: "127.0.0.1:8080", Key: "test-key", NoTLS: true, Pin: "00"}
+	if err := client.Send("a.txt"); err == nil || !strings.Contains(err.Error(), "-no-tls") {
+		t.Errorf("Send with -no-tls and -pin = %v, want it refused", err)
+	}
+	srv := &Server{Addr: "127.0.0.1:0", Key: "test-key", OutDir: t.TempDir(), NoTLS: true, ClientCA: "ca.pem"}
+	if err := srv.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "-no-tls") {
+		t.Errorf("ListenAndServe with -no-tls and -client-ca = %v, want it refused", err)
+	}
+}
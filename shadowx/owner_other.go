@@ -0,0 +1,10 @@
+//go:build !unix
+
+package shadowx
+
+import "os"
+
+// Files have no numeric owner on this platform
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
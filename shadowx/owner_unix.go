@@ -0,0 +1,17 @@
+//go:build unix
+
+package shadowx
+
+import (
+	"os"
+	"syscall"
+)
+
+// The owner and group IDs of a file
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
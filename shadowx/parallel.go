@@ -0,0 +1,69 @@
+package shadowx
+
+import "sync"
+
+// Sends files on up to cfg.parallel goroutines at once. Each worker slot
+// holds its own session, so taking a slot from the channel both bounds the
+// concurrency and hands the goroutine a connection nobody else is using,
+// unless the workers share a multiplexed connection.
+type sendPool struct {
+	cfg   *clientConfig
+	slots chan *uploadSession
+	mux   *muxClient // shared by the workers' sessions with -mux, nil otherwise
+	wg    sync.WaitGroup
+
+	mu     sync.Mutex
+	failed []SendFailure
+}
+
+func newSendPool(cfg *clientConfig) *sendPool {
+	workers := max(cfg.parallel, 1)
+	p := &sendPool{cfg: cfg, slots: make(chan *uploadSession, workers)}
+	if cfg.mux && cfg.sessions() {
+		p.mux = &muxClient{}
+	}
+	for range workers {
+		session := newUploadSession(cfg)
+		if session != nil {
+			session.mux = p.mux
+		}
+		p.slots <- session
+	}
+	return p
+}
+
+// Send a file once a worker is free
+func (p *sendPool) send(filename string) {
+	session := <-p.slots
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { p.slots <- session }()
+		if err := trySend(p.cfg, session, filename); err != nil {
+			p.mu.Lock()
+			p.failed = append(p.failed, SendFailure{Path: filename, Err: err})
+			p.mu.Unlock()
+		}
+	}()
+}
+
+// Wait for the files being sent and return those that failed since the last wait
+func (p *sendPool) wait() []SendFailure {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failed := p.failed
+	p.failed = nil
+	return failed
+}
+
+// Wait for the files being sent, then end the workers' sessions and the
+// connection they share
+func (p *sendPool) close() []SendFailure {
+	failed := p.wait()
+	for range cap(p.slots) {
+		(<-p.slots).close()
+	}
+	p.mux.close()
+	return failed
+}
@@ -0,0 +1,74 @@
+package shadowx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Files of a directory are spread over the workers' connections, with and
+// without checkpointed batches
+func TestClientSendParallel(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *Client
+	}{
+		{"walk", &Client{Parallel: 4}},
+		{"batches", &Client{Parallel: 4, BatchSize: 30}},
+		{"one connection each", &Client{Parallel: 4, Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ManifestPath: "manifest.jsonl"}
+			startTestServer(t, srv)
+
+			const count = 100
+			if err := os.Mkdir("files", 0755); err != nil {
+				t.Fatal(err)
+			}
+			for i := range count {
+				if err := os.WriteFile(filepath.Join("files", fmt.Sprintf("%03d.txt", i)), []byte(fmt.Sprint(i)), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.client.Addr, tt.client.Key = srv.Addr, srv.Key
+			if err := tt.client.Send("files"); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			for i := range count {
+				name := filepath.Join(DefaultOutDir, "files", fmt.Sprintf("%03d.txt", i))
+				if got, err := os.ReadFile(name); err != nil || string(got) != fmt.Sprint(i) {
+					t.Fatalf("%s = %q, %v; want %q", name, got, err, fmt.Sprint(i))
+				}
+			}
+			if remotes := manifestRemotes(t, "manifest.jsonl"); !tt.client.Compress && len(remotes) > tt.client.Parallel {
+				t.Errorf("files arrived over %d connections, want at most %d", len(remotes), tt.client.Parallel)
+			}
+		})
+	}
+}
+
+// How many files in a manifest arrived from each remote address, that is
+// over each connection
+func manifestRemotes(t *testing.T, path string) map[string]int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	remotes := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		remotes[entry.Remote]++
+	}
+	return remotes
+}
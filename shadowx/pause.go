@@ -0,0 +1,91 @@
+package shadowx
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Gate that transfer loops pass through between chunks; while set(true) is
+// in effect, wait blocks the data flow until set(false) resumes it or the
+// transfer's context is done
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{} // closed while transfers run, replaced by an open one while paused
+}
+
+// Gate toggled by the pause/resume signals
+var transferGate = newPauseGate()
+
+func newPauseGate() *pauseGate {
+	g := &pauseGate{resumed: make(chan struct{})}
+	close(g.resumed)
+	return g
+}
+
+// Pause or resume transfers
+func (g *pauseGate) set(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused == paused {
+		return
+	}
+	g.paused = paused
+	breakProgress()
+	if paused {
+		g.resumed = make(chan struct{})
+		slog.Info("Transfer paused")
+	} else {
+		close(g.resumed)
+		slog.Info("Transfer resumed")
+	}
+}
+
+// How often a paused upload sends a byte of its data, so the server
+// doesn't take the pause for a stalled client and drop it at its
+// -idle-timeout
+var pauseKeepalive = 30 * time.Second
+
+// Block while transfers are paused, calling keepalive, when it isn't nil,
+// every pauseKeepalive meanwhile; the wait ends early once it reports it
+// has nothing more to send. Returns ctx.Err() once ctx is done, paused or
+// not.
+func (g *pauseGate) wait(ctx context.Context, keepalive func() bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	default:
+	}
+	var tick <-chan time.Time
+	if keepalive != nil {
+		ticker := time.NewTicker(pauseKeepalive)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-resumed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick:
+			if !keepalive() {
+				return nil
+			}
+		}
+	}
+}
+
+// Pause transfers on SIGUSR1 and resume them on SIGUSR2, where the platform
+// has those signals
+func WatchPauseSignals() {
+	watchPauseSignals(transferGate)
+}
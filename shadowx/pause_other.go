@@ -0,0 +1,6 @@
+//go:build !unix
+
+package shadowx
+
+// Pause signals are not available on this platform
+func watchPauseSignals(g *pauseGate) {}
@@ -0,0 +1,144 @@
+package shadowx
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Waiting ends when transfers resume, or when the waiter's context is done
+// while they're still paused
+func TestPauseGateWait(t *testing.T) {
+	captureLog(t, slog.LevelError)
+	g := newPauseGate()
+	if err := g.wait(context.Background(), nil); err != nil {
+		t.Fatalf("wait while running = %v", err)
+	}
+	g.set(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled, resumed := make(chan error, 1), make(chan error, 1)
+	go func() { canceled <- g.wait(ctx, nil) }()
+	go func() { resumed <- g.wait(context.Background(), nil) }()
+	select {
+	case err := <-canceled:
+		t.Fatalf("wait returned %v while paused", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("wait after cancel = %v, want context.Canceled", err)
+	}
+	g.set(false)
+	if err := <-resumed; err != nil {
+		t.Errorf("wait after resume = %v", err)
+	}
+}
+
+// Canceling a paused send stops it without waiting for the resume
+func TestSendContextWhilePaused(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelError)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	transferGate.set(true)
+	t.Cleanup(func() { transferGate.set(false) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() { done <- (&Client{Addr: srv.Addr, Key: srv.Key}).SendContext(ctx, "a.txt") }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("SendContext = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendContext kept waiting for the resume after it was canceled")
+	}
+}
+
+// A paused upload trickles a byte of the held data out every keepalive, and
+// sends the rest once resumed, with the count and hash covering all of it
+func TestCountingWriterKeepalive(t *testing.T) {
+	captureLog(t, slog.LevelError)
+	defer func(interval time.Duration) { pauseKeepalive = interval }(pauseKeepalive)
+	pauseKeepalive = 10 * time.Millisecond
+	g := newPauseGate()
+	g.set(true)
+
+	var mu sync.Mutex
+	var out bytes.Buffer
+	hasher := sha256.New()
+	counter := &countingWriter{w: &lockedWriter{mu: &mu, w: &out}, hasher: hasher, gate: g, ctx: context.Background(), keepalive: true}
+	done := make(chan error, 1)
+	go func() {
+		_, err := counter.Write([]byte("hello"))
+		done <- err
+	}()
+	time.Sleep(25 * time.Millisecond)
+	mu.Lock()
+	trickled := out.Len()
+	mu.Unlock()
+	if trickled == 0 || trickled == 5 {
+		t.Errorf("%d bytes sent while paused, want a few", trickled)
+	}
+	g.set(false)
+	if err := <-done; err != nil {
+		t.Fatalf("Write = %v", err)
+	}
+	want := sha256.Sum256([]byte("hello"))
+	if out.String() != "hello" || counter.count != 5 || !bytes.Equal(hasher.Sum(nil), want[:]) {
+		t.Errorf("sent %q, counted %d, want all of hello once", out.String(), counter.count)
+	}
+}
+
+// Serializes writes with a test reading what was written so far
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// A pause longer than the server's idle timeout doesn't drop the upload,
+// compressed or not
+func TestPausePastIdleTimeout(t *testing.T) {
+	defer func(interval time.Duration) { pauseKeepalive = interval }(pauseKeepalive)
+	pauseKeepalive = 20 * time.Millisecond
+	for _, compress := range []bool{false, true} {
+		t.Run(map[bool]string{false: "plain", true: "compressed"}[compress], func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			captureLog(t, slog.LevelError)
+			data := bytes.Repeat([]byte("0123456789abcdef"), 8<<10)
+			if err := os.WriteFile("a.bin", data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, IdleTimeout: 100 * time.Millisecond}
+			startTestServer(t, srv)
+			transferGate.set(true)
+			defer transferGate.set(false)
+			time.AfterFunc(500*time.Millisecond, func() { transferGate.set(false) })
+
+			if err := (&Client{Addr: srv.Addr, Key: srv.Key, Compress: compress}).Send("a.bin"); err != nil {
+				t.Fatalf("Send across the pause: %v", err)
+			}
+			if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "a.bin")); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("stored %d bytes, %v; want %d", len(got), err, len(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package shadowx
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Pause transfers on SIGUSR1 and resume them on SIGUSR2
+func watchPauseSignals(g *pauseGate) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			g.set(sig == syscall.SIGUSR1)
+		}
+	}()
+}
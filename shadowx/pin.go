@@ -0,0 +1,83 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SHA-256 of a certificate's public key (SubjectPublicKeyInfo), which stays
+// the same when the certificate is reissued for the same key
+func publicKeyPin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// Parse a -pin value: 64 hex digits, optionally separated by colons as
+// openssl prints them
+func parsePin(value string) ([]byte, error) {
+	pin, err := hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("pin must be a SHA-256 fingerprint in hex, got %q", value)
+	}
+	return pin, nil
+}
+
+// Build a VerifyPeerCertificate callback that accepts only a server whose
+// certificate has the pinned public key
+func verifyPin(pin []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("pin: server presented no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("pin: parsing server certificate: %w", err)
+		}
+		if got := publicKeyPin(cert); !bytes.Equal(got, pin) {
+			return fmt.Errorf("pin: server public key %x doesn't match the pinned %x", got, pin)
+		}
+		return nil
+	}
+}
+
+// TLS settings for connecting to host. With a CA bundle the certificate
+// chain and name are verified as usual; pins, DANE records and known hosts
+// are checked on top. With none of them the server isn't authenticated at all.
+func clientTLSConfig(cfg *clientConfig, host string) *tls.Config {
+	tlsConfig := &tls.Config{ServerName: host, Certificates: cfg.clientCert, RootCAs: cfg.rootCAs, MinVersion: cfg.minTLS, CipherSuites: cfg.ciphers}
+	var checks []func([][]byte, [][]*x509.Certificate) error
+	if cfg.pin != nil {
+		checks = append(checks, verifyPin(cfg.pin))
+	}
+	if cfg.tlsa != nil {
+		checks = append(checks, verifyDANE(cfg.tlsaHost, cfg.tlsa))
+	}
+	if cfg.knownHosts != nil {
+		checks = append(checks, verifyKnownHost(cfg.knownHosts, cfg.address))
+	}
+	// The custom checks stand in for chain verification unless a CA was given
+	tlsConfig.InsecureSkipVerify = cfg.rootCAs == nil
+	if len(checks) > 0 {
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			for _, check := range checks {
+				if err := check(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return tlsConfig
+}
+
+// Whether the client has any way to authenticate the server; known hosts
+// only do from the second connection on
+func verifiesServer(cfg *clientConfig) bool {
+	return cfg.rootCAs != nil || cfg.pin != nil || cfg.tlsa != nil || cfg.knownHosts != nil
+}
@@ -0,0 +1,89 @@
+package shadowx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParsePin(t *testing.T) {
+	hexPin := strings.Repeat("ab", 32)
+	colonPin := strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{hexPin, true},
+		{colonPin, true},
+		{hexPin[:62], false},
+		{hexPin + "00", false},
+		{strings.Repeat("zz", 32), false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		pin, err := parsePin(tt.value)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePin(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+		}
+		if tt.ok && len(pin) != 32 {
+			t.Errorf("parsePin(%q) = %d bytes", tt.value, len(pin))
+		}
+	}
+}
+
+// Handshake with a server presenting cert and report the client's error.
+// Loopback TCP buffers what net.Pipe wouldn't, so an aborted handshake
+// can't leave both sides blocked writing.
+func testClientHandshake(t *testing.T, cfg *clientConfig, cert tls.Certificate) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	return tls.Client(raw, clientTLSConfig(cfg, "server")).Handshake()
+}
+
+func TestClientTLSConfig(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	server := newTestCert(t, "server", ca, false)
+	other := newTestCert(t, "server", nil, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name   string
+		cfg    *clientConfig
+		cert   *testCert
+		wantOK bool
+	}{
+		{"matching pin", &clientConfig{pin: publicKeyPin(server.cert)}, server, true},
+		{"mismatched pin", &clientConfig{pin: publicKeyPin(other.cert)}, server, false},
+		{"valid CA chain", &clientConfig{rootCAs: roots}, server, true},
+		{"certificate outside the CA", &clientConfig{rootCAs: roots}, other, false},
+		{"CA chain and matching pin", &clientConfig{rootCAs: roots, pin: publicKeyPin(server.cert)}, server, true},
+		{"CA chain and mismatched pin", &clientConfig{rootCAs: roots, pin: publicKeyPin(other.cert)}, server, false},
+		{"no verification", &clientConfig{}, other, true},
+	}
+	for _, tt := range tests {
+		err := testClientHandshake(t, tt.cfg, tt.cert.tlsCertificate())
+		if (err == nil) != tt.wantOK {
+			t.Errorf("%s: handshake error = %v, want ok %v", tt.name, err, tt.wantOK)
+		}
+		if verifiesServer(tt.cfg) == (tt.name == "no verification") {
+			t.Errorf("%s: verifiesServer = %v", tt.name, verifiesServer(tt.cfg))
+		}
+	}
+}
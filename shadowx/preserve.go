@@ -0,0 +1,90 @@
+package shadowx
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Permission bits, modification time and owner sent with -preserve
+type fileMetadata struct {
+	mode     *os.FileMode
+	mtime    *time.Time
+	uid, gid *int // owner and group IDs, nil where the client has none
+}
+
+// Add a file's permission bits, in octal, modification time, in Unix
+// nanoseconds, and owner and group IDs where the platform has them, to
+// request attributes
+func addFileMetadata(attrs map[string]string, info os.FileInfo) {
+	attrs["mode"] = strconv.FormatUint(uint64(info.Mode().Perm()), 8)
+	attrs["mtime"] = strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	if uid, gid, ok := fileOwner(info); ok {
+		attrs["uid"], attrs["gid"] = strconv.Itoa(uid), strconv.Itoa(gid)
+	}
+}
+
+// Parse the mode, mtime, uid and gid attributes of a request, any of which
+// may be absent, though uid and gid come together. Only permission bits are
+// accepted, never setuid, setgid or sticky.
+func parseFileMetadata(attrs map[string]string) (fileMetadata, error) {
+	var meta fileMetadata
+	if value, ok := attrs["mode"]; ok {
+		bits, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || bits > 0777 {
+			return meta, fmt.Errorf("malformed mode")
+		}
+		mode := os.FileMode(bits)
+		meta.mode = &mode
+	}
+	if value, ok := attrs["mtime"]; ok {
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return meta, fmt.Errorf("malformed mtime")
+		}
+		t := time.Unix(0, nanos)
+		meta.mtime = &t
+	}
+	uid, hasUID := attrs["uid"]
+	gid, hasGID := attrs["gid"]
+	if hasUID || hasGID {
+		u, errU := strconv.ParseUint(uid, 10, 32)
+		g, errG := strconv.ParseUint(gid, 10, 32)
+		// -1 leaves an ID unchanged in chown, so it's never a valid one
+		if errU != nil || errG != nil || u == math.MaxUint32 || g == math.MaxUint32 {
+			return meta, fmt.Errorf("malformed uid or gid")
+		}
+		ids := [2]int{int(u), int(g)}
+		meta.uid, meta.gid = &ids[0], &ids[1]
+	}
+	return meta, nil
+}
+
+// Restore the metadata sent with a stored file at path, warning about what
+// can't be restored. The owner is only restored with -preserve-owner.
+func (cfg *serverConfig) restoreMetadata(log *slog.Logger, meta fileMetadata, path string) {
+	if cfg.chown && meta.uid != nil {
+		if err := os.Lchown(path, *meta.uid, *meta.gid); err != nil {
+			log.Warn("Can't restore owner", "file", path, "uid", *meta.uid, "gid", *meta.gid, "err", err)
+		}
+	}
+	if err := meta.apply(path); err != nil {
+		log.Warn("Can't restore mode and modification time", "file", path, "err", err)
+	}
+}
+
+// Apply the metadata to a stored file once its content is final
+func (meta fileMetadata) apply(path string) error {
+	if meta.mode != nil {
+		if err := os.Chmod(path, *meta.mode); err != nil {
+			return err
+		}
+	}
+	if meta.mtime != nil {
+		return os.Chtimes(path, time.Time{}, *meta.mtime)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package shadowx
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFileMetadata(t *testing.T) {
+	tests := []struct {
+		attrs   map[string]string
+		mode    os.FileMode
+		mtime   int64
+		wantErr bool
+	}{
+		{attrs: map[string]string{}},
+		{attrs: map[string]string{"mode": "755"}, mode: 0755},
+		{attrs: map[string]string{"mode": "0600", "mtime": "1700000000123456789"}, mode: 0600, mtime: 1700000000123456789},
+		{attrs: map[string]string{"mtime": "-1"}, mtime: -1},
+		{attrs: map[string]string{"mode": "4755"}, wantErr: true},
+		{attrs: map[string]string{"mode": "rwx"}, wantErr: true},
+		{attrs: map[string]string{"mode": "999"}, wantErr: true},
+		{attrs: map[string]string{"mtime": "yesterday"}, wantErr: true},
+		{attrs: map[string]string{"uid": "1000", "gid": "100"}},
+		{attrs: map[string]string{"uid": "1000"}, wantErr: true},
+		{attrs: map[string]string{"uid": "-1", "gid": "100"}, wantErr: true},
+		{attrs: map[string]string{"uid": "4294967295", "gid": "100"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		meta, err := parseFileMetadata(tt.attrs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFileMetadata(%v) error = %v, wantErr %v", tt.attrs, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if (meta.mode != nil) != (tt.attrs["mode"] != "") || (meta.mode != nil && *meta.mode != tt.mode) {
+			t.Errorf("parseFileMetadata(%v) mode = %v, want %v", tt.attrs, meta.mode, tt.mode)
+		}
+		if (meta.mtime != nil) != (tt.attrs["mtime"] != "") || (meta.mtime != nil && meta.mtime.UnixNano() != tt.mtime) {
+			t.Errorf("parseFileMetadata(%v) mtime = %v, want %d", tt.attrs, meta.mtime, tt.mtime)
+		}
+	}
+}
+
+func TestFileMetadataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "build.sh")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := make(map[string]string)
+	addFileMetadata(attrs, info)
+	meta, err := parseFileMetadata(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, ok := fileOwner(info); ok && (meta.uid == nil || *meta.uid != uid || *meta.gid != gid) {
+		t.Errorf("owner sent as %v:%v, want %d:%d", meta.uid, meta.gid, uid, gid)
+	}
+
+	dst := filepath.Join(dir, "copy.sh")
+	if err := os.WriteFile(dst, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.apply(dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Mode().Perm() != 0755 || !got.ModTime().Equal(mtime) {
+		t.Errorf("copy has mode %v, mtime %v; want 0755, %v", got.Mode().Perm(), got.ModTime(), mtime)
+	}
+}
+
+// The owner a client sends is only restored with -preserve-owner, and a
+// file whose owner can't be changed is stored anyway
+func TestPreserveOwner(t *testing.T) {
+	payload := "upload a.txt\tuid=12345\tgid=12345\tsize=5\nhello"
+	for _, chown := range []bool{false, true} {
+		logs := captureLog(t, slog.LevelInfo)
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), chown: chown}
+		if replies := testSession(t, cfg, payload); !strings.HasPrefix(replies, "OK ") {
+			t.Fatalf("chown %v: replies %q", chown, replies)
+		}
+		info, err := os.Stat(filepath.Join(dir, "a.txt"))
+		if err != nil {
+			t.Fatalf("chown %v: file not stored: %v", chown, err)
+		}
+		uid, _, ok := fileOwner(info)
+		if !ok {
+			t.Skip("files have no numeric owner on this platform")
+		}
+		switch {
+		case !chown && uid != os.Geteuid():
+			t.Errorf("without -preserve-owner the file is owned by %d, want the server's %d", uid, os.Geteuid())
+		case chown && os.Geteuid() == 0 && uid != 12345:
+			t.Errorf("as root with -preserve-owner the file is owned by %d, want 12345", uid)
+		case chown && os.Geteuid() != 0 && !strings.Contains(logs.String(), "Can't restore owner"):
+			t.Error("failing to restore the owner wasn't logged")
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package shadowx
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Each side opens a connection with a banner naming the software and the
+// version of the protocol it speaks, "SHADOWX <major>.<minor>", the client
+// following its banner with the key without waiting for the server's, which
+// the server only sends once it has read the client's. Sides
+// whose major versions differ would misread each other's framing, so both
+// abort: the server answers "VERSION MISMATCH <reason>" in place of the
+// authentication reply. A minor version only adds what the other side can
+// do without, and each side only uses what the other's banner says it knows:
+//
+//	1.1  the server acknowledges how much of an upload arrived
+//	1.2  the server takes multiplexed connections, see mux.go
+const (
+	protocolMajor = 1
+	protocolMinor = 2
+)
+
+// The banner this side opens connections with
+var protocolBanner = fmt.Sprintf("SHADOWX %d.%d", protocolMajor, protocolMinor)
+
+// Returned, wrapped, when the server speaks another major version of the
+// protocol, or predates versions altogether
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+
+// The minor version of the other side's banner, or why the banner rules out
+// talking to it when its major version doesn't match
+func parseBanner(line string) (minor int, reason string) {
+	version, ok := strings.CutPrefix(line, "SHADOWX ")
+	if !ok {
+		return 0, "no protocol version"
+	}
+	majorStr, minorStr, ok := strings.Cut(version, ".")
+	major, err := strconv.Atoi(majorStr)
+	minor, minorErr := strconv.Atoi(minorStr)
+	if !ok || err != nil || minorErr != nil || minor < 0 {
+		return 0, fmt.Sprintf("malformed protocol version %q", version)
+	}
+	if major != protocolMajor {
+		return 0, fmt.Sprintf("protocol %s, not %d.%d", version, protocolMajor, protocolMinor)
+	}
+	return minor, ""
+}
+
+// A request line sent by the client after authentication:
+// "<verb> <name>" followed by optional tab-separated key=value attributes
+type request struct {
+	verb  string
+	name  string
+	attrs map[string]string
+}
+
+// Parse a request line
+func parseRequest(line string) (request, error) {
+	fields := strings.Split(line, "\t")
+	verb, name, ok := strings.Cut(fields[0], " ")
+	if !ok || verb == "" || name == "" {
+		return request{}, fmt.Errorf("malformed request %q", line)
+	}
+	req := request{verb: verb, name: name, attrs: make(map[string]string)}
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return request{}, fmt.Errorf("malformed attribute %q", field)
+		}
+		req.attrs[key] = value
+	}
+	return req, nil
+}
+
+// Encode the request as a line, without the trailing newline
+func (r request) String() string {
+	var b strings.Builder
+	b.WriteString(r.verb + " " + r.name)
+	keys := make([]string, 0, len(r.attrs))
+	for key := range r.attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString("\t" + key + "=" + r.attrs[key])
+	}
+	return b.String()
+}
+
+// Check that a name can be carried in a request line
+func validRequestName(name string) error {
+	if name == "" || strings.ContainsAny(name, "\t\r\n") {
+		return fmt.Errorf("unsupported file name %q", name)
+	}
+	return nil
+}
+
+// Check that a requested name stays under the server's root: not absolute
+// and without ".." components, whichever separator the client used
+func validStoredName(name string) error {
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return fmt.Errorf("absolute file name %q", name)
+	}
+	for _, part := range strings.FieldsFunc(name, isSeparator) {
+		if part == ".." {
+			return fmt.Errorf("file name %q leaves its directory", name)
+		}
+	}
+	return nil
+}
+
+// Check that an address given with flag is host:port. IPv6 addresses need
+// brackets, which is easy to miss.
+func validAddress(flag, addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("%s %q: put IPv6 addresses in brackets, as in [::1]:8080", flag, addr)
+		}
+		return fmt.Errorf("%s %q: want host:port, as in 192.168.1.100:8080, [::1]:8080 or example.com:8080", flag, addr)
+	}
+	return nil
+}
+
+func isSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+// The name a local path is sent under: absolute paths are made relative so
+// the server stores them under its root
+func sendName(path string) string {
+	name := strings.TrimPrefix(path, filepath.VolumeName(path))
+	return strings.TrimLeftFunc(name, isSeparator)
+}
+
+// Parse a "RESUME <token> <offset>" reply
+func parseResume(line string) (token string, offset int64, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "RESUME" || !validUploadToken(fields[1]) {
+		return "", 0, fmt.Errorf("unexpected reply %q", line)
+	}
+	offset, err = strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || offset < 0 {
+		return "", 0, fmt.Errorf("bad offset in %q", line)
+	}
+	return fields[1], offset, nil
+}
+
+// Parse an "APPEND <offset>" reply
+func parseAppend(line string) (int64, error) {
+	value, ok := strings.CutPrefix(line, "APPEND ")
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %q", line)
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("bad offset in %q", line)
+	}
+	return offset, nil
+}
+
+// Request verbs the server accepts
+var knownVerbs = map[string]bool{
+	"upload":     true, // store the data that follows
+	"checksum":   true, // report the SHA-256 of a stored file
+	"download":   true, // send back a stored file
+	"patch":      true, // apply the unified diff that follows to a stored file
+	"session":    true, // receive the framed uploads that follow, see session.go
+	"manifest":   true, // say which of the files that follow are stored already, see dedupe.go
+	"list":       true, // list a stored directory, see listing.go
+	"verify":     true, // say whether a stored file has the given SHA-256, see audit.go
+	"chunked":    true, // receive a file whose byte ranges arrive on other connections, see streams.go
+	"range":      true, // write the data that follows into a chunked upload, see streams.go
+	"symlink":    true, // create a symbolic link to the target attribute, see symlink.go
+	"mkdir":      true, // create a directory, see mkdir.go
+	"delete":     true, // remove a stored file, see delete.go
+	"dirsession": true, // say which files of a resumable directory are stored, see dirsession.go
+	"mux":        true, // receive the multiplexed uploads that follow, see mux.go
+}
+
+// Longest protocol line accepted, which bounds what a client can make the
+// server buffer before authenticating
+const maxLineLength = 4096
+
+var errLineTooLong = errors.New("line too long")
+
+// A connection whose protocol lines are read through a buffer. Reads return
+// the buffered data first, so data that arrived in the same segment as a
+// line isn't lost.
+type lineConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read conn through a buffer of size bytes, or of maxLineLength if that is larger
+func newLineConn(conn net.Conn, size int) *lineConn {
+	return &lineConn{Conn: conn, reader: bufio.NewReaderSize(conn, max(size, maxLineLength))}
+}
+
+func (c *lineConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Read a line of at most maxLineLength bytes, without its line ending
+func (c *lineConn) readLine() (string, error) {
+	line, err := c.reader.ReadSlice('\n')
+	switch {
+	case err == bufio.ErrBufferFull || len(line) > maxLineLength:
+		return "", errLineTooLong
+	case err == io.EOF && len(line) > 0:
+		return "", io.ErrUnexpectedEOF
+	case err != nil:
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// An authenticated connection to the server. Everything from the
+// authentication reply on is read through reader, which the replies to a
+// request are read with too, so control lines and the data around them are
+// never split between buffers.
+type clientConn struct {
+	serverConn
+	reader *bufio.Reader
+	minor  int // minor protocol version the server speaks
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
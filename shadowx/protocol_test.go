@@ -0,0 +1,324 @@
+package shadowx
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    request
+		wantErr bool
+	}{
+		{line: "upload data.bin", want: request{verb: "upload", name: "data.bin", attrs: map[string]string{}}},
+		{line: "upload my report final.pdf", want: request{verb: "upload", name: "my report final.pdf", attrs: map[string]string{}}},
+		{line: "upload a b\tresume=new\tsha256=ab=cd", want: request{verb: "upload", name: "a b", attrs: map[string]string{"resume": "new", "sha256": "ab=cd"}}},
+		{line: "upload", wantErr: true},
+		{line: "upload ", wantErr: true},
+		{line: "upload x\tnovalue", wantErr: true},
+		{line: "upload x\t=v", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRequest(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRequest(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRequest(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	req := request{verb: "upload", name: "dir/my file.txt", attrs: map[string]string{"sha256": "abc", "resume": "new"}}
+	line := req.String()
+	if line != "upload dir/my file.txt\tresume=new\tsha256=abc" {
+		t.Errorf("String() = %q", line)
+	}
+	got, err := parseRequest(line)
+	if err != nil || !reflect.DeepEqual(got, req) {
+		t.Errorf("parseRequest(String()) = %+v, %v; want %+v", got, err, req)
+	}
+}
+
+func TestValidRequestName(t *testing.T) {
+	for _, name := range []string{"a.txt", "dir/with space.txt"} {
+		if err := validRequestName(name); err != nil {
+			t.Errorf("validRequestName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "tab\tname", "new\nline", "cr\rname"} {
+		if err := validRequestName(name); err == nil {
+			t.Errorf("validRequestName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestParseResume(t *testing.T) {
+	token := "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		line       string
+		wantOffset int64
+		wantErr    bool
+	}{
+		{line: "RESUME " + token + " 0", wantOffset: 0},
+		{line: "RESUME " + token + " 4096", wantOffset: 4096},
+		{line: "RESUME " + token + " -1", wantErr: true},
+		{line: "RESUME " + token, wantErr: true},
+		{line: "RESUME nothex 10", wantErr: true},
+		{line: "OK " + token + " 10", wantErr: true},
+	}
+	for _, tt := range tests {
+		gotToken, gotOffset, err := parseResume(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseResume(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (gotToken != token || gotOffset != tt.wantOffset) {
+			t.Errorf("parseResume(%q) = %q, %d", tt.line, gotToken, gotOffset)
+		}
+	}
+}
+
+func TestLineConnReadLine(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		rest    string
+		wantErr error
+	}{
+		{input: "upload a.txt\nhello", want: "upload a.txt", rest: "hello"},
+		{input: "upload my report final.pdf\r\n\x00\x01", want: "upload my report final.pdf", rest: "\x00\x01"},
+		{input: "\n", want: ""},
+		{input: "upload a.txt", wantErr: io.ErrUnexpectedEOF},
+		{input: "", wantErr: io.EOF},
+		{input: strings.Repeat("x", maxLineLength-1) + "\n", want: strings.Repeat("x", maxLineLength-1)},
+		{input: strings.Repeat("x", maxLineLength) + "\n", wantErr: errLineTooLong},
+	}
+	for _, tt := range tests {
+		// The limit holds however large the buffer is
+		c := &lineConn{reader: bufio.NewReaderSize(strings.NewReader(tt.input), DefaultBufferSize)}
+		got, err := c.readLine()
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("readLine(%.20q) error = %v, want %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr != nil {
+			continue
+		}
+		rest, _ := io.ReadAll(c)
+		if got != tt.want || string(rest) != tt.rest {
+			t.Errorf("readLine(%.20q) = %q then %q, want %q then %q", tt.input, got, rest, tt.want, tt.rest)
+		}
+	}
+}
+
+func TestValidStoredName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"report.pdf", true},
+		{"dir/sub/my file.txt", true},
+		{"..hidden/x..y", true},
+		{"./a", true},
+		{"../../../tmp/pwn", false},
+		{"dir/../../x", false},
+		{"dir/..", false},
+		{`..\..\windows\x`, false},
+		{"/etc/cron.d/evil", false},
+		{`\\server\share\x`, false},
+	}
+	for _, tt := range tests {
+		if err := validStoredName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("validStoredName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestSendName(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"file.txt", "file.txt"},
+		{"dir/a.txt", "dir/a.txt"},
+		{"/var/log/syslog", "var/log/syslog"},
+		{"//srv/x", "srv/x"},
+	}
+	for _, tt := range tests {
+		if got := sendName(tt.path); got != tt.want {
+			t.Errorf("sendName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1:8080"},
+		{addr: "0.0.0.0:8080"},
+		{addr: "[::1]:8080"},
+		{addr: "[::]:8080"},
+		{addr: "[fe80::1%eth0]:8080"},
+		{addr: "example.com:8080"},
+		{addr: ":8080"},
+		{addr: "", wantErr: true},
+		{addr: "example.com", wantErr: true},
+		{addr: "::1:8080", wantErr: true},
+		{addr: "[::1]", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validAddress("-i", tt.addr); (err != nil) != tt.wantErr {
+			t.Errorf("validAddress(%q) = %v, wantErr %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+// A server that sends its authentication reply, the reply to the request
+// and the data that follows in one write loses the client nothing: every
+// line and byte after the reply is read through the same buffer
+func TestClientReadsRepliesAfterAuthentication(t *testing.T) {
+	t.Chdir(t.TempDir())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requests := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n') // banner
+		reader.ReadString('\n') // key
+		conn.Write([]byte(protocolBanner + "\nAuthentication successful\nOK 11\nhello worldBYE files=0 bytes=11 duration=1ms\n"))
+		request, _ := reader.ReadString('\n')
+		requests <- request
+	}()
+
+	client := &Client{Addr: listener.Addr().String(), Key: "test-key", NoTLS: true}
+	if err := client.Download("greeting.txt", "greeting.txt"); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if data, err := os.ReadFile("greeting.txt"); err != nil || string(data) != "hello world" {
+		t.Errorf("downloaded %q, %v; want hello world", data, err)
+	}
+	if request := <-requests; request != "download greeting.txt\n" {
+		t.Errorf("server received request %q", request)
+	}
+}
+
+func TestParseBanner(t *testing.T) {
+	for line, want := range map[string]string{
+		protocolBanner:   "",
+		"SHADOWX 1.7":    "",
+		"SHADOWX 2.0":    "protocol 2.0",
+		"SHADOWX 1":      "malformed",
+		"SHADOWX one.0":  "malformed",
+		"test-key":       "no protocol version",
+		"SHADOWX1.0":     "no protocol version",
+		"shadowx 1.0":    "no protocol version",
+		"SHADOWX 1.0 2":  "malformed",
+		"SHADOWX 01.0.0": "malformed",
+		"SHADOWX 1.-1":   "malformed",
+	} {
+		if _, got := parseBanner(line); want == "" && got != "" || !strings.Contains(got, want) {
+			t.Errorf("parseBanner(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+// A client refuses a server of another major version, or one that predates
+// banners and so took the client's banner for a wrong key, without retrying
+func TestClientVersionMismatch(t *testing.T) {
+	for name, greeting := range map[string]string{
+		"newer major":    "SHADOWX 2.0\nAuthentication successful\n",
+		"older server":   "Authentication failed\n",
+		"refused banner": protocolBanner + "\nVERSION MISMATCH client speaks protocol 1.0, not 2.0\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					bufio.NewReader(conn).ReadString('\n')
+					conn.Write([]byte(greeting))
+					conn.Close()
+				}
+			}()
+			if err := os.WriteFile("a.txt", []byte("alpha"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{Addr: listener.Addr().String(), Key: "test-key", NoTLS: true, Retries: 3}
+			err = client.Send("a.txt")
+			if !errors.Is(err, ErrVersionMismatch) || errors.Is(err, ErrAuthFailed) {
+				t.Errorf("Send = %v, want a version mismatch", err)
+			}
+		})
+	}
+}
+
+// The server answers a client of another major version, or one that opens
+// with its key as clients before banners did, with VERSION MISMATCH and
+// doesn't count it as a failed authentication
+func TestServerVersionMismatch(t *testing.T) {
+	for name, tt := range map[string]struct {
+		hello      string
+		wantBanner bool
+	}{
+		"newer major":  {hello: "SHADOWX 2.0\nsecret\n", wantBanner: true},
+		"older client": {hello: "secret\nupload a.txt\tsize=1\nx"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			logs := captureLog(t, slog.LevelInfo)
+			cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan error, 1)
+			go func() { done <- handleConnection(server, cfg) }()
+			go client.Write([]byte(tt.hello))
+
+			replies, _ := io.ReadAll(client)
+			if err := <-done; err != nil {
+				t.Fatalf("handleConnection: %v", err)
+			}
+			want := "VERSION MISMATCH client speaks "
+			if tt.wantBanner {
+				want = protocolBanner + "\n" + want
+			}
+			if !strings.HasPrefix(string(replies), want) || strings.Contains(string(replies), "Authentication") {
+				t.Errorf("replies %q, want them to start with %q", replies, want)
+			}
+			if len(cfg.authFailures.clients) != 0 {
+				t.Error("version mismatch counted as a failed authentication")
+			}
+			if strings.Contains(logs.String(), "secret") {
+				t.Error("the key an older client sent was logged")
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("output directory holds %d entries, want none", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable the PSK is read from when -p isn't given
+const PSKEnv = "SHADOWX_PSK"
+
+// Returned by LoadKey when no source provides a key
+var ErrNoKey = errors.New("no pre-shared key: pass -p, set " + PSKEnv + " or use -psk-file")
+
+// Find the PSK, keeping it out of shell history and ps output when it comes
+// from the environment or a file. key (from -p) wins over $SHADOWX_PSK,
+// which wins over the contents of file, less one trailing newline.
+func LoadKey(key, file string) (string, error) {
+	if key != "" && file != "" {
+		return "", errors.New("-p and -psk-file can't be combined")
+	}
+	if key != "" {
+		return key, nil
+	}
+	if env := os.Getenv(PSKEnv); env != "" {
+		return env, nil
+	}
+	if file == "" {
+		return "", ErrNoKey
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("reading -psk-file: %w", err)
+	}
+	key = strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if key == "" {
+		return "", fmt.Errorf("-psk-file %s holds an empty key", file)
+	}
+	return key, nil
+}
+
+// Read the further keys of -psk-dirs from file, one "key:dir" per line, the
+// key ending at the first colon. Blank lines and lines starting with # are
+// skipped.
+func LoadKeyDirs(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading -psk-dirs: %w", err)
+	}
+	dirs := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, dir, ok := strings.Cut(line, ":")
+		key, dir = strings.TrimSpace(key), strings.TrimSpace(dir)
+		if !ok || key == "" || dir == "" {
+			return nil, fmt.Errorf("-psk-dirs %s line %d: want key:dir", file, i+1)
+		}
+		if _, ok := dirs[key]; ok {
+			return nil, fmt.Errorf("-psk-dirs %s line %d: key given twice", file, i+1)
+		}
+		dirs[key] = dir
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("-psk-dirs %s holds no keys", file)
+	}
+	return dirs, nil
+}
@@ -0,0 +1,94 @@
+package shadowx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadKey(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"key": "from-file\n", "crlf": "from-file\r\n", "bare": "from-file", "empty": "\n", "blank": ""} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		key     string
+		env     string
+		file    string
+		want    string
+		wantErr error
+	}{
+		{name: "flag", key: "from-flag", want: "from-flag"},
+		{name: "flag over env", key: "from-flag", env: "from-env", want: "from-flag"},
+		{name: "env", env: "from-env", want: "from-env"},
+		{name: "env over file", env: "from-env", file: "key", want: "from-env"},
+		{name: "file", file: "key", want: "from-file"},
+		{name: "file with CRLF", file: "crlf", want: "from-file"},
+		{name: "file without newline", file: "bare", want: "from-file"},
+		{name: "flag and file", key: "from-flag", file: "key"},
+		{name: "empty file", file: "empty"},
+		{name: "blank file", file: "blank"},
+		{name: "missing file", file: "missing"},
+		{name: "none", wantErr: ErrNoKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(PSKEnv, tt.env)
+			file := tt.file
+			if file != "" {
+				file = filepath.Join(dir, file)
+			}
+			got, err := LoadKey(tt.key, file)
+			if tt.want == "" {
+				if err == nil || tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("LoadKey = %q, %v; want error %v", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("LoadKey = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadKeyDirs(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		data string
+		want map[string]string
+	}{
+		{"red:/srv/red\nblue:/srv/blue\n", map[string]string{"red": "/srv/red", "blue": "/srv/blue"}},
+		{"# teams\n\n red : /srv/red \r\n", map[string]string{"red": "/srv/red"}},
+		{"red:C:\\shadowx\\red\n", map[string]string{"red": "C:\\shadowx\\red"}},
+		{"red:/srv/red\nred:/srv/blue\n", nil},
+		{"red\n", nil},
+		{":/srv/red\n", nil},
+		{"red:\n", nil},
+		{"# none\n", nil},
+	}
+	for i, tt := range tests {
+		file := filepath.Join(dir, "dirs")
+		if err := os.WriteFile(file, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := LoadKeyDirs(file)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%d: LoadKeyDirs = %v, want an error", i, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d: LoadKeyDirs = %v, %v; want %v", i, got, err, tt.want)
+		}
+	}
+	if _, err := LoadKeyDirs(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadKeyDirs of a missing file succeeded")
+	}
+}
@@ -0,0 +1,112 @@
+package shadowx
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A -psk-hash value is "scrypt$<N>$<r>$<p>$<salt>$<hash>", the salt and the
+// hash in unpadded base64. The server keeps it instead of the key and hashes
+// each key a client presents to compare, so a leaked config or command line
+// doesn't give the key away.
+
+// scrypt costs of the hashes HashKey makes, the recommended ones for
+// interactive logins: each check takes 32MiB and tens of milliseconds
+const (
+	keyHashN = 1 << 15
+	keyHashR = 8
+	keyHashP = 1
+)
+
+// Highest costs a -psk-hash may ask for, so checking a key can't take the
+// server's memory or CPU: N up to twice HashKey's, at most 64MiB for a
+// check, which takes 128*N*r bytes, and a few passes over it
+const (
+	maxKeyHashN      = 1 << 16
+	maxKeyHashMemory = 64 << 20
+	maxKeyHashP      = 4
+)
+
+// Keys checked against a hash at once; further checks wait their turn, so
+// a flood of connections can't make the server hash more than this many
+// at a time
+const maxKeyChecks = 4
+
+// A parsed -psk-hash value
+type keyHash struct {
+	n, r, p int
+	salt    []byte
+	sum     []byte
+	checks  chan struct{} // one per check running
+}
+
+// Hash key with scrypt under a random salt into a value for Server.KeyHash
+// and -psk-hash
+func HashKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("a pre-shared key is required")
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	sum, err := scrypt.Key([]byte(key), salt, keyHashN, keyHashR, keyHashP, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("scrypt$%d$%d$%d$%s$%s", keyHashN, keyHashR, keyHashP, enc.EncodeToString(salt), enc.EncodeToString(sum)), nil
+}
+
+// Parse a value HashKey made
+func parseKeyHash(s string) (*keyHash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "scrypt" {
+		return nil, errors.New("want scrypt$N$r$p$salt$hash, as -hash-psk prints it")
+	}
+	h := &keyHash{}
+	var err error
+	for i, cost := range []*int{&h.n, &h.r, &h.p} {
+		if *cost, err = strconv.Atoi(parts[i+1]); err != nil || *cost <= 0 {
+			return nil, fmt.Errorf("malformed scrypt cost %q", parts[i+1])
+		}
+	}
+	if h.n < 2 || h.n&(h.n-1) != 0 || h.n > maxKeyHashN {
+		return nil, fmt.Errorf("scrypt N must be a power of two up to %d", maxKeyHashN)
+	}
+	if h.r > maxKeyHashMemory/(128*h.n) || h.p > maxKeyHashP {
+		return nil, fmt.Errorf("scrypt r and p are too large, a check may take at most %dMiB and %d passes", maxKeyHashMemory>>20, maxKeyHashP)
+	}
+	enc := base64.RawStdEncoding
+	if h.salt, err = enc.DecodeString(parts[4]); err != nil || len(h.salt) == 0 {
+		return nil, errors.New("malformed salt")
+	}
+	if h.sum, err = enc.DecodeString(parts[5]); err != nil || len(h.sum) < 16 {
+		return nil, errors.New("malformed hash")
+	}
+	h.checks = make(chan struct{}, maxKeyChecks)
+	return h, nil
+}
+
+// Whether key hashes to h, compared in constant time. Waits while
+// maxKeyChecks other checks are running.
+func (h *keyHash) matches(key string) bool {
+	h.checks <- struct{}{}
+	defer func() { <-h.checks }()
+	sum, err := scrypt.Key([]byte(key), h.salt, h.n, h.r, h.p, len(h.sum))
+	return err == nil && subtle.ConstantTimeCompare(sum, h.sum) == 1
+}
+
+// Whether key is the one connections authenticate to cfg with, checked
+// against the -psk-hash when the server was given that instead
+func (cfg *serverConfig) keyAccepted(key string) bool {
+	if cfg.keyHash != nil {
+		return cfg.keyHash.matches(key)
+	}
+	return keyMatches(key, cfg.secretKey)
+}
@@ -0,0 +1,118 @@
+package shadowx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseKeyHash(t *testing.T) {
+	hash, err := HashKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseKeyHash(hash)
+	if err != nil {
+		t.Fatalf("parseKeyHash(%q) = %v", hash, err)
+	}
+	if !h.matches("correct horse") || h.matches("correct horse ") || h.matches("") {
+		t.Error("hash doesn't tell the key from others")
+	}
+	if other, _ := HashKey("correct horse"); other == hash {
+		t.Error("two hashes of one key share a salt")
+	}
+
+	parts := strings.Split(hash, "$")
+	for _, bad := range []string{
+		"",
+		"correct horse",
+		strings.Replace(hash, "scrypt", "bcrypt", 1),
+		strings.Join(parts[:5], "$"),
+		strings.Replace(hash, "$32768$", "$1000$", 1),
+		strings.Replace(hash, "$32768$", "$2097152$", 1),
+		strings.Replace(hash, "$32768$", "$131072$", 1),
+		strings.Replace(hash, "$8$", "$0$", 1),
+		strings.Replace(hash, "$8$", "$64$", 1),
+		strings.Replace(hash, "$8$1$", "$8$5$", 1),
+		strings.Join(append(parts[:4:4], "!!", parts[5]), "$"),
+		strings.Join(append(parts[:5:5], "c2hvcnQ"), "$"),
+	} {
+		if _, err := parseKeyHash(bad); err == nil {
+			t.Errorf("parseKeyHash(%q) accepted it", bad)
+		}
+	}
+}
+
+// A server holding only the hash of the key lets in a client with the key
+// and turns away one with another
+func TestServerKeyHash(t *testing.T) {
+	t.Chdir(t.TempDir())
+	hash, err := HashKey("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{KeyHash: hash, OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&Client{Addr: srv.Addr, Key: "test-key"}).Send("a.txt"); err != nil {
+		t.Fatalf("Send with the key: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "a.txt")); err != nil || string(got) != "hello" {
+		t.Errorf("stored file = %q, %v; want %q", got, err, "hello")
+	}
+	if err := (&Client{Addr: srv.Addr, Key: "wrong-key"}).Send("a.txt"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Send with another key = %v, want authentication to fail", err)
+	}
+	if err := (&Client{Addr: srv.Addr, Key: hash}).Send("a.txt"); err == nil {
+		t.Error("Send with the hash itself authenticated")
+	}
+}
+
+// Checks past maxKeyChecks wait for a running one to finish
+func TestKeyHashLimitsChecks(t *testing.T) {
+	hash, err := HashKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseKeyHash(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range maxKeyChecks {
+		h.checks <- struct{}{}
+	}
+	done := make(chan bool)
+	go func() { done <- h.matches("correct horse") }()
+	select {
+	case <-done:
+		t.Fatal("check ran with maxKeyChecks others running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-h.checks
+	if !<-done {
+		t.Error("check that waited didn't match the key")
+	}
+}
+
+func TestServerKeyHashErrors(t *testing.T) {
+	hash, err := HashKey("test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, srv := range map[string]*Server{
+		"key and hash":          {Key: "test-key", KeyHash: hash},
+		"malformed hash":        {KeyHash: "scrypt$1$2$3"},
+		"hashed names":          {KeyHash: hash, HashNames: true, ManifestPath: filepath.Join(t.TempDir(), "manifest.jsonl")},
+		"encryption by the key": {KeyHash: hash, EncryptAtRest: true},
+	} {
+		srv.Addr, srv.OutDir = "127.0.0.1:0", t.TempDir()
+		if err := srv.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "-psk-hash") {
+			t.Errorf("%s: ListenAndServe = %v, want a -psk-hash error", name, err)
+		}
+	}
+}
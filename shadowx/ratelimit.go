@@ -0,0 +1,193 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket pacing a byte stream to a fixed rate
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64 // most bytes that can go out at once after idling
+	tokens float64 // may go negative, which is paid off by sleeping
+	last   time.Time
+}
+
+// Create a bucket for rate bytes per second, allowing a tenth of a second of burst
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Account for n bytes, sleeping as long as needed to stay within the rate
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens < 0 {
+		time.Sleep(time.Duration(-b.tokens / b.rate * float64(time.Second)))
+		b.last = time.Now()
+		b.tokens = 0
+	}
+}
+
+// Connection whose reads and writes are paced by independent buckets
+type throttledConn struct {
+	net.Conn
+	read  *tokenBucket // nil when reads are unlimited
+	write *tokenBucket // nil when writes are unlimited
+}
+
+// Wrap conn so it sends at most up and receives at most down bytes per
+// second; 0 leaves that direction unlimited
+func throttle(conn net.Conn, up, down int64) net.Conn {
+	if up == 0 && down == 0 {
+		return conn
+	}
+	t := &throttledConn{Conn: conn}
+	if up > 0 {
+		t.write = newTokenBucket(up)
+	}
+	if down > 0 {
+		t.read = newTokenBucket(down)
+	}
+	return t
+}
+
+func (t *throttledConn) Read(p []byte) (int, error) {
+	if t.read == nil {
+		return t.Conn.Read(p)
+	}
+	if max := int(t.read.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.read.take(n)
+	}
+	return n, err
+}
+
+func (t *throttledConn) Write(p []byte) (int, error) {
+	if t.write == nil {
+		return t.Conn.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := int(t.write.burst); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		t.write.take(len(chunk))
+		n, err := t.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Half-close the connection underneath, which plain Unix sockets carry
+// uploads on directly
+func (t *throttledConn) CloseWrite() error {
+	if c, ok := t.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return errors.New("connection can't be half-closed")
+}
+
+// Return the connection underneath any throttling and context
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *throttledConn:
+			conn = c.Conn
+		case *ctxConn:
+			conn = c.Conn
+		case *clientConn:
+			conn = c.serverConn
+		default:
+			return conn
+		}
+	}
+}
+
+// Parse a rate in bytes per second with an optional K, M or G suffix
+// (powers of 1024), e.g. "512K" or "5MB"; an empty string or "0" means
+// unlimited
+func ParseRate(value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	n, err := parseByteCount(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q, want bytes per second like 500KB or 10MB", value)
+	}
+	return n, nil
+}
+
+// Parse a byte count with an optional K, M or G suffix (powers of 1024),
+// which may be followed by B
+func parseByteCount(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, errors.New("empty byte count")
+	}
+	if last := value[len(value)-1]; (last == 'B' || last == 'b') && len(value) > 1 {
+		value = value[:len(value)-1]
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/multiplier {
+		return 0, fmt.Errorf("invalid byte count %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// Format the average rate of n bytes moved since start, e.g. "1.00 MB/s"
+func throughput(n int64, start time.Time) string {
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return "- B/s"
+	}
+	return formatRate(float64(n) / elapsed)
+}
+
+// Format a rate in bytes per second with the largest unit that keeps it at
+// least 1, e.g. "1.50 KB/s"
+func formatRate(rate float64) string {
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+	i := 0
+	for ; rate >= 1024 && i < len(units)-1; i++ {
+		rate /= 1024
+	}
+	return fmt.Sprintf("%.2f %s", rate, units[i])
+}
@@ -0,0 +1,124 @@
+package shadowx
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "1000", want: 1000},
+		{value: "512K", want: 512 << 10},
+		{value: "10m", want: 10 << 20},
+		{value: "1G", want: 1 << 30},
+		{value: "K", wantErr: true},
+		{value: "-5M", wantErr: true},
+		{value: "1.5M", wantErr: true},
+		{value: "10MB", want: 10 << 20},
+		{value: "500KB", want: 500 << 10},
+		{value: "5mb", want: 5 << 20},
+		{value: "100B", want: 100},
+		{value: "B", wantErr: true},
+		{value: "KB", wantErr: true},
+		{value: "5BB", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRate(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketPacing(t *testing.T) {
+	b := newTokenBucket(1 << 20)
+	start := time.Now()
+	b.take(int(b.burst)) // the initial burst is free
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("initial burst took %s", elapsed)
+	}
+	b.take(200 << 10) // about 0.2s at 1 MiB/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("200 KiB at 1 MiB/s took %s", elapsed)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want string
+	}{
+		{0, "0.00 B/s"},
+		{512, "512.00 B/s"},
+		{1536, "1.50 KB/s"},
+		{10 << 20, "10.00 MB/s"},
+		{2 << 30, "2.00 GB/s"},
+		{5 << 40, "5120.00 GB/s"},
+	}
+	for _, tt := range tests {
+		if got := formatRate(tt.rate); got != tt.want {
+			t.Errorf("formatRate(%v) = %q, want %q", tt.rate, got, tt.want)
+		}
+	}
+}
+
+// 10 MB sent over a connection limited to 1 MB/s takes about ten seconds
+func TestThrottledTransfer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes ten seconds")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- -1
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := throttle(raw, 1<<20, 0)
+
+	const size = 10 << 20
+	start := time.Now()
+	if _, err := io.Copy(conn, io.LimitReader(zeroReader{}, size)); err != nil {
+		t.Fatal(err)
+	}
+	raw.Close()
+	if n := <-received; n != size {
+		t.Fatalf("received %d bytes, want %d", n, size)
+	}
+	if elapsed := time.Since(start); elapsed < 9*time.Second || elapsed > 12*time.Second {
+		t.Errorf("10 MB at 1 MB/s took %s, want about 10s", elapsed)
+	}
+}
+
+// Endless zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,86 @@
+package shadowx
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Client record of upload tokens the server assigned to interrupted transfers
+type resumeState struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]resumeEntry
+}
+
+// Token for a file, valid only while its content has the same digest, or
+// the session ID of a directory, which has no digest
+type resumeEntry struct {
+	Token  string `json:"token"`
+	SHA256 string `json:"sha256"`
+}
+
+// Load resume state from path; a missing file yields an empty state
+func loadResumeState(path string) (*resumeState, error) {
+	r := &resumeState{path: path, entries: make(map[string]resumeEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.entries); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Return the token to resume filename with, or "new" to start a fresh upload
+func (r *resumeState) token(filename, sum string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[cacheKey(filename)]
+	if !ok || entry.SHA256 != sum {
+		return "new"
+	}
+	return entry.Token
+}
+
+// Remember the token assigned to filename and persist it immediately, so an
+// interrupted run can pick up where it stopped
+func (r *resumeState) remember(filename, sum, token string) error {
+	r.mu.Lock()
+	r.entries[cacheKey(filename)] = resumeEntry{Token: token, SHA256: sum}
+	r.mu.Unlock()
+	return r.save()
+}
+
+// Drop the token for filename and persist the change
+func (r *resumeState) forget(filename string) error {
+	r.mu.Lock()
+	key := cacheKey(filename)
+	_, ok := r.entries[key]
+	delete(r.entries, key)
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return r.save()
+}
+
+// Write the state to disk
+func (r *resumeState) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := json.Marshal(r.entries)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
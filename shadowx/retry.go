@@ -0,0 +1,108 @@
+package shadowx
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Wait before the first retry of a failed connection unless configured;
+// each further retry waits twice as long, up to maxRetryDelay
+const (
+	DefaultRetryDelay = time.Second
+	maxRetryDelay     = time.Minute
+)
+
+// The wait before retry attempt, counting from 1, of something that failed
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = DefaultRetryDelay
+	}
+	delay := base
+	for range attempt - 1 {
+		if delay *= 2; delay >= maxRetryDelay {
+			return maxRetryDelay
+		}
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// Whether err is a network failure that another attempt may get past: a
+// refused, reset or dropped connection, or a timeout. A rejected key, a
+// certificate that fails verification or a canceled Send aren't.
+func transient(err error) bool {
+	if errors.Is(err, ErrAuthFailed) || errors.Is(err, ErrVersionMismatch) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EPIPE,
+		syscall.ENETUNREACH, syscall.EHOSTUNREACH, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// The server closing the connection before answering
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Wait for d, or until ctx is done; returns false when it is
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// A failure to connect that openSession gave up retrying, so a transfer
+// isn't retried for it again
+type connectError struct{ err error }
+
+func (e *connectError) Error() string { return e.err.Error() }
+func (e *connectError) Unwrap() error { return e.err }
+
+// Connect and authenticate to the server, retrying transient failures up
+// to cfg.retries times with exponential backoff
+func openSession(cfg *clientConfig) (*clientConn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := connectSession(cfg)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt > cfg.retries || !transient(err) {
+			return nil, &connectError{err}
+		}
+		delay := backoff(cfg.retryDelay, attempt)
+		slog.Warn("Connection failed, retrying", "err", err, "delay", delay, "attempt", attempt, "of", cfg.retries)
+		if !sleepContext(cfg.ctx, delay) {
+			return nil, &connectError{err}
+		}
+	}
+}
+
+// Send a file on a connection of its own, and with resuming on, send it
+// again after a transient failure, continuing where the server's copy ends
+func sendRetrying(cfg *clientConfig, filename string) error {
+	for attempt := 1; ; attempt++ {
+		err := sendSingleFile(cfg, filename)
+		var connectErr *connectError
+		if err == nil || cfg.resume == nil || filename == stdinPath || attempt > cfg.retries || !transient(err) || errors.As(err, &connectErr) {
+			return err
+		}
+		delay := backoff(cfg.retryDelay, attempt)
+		slog.Warn("Transfer interrupted, resuming", "file", filename, "err", err, "delay", delay, "attempt", attempt, "of", cfg.retries)
+		if !sleepContext(cfg.ctx, delay) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package shadowx
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 4, 8 * time.Second},
+		{time.Second, 7, maxRetryDelay},
+		{time.Second, 1000, maxRetryDelay},
+		{0, 1, DefaultRetryDelay},
+		{10 * time.Millisecond, 3, 40 * time.Millisecond},
+		{2 * time.Minute, 1, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.base, tt.attempt); got != tt.want {
+			t.Errorf("backoff(%v, %d) = %v, want %v", tt.base, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"reset", fmt.Errorf("%w: %w", errSendingData, syscall.ECONNRESET), true},
+		{"timeout", os.ErrDeadlineExceeded, true},
+		{"closed during handshake", fmt.Errorf("connecting to server: %w", io.EOF), true},
+		{"rejected key", fmt.Errorf("%w. Server response: no", ErrAuthFailed), false},
+		{"canceled", context.Canceled, false},
+		{"bad certificate", &x509.UnknownAuthorityError{}, false},
+		{"missing file", os.ErrNotExist, false},
+	}
+	for _, tt := range tests {
+		if got := transient(tt.err); got != tt.want {
+			t.Errorf("%s: transient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// Listen in front of addr, closing the first refuse connections at once
+// and relaying the rest. Returns the proxy's address and the connection count.
+func flakyProxy(t *testing.T, addr string, refuse int32) (string, *atomic.Int32) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) <= refuse {
+				conn.Close()
+				continue
+			}
+			upstream, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				conn.Close()
+				upstream.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+// A server that drops the first two connections is reached on the third
+// attempt, while too few retries, or a rejected key, give up
+func TestConnectRetries(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	tests := []struct {
+		name     string
+		key      string
+		retries  int
+		ok       bool
+		attempts int32
+	}{
+		{"enough retries", srv.Key, 2, true, 3},
+		{"too few retries", srv.Key, 1, false, 2},
+		{"no retries", srv.Key, 0, false, 1},
+		{"rejected key", "wrong-key", 5, false, 3},
+	}
+	for _, tt := range tests {
+		os.RemoveAll(DefaultOutDir)
+		addr, accepted := flakyProxy(t, srv.Addr, 2)
+		client := &Client{Addr: addr, Key: tt.key, Retries: tt.retries, RetryDelay: time.Millisecond}
+		err := client.Send("a.txt")
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Send = %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if got := accepted.Load(); got != tt.attempts {
+			t.Errorf("%s: %d connections, want %d", tt.name, got, tt.attempts)
+		}
+		if _, err := os.Stat(filepath.Join(DefaultOutDir, "a.txt")); (err == nil) != tt.ok {
+			t.Errorf("%s: file stored %v, want %v", tt.name, err == nil, tt.ok)
+		}
+		if tt.key != srv.Key && !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: Send = %v, want ErrAuthFailed", tt.name, err)
+		}
+	}
+}
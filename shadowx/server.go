@@ -0,0 +1,362 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A ShadowX server, receiving files from clients over TLS. Set the fields
+// before calling ListenAndServe.
+type Server struct {
+	Addr         string   // address to listen on, host:port
+	Key          string   // pre-shared key clients authenticate with
+	KeyHash      string   // HashKey's hash of the key, to check clients' keys against instead of Key, which must be empty
+	OutDir       string   // directory received files are written under, DefaultOutDir when empty
+	CreateOutDir bool     // create OutDir if it doesn't exist; DefaultOutDir always is
+	Device       string   // write the single upload to this existing device instead of a file
+	HashNames    bool     // store files as <HMAC-SHA256 of name>.dat; requires ManifestPath
+	ManifestPath string   // append a JSON record of every received file here, empty to disable
+	DenyHashes   string   // file listing SHA-256 digests of content to refuse, empty to disable
+	UpLimit      int64    // bytes per second sent on each connection, 0 for no limit
+	DownLimit    int64    // bytes per second received on each connection, 0 for no limit
+	HTTPAddr     string   // also serve OutDir read-only over HTTPS on this address, empty to disable
+	MetricsAddr  string   // serve counters at /metrics over plain HTTP on this address, empty to disable
+	Immutable    bool     // make stored files write-once
+	NoClobber    bool     // store uploads of a name that's taken as name.1, name.2 and so on
+	AllowDelete  bool     // delete stored files when a watching client reports them removed
+	ClientCA     string   // require client certificates signed by a CA in this PEM bundle, empty to disable
+	CertHosts    []string // hostnames and IP addresses a generated certificate is valid for, the Addr host when empty
+	TLSCert      string   // certificate to serve, with TLSKey; server.crt, generated when missing, when both are empty
+	TLSKey       string   // private key for TLSCert; server.key when both are empty
+	SocketTLS    bool     // use TLS when Addr is a Unix socket, "unix:<path>", too
+	BufferSize   int      // bytes read and written at a time, 0 for DefaultBufferSize
+	MinTLS       uint16   // oldest TLS version clients may use, tls.VersionTLS12 when 0
+	CipherSuites []uint16 // TLS 1.2 cipher suites to offer, nil for Go's defaults
+
+	// Serve without TLS, so file data and the key cross the network in the
+	// clear; only for trusted networks. Clients must set NoTLS too.
+	NoTLS bool
+
+	// Write the single upload here instead of a file, then stop; nil to
+	// store files
+	Output io.Writer
+
+	// Called with the bytes of an upload received so far, and its declared
+	// size or -1 when unknown, in place of the live progress counter. It's
+	// called at most every 100ms during a transfer and once when it ends,
+	// from a goroutine per connection.
+	ProgressFunc func(file string, received, total int64)
+
+	// Called once the server is listening, on HTTPAddr and MetricsAddr too
+	// when they're set, just before it accepts the first connection; nil to
+	// skip
+	ReadyFunc func()
+
+	// How long Shutdown lets running transfers finish before closing their
+	// connections; 0 waits for them indefinitely
+	ShutdownTimeout time.Duration
+
+	// How long a client has for the TLS handshake, and then for sending its
+	// key and request; 0 for no limit
+	ReadTimeout time.Duration
+
+	// How long a transfer may go without data arriving before the server
+	// drops it; 0 for no limit
+	IdleTimeout time.Duration
+
+	// Failed authentications from an IP address before the server refuses
+	// its connections for 10s, doubling with each further failure up to an
+	// hour; a success clears the count. 0 for no limit.
+	MaxAuthFailures int
+
+	// Connections served at once, from the handshake until they close;
+	// further ones are closed as soon as they're accepted. 0 for no limit.
+	MaxConns int
+
+	// Restore the owner and group IDs clients send with -preserve. Changing
+	// a file's owner takes root; where it fails the file is kept as it is.
+	PreserveOwner bool
+
+	// Largest file a client may upload, and most bytes it may store over
+	// one connection, whether that carries a single upload or a session of
+	// many. Uploads that declare more are refused up front; others are cut
+	// off when they go past, and their partial files removed. 0 for no
+	// limit.
+	MaxFileSize int64
+	MaxDisk     int64
+
+	// Free bytes to keep on the volume OutDir is on. An upload that declares
+	// more than would leave free is refused up front with a NO SPACE
+	// reason, as is every upload once less is free; 0 to only refuse
+	// uploads that don't fit at all.
+	Reserve int64
+
+	// CIDR ranges or IP addresses of the clients allowed to connect, nil to
+	// allow any, and of those refused, which wins over Allow. Refused
+	// clients are disconnected before anything is read from them, on the
+	// HTTPS file server too.
+	Allow []string
+	Deny  []string
+
+	// Encrypt received files on disk with AES-256-GCM, under keys derived
+	// from StorageKey, or from Key when that's empty; setting StorageKey
+	// implies EncryptAtRest. Downloads, checksums and diffs see the
+	// decrypted content, and DecryptFile recovers a file from disk.
+	// Resumable uploads are refused.
+	EncryptAtRest bool
+	StorageKey    string
+
+	// Further keys clients may authenticate with, each mapped to the
+	// directory its uploads are stored under, and its downloads and listings
+	// served from, in place of OutDir. Connections can't tell which key
+	// matched from how long authentication takes. The directories must not
+	// overlap each other or OutDir.
+	KeyDirs map[string]string
+
+	// Checks the credentials of connecting clients in place of the key, nil
+	// to check Key. Key, KeyHash and KeyDirs must be empty, and as there's
+	// no key to hash names, encrypt files or guard HTTPS with, it can't be
+	// combined with HashNames, HTTPAddr, or EncryptAtRest without
+	// StorageKey.
+	Authenticator Authenticator
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	stopped  bool
+}
+
+// Listen on s.Addr and receive files until Shutdown is called. Returns once
+// the transfers running at that point have finished.
+func (s *Server) ListenAndServe() error {
+	outDir := s.OutDir
+	if outDir == "" {
+		outDir = DefaultOutDir
+	}
+	var keyHash *keyHash
+	switch {
+	case s.Authenticator != nil:
+		// Names are hashed, files encrypted and HTTPS requests checked with the key
+		if s.Key != "" || s.KeyHash != "" || len(s.KeyDirs) > 0 {
+			return errors.New("an Authenticator replaces the key, leave Key, KeyHash and KeyDirs empty")
+		}
+		if s.HashNames || s.HTTPAddr != "" || s.EncryptAtRest && s.StorageKey == "" {
+			return errors.New("an Authenticator can't be combined with -hash-names, -http-addr, or -encrypt-at-rest without -storage-key")
+		}
+	case s.Key != "" && s.KeyHash != "":
+		return errors.New("-psk-hash replaces the key, give one or the other")
+	case s.KeyHash != "":
+		// Names are hashed and files encrypted with the key itself
+		if s.HashNames || s.EncryptAtRest && s.StorageKey == "" {
+			return errors.New("-psk-hash can't be combined with -hash-names, or with -encrypt-at-rest without -storage-key")
+		}
+		var err error
+		if keyHash, err = parseKeyHash(s.KeyHash); err != nil {
+			return fmt.Errorf("-psk-hash: %w", err)
+		}
+	case s.Key == "":
+		return errors.New("a pre-shared key is required")
+	}
+	if err := validServerAddress(s.Addr); err != nil {
+		return err
+	}
+	if s.HTTPAddr != "" {
+		if err := validAddress("-http-addr", s.HTTPAddr); err != nil {
+			return err
+		}
+	}
+	if s.MetricsAddr != "" {
+		if err := validAddress("-metrics-addr", s.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if s.Output != nil {
+		switch {
+		case s.Device != "":
+			return errors.New("-o - can't be combined with -dev")
+		case s.Immutable || s.HashNames || s.DenyHashes != "" || s.HTTPAddr != "":
+			return errors.New("-o - can't be combined with -immutable, -hash-names, -deny-hashes or -http-addr")
+		}
+	} else if s.Device == "" {
+		// A device takes the uploads, so the output directory is never written to
+		if err := prepareOutputDir(outDir, s.CreateOutDir || outDir == DefaultOutDir); err != nil {
+			return err
+		}
+	}
+	cfg := &serverConfig{address: s.Addr, secretKey: s.Key, keyHash: keyHash, outDir: outDir, device: s.Device, hashNames: s.HashNames, uploads: newUploadStore(outDir),
+		upLimit: s.UpLimit, downLimit: s.DownLimit, httpAddr: s.HTTPAddr, immutable: s.Immutable, noClobber: s.NoClobber, clientCA: s.ClientCA, output: s.Output}
+	if s.Immutable && s.Device != "" {
+		return errors.New("-immutable can't be combined with -dev")
+	}
+	if s.AllowDelete && s.Immutable {
+		return errors.New("-allow-delete can't be combined with -immutable")
+	}
+	cfg.allowDelete = s.AllowDelete
+	cfg.auth = s.Authenticator
+	if s.PreserveOwner && (s.Device != "" || s.Output != nil) {
+		return errors.New("-preserve-owner can't be combined with -dev or -o -")
+	}
+	if s.PreserveOwner && os.Geteuid() != 0 {
+		slog.Warn("Not running as root, so -preserve-owner can only restore files owned by the server's own user")
+	}
+	cfg.chown = s.PreserveOwner
+	bufferSize, err := checkBufferSize(s.BufferSize)
+	if err != nil {
+		return err
+	}
+	cfg.bufferSize = bufferSize
+	if s.ReadTimeout < 0 || s.IdleTimeout < 0 {
+		return errors.New("-read-timeout and -idle-timeout must not be negative")
+	}
+	cfg.readTimeout, cfg.idleTimeout = s.ReadTimeout, s.IdleTimeout
+	if s.MaxAuthFailures < 0 {
+		return errors.New("-max-auth-failures must not be negative")
+	}
+	cfg.maxAuthFailures = s.MaxAuthFailures
+	if s.MetricsAddr != "" {
+		cfg.metricsAddr, cfg.metrics = s.MetricsAddr, &serverMetrics{}
+	}
+	if s.MaxConns < 0 {
+		return errors.New("-max-conns must not be negative")
+	}
+	if s.MaxConns > 0 {
+		cfg.connSlots = make(chan struct{}, s.MaxConns)
+	}
+	if s.MaxFileSize < 0 || s.MaxDisk < 0 || s.Reserve < 0 {
+		return errors.New("-max-file-size, -max-disk and -reserve must not be negative")
+	}
+	cfg.maxFileSize, cfg.maxDisk, cfg.reserve = s.MaxFileSize, s.MaxDisk, s.Reserve
+	if cfg.clients.allow, err = parsePrefixes("-allow", s.Allow); err != nil {
+		return err
+	}
+	if cfg.clients.deny, err = parsePrefixes("-deny", s.Deny); err != nil {
+		return err
+	}
+	if s.EncryptAtRest || s.StorageKey != "" {
+		// Devices and outputs hold no files, and HTTPS would serve ciphertext
+		if s.Device != "" || s.Output != nil || s.HTTPAddr != "" {
+			return errors.New("-encrypt-at-rest can't be combined with -dev, -o - or -http-addr")
+		}
+		cfg.storage = storageKey(s.Key)
+		if s.StorageKey != "" {
+			cfg.storage = storageKey(s.StorageKey)
+		}
+	}
+	for _, host := range s.CertHosts {
+		if err := checkCertHost(host); err != nil {
+			return err
+		}
+	}
+	cfg.certHosts = s.CertHosts
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	cfg.tlsCert, cfg.tlsKey = s.TLSCert, s.TLSKey
+	cfg.socketTLS = s.SocketTLS
+	cfg.noTLS = s.NoTLS
+	cfg.progress = s.ProgressFunc
+	if s.NoTLS && (s.SocketTLS || s.ClientCA != "") {
+		return errors.New("-no-tls can't be combined with -socket-tls or -client-ca")
+	}
+	if plainSocket(s.Addr, s.SocketTLS) && s.ClientCA != "" {
+		return errors.New("-client-ca needs TLS on the Unix socket, add -socket-tls")
+	}
+	if cfg.minTLS, err = checkTLSPolicy(s.MinTLS, s.CipherSuites); err != nil {
+		return err
+	}
+	cfg.ciphers = s.CipherSuites
+	if s.HashNames {
+		if err := checkManifestPath(s.ManifestPath, outDir); err != nil {
+			return err
+		}
+	}
+	if s.ManifestPath != "" {
+		cfg.manifest = &manifest{path: s.ManifestPath}
+	}
+	if s.DenyHashes != "" {
+		if s.Device != "" {
+			return errors.New("-deny-hashes can't be combined with -dev, which writes data before it can be checked")
+		}
+		hashes, err := loadHashList(s.DenyHashes)
+		if err != nil {
+			return fmt.Errorf("loading hash denylist: %w", err)
+		}
+		cfg.denyHashes = hashes
+	}
+	if cfg.tenants, err = s.keyConfigs(cfg); err != nil {
+		return err
+	}
+	return s.serve(cfg)
+}
+
+// Stop accepting connections. ListenAndServe returns once the running
+// transfers have finished or ShutdownTimeout has passed.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// Record the listener for Shutdown to close, reporting false if the server
+// has already been shut down
+func (s *Server) setListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listener = listener
+	return !s.stopped
+}
+
+// Record a connection being served, or forget it once it's done
+func (s *Server) trackConn(conn net.Conn, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	if active {
+		s.conns[conn] = true
+	} else {
+		delete(s.conns, conn)
+	}
+}
+
+// Close the connections still being served, failing their transfers so the
+// handlers clean up and return
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Wait for the running transfers, closing their connections once timeout
+// has passed unless it is 0
+func (s *Server) waitForTransfers(active *sync.WaitGroup, timeout time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		active.Wait()
+		close(finished)
+	}()
+	if timeout <= 0 {
+		<-finished
+		return
+	}
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		breakProgress()
+		slog.Warn("Transfers still running, closing their connections", "after", timeout)
+		s.closeConns()
+		<-finished
+	}
+}
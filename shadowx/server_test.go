@@ -0,0 +1,236 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Start srv on a free loopback port, or its Unix socket when Addr names one.
+// The returned stop shuts it down and returns what ListenAndServe did; it
+// also runs when the test ends.
+func startTestServer(t *testing.T, srv *Server) (stop func() error) {
+	t.Helper()
+	if srv.Addr == "" {
+		srv.Addr = "127.0.0.1:0"
+	}
+	network, address := "unix", strings.TrimPrefix(srv.Addr, unixPrefix)
+	if !strings.HasPrefix(srv.Addr, unixPrefix) {
+		listener, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Addr = listener.Addr().String()
+		listener.Close()
+		network, address = "tcp", srv.Addr
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	stop = sync.OnceValue(func() error {
+		srv.Shutdown()
+		return <-served
+	})
+	t.Cleanup(func() {
+		if err := stop(); err != nil {
+			t.Errorf("ListenAndServe: %v", err)
+		}
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+			return stop
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start listening")
+		}
+	}
+}
+
+func TestServerConfigErrors(t *testing.T) {
+	keyDirs := t.TempDir()
+	tests := []struct {
+		name   string
+		server *Server
+	}{
+		{"no key", &Server{}},
+		{"immutable device", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), Immutable: true, Device: "/dev/null"}},
+		{"hash names without manifest", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), HashNames: true}},
+		{"output and device", &Server{Addr: "127.0.0.1:0", Key: "k", Output: &bytes.Buffer{}, Device: "/dev/null"}},
+		{"immutable output", &Server{Addr: "127.0.0.1:0", Key: "k", Output: &bytes.Buffer{}, Immutable: true}},
+		{"IPv6 without brackets", &Server{Addr: ":::8080", Key: "k", OutDir: t.TempDir()}},
+		{"bad HTTP address", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), HTTPAddr: "8443"}},
+		{"negative idle timeout", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), IdleTimeout: -time.Second}},
+		{"negative auth failure limit", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), MaxAuthFailures: -1}},
+		{"encryption with HTTP", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), EncryptAtRest: true, HTTPAddr: "127.0.0.1:0"}},
+		{"bad deny range", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), Allow: []string{"10.0.0.0"}, Deny: []string{"example.com"}}},
+		{"TLS 1.1 minimum", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), MinTLS: tls.VersionTLS11}},
+		{"cert host with a port", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), CertHosts: []string{"example.com:8080"}}},
+		{"key directory overlapping OutDir", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: keyDirs, KeyDirs: map[string]string{"k2": filepath.Join(keyDirs, "team")}}},
+		{"key directory repeating the key", &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: t.TempDir(), KeyDirs: map[string]string{"k": t.TempDir()}}},
+		{"client CA on a plain socket", &Server{Addr: "unix:" + t.TempDir() + "/s.sock", Key: "k", OutDir: t.TempDir(), ClientCA: "ca.pem"}},
+	}
+	for _, tt := range tests {
+		if err := tt.server.ListenAndServe(); err == nil {
+			t.Errorf("%s: ListenAndServe succeeded, want a configuration error", tt.name)
+		}
+	}
+
+	// A device takes every upload, so a server writing to one has no output
+	// directory to create, nor key directories beside it
+	outDir := filepath.Join(t.TempDir(), "received")
+	srv := &Server{Addr: "127.0.0.1:0", Key: "k", OutDir: outDir, CreateOutDir: true, Device: "/dev/null", KeyDirs: map[string]string{"k2": t.TempDir()}}
+	if err := srv.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "-psk-dirs can't be combined with -dev") {
+		t.Errorf("key directories on a device: ListenAndServe = %v, want it refused", err)
+	}
+	if _, err := os.Stat(outDir); !os.IsNotExist(err) {
+		t.Errorf("a device server created its output directory: %v", err)
+	}
+}
+
+// Data piped into the client comes out of the server's output under the
+// given name, and the server stops once it has
+func TestServerOutput(t *testing.T) {
+	t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+	var out bytes.Buffer
+	srv := &Server{Key: "test-key", Output: &out}
+	stop := startTestServer(t, srv)
+
+	stdin, pipe, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+	go func() {
+		pipe.Write([]byte("tar stream"))
+		pipe.Close()
+	}()
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Name: "backup.tar"}
+	if err := client.Send("-"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", srv.Addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server kept listening after writing its output")
+		}
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if out.String() != "tar stream" {
+		t.Errorf("output holds %q, want %q", out.String(), "tar stream")
+	}
+	if _, err := os.Stat(DefaultOutDir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("output directory was created: %v", err)
+	}
+}
+
+// A transfer that outlasts the shutdown timeout has its connection closed,
+// and what it wrote so far is cleaned up before ListenAndServe returns
+func TestServerShutdownTimeout(t *testing.T) {
+	t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+	const timeout = 200 * time.Millisecond
+	srv := &Server{Key: "test-key", OutDir: "out", CreateOutDir: true, ShutdownTimeout: timeout}
+	stop := startTestServer(t, srv)
+
+	conn, err := tls.Dial("tcp", srv.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\n%s\nupload stalled.bin\tsize=1000\npartial", protocolBanner, srv.Key)
+	for deadline := time.Now().Add(5 * time.Second); len(partialFiles(t, "out")) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start receiving")
+		}
+	}
+	if _, err := os.Stat(filepath.Join("out", "stalled.bin")); err == nil {
+		t.Error("upload visible under its name before it finished")
+	}
+
+	start := time.Now()
+	if err := stop(); err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 5*time.Second {
+		t.Errorf("shutdown took %s, want about %s", elapsed, timeout)
+	}
+	if left := partialFiles(t, "out"); len(left) != 0 {
+		t.Errorf("partial files left behind: %v", left)
+	}
+	if _, err := os.Stat(filepath.Join("out", "stalled.bin")); err == nil {
+		t.Error("interrupted upload stored under its name")
+	}
+}
+
+// The temporary files uploads are received into
+func partialFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".part") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// ReadyFunc is called once connections can be made, and not at all when the
+// server fails to start
+func TestServerReadyFunc(t *testing.T) {
+	t.Chdir(t.TempDir())
+	ready := make(chan struct{})
+	srv := &Server{Key: "test-key", Addr: "127.0.0.1:0", ReadyFunc: func() { close(ready) }}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+	select {
+	case <-ready:
+	case err := <-served:
+		t.Fatalf("ListenAndServe = %v before ReadyFunc", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadyFunc wasn't called")
+	}
+	srv.mu.Lock()
+	addr := srv.listener.Addr().String()
+	srv.mu.Unlock()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing a ready server: %v", err)
+	}
+	conn.Close()
+	srv.Shutdown()
+	if err := <-served; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+
+	taken := &Server{Key: "test-key", Addr: addr, ReadyFunc: func() { t.Error("ReadyFunc called for a server that couldn't listen") }}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if err := taken.ListenAndServe(); err == nil {
+		t.Error("ListenAndServe on a taken address succeeded")
+	}
+}
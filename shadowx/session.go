@@ -0,0 +1,410 @@
+package shadowx
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A session carries many uploads over one authenticated connection. The
+// client asks for it with a "session <version>" request and the server
+// accepts with "SESSION <version>". Each file is then sent as a frame:
+//
+//	uint16  length of the request line
+//	bytes   the upload request line, naming the file
+//	uint64  length of the file
+//	bytes   the file's data
+//
+// with integers big-endian. The server answers every frame with OK, MISMATCH
+// or REJECTED as for a single upload, and a request length of zero ends the
+// session, after which the server sends BYE with the totals.
+const sessionVersion = "1"
+
+// Write the header of a frame; size bytes of file data must follow
+func writeFrameHeader(w io.Writer, req request, size int64) error {
+	line := req.String()
+	if len(line) > maxLineLength {
+		return errLineTooLong
+	}
+	frame := make([]byte, 0, 2+len(line)+8)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(line)))
+	frame = append(frame, line...)
+	frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	_, err := w.Write(frame)
+	return err
+}
+
+// Write the empty frame that ends a session
+func writeSessionEnd(w io.Writer) error {
+	_, err := w.Write([]byte{0, 0})
+	return err
+}
+
+// Read the header of a frame. more is false at the end of the session.
+func readFrameHeader(r io.Reader) (req request, size int64, more bool, err error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return request{}, 0, false, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n == 0 {
+		return request{}, 0, false, nil
+	}
+	if n > maxLineLength {
+		return request{}, 0, false, errLineTooLong
+	}
+	header := make([]byte, n+8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return request{}, 0, false, err
+	}
+	if req, err = parseRequest(string(header[:n])); err != nil {
+		return request{}, 0, false, err
+	}
+	if req.verb != "upload" {
+		return request{}, 0, false, fmt.Errorf("unexpected %s request in a session", req.verb)
+	}
+	size = int64(binary.BigEndian.Uint64(header[n:]))
+	if size < 0 {
+		return request{}, 0, false, errors.New("file length out of range")
+	}
+	return req, size, true, nil
+}
+
+// Receive the framed uploads of a session until the client ends it, then
+// say goodbye with the totals. A file that can't be stored doesn't end the
+// session; the errors are returned once it's over.
+func receiveSession(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	if req.name != sessionVersion {
+		rejectUpload(conn, log, "unsupported session version")
+		return nil
+	}
+	// A device or output takes a single upload, which gains nothing from a session
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "sessions are not supported when writing to the "+cfg.sink())
+		return nil
+	}
+	fmt.Fprintf(conn, "SESSION %s\n", sessionVersion)
+
+	var stats sessionStats
+	var stored int64 // bytes of the files stored, which -max-disk limits
+	var errs []error
+	for {
+		req, size, more, err := readFrameHeader(conn)
+		if err != nil {
+			return errors.Join(append(errs, fmt.Errorf("reading frame: %w", err))...)
+		}
+		if !more {
+			break
+		}
+		log.Debug("Frame", "name", req.name, "offset", stats.Bytes, "size", size)
+		body := &io.LimitedReader{R: conn, N: size}
+		files, err := receiveFramed(conn, log, cfg, req, body, stored)
+		// Skip what a refused upload didn't read to reach the next frame
+		if _, drainErr := io.Copy(io.Discard, body); drainErr != nil || body.N > 0 {
+			return errors.Join(append(errs, err, fmt.Errorf("session ended inside %s", req.name))...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+		stats.Files += files
+		stats.Bytes += size
+		if files > 0 {
+			stored += size
+		}
+	}
+
+	stats.Duration = time.Since(start).Round(time.Millisecond)
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		errs = append(errs, fmt.Errorf("sending goodbye: %w", err))
+	}
+	log.Info("Session summary", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration, "rate", throughput(stats.Bytes, start))
+	return errors.Join(errs...)
+}
+
+// Receive a framed upload from body, in a session that has stored used bytes
+// so far, and reply to it. Returns how many files were stored and why
+// storing failed, if it did.
+func receiveFramed(conn net.Conn, log *slog.Logger, cfg *serverConfig, req request, body *io.LimitedReader, used int64) (int, error) {
+	for _, attr := range []string{"resume", "append", "compress"} {
+		if _, ok := req.attrs[attr]; ok {
+			rejectUpload(conn, log, attr+" is not supported in a session")
+			return 0, nil
+		}
+	}
+	if algorithm := req.attrs["checksum"]; algorithm != "" && algorithm != defaultChecksum {
+		rejectUpload(conn, log, "sessions only support sha256 checksums")
+		return 0, nil
+	}
+	// The frame's length is the file's declared size
+	size := body.N
+	if over, err := cfg.exceedsLimit(size, used); over {
+		rejectUpload(conn, log, err.Error())
+		return 0, nil
+	}
+	req.attrs["size"] = strconv.FormatInt(size, 10)
+	checked, reason := checkRequest(log, cfg, req)
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return 0, nil
+	}
+	log.Info("Receiving", "file", checked.stored, "trace", checked.trace)
+
+	file, err := createPartial(checked.stored)
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not store file\n")
+		return 0, fmt.Errorf("receiving file: %w", err)
+	}
+	dest, seal, err := cfg.storageWriter(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		fmt.Fprintf(conn, "REJECTED could not store file\n")
+		return 0, err
+	}
+	hasher := sha256.New()
+	received, err := receiveFile(body, dest, hasher, cfg.bufferSize, cfg.progressMeter(checked.stored, 0, size), cfg.metrics, 0)
+	if sealErr := seal(); err == nil && sealErr != nil {
+		err = fmt.Errorf("encrypting file: %w", sealErr)
+	}
+	if closeErr := closePartial(file); err == nil && closeErr != nil {
+		err = fmt.Errorf("writing to file: %w", closeErr)
+	}
+	if err == nil && received < size {
+		err = fmt.Errorf("upload incomplete: %s (%d of %d bytes)", checked.stored, received, size)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		fmt.Fprintf(conn, "REJECTED could not store file\n")
+		return 0, fmt.Errorf("receiving file: %w", err)
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	files, protection, err := storeUpload(conn, log, cfg, checked, file.Name(), "", received, checksum)
+	if err != nil || files == 0 {
+		return files, err
+	}
+	return files, recordUpload(conn, cfg, checked, received, checksum, protection)
+}
+
+// Whether the files of a directory can share a session: diffs, resumable
+// and appended uploads and round-trip checks take exchanges of their own, compressed
+// data has no length to frame up front, and frames are checked with SHA-256
+func (cfg *clientConfig) sessions() bool {
+	return !cfg.diff && cfg.resume == nil && !cfg.appending && !cfg.verifyRoundtrip && cfg.compress == "" && cfg.streams <= 1 && cfg.checksum == defaultChecksum
+}
+
+// A connection to the server that carries a series of uploads. It's opened
+// on first use and again after a failure breaks it.
+type uploadSession struct {
+	conn        serverConn
+	reader      *bufio.Reader
+	unsupported bool       // the server doesn't take sessions, so files go one per connection
+	mux         *muxClient // the pool's multiplexed connection, which files go on when the server takes it
+}
+
+// A session for sending a directory, or nil when each file needs a
+// connection of its own
+func newUploadSession(cfg *clientConfig) *uploadSession {
+	if !cfg.sessions() {
+		return nil
+	}
+	return &uploadSession{}
+}
+
+// Connect and start a session, falling back to a connection per file when
+// the server doesn't take sessions
+func (s *uploadSession) open(cfg *clientConfig) error {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "session", name: sessionVersion}); err != nil {
+		conn.Close()
+		return fmt.Errorf("starting session: %w", err)
+	}
+	reader := conn.reader
+	line, _ := reader.ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "SESSION "+sessionVersion {
+		conn.Close()
+		// Servers that predate sessions close the connection without a word
+		reason, ok := strings.CutPrefix(line, "REJECTED ")
+		if !ok {
+			reason = "the server doesn't support them"
+		}
+		slog.Info("Sending one file per connection, sessions are unavailable", "reason", reason)
+		s.unsupported = true
+		return nil
+	}
+	slog.Debug("Session started", "version", sessionVersion)
+	s.conn, s.reader = conn, reader
+	return nil
+}
+
+// Drop a connection that can't carry on, so the next file opens another
+func (s *uploadSession) abort() {
+	abortConnection(s.conn)
+	s.conn, s.reader = nil, nil
+}
+
+// End the session and read the server's goodbye
+func (s *uploadSession) close() {
+	if s == nil || s.conn == nil {
+		return
+	}
+	defer func() {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}()
+	if err := writeSessionEnd(s.conn); err != nil {
+		slog.Error("Error ending session", "err", err)
+		return
+	}
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		slog.Error("Error ending session", "err", "connection closed without a goodbye from the server")
+		return
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		slog.Error("Error ending session", "err", err)
+		return
+	}
+	slog.Debug("Session closed by server", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+}
+
+// Send a file in the session. Files whose length can't be known up front
+// go on a connection of their own.
+func (s *uploadSession) send(cfg *clientConfig, filename string) error {
+	if s.unsupported {
+		return sendSingleFile(cfg, filename)
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return errors.New("file does not exist")
+	}
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("reading file info: %w", err)
+	}
+	size := sourceSize(file, fileInfo)
+	if !fileInfo.Mode().IsRegular() || size < 0 {
+		file.Close()
+		return sendSingleFile(cfg, filename)
+	}
+	req, err := uploadRequest(cfg, filename, fileInfo, false)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the cached digest when the file is unchanged, otherwise hash while sending
+	var localSum string
+	cacheHit := false
+	if cfg.cache != nil {
+		localSum, cacheHit = cfg.cache.lookup(filename, fileInfo)
+	}
+	var hasher hash.Hash
+	if !cacheHit {
+		hasher = sha256.New()
+	}
+	if cfg.verify {
+		if !cacheHit {
+			if localSum, err = hashFile(filename, size); err != nil {
+				return fmt.Errorf("hashing file: %w", err)
+			}
+			hasher = nil
+		}
+		req.attrs["sha256"] = localSum
+	}
+
+	// The file goes as a stream of the pool's multiplexed connection, or
+	// as a frame of this worker's session; abort drops whichever it was
+	// after a failure that leaves it out of step
+	var (
+		out    io.Writer
+		reader *bufio.Reader
+		abort  func()
+	)
+	var stream *muxStream
+	if s.mux != nil {
+		if stream, err = s.mux.open(cfg, req, size); err != nil {
+			return err
+		}
+	}
+	if stream != nil {
+		defer stream.release()
+		out, reader, abort = stream, stream.reader, stream.cancel
+	} else {
+		if s.conn == nil {
+			if err := s.open(cfg); err != nil {
+				return err
+			}
+			if s.unsupported {
+				file.Close()
+				return sendSingleFile(cfg, filename)
+			}
+		}
+		if err := writeFrameHeader(s.conn, req, size); err != nil {
+			s.abort()
+			return fmt.Errorf("sending file metadata: %w", err)
+		}
+		out, reader, abort = s.conn, s.reader, s.abort
+	}
+	sent, err := sendData(cfg, filename, out, io.LimitReader(file, size), hasher, 0, size)
+	if err != nil {
+		abort()
+		return err
+	}
+	// The frame promised size bytes, so a file that shrank breaks the session
+	if sent < size {
+		abort()
+		return fmt.Errorf("changed during transfer: expected %d bytes but only %d could be read", size, sent)
+	}
+	if stream != nil {
+		if err := stream.end(); err != nil {
+			return fmt.Errorf("%w: %w", errSendingData, err)
+		}
+	}
+	changed := false
+	if after, err := os.Stat(filename); err == nil && (after.Size() != fileInfo.Size() || !after.ModTime().Equal(fileInfo.ModTime())) {
+		changed = true
+		slog.Warn("File changed during transfer, sent a snapshot", "file", filename, "size", after.Size(), "sent", sent)
+	}
+
+	serverSum, renamed, rejected, err := readUploadStatus(reader, localSum, cfg.checksum)
+	if rejected && cacheHit && cfg.verify {
+		// The server discarded the upload; a stale cached digest may be why
+		cfg.cache.forget(filename)
+	}
+	if err != nil {
+		if !rejected {
+			abort()
+		}
+		return err
+	}
+	if localSum, cacheHit, err = matchDigest(cfg, filename, hasher, localSum, cacheHit, sent, serverSum); err != nil {
+		return err
+	}
+	if cfg.cache != nil && !cacheHit && !changed {
+		cfg.cache.store(filename, fileInfo, localSum)
+	}
+	if renamed != "" {
+		slog.Info("File exists on the server, stored under a new name", "file", filename, "as", renamed)
+	}
+	slog.Info("File sent successfully", "file", filename, "bytes", sent)
+	return nil
+}
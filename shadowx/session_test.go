@@ -0,0 +1,180 @@
+package shadowx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadFrameHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  string
+		size  int64
+		more  bool
+		err   bool
+	}{
+		{name: "file", frame: rawFrame("upload dir/a.txt\tmode=644", 5), want: "upload dir/a.txt\tmode=644", size: 5, more: true},
+		{name: "empty file", frame: rawFrame("upload b", 0), want: "upload b", more: true},
+		{name: "end", frame: []byte{0, 0}},
+		{name: "truncated length", frame: []byte{0}, err: true},
+		{name: "truncated header", frame: []byte{0, 8, 'u', 'p'}, err: true},
+		{name: "other verb", frame: rawFrame("download a", 0), err: true},
+		{name: "malformed request", frame: rawFrame("upload", 0), err: true},
+		{name: "oversized request", frame: []byte{0xff, 0xff}, err: true},
+		{name: "length out of range", frame: rawFrame("upload a", 1<<63), err: true},
+	}
+	for _, tt := range tests {
+		req, size, more, err := readFrameHeader(bytes.NewReader(tt.frame))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && (more && req.String() != tt.want || size != tt.size || more != tt.more) {
+			t.Errorf("%s: got %q, %d, more %v; want %q, %d, more %v", tt.name, req, size, more, tt.want, tt.size, tt.more)
+		}
+	}
+}
+
+func TestWriteFrameHeader(t *testing.T) {
+	var b bytes.Buffer
+	req := request{verb: "upload", name: "dir/a.txt", attrs: map[string]string{"mode": "644"}}
+	if err := writeFrameHeader(&b, req, 5); err != nil {
+		t.Fatal(err)
+	}
+	if want := rawFrame("upload dir/a.txt\tmode=644", 5); !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("frame header %q, want %q", b.Bytes(), want)
+	}
+	long := request{verb: "upload", name: strings.Repeat("a", maxLineLength)}
+	if err := writeFrameHeader(&b, long, 0); err == nil {
+		t.Error("writeFrameHeader accepted a request longer than maxLineLength")
+	}
+}
+
+// A frame header for a request line and file length, encoded by hand
+func rawFrame(line string, size uint64) []byte {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(line)))
+	frame = append(frame, line...)
+	return binary.BigEndian.AppendUint64(frame, size)
+}
+
+func TestHandleConnectionSession(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	conn, reader, done := dialTestServer(t, cfg)
+
+	var session bytes.Buffer
+	session.WriteString("session 1\n")
+	frame := func(name, data string) {
+		writeFrameHeader(&session, request{verb: "upload", name: name}, int64(len(data)))
+		session.WriteString(data)
+	}
+	frame("a.txt", "first")
+	frame("../escape.txt", "refused")
+	frame("sub/b.txt", "second")
+	writeSessionEnd(&session)
+	if _, err := conn.Write(session.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readLine(t, reader); got != "SESSION 1\n" {
+		t.Fatalf("session reply %q, want %q", got, "SESSION 1\n")
+	}
+	for _, want := range []string{"OK ", "REJECTED unsafe file name", "OK "} {
+		if got := readLine(t, reader); !strings.HasPrefix(got, want) {
+			t.Errorf("reply %q, want prefix %q", got, want)
+		}
+	}
+	stats, err := parseBye(strings.TrimSpace(readLine(t, reader)))
+	if err != nil || stats.Files != 2 {
+		t.Errorf("goodbye %+v, %v; want 2 files", stats, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("handleConnection: %v", err)
+	}
+	for name, want := range map[string]string{"a.txt": "first", "sub/b.txt": "second"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+}
+
+// A session that stops inside a file's data is an error, and the partial
+// file is removed
+func TestHandleConnectionSessionTruncated(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	var session bytes.Buffer
+	session.WriteString("session 1\n")
+	writeFrameHeader(&session, request{verb: "upload", name: "a.txt"}, 10)
+	session.WriteString("short")
+
+	replies, err := testSessionErr(t, cfg, session.String())
+	if err == nil {
+		t.Errorf("handleConnection succeeded, want an error; replies %q", replies)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("output directory holds %d entries, want none", len(entries))
+	}
+}
+
+// A device or output takes a single upload, so it refuses sessions and the
+// client falls back to a connection per file
+func TestHandleConnectionSessionRefused(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		cfg   *serverConfig
+		reply string
+	}{
+		{"version", "session 2\n", &serverConfig{secretKey: "secret"}, "REJECTED unsupported session version\n"},
+		{"output", "session 1\n", &serverConfig{secretKey: "secret", output: &bytes.Buffer{}}, "REJECTED sessions are not supported when writing to the output\n"},
+	}
+	for _, tt := range tests {
+		if got := testSession(t, tt.cfg, tt.line); got != tt.reply {
+			t.Errorf("%s: replies %q, want %q", tt.name, got, tt.reply)
+		}
+	}
+}
+
+// A directory of many small files goes over a single connection
+func TestClientSendSession(t *testing.T) {
+	t.Chdir(t.TempDir())
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ManifestPath: "manifest.jsonl"}
+	startTestServer(t, srv)
+
+	const count = 1000
+	if err := os.Mkdir("tiny", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range count {
+		if err := os.WriteFile(filepath.Join("tiny", fmt.Sprintf("%04d.txt", i)), []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Verify: true}
+	if err := client.Send("tiny"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	for i := range count {
+		name := filepath.Join(DefaultOutDir, "tiny", fmt.Sprintf("%04d.txt", i))
+		if got, err := os.ReadFile(name); err != nil || string(got) != fmt.Sprint(i) {
+			t.Fatalf("%s = %q, %v; want %q", name, got, err, fmt.Sprint(i))
+		}
+	}
+	if remotes := manifestRemotes(t, "manifest.jsonl"); len(remotes) != 1 {
+		t.Errorf("files arrived over %d connections, want 1", len(remotes))
+	} else {
+		for _, files := range remotes {
+			if files != count {
+				t.Errorf("manifest records %d files, want %d", files, count)
+			}
+		}
+	}
+}
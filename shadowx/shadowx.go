@@ -0,0 +1,2579 @@
+// Package shadowx transfers files over TLS, authenticated with a pre-shared
+// key. A Server receives files into a directory; a Client sends files and
+// directories to it and downloads them back.
+package shadowx
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Path that stands for standard input when sending
+const stdinPath = "-"
+
+// Directory received files are written under unless another is given
+const DefaultOutDir = "received"
+
+// Server settings shared by all connections
+type serverConfig struct {
+	address     string
+	secretKey   string
+	keyHash     *keyHash        // checks presented keys instead of secretKey, which is empty, with -psk-hash
+	outDir      string          // root directory received files are written under
+	device      string          // write received data to this device instead of a file
+	hashNames   bool            // store files under a hash of their name
+	manifest    *manifest       // record of received files, nil when disabled
+	denyHashes  map[string]bool // SHA-256 digests of content that is refused
+	uploads     *uploadStore    // partial resumable uploads
+	upLimit     int64           // bytes per second sent on each connection, 0 for no limit
+	downLimit   int64           // bytes per second received on each connection, 0 for no limit
+	httpAddr    string          // address of the read-only HTTPS file server, empty when disabled
+	metricsAddr string          // address of the metrics server, empty when disabled
+	immutable   bool            // stored files are write-once
+	noClobber   bool            // store uploads of a taken name as name.1, name.2, ...
+	allowDelete bool            // honor requests to delete stored files
+	chown       bool            // restore the owner and group IDs clients send
+	minTLS      uint16          // oldest TLS version clients may use
+	ciphers     []uint16        // TLS 1.2 cipher suites to offer, nil for Go's defaults
+	clientCA    string          // CA bundle client certificates must chain to, empty to not ask for one
+	certHosts   []string        // names and addresses a generated certificate is valid for, nil for the defaults
+	tlsCert     string          // certificate to serve, empty for the generated server.crt
+	tlsKey      string          // private key for tlsCert
+	socketTLS   bool            // use TLS on a Unix socket too
+	noTLS       bool            // serve plain TCP without TLS, relying on the PSK alone
+	output      io.Writer       // write the single upload here instead of a file, nil when storing files
+	bufferSize  int             // bytes read and written at a time, 0 for DefaultBufferSize
+	readTimeout time.Duration   // time for the handshake, key and request, 0 for no limit
+	idleTimeout time.Duration   // time a transfer may wait for data, 0 for no limit
+	maxFileSize int64           // largest upload accepted, 0 for no limit
+	maxDisk     int64           // most bytes stored per connection or session, 0 for no limit
+	reserve     int64           // free bytes uploads must leave on the output volume
+
+	sinkMu      sync.Mutex // held while an upload is written to the device or output
+	sinkWritten bool       // the device or output already holds a completed upload
+
+	authFailures    authFailures    // failed authentications by client IP
+	maxAuthFailures int             // failures before an address is refused for a while, 0 for no limit
+	clients         addressFilter   // addresses allowed to connect
+	connSlots       chan struct{}   // one per connection being served, nil for no limit
+	metrics         *serverMetrics  // counters for -metrics-addr, nil when disabled
+	chunked         chunkedUploads  // files being received over several connections
+	appending       appendLocks     // stored files uploads are being appended to
+	storage         storageKey      // key files are encrypted at rest with, nil to store them as received
+	tenants         []*serverConfig // configs of the further keys clients may authenticate with, by -psk-dirs
+	auth            Authenticator   // checks clients' credentials in place of the key, nil for keyAuthenticator
+
+	// Reports upload progress, nil for the live counter
+	progress func(file string, received, total int64)
+}
+
+// Take a slot for a new connection, reporting false when -max-conns are
+// already being served
+func (cfg *serverConfig) acquireConn() bool {
+	if cfg.connSlots == nil {
+		return true
+	}
+	select {
+	case cfg.connSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Free the slot of a connection that has closed
+func (cfg *serverConfig) releaseConn() {
+	if cfg.connSlots != nil {
+		<-cfg.connSlots
+	}
+}
+
+// What a single-upload server writes to instead of files, for messages;
+// empty when it stores files
+func (cfg *serverConfig) sink() string {
+	switch {
+	case cfg.device != "":
+		return "device"
+	case cfg.output != nil:
+		return "output"
+	}
+	return ""
+}
+
+// Whether the device or output already holds a completed upload
+func (cfg *serverConfig) sinkDone() bool {
+	cfg.sinkMu.Lock()
+	defer cfg.sinkMu.Unlock()
+	return cfg.sinkWritten
+}
+
+// Client settings shared by all transfers
+type clientConfig struct {
+	address          string
+	secretKey        string
+	cache            *checksumCache    // digests of unchanged files reused instead of rehashing, nil when disabled
+	newerThan        time.Time         // only send files modified after this, when set
+	olderThan        time.Time         // only send files modified before this, when set
+	maxSize          int64             // skip files larger than this many bytes, 0 for no limit
+	tlsa             []tlsaRecord      // DANE records the server certificate must match, nil when disabled
+	tlsaHost         string            // server name the TLSA records were looked up for
+	resume           *resumeState      // upload tokens of interrupted transfers, nil when resuming is disabled
+	resumeDirs       bool              // send directories as sessions the server keeps
+	dirSession       string            // ID of the directory session being sent, empty when none
+	handshakes       chan struct{}     // slots bounding concurrent TLS handshakes, nil when unlimited
+	clientCert       []tls.Certificate // certificate presented to servers that require one
+	root             string            // the file or directory being sent, which remote names are relative to
+	pin              []byte            // SHA-256 of the server's public key, nil when not pinned
+	rootCAs          *x509.CertPool    // CAs the server certificate must chain to, nil to not check the chain
+	knownHosts       *knownHosts       // servers trusted on first use, nil when disabled
+	traceID          string            // trace ID sent with every upload, empty to let the server assign one
+	upLimit          int64             // bytes per second sent on each connection, 0 for no limit
+	downLimit        int64             // bytes per second received on each connection, 0 for no limit
+	events           *eventWriter      // JSON progress events, nil when disabled
+	skipStored       bool              // leave out files the server already stores identically
+	preserveSymlinks bool              // send symbolic links as links instead of what they point to
+	stats            *transferStats    // totals of the Send in progress
+	quietSuccess     bool              // log the summary whatever the level
+	socketTLS        bool              // use TLS on a Unix socket too
+	noTLS            bool              // connect without TLS, relying on the PSK alone
+	minTLS           uint16            // oldest TLS version the server may use
+	ciphers          []uint16          // TLS 1.2 cipher suites to offer, nil for Go's defaults
+	httpTimeout      time.Duration     // time a URL being sent may go without sending data, 0 for no limit
+	move             bool              // delete each file once the server has confirmed it
+	appending        bool              // append to the server's copy of each file, sending only what it's missing
+
+	verify          bool   // declare each file's digest for the server to check before storing it
+	verifyRoundtrip bool   // confirm the server's stored copy after each upload
+	diff            bool   // send edits to text files as diffs against the server's copy
+	preserveBtime   bool   // send file creation times for the server to restore
+	preserve        bool   // send permission bits and modification times for the server to restore
+	compress        string // codec file data is compressed with on the wire, empty for none
+	checksum        string // algorithm uploads are checked with
+	stdinName       string // name data read from standard input is sent under
+	as              string // name the single file sent is stored under, empty for its own
+	bufferSize      int    // bytes read and written at a time, 0 for DefaultBufferSize
+	parallel        int    // files of a directory sent at once
+	mux             bool   // send a directory's files as streams of one multiplexed connection
+	streams         int    // connections a large file is sent over at once, each with a byte range
+
+	batchSize      int    // files per checkpointed batch when sending a directory, 0 to disable
+	checkpointPath string // where batch progress is saved
+
+	keyRejected *atomic.Bool    // the server rejected the key during this call
+	fingerprint *atomic.Bool    // the server's fingerprint has been logged during this call
+	ctx         context.Context // cancels this call, context.Background() otherwise
+
+	// Reports transfer progress, nil for the live counter
+	progress func(file string, done, total int64)
+
+	retries    int           // times a failed connection, or with resuming an interrupted transfer, is retried
+	retryDelay time.Duration // wait before the first retry, doubling with each one
+}
+
+// Session statistics carried by the BYE frame the server sends before closing
+type sessionStats struct {
+	Files    int
+	Bytes    int64
+	Duration time.Duration
+	Trace    string // trace ID the session was recorded under
+}
+
+// Encode the stats as the payload of a BYE frame
+func (s sessionStats) String() string {
+	line := fmt.Sprintf("files=%d bytes=%d duration=%s", s.Files, s.Bytes, s.Duration)
+	if s.Trace != "" {
+		line += " trace=" + s.Trace
+	}
+	return line
+}
+
+// Parse a "BYE key=value ..." frame
+func parseBye(line string) (sessionStats, error) {
+	var stats sessionStats
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "BYE" {
+		return stats, fmt.Errorf("unexpected frame %q", line)
+	}
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		var err error
+		switch key {
+		case "files":
+			stats.Files, err = strconv.Atoi(value)
+		case "bytes":
+			stats.Bytes, err = strconv.ParseInt(value, 10, 64)
+		case "duration":
+			stats.Duration, err = time.ParseDuration(value)
+		case "trace":
+			stats.Trace = value
+		}
+		if err != nil {
+			return stats, fmt.Errorf("invalid %s in BYE frame: %w", key, err)
+		}
+	}
+	return stats, nil
+}
+
+// Generate a self-signed TLS certificate valid for hosts, each a hostname or
+// an IP address. It's a leaf rather than a CA, so clients can trust it
+// directly with -ca without it being able to vouch for other certificates.
+func generateTLSCert(certFile, keyFile string, hosts []string) error {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(365 * 24 * time.Hour)
+
+	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: sn,
+		Subject:      pkix.Name{Organization: []string{"ShadowX Secure File Transfer"}},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject.CommonName = hosts[0]
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+
+	certFileHandle, err := os.Create(certFile)
+	if err != nil {
+		return err
+	}
+	defer certFileHandle.Close()
+	pem.Encode(certFileHandle, &pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	keyFileHandle, err := os.Create(keyFile)
+	if err != nil {
+		return err
+	}
+	defer keyFileHandle.Close()
+	pem.Encode(keyFileHandle, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+
+	return nil
+}
+
+// The names a generated certificate covers when -cert-host isn't given: the
+// host the server listens on, or when that's every interface, this machine's
+// hostname and the loopback addresses; localhost for a Unix socket
+func defaultCertHosts(addr string) []string {
+	if _, ok := unixSocketPath(addr); ok {
+		return []string{"localhost"}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{host}
+	}
+	var hosts []string
+	if name, err := os.Hostname(); err == nil && name != "" {
+		hosts = append(hosts, name)
+	}
+	return append(hosts, "localhost", "127.0.0.1", "::1")
+}
+
+// Check a -cert-host entry is a bare hostname or IP address
+func checkCertHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" || strings.ContainsAny(host, ":/ []") {
+		return fmt.Errorf("-cert-host %q: want a hostname or IP address without a port", host)
+	}
+	return nil
+}
+
+// Make sure the output root exists, creating it only when explicitly asked to
+func prepareOutputDir(dir string, create bool) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if !create {
+			return fmt.Errorf("output directory %s does not exist (use -create-dest to create it)", dir)
+		}
+		slog.Info("Creating output directory", "dir", dir)
+		return os.MkdirAll(dir, 0750)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("output path %s is not a directory", dir)
+	}
+	return nil
+}
+
+// Report whether path names something strictly inside root
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// The certificate and key the server presents: -tls-cert and -tls-key, or
+// server.crt and server.key in the working directory
+func (cfg *serverConfig) tlsFiles() (certFile, keyFile string) {
+	if cfg.tlsCert == "" {
+		return "server.crt", "server.key"
+	}
+	return cfg.tlsCert, cfg.tlsKey
+}
+
+// Whether path is the server's TLS certificate or key
+func (cfg *serverConfig) isTLSFile(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return true
+	}
+	certFile, keyFile := cfg.tlsFiles()
+	for _, name := range []string{certFile, keyFile} {
+		if tlsPath, err := filepath.Abs(name); err == nil && tlsPath == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// The manifest maps hashed names back to real ones, so it must be given
+// explicitly and kept out of the directory clients write into
+func checkManifestPath(manifestPath, outDir string) error {
+	if manifestPath == "" {
+		return fmt.Errorf("-hash-names requires -manifest")
+	}
+	absManifest, err := filepath.Abs(manifestPath)
+	if err != nil {
+		return err
+	}
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return err
+	}
+	if isWithin(absOut, absManifest) {
+		return fmt.Errorf("-manifest %s must be outside the output directory %s", manifestPath, outDir)
+	}
+	return nil
+}
+
+// Load the server certificate, generating it if it doesn't exist, and
+// build the TLS settings connections are served with. A certificate given
+// with -tls-cert is only ever read.
+func serverTLSConfig(cfg *serverConfig) (*tls.Config, error) {
+	// Generate TLS certificate if it doesn't exist
+	certFile, keyFile := cfg.tlsFiles()
+	hosts := cfg.certHosts
+	if len(hosts) == 0 {
+		hosts = defaultCertHosts(cfg.address)
+	}
+	if _, err := os.Stat(certFile); os.IsNotExist(err) && cfg.tlsCert == "" {
+		slog.Info("Generating a self-signed certificate", "hosts", strings.Join(hosts, ","))
+		if err := generateTLSCert(certFile, keyFile, hosts); err != nil {
+			return nil, fmt.Errorf("generating TLS certificate: %w", err)
+		}
+	}
+
+	// Load the certificate
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+
+	slog.Info("Certificate pin for clients' -pin", "pin", hex.EncodeToString(publicKeyPin(cert.Leaf)))
+	stale := "The existing certificate isn't valid for -cert-host; delete server.crt and server.key to generate a new one"
+	if cfg.tlsCert != "" {
+		stale = "The -tls-cert certificate isn't valid for -cert-host"
+	}
+	for _, host := range cfg.certHosts {
+		if err := cert.Leaf.VerifyHostname(host); err != nil {
+			slog.Warn(stale, "host", host)
+		}
+	}
+
+	// Configure TLS
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   cfg.minTLS,
+		CipherSuites: cfg.ciphers,
+	}
+	if cfg.clientCA != "" {
+		if err := requireClientCerts(tlsConfig, cfg.clientCA); err != nil {
+			return nil, fmt.Errorf("loading client CA: %w", err)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Run the server until Shutdown is called and the running transfers finish
+func (s *Server) serve(cfg *serverConfig) error {
+	// A plain Unix socket relies on its permissions and the PSK instead of
+	// TLS, and -no-tls on the network being trusted
+	plain := cfg.noTLS || plainSocket(cfg.address, cfg.socketTLS)
+	var tlsConfig *tls.Config
+	var err error
+	if !plain || cfg.httpAddr != "" {
+		if tlsConfig, err = serverTLSConfig(cfg); err != nil {
+			return err
+		}
+	}
+
+	// Start the listener; TLS runs on top of any throttling so limits apply to the wire
+	listener, err := listen(cfg.address)
+	if err != nil {
+		return fmt.Errorf("starting server: %w", err)
+	}
+	listener = filterListener{listener, cfg.clients}
+	defer listener.Close()
+	if !s.setListener(listener) {
+		return nil
+	}
+	slog.Info("ShadowX Server listening", "address", cfg.address)
+	switch {
+	case cfg.noTLS:
+		slog.Warn("TLS IS OFF: file data and the pre-shared key cross the network unencrypted; only use -no-tls on a trusted network")
+	case plain:
+		slog.Info("Serving the Unix socket without TLS; its permissions and the PSK control access")
+	}
+
+	var httpServer *http.Server
+	if cfg.httpAddr != "" {
+		if httpServer, err = startHTTPServer(cfg, tlsConfig); err != nil {
+			return fmt.Errorf("starting HTTP server: %w", err)
+		}
+	}
+	var metricsServer *http.Server
+	if cfg.metricsAddr != "" {
+		if metricsServer, err = startMetricsServer(cfg); err != nil {
+			if httpServer != nil {
+				httpServer.Close()
+			}
+			return fmt.Errorf("starting metrics server: %w", err)
+		}
+	}
+	if s.ReadyFunc != nil {
+		s.ReadyFunc()
+	}
+
+	// Accept incoming connections
+	var active sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if err != nil {
+			slog.Error("Error accepting connection", "err", err)
+			continue
+		}
+		if !cfg.acquireConn() {
+			slog.Warn("Refused connection", "remote", conn.RemoteAddr().String(), "reason", "-max-conns reached")
+			conn.Close()
+			continue
+		}
+		active.Add(1)
+		s.trackConn(conn, true)
+		go func() {
+			defer active.Done()
+			defer cfg.releaseConn()
+			defer s.trackConn(conn, false)
+			// Refused before the handshake, so guessing costs the server nothing
+			if cfg.authFailures.blocked(clientIP(conn.RemoteAddr()), time.Now()) {
+				slog.Debug("Refused connection from a blocked address", "remote", conn.RemoteAddr().String())
+				conn.Close()
+				return
+			}
+			// Both ways, so a client that stops reading can't stall the
+			// handshake either
+			if cfg.readTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(cfg.readTimeout))
+			}
+			served := throttle(conn, cfg.upLimit, cfg.downLimit)
+			if !plain {
+				tlsConn := tls.Server(served, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					slog.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), "err", err)
+					tlsConn.Close()
+					return
+				}
+				served = tlsConn
+			}
+			conn.SetWriteDeadline(time.Time{})
+			err := handleConnection(served, cfg)
+			switch {
+			case errors.Is(err, os.ErrDeadlineExceeded):
+				slog.Warn("Client timed out, closed the connection", "remote", conn.RemoteAddr().String(), "err", err)
+			case err != nil:
+				slog.Error("Error with client", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			// The output ends with its upload, so whatever reads it sees EOF
+			if cfg.output != nil && cfg.sinkDone() {
+				s.Shutdown()
+			}
+		}()
+	}
+	s.waitForTransfers(&active, s.ShutdownTimeout)
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	if httpServer != nil {
+		ctx := context.Background()
+		if s.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.ShutdownTimeout)
+			defer cancel()
+		}
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+		}
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// Handle client connections. Returns why the session failed; a refused
+// request isn't a failure of the server and returns nil.
+func handleConnection(conn net.Conn, cfg *serverConfig) error {
+	defer conn.Close()
+	log := slog.With("remote", conn.RemoteAddr().String())
+	log.Debug("Client connected")
+	cfg.metrics.connected()
+	start := time.Now()
+
+	// The key and request must arrive within the read timeout; after that,
+	// every read of the transfer gets the idle timeout
+	if cfg.readTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(cfg.readTimeout))
+	}
+	idle := &idleConn{Conn: conn}
+
+	// Data may follow the request line in the same read, so the lines are
+	// read through a buffer that later reads drain first
+	lines := newLineConn(idle, bufferLen(cfg.bufferSize))
+	conn = lines
+	banner, err := lines.readLine()
+	if err != nil {
+		return fmt.Errorf("reading protocol version: %w", err)
+	}
+	// A client that predates banners opens with its key, which mustn't be
+	// logged, and takes whatever comes first for the authentication reply
+	_, reason := parseBanner(banner)
+	if reason == "" || strings.HasPrefix(banner, "SHADOWX ") {
+		fmt.Fprintf(conn, "%s\n", protocolBanner)
+	}
+	if reason != "" {
+		fmt.Fprintf(conn, "VERSION MISMATCH client speaks %s, the server %s\n", reason, protocolBanner)
+		log.Warn("Client speaks another protocol version, disconnected", "reason", reason)
+		return nil
+	}
+	auth := cfg.auth
+	if auth == nil {
+		auth = keyAuthenticator{cfg}
+	}
+	// An address refused while the connection waited isn't let near the
+	// key check, which may be an expensive hash
+	ip := clientIP(conn.RemoteAddr())
+	if cfg.authFailures.blocked(ip, time.Now()) {
+		log.Debug("Refused connection from a blocked address")
+		return nil
+	}
+	identity, err := auth.Authenticate(lines)
+	switch {
+	case errors.Is(err, ErrAuthFailed):
+		conn.Write([]byte("Authentication failed\n"))
+		cfg.metrics.authFailed()
+		failures, block := cfg.authFailures.add(ip, cfg.maxAuthFailures, time.Now())
+		args := []any{"failures", failures}
+		if err != ErrAuthFailed {
+			// An Authenticator's own reason
+			args = append(args, "reason", err)
+		}
+		log.Warn("Invalid authentication key, disconnected client", args...)
+		if block > 0 {
+			log.Warn("Refusing connections from the address after repeated authentication failures", "ip", ip, "for", block)
+		}
+		return nil
+	case err != nil:
+		return err
+	}
+	cfg.authFailures.clear(ip)
+	if cfg.auth != nil {
+		log = log.With("identity", identity)
+	}
+	// Everything from here on works within the directory of the key
+	cfg = cfg.tenant(identity)
+	conn.Write([]byte("Authentication successful\n"))
+	log.Debug("Client authenticated", "identity", identity)
+
+	metadata, err := lines.readLine()
+	if err != nil {
+		return fmt.Errorf("reading file metadata: %w", err)
+	}
+	req, err := parseRequest(metadata)
+	if err != nil || !knownVerbs[req.verb] {
+		return errors.New("invalid transfer request")
+	}
+	conn.SetReadDeadline(time.Time{})
+	idle.timeout = cfg.idleTimeout
+	log.Debug("Request", "verb", req.verb, "name", req.name)
+	switch req.verb {
+	case "session":
+		return receiveSession(lines, log, cfg, req, start)
+	case "mux":
+		return receiveMux(lines, log, cfg, req, start)
+	case "manifest":
+		return receiveManifest(lines, log, cfg, req, start)
+	case "list":
+		return sendListing(lines, log, cfg, req, start)
+	case "chunked":
+		return receiveChunked(lines, log, cfg, req, start)
+	case "range":
+		return receiveRange(lines, log, cfg, req, start)
+	case "symlink":
+		return receiveSymlink(lines, log, cfg, req, start)
+	case "mkdir":
+		return receiveMkdir(lines, log, cfg, req, start)
+	case "delete":
+		return receiveDelete(lines, log, cfg, req, start)
+	case "dirsession":
+		return receiveDirSession(lines, log, cfg, req, start)
+	}
+	checked, reason := checkRequest(log, cfg, req)
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return nil
+	}
+	filename, stored, declared, trace, size, meta := req.name, checked.stored, checked.declared, checked.trace, checked.size, checked.meta
+	if req.verb != "upload" {
+		var files int
+		var bytes int64
+		switch req.verb {
+		case "checksum":
+			err = sendChecksum(conn, log, cfg, stored, size)
+		case "verify":
+			err = verifyStored(conn, log, cfg, stored, declared)
+		case "download":
+			bytes, err = sendFileToClient(conn, log, cfg, stored)
+		case "patch":
+			files, bytes, err = receivePatch(conn, log, cfg, req, stored, size, trace, meta)
+		}
+		stats := sessionStats{Files: files, Bytes: bytes, Duration: time.Since(start).Round(time.Millisecond), Trace: trace}
+		fmt.Fprintf(conn, "BYE %s\n", stats)
+		log.Debug("Session closed", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+		return err
+	}
+	if cfg.output != nil {
+		// Nothing is stored, so messages name the upload itself
+		stored = filename
+		checked.stored = stored
+	}
+	log.Info("Receiving", "file", stored, "trace", trace)
+	// A client offering codecs waits to hear which one to send with
+	if _, ok := req.attrs["codecs"]; ok && checked.codec != "" {
+		if checked.codec != req.attrs["compress"] {
+			log.Info("Client asked for unsupported compression, using another", "requested", req.attrs["compress"], "codec", checked.codec)
+		}
+		fmt.Fprintf(conn, "COMPRESS %s\n", checked.codec)
+	}
+
+	// Pick where the data goes: the device or output, a resumable upload,
+	// the end of the stored file, or a fresh temporary file
+	var file *os.File
+	var dest io.Writer
+	var partial, token string
+	var offset int64
+	seal := func() error { return nil }
+	hasher := sha256.New()
+	switch {
+	case cfg.sink() != "":
+		// A device or output takes a single upload per server run
+		if req.attrs["resume"] != "" || req.attrs["append"] != "" {
+			rejectUpload(conn, log, "resume and append are not supported when writing to the "+cfg.sink())
+			return nil
+		}
+		if !cfg.sinkMu.TryLock() {
+			rejectUpload(conn, log, cfg.sink()+" is busy with another upload")
+			return nil
+		}
+		defer cfg.sinkMu.Unlock()
+		if cfg.sinkWritten {
+			rejectUpload(conn, log, cfg.sink()+" has already been written")
+			return nil
+		}
+		if cfg.output != nil {
+			log.Info("Writing to the output", "name", filename)
+			dest = cfg.output
+			break
+		}
+		log.Info("Writing to device", "device", cfg.device)
+		if file, err = openDevice(cfg.device); err != nil {
+			return fmt.Errorf("opening device: %w", err)
+		}
+	case req.attrs["resume"] != "" && cfg.storage != nil:
+		// A sealed stream can't be continued by another connection
+		rejectUpload(conn, log, "resume is not supported with encryption at rest")
+		return nil
+	case req.attrs["resume"] != "":
+		if declared == "" {
+			rejectUpload(conn, log, "resuming requires the file's sha256")
+			return nil
+		}
+		token, file, offset, err = cfg.uploads.open(req.attrs["resume"], filename, declared)
+		if err != nil {
+			rejectUpload(conn, log, err.Error())
+			return nil
+		}
+		defer cfg.uploads.release(token)
+		partial = file.Name()
+		// Hash what earlier sessions already delivered
+		if _, err := io.Copy(hasher, io.LimitReader(file, offset)); err != nil {
+			file.Close()
+			return fmt.Errorf("reading partial upload: %w", err)
+		}
+		if reason := cfg.noSpace(checked.size, offset); reason != "" {
+			// What arrived before is kept for a retry once there's room
+			file.Close()
+			if offset == 0 {
+				cfg.uploads.discard(token)
+			}
+			rejectUpload(conn, log, reason)
+			return nil
+		}
+		if offset > 0 {
+			log.Info("Resuming upload", "token", token, "offset", offset)
+		}
+		// A directory session reports the token if the client has to start again
+		if id := req.attrs["dirsession"]; id != "" {
+			if err := cfg.uploads.sessionUpload(id, filename, declared, token); err != nil {
+				log.Error("Error saving directory session", "session", id, "err", err)
+			}
+		}
+		fmt.Fprintf(conn, "RESUME %s %d\n", token, offset)
+	case req.attrs["append"] != "":
+		// Data goes straight onto the stored file, and is cut off again if
+		// the upload fails or the whole file doesn't match its digest
+		if reason := appendRejection(cfg, checked); reason != "" {
+			rejectUpload(conn, log, reason)
+			return nil
+		}
+		if !cfg.appending.claim(stored) {
+			rejectUpload(conn, log, "file is being appended to by another upload")
+			return nil
+		}
+		defer cfg.appending.release(stored)
+		if file, offset, err = openAppend(stored, hasher); err != nil {
+			rejectUpload(conn, log, "could not open file to append to")
+			return fmt.Errorf("opening file to append to: %w", err)
+		}
+		if reason := cfg.noSpace(checked.size, offset); reason != "" {
+			file.Close()
+			undoAppend(log, stored, offset)
+			rejectUpload(conn, log, reason)
+			return nil
+		}
+		checked.base = offset
+		if offset > 0 {
+			log.Info("Appending to file", "file", stored, "offset", offset)
+		}
+		fmt.Fprintf(conn, "APPEND %d\n", offset)
+	default:
+		if file, err = createPartial(stored); err != nil {
+			return fmt.Errorf("receiving file: %w", err)
+		}
+		partial = file.Name()
+		if dest, seal, err = cfg.storageWriter(file); err != nil {
+			file.Close()
+			os.Remove(partial)
+			return err
+		}
+	}
+
+	// Compressed data is inflated as it arrives, so sizes, digests and the
+	// server's limits are of the original file
+	limit, limitErr := cfg.uploadLimit(offset, 0)
+	source := capReader(decompressReader(checked.codec, conn), limit, limitErr)
+	if dest == nil {
+		dest = file
+	}
+	// Stored files are recorded by SHA-256, so another algorithm hashes alongside it
+	var digester hash.Hash
+	if checked.algorithm != defaultChecksum {
+		digester = checksumAlgorithms[checked.algorithm]()
+		dest = io.MultiWriter(dest, digester)
+	}
+	received, err := receiveFile(source, dest, hasher, cfg.bufferSize, cfg.progressMeter(stored, offset, size), cfg.metrics, offset)
+	if sealErr := seal(); err == nil && sealErr != nil {
+		err = fmt.Errorf("encrypting file: %w", sealErr)
+	}
+	if file != nil {
+		if closeErr := closePartial(file); err == nil && closeErr != nil {
+			err = fmt.Errorf("writing to file: %w", closeErr)
+		}
+	}
+	if limitErr != nil && errors.Is(err, limitErr) {
+		// Nothing of an upload past the limits is kept, resumable or not
+		if token != "" {
+			cfg.uploads.discard(token)
+		} else if partial != "" {
+			os.Remove(partial)
+		} else if checked.base >= 0 {
+			undoAppend(log, stored, checked.base)
+		}
+		rejectUpload(conn, log, limitErr.Error())
+		return fmt.Errorf("receiving file: %s: %w", stored, err)
+	}
+	if err != nil {
+		// An interrupted resumable upload keeps its data for the next attempt
+		if partial != "" && token == "" {
+			os.Remove(partial)
+		} else if checked.base >= 0 {
+			undoAppend(log, stored, checked.base)
+		}
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if digester != nil {
+		checked.digest = hex.EncodeToString(digester.Sum(nil))
+	}
+
+	// A client that dies can end the stream as cleanly as a finished one, so
+	// only the declared size says whether it all arrived; keep a short
+	// resumable upload for the next attempt. Clients that asked hear
+	// COMPLETE or INCOMPLETE before the verdict.
+	total := offset + received
+	acked := req.attrs["ack"] != ""
+	if size >= 0 && total < size {
+		if checked.base >= 0 {
+			undoAppend(log, stored, checked.base)
+		} else if token == "" {
+			os.Remove(partial)
+		}
+		if acked {
+			fmt.Fprintf(conn, "INCOMPLETE %d %d\n", total, size)
+		} else {
+			fmt.Fprintf(conn, "REJECTED incomplete upload\n")
+		}
+		return fmt.Errorf("upload incomplete: %s (%d of %d bytes)", stored, total, size)
+	}
+	if acked {
+		fmt.Fprintf(conn, "COMPLETE %d\n", total)
+	}
+
+	files, protection, err := storeUpload(conn, log, cfg, checked, partial, token, total, checksum)
+	if err != nil {
+		return err
+	}
+
+	// The file is stored either way, so a manifest failure still ends the session cleanly
+	var manifestErr error
+	if files > 0 {
+		manifestErr = recordUpload(conn, cfg, checked, received, checksum, protection)
+		if id := req.attrs["dirsession"]; id != "" {
+			if err := cfg.uploads.sessionUpload(id, filename, declared, ""); err != nil {
+				log.Error("Error saving directory session", "session", id, "err", err)
+			}
+		}
+	}
+
+	// Tell the client the session finished cleanly
+	stats := sessionStats{Files: files, Bytes: received, Duration: time.Since(start).Round(time.Millisecond), Trace: trace}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return errors.Join(manifestErr, fmt.Errorf("sending goodbye: %w", err))
+	}
+	log.Debug("Session closed", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+	return manifestErr
+}
+
+// A request that passed the server's checks, with what they worked out
+type checkedRequest struct {
+	request
+	stored   string       // where the file is stored
+	declared string       // SHA-256 the client declared, empty when none
+	trace    string       // trace ID the transfer is recorded under
+	btime    *time.Time   // creation time to restore, nil when not sent
+	meta     fileMetadata // mode and modification time to restore
+	size     int64        // declared size, -1 when not given
+	codec    string       // compression of the data, empty when it isn't compressed
+	base     int64        // size of the stored file an upload is appended to, -1 when it replaces it
+
+	algorithm string // checksum algorithm the client checks the upload with
+	digest    string // the upload's digest in algorithm when that isn't sha256, once received
+}
+
+// Check a request's name and attributes against the server's rules. Returns
+// the reason to refuse it, or an empty reason when it may proceed.
+func checkRequest(log *slog.Logger, cfg *serverConfig, req request) (*checkedRequest, string) {
+	if err := validStoredName(req.name); err != nil {
+		log.Warn("Rejecting unsafe file name", "err", err)
+		return nil, "unsafe file name"
+	}
+	stored := req.name
+	if cfg.hashNames {
+		stored = hashedName(cfg.secretKey, req.name)
+	}
+	stored = filepath.Join(cfg.outDir, stored)
+	if !isWithin(cfg.outDir, stored) {
+		return nil, "file name escapes the output directory"
+	}
+	if isWithin(cfg.uploads.dir, stored) || cfg.isTLSFile(stored) {
+		return nil, "file name is reserved"
+	}
+	// With -no-clobber the upload is stored under a new name instead
+	if cfg.immutable && !cfg.noClobber && (req.verb == "upload" || req.verb == "chunked" || req.verb == "patch" || req.verb == "symlink") {
+		if _, err := os.Lstat(stored); err == nil {
+			return nil, "file already exists and is immutable"
+		}
+	}
+	// Reading back is limited to what clients could have uploaded themselves
+	if req.verb != "upload" && req.verb != "chunked" && req.verb != "symlink" && req.verb != "mkdir" && req.verb != "delete" && strings.HasPrefix(filepath.Base(stored), ".") {
+		return nil, "no such file"
+	}
+	// The client may check uploads with another algorithm, declaring the
+	// digest under its name
+	algorithm := req.attrs["checksum"]
+	if algorithm == "" {
+		algorithm = defaultChecksum
+	}
+	if checksumAlgorithms[algorithm] == nil {
+		return nil, "unsupported checksum algorithm"
+	}
+	if algorithm != defaultChecksum && req.attrs["resume"] != "" {
+		return nil, "resume only supports sha256 checksums"
+	}
+	checked := &checkedRequest{request: req, stored: stored, declared: req.attrs[algorithm], trace: req.attrs["trace"], size: -1, base: -1, algorithm: algorithm}
+	if checked.declared != "" && !validDigest(algorithm, checked.declared) {
+		return nil, "malformed " + algorithm
+	}
+	if checked.trace == "" {
+		checked.trace = newTraceID()
+	} else if !validTraceID(checked.trace) {
+		return nil, "malformed trace ID"
+	}
+	if id, ok := req.attrs["dirsession"]; ok && !validUploadToken(id) {
+		return nil, "malformed session ID"
+	}
+	if value, ok := req.attrs["btime"]; ok {
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, "malformed btime"
+		}
+		t := time.Unix(0, nanos).UTC()
+		checked.btime = &t
+	}
+	var err error
+	if checked.meta, err = parseFileMetadata(req.attrs); err != nil {
+		return nil, err.Error()
+	}
+	// A client that offers codecs takes the server's pick; one that doesn't
+	// predates negotiation and only asks for codecs every server knows
+	if compression, ok := req.attrs["compress"]; ok {
+		if offered, ok := req.attrs["codecs"]; ok {
+			checked.codec = negotiateCompression(compression, offered)
+		} else if !knownCompression[compression] {
+			return nil, "unsupported compression"
+		} else {
+			checked.codec = compression
+		}
+	}
+	if value, ok := req.attrs["size"]; ok {
+		if checked.size, err = strconv.ParseInt(value, 10, 64); err != nil || checked.size < 0 {
+			return nil, "malformed size"
+		}
+	}
+	if req.verb == "upload" || req.verb == "chunked" {
+		if over, err := cfg.exceedsLimit(checked.size, 0); over {
+			return nil, err.Error()
+		}
+		// Resumed and appended uploads only need room for what they add,
+		// which is known once the server has found where they start
+		if req.attrs["resume"] == "" && req.attrs["append"] == "" {
+			if reason := cfg.noSpace(checked.size, 0); reason != "" {
+				return nil, reason
+			}
+		}
+	}
+	return checked, ""
+}
+
+// Enforce the declared size and digest and the content denylist on a
+// received upload of total bytes, then move it from partial to its real
+// name, keep what was appended to the stored file, or mark the device or
+// output written when partial is empty. Replies
+// OK, MISMATCH or REJECTED and returns how many files were stored and the
+// write-once protection applied; an error means storing failed.
+func storeUpload(conn net.Conn, log *slog.Logger, cfg *serverConfig, r *checkedRequest, partial, token string, total int64, checksum string) (files int, protection string, err error) {
+	reason, renamed := "", ""
+	digest := checksum
+	if r.digest != "" {
+		digest = r.digest
+	}
+	switch {
+	case r.size >= 0 && total != r.size:
+		reason = "upload larger than declared size"
+	case r.declared != "" && digest != r.declared:
+		reason = "checksum mismatch"
+	case cfg.denyHashes[checksum]:
+		reason = "rejected by policy"
+	}
+	if reason != "" {
+		log.Warn("Rejected", "file", r.stored, "sha256", checksum, "reason", reason)
+		if token != "" {
+			cfg.uploads.discard(token)
+		} else if partial != "" {
+			if err := os.Remove(partial); err != nil {
+				log.Error("Error removing rejected file", "err", err)
+			}
+		} else if r.base >= 0 {
+			undoAppend(log, r.stored, r.base)
+		}
+		if reason == "checksum mismatch" {
+			log.Warn("Checksum mismatch", "file", r.stored, "expected", r.declared)
+			fmt.Fprintf(conn, "MISMATCH %s\n", digest)
+		} else {
+			fmt.Fprintf(conn, "REJECTED %s\n", reason)
+		}
+		return 0, "", nil
+	}
+
+	if r.declared != "" {
+		log.Info("Checksum OK", "file", r.stored)
+	}
+	if partial != "" {
+		if r.btime != nil {
+			if err := setBirthTime(partial, *r.btime); err != nil {
+				log.Warn("Can't restore creation time", "file", r.stored, "err", err)
+			}
+		}
+		stored := r.stored
+		// A resumable upload waits in the uploads directory, so nothing has
+		// created the directories it's stored in yet
+		if token != "" {
+			err = os.MkdirAll(filepath.Dir(r.stored), os.ModePerm)
+		}
+		switch {
+		case err != nil:
+		case cfg.noClobber:
+			stored, err = storeNoClobber(partial, r.stored)
+		default:
+			if _, statErr := os.Lstat(r.stored); statErr == nil && !cfg.immutable {
+				log.Warn("Overwriting existing file", "file", r.stored)
+			}
+			err = storePartial(cfg, partial, r.stored)
+		}
+		if err != nil {
+			os.Remove(partial)
+			if errors.Is(err, os.ErrExist) {
+				fmt.Fprintf(conn, "REJECTED file already exists and is immutable\n")
+			} else {
+				fmt.Fprintf(conn, "REJECTED could not store file\n")
+			}
+			return 0, "", fmt.Errorf("storing file: %w", err)
+		}
+		if stored != r.stored {
+			log.Info("File exists, stored under a new name", "file", r.stored, "as", stored)
+			if rel, err := filepath.Rel(cfg.outDir, stored); err == nil {
+				renamed = "\trenamed=" + filepath.ToSlash(rel)
+			}
+			r.stored = stored
+		}
+		if token != "" {
+			cfg.uploads.discard(token)
+		}
+		cfg.restoreMetadata(log, r.meta, r.stored)
+		protection = protectStored(log, cfg, r.stored)
+	} else if r.base >= 0 {
+		cfg.restoreMetadata(log, r.meta, r.stored)
+	} else {
+		cfg.sinkWritten = true
+	}
+	cfg.metrics.stored()
+	log.Info("File received successfully", "file", r.stored, "bytes", total)
+	// Clients that name their algorithm hear it back, older ones would take
+	// it for part of renamed
+	algorithm := ""
+	if _, ok := r.attrs["checksum"]; ok {
+		algorithm = "\tchecksum=" + r.algorithm
+	}
+	fmt.Fprintf(conn, "OK %s%s%s\n", digest, algorithm, renamed)
+	return 1, protection, nil
+}
+
+// Add a stored upload to the manifest, if there is one
+func recordUpload(conn net.Conn, cfg *serverConfig, r *checkedRequest, received int64, checksum, protection string) error {
+	if cfg.manifest == nil {
+		return nil
+	}
+	stored := r.stored
+	switch {
+	case cfg.device != "":
+		stored = cfg.device
+	case cfg.output != nil:
+		stored = "-"
+	}
+	entry := manifestEntry{Time: time.Now().UTC(), Remote: conn.RemoteAddr().String(), Name: r.name, Stored: stored, Bytes: received, SHA256: checksum, Trace: r.trace, Btime: r.btime, Immutable: protection}
+	if err := cfg.manifest.record(entry); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return nil
+}
+
+// Report the SHA-256 of a stored file as read back from disk, or of the
+// first size bytes of the device
+func sendChecksum(conn net.Conn, log *slog.Logger, cfg *serverConfig, stored string, size int64) error {
+	if cfg.output != nil {
+		rejectUpload(conn, log, "checksums are not supported when writing to the output")
+		return nil
+	}
+	path := stored
+	if cfg.device != "" {
+		path = cfg.device
+	}
+	sum, err := hashStored(cfg, path, size)
+	if errors.Is(err, os.ErrNotExist) {
+		rejectUpload(conn, log, "no such file")
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not read stored file\n")
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+	log.Info("Checksum", "file", path, "sha256", sum)
+	fmt.Fprintf(conn, "OK %s\n", sum)
+	return nil
+}
+
+// Send the current content of a stored file, preceded by "OK <size>".
+// Returns the number of bytes sent.
+func sendFileToClient(conn net.Conn, log *slog.Logger, cfg *serverConfig, stored string) (int64, error) {
+	if cfg.sink() != "" {
+		rejectUpload(conn, log, "downloads are not supported when writing to the "+cfg.sink())
+		return 0, nil
+	}
+	info, err := os.Stat(stored)
+	if errors.Is(err, os.ErrNotExist) {
+		rejectUpload(conn, log, "no such file")
+		return 0, nil
+	}
+	if err == nil && !info.Mode().IsRegular() {
+		rejectUpload(conn, log, "not a regular file")
+		return 0, nil
+	}
+	var file io.ReadCloser
+	var size int64
+	if err == nil {
+		file, size, err = openStored(cfg, stored)
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not read stored file\n")
+		return 0, fmt.Errorf("opening file for download: %w", err)
+	}
+	defer file.Close()
+	log.Info("Sending", "file", stored)
+	fmt.Fprintf(conn, "OK %d\n", size)
+	sent, err := io.Copy(conn, io.LimitReader(file, size))
+	if err != nil {
+		return sent, fmt.Errorf("sending file: %w", err)
+	}
+	return sent, nil
+}
+
+// Receive a diff against the stored file and apply it. The base digest must
+// match the stored file and the patched result the declared digest, otherwise
+// nothing is changed. Returns the files stored and the diff bytes received.
+func receivePatch(conn net.Conn, log *slog.Logger, cfg *serverConfig, req request, stored string, size int64, trace string, meta fileMetadata) (int, int64, error) {
+	switch {
+	case cfg.sink() != "":
+		rejectUpload(conn, log, "diffs are not supported when writing to the "+cfg.sink())
+		return 0, 0, nil
+	case cfg.noClobber:
+		rejectUpload(conn, log, "diffs would overwrite the stored file")
+		return 0, 0, nil
+	case size < 0 || size > maxDiffFileSize:
+		rejectUpload(conn, log, "diff size missing or too large")
+		return 0, 0, nil
+	case !validSHA256(req.attrs["base"]) || !validSHA256(req.attrs["sha256"]):
+		rejectUpload(conn, log, "diff needs the base and result sha256")
+		return 0, 0, nil
+	}
+	info, err := os.Stat(stored)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > maxDiffFileSize {
+		rejectUpload(conn, log, "no base file to patch")
+		return 0, 0, nil
+	}
+	base, err := readStored(cfg, stored)
+	if err != nil {
+		rejectUpload(conn, log, "could not read base file")
+		return 0, 0, nil
+	}
+	baseSum := sha256.Sum256(base)
+	if hex.EncodeToString(baseSum[:]) != req.attrs["base"] {
+		rejectUpload(conn, log, "base has changed")
+		return 0, 0, nil
+	}
+	fmt.Fprintf(conn, "READY\n")
+
+	patch, err := io.ReadAll(io.LimitReader(conn, size+1))
+	if err != nil || int64(len(patch)) != size {
+		fmt.Fprintf(conn, "REJECTED incomplete diff\n")
+		return 0, int64(len(patch)), fmt.Errorf("receiving diff for %s: got %d of %d bytes", stored, len(patch), size)
+	}
+	received := int64(len(patch))
+	cfg.metrics.received(received)
+	result, err := applyPatch(base, patch)
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED diff does not apply\n")
+		return 0, received, fmt.Errorf("applying diff: %w", err)
+	}
+	resultSum := sha256.Sum256(result)
+	checksum := hex.EncodeToString(resultSum[:])
+	switch {
+	case checksum != req.attrs["sha256"]:
+		fmt.Fprintf(conn, "REJECTED checksum mismatch\n")
+		return 0, received, nil
+	case cfg.denyHashes[checksum]:
+		log.Warn("Rejected", "file", stored, "sha256", checksum, "reason", "rejected by policy")
+		fmt.Fprintf(conn, "REJECTED rejected by policy\n")
+		return 0, received, nil
+	}
+
+	file, err := createPartial(stored)
+	if err == nil {
+		var dest io.Writer
+		var seal func() error
+		if dest, seal, err = cfg.storageWriter(file); err == nil {
+			if _, err = dest.Write(result); err == nil {
+				err = seal()
+			}
+		}
+		if closeErr := closePartial(file); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = storePartial(cfg, file.Name(), stored)
+		}
+		if err != nil {
+			os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(conn, "REJECTED could not store file\n")
+		return 0, received, fmt.Errorf("storing file: %w", err)
+	}
+	cfg.restoreMetadata(log, meta, stored)
+	protection := protectStored(log, cfg, stored)
+	cfg.metrics.stored()
+	log.Info("File patched successfully", "file", stored, "diff_bytes", received)
+	fmt.Fprintf(conn, "OK %s\n", checksum)
+
+	if cfg.manifest != nil {
+		entry := manifestEntry{Time: time.Now().UTC(), Remote: conn.RemoteAddr().String(), Name: req.name, Stored: stored, Bytes: int64(len(result)), SHA256: checksum, Trace: trace, Immutable: protection}
+		if err := cfg.manifest.record(entry); err != nil {
+			return 1, received, fmt.Errorf("writing manifest: %w", err)
+		}
+	}
+	return 1, received, nil
+}
+
+// Hash a stored file, checking it holds exactly size bytes when size isn't
+// negative. Devices are hashed up to size, which they require. Files
+// encrypted at rest are hashed as decrypted.
+func hashStored(cfg *serverConfig, path string, size int64) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case info.Mode().IsRegular() && cfg.storage != nil:
+		file, stored, err := openStored(cfg, path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		if size >= 0 && stored != size {
+			return "", fmt.Errorf("%s holds %d bytes, expected %d", path, stored, size)
+		}
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hasher.Sum(nil)), nil
+	case info.Mode().IsRegular():
+		if size >= 0 && info.Size() != size {
+			return "", fmt.Errorf("%s holds %d bytes, expected %d", path, info.Size(), size)
+		}
+		return hashFile(path, info.Size())
+	case info.Mode()&os.ModeDevice != 0 && size >= 0:
+		return hashFile(path, size)
+	default:
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+}
+
+// Refuse an upload before reading its data
+func rejectUpload(conn net.Conn, log *slog.Logger, reason string) {
+	log.Warn("Rejecting upload", "reason", reason)
+	fmt.Fprintf(conn, "REJECTED %s\n", reason)
+}
+
+// Open an existing device for writing without truncating it
+func openDevice(device string) (*os.File, error) {
+	info, err := os.Stat(device)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeDevice == 0 {
+		return nil, fmt.Errorf("%s is not a device", device)
+	}
+	return os.OpenFile(device, os.O_WRONLY, 0)
+}
+
+// Create a hidden temporary file next to filename to receive into
+func createPartial(filename string) (*os.File, error) {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating directories: %w", err)
+	}
+	file, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".*.part")
+	if err != nil {
+		return nil, fmt.Errorf("creating file: %w", err)
+	}
+	return file, nil
+}
+
+// Flush a received file to disk and close it, so a crash after the rename
+// that publishes it can't leave the name holding less than was received
+func closePartial(file *os.File) error {
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Move a fully received file to its final name
+func commitPartial(partial, filename string) error {
+	if err := os.Chmod(partial, 0644); err != nil {
+		return err
+	}
+	return os.Rename(partial, filename)
+}
+
+// Move a completed partial file into place, without replacing an existing
+// file when the server is write-once
+func storePartial(cfg *serverConfig, partial, filename string) error {
+	if !cfg.immutable {
+		return commitPartial(partial, filename)
+	}
+	if err := os.Link(partial, filename); err != nil {
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// Store a completed partial file as filename, or as filename.1, filename.2
+// and so on when that exists, never replacing a file. Linking fails rather
+// than replaces, so concurrent uploads of one name each get their own.
+// Returns the name used.
+func storeNoClobber(partial, filename string) (string, error) {
+	if err := os.Chmod(partial, 0644); err != nil {
+		return "", err
+	}
+	name := filename
+	for i := 1; ; i++ {
+		err := os.Link(partial, name)
+		if err == nil {
+			return name, os.Remove(partial)
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s.%d", filename, i)
+	}
+}
+
+// Make a stored file write-once when the server is, returning the protection
+// applied for the manifest
+func protectStored(log *slog.Logger, cfg *serverConfig, stored string) string {
+	if !cfg.immutable {
+		return ""
+	}
+	protection, err := makeImmutable(stored)
+	if err != nil {
+		log.Warn("Can't make file immutable", "file", stored, "err", err)
+	}
+	if protection != "" {
+		log.Info("Marked file", "protection", protection, "file", stored)
+	}
+	return protection
+}
+
+// Receive the upload stream from the client into dest, bufferSize bytes at
+// a time, until the client closes its side, feeding the data to hasher.
+// Progress counts the offset bytes delivered earlier, and metrics the bytes
+// as they arrive. Returns the number of bytes received.
+func receiveFile(source io.Reader, dest io.Writer, hasher hash.Hash, bufferSize int, progress *progressMeter, metrics *serverMetrics, offset int64) (received int64, err error) {
+	defer metrics.transferStarted()()
+	var counted int64
+	counter := &countingWriter{w: dest, hasher: hasher,
+		written: func(count int64) {
+			metrics.received(count - counted)
+			counted = count
+			progress.update(offset + count)
+		}}
+	err = copyBuffered(counter, source, bufferSize)
+	if counter.writeErr != nil {
+		return counter.count, fmt.Errorf("writing to file: %w", counter.writeErr)
+	}
+	if err != nil {
+		return counter.count, err
+	}
+	progress.finish(offset + counter.count)
+	return counter.count, nil
+}
+
+// The name a file is stored under on the server: its path below the parent
+// of the file or directory being sent. A single file goes by its base name
+// and a directory keeps its own name and structure, without the sender's
+// absolute layout. -as replaces the name of a single file.
+func (cfg *clientConfig) remoteName(path string) string {
+	if cfg.as != "" {
+		return cfg.as
+	}
+	if cfg.root == "" {
+		return sendName(path)
+	}
+	root, err := filepath.Abs(cfg.root)
+	if err != nil {
+		return sendName(path)
+	}
+	abs, err := filepath.Abs(path)
+	parent := filepath.Dir(root)
+	if err != nil || !isWithin(parent, abs) {
+		return sendName(path)
+	}
+	rel, _ := filepath.Rel(parent, abs)
+	return rel
+}
+
+// Send files to the server, returning the paths that failed and why
+func sendFile(cfg *clientConfig, path string) (failed []SendFailure) {
+	if path == stdinPath || isURL(path) {
+		if err := trySend(cfg, nil, path); err != nil {
+			return []SendFailure{{Path: path, Err: err}}
+		}
+		return nil
+	}
+
+	// Check if the path is a directory or a single file
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("accessing file or directory: %w", err)
+		cfg.events.finish(path, err)
+		return []SendFailure{{Path: path, Err: err}}
+	}
+
+	if fileInfo.IsDir() {
+		if cfg.resumeDirs {
+			return sendDirSession(cfg, path)
+		}
+		if cfg.batchSize > 0 {
+			return sendBatched(cfg, path)
+		}
+		// If it's a directory, send every file as the walk finds it, or once
+		// the server has said which it already has
+		pool := newSendPool(cfg)
+		if cfg.skipStored {
+			var files []string
+			failed = walkFiles(cfg, path, func(filePath string) {
+				files = append(files, filePath)
+			})
+			for _, filePath := range skipStored(cfg, files) {
+				pool.send(filePath)
+			}
+		} else {
+			failed = walkFiles(cfg, path, pool.send)
+		}
+		failed = append(failed, pool.close()...)
+	} else {
+		// If it's a single file, send it directly
+		if reason := cfg.filtered(fileInfo); reason != "" {
+			slog.Info("Skipping", "file", path, "reason", reason)
+			return nil
+		}
+		if cfg.skipStored && len(skipStored(cfg, []string{path})) == 0 {
+			return nil
+		}
+		if err := trySend(cfg, nil, path); err != nil {
+			failed = append(failed, SendFailure{Path: path, Err: err})
+		}
+	}
+	return failed
+}
+
+// Walk a directory and call visit for every file that should be sent,
+// stacking the rules of each .shadowxignore on those of its parent
+// directories and applying the time window and size limit. Empty directories are visited
+// too, since sending files wouldn't recreate them. Links to directories are
+// walked into under their own name, except where that would loop, unless
+// links are sent as links. Returns the paths that couldn't be read.
+func walkFiles(cfg *clientConfig, root string, visit func(filePath string)) (failed []SendFailure) {
+	rulesByDir := make(map[string]ignoreRules)
+	var walk func(dir string, walking []string)
+	walk = func(dir string, walking []string) {
+		// A trailing separator makes Walk follow a link it starts at
+		filepath.Walk(dir+string(filepath.Separator), func(filePath string, info os.FileInfo, err error) error {
+			filePath = filepath.Clean(filePath)
+			if err != nil {
+				slog.Error("Error accessing file", "err", err)
+				err = fmt.Errorf("accessing file: %w", err)
+				cfg.events.finish(filePath, err)
+				failed = append(failed, SendFailure{Path: filePath, Err: err})
+				return nil
+			}
+			rel, _ := filepath.Rel(root, filePath)
+			rel = filepath.ToSlash(rel)
+			rules := rulesByDir[filepath.Dir(filePath)]
+			if rel != "." && rules.ignored(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				own, err := loadIgnoreRules(filePath, rel, rules)
+				if err != nil {
+					slog.Error("Error reading ignore file", "err", err)
+				}
+				rulesByDir[filePath] = own
+				if empty, err := isEmptyDir(filePath); err == nil && empty && cfg.inTimeWindow(info) {
+					visit(filePath)
+				}
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 && !cfg.preserveSymlinks {
+				if target, err := os.Stat(filePath); err == nil && target.IsDir() {
+					// It loops if it leads to a directory that holds the link or
+					// that's being walked into already
+					real := realPath(filePath)
+					for _, ancestor := range append(walking, realPath(filepath.Dir(filePath))) {
+						if isWithinOrAt(real, ancestor) {
+							slog.Warn("Skipping symlink that loops back to a directory being sent", "file", filePath, "target", real)
+							return nil
+						}
+					}
+					walk(filePath, append(walking, real))
+					return nil
+				}
+			}
+			if cfg.filtered(info) == "" {
+				visit(filePath)
+			}
+			return nil
+		})
+	}
+	walk(root, []string{realPath(root)})
+	return failed
+}
+
+// Send a directory in batches of files, saving a checkpoint after each batch
+// so an interrupted run picks up after the last completed batch without
+// walking the tree again
+func sendBatched(cfg *clientConfig, root string) []SendFailure {
+	cp, err := loadCheckpoint(cfg.checkpointPath, root)
+	if err != nil {
+		slog.Warn("Error loading checkpoint, starting over", "err", err)
+	}
+	if cp != nil {
+		slog.Info("Resuming from checkpoint", "done", cp.Done, "files", len(cp.Files))
+	} else {
+		cp = newCheckpoint(cfg.checkpointPath, root)
+		cp.addFailures(walkFiles(cfg, root, func(filePath string) {
+			cp.Files = append(cp.Files, filePath)
+		}))
+	}
+	// An interrupted batch may have delivered some of the files left
+	if cfg.skipStored {
+		cp.Files = append(cp.Files[:cp.Done], skipStored(cfg, cp.Files[cp.Done:])...)
+	}
+	if err := cp.save(); err != nil {
+		slog.Error("Error saving checkpoint", "err", err)
+	}
+
+	pool := newSendPool(cfg)
+	defer pool.close()
+	for cp.Done < len(cp.Files) {
+		end := min(cp.Done+cfg.batchSize, len(cp.Files))
+		for _, filePath := range cp.Files[cp.Done:end] {
+			pool.send(filePath)
+		}
+		cp.addFailures(pool.wait())
+		cp.Done = end
+		if cfg.cache != nil {
+			if err := cfg.cache.save(); err != nil {
+				slog.Error("Error saving checksum cache", "err", err)
+			}
+		}
+		if err := cp.save(); err != nil {
+			slog.Error("Error saving checkpoint", "err", err)
+		}
+		slog.Info("Checkpoint", "done", cp.Done, "files", len(cp.Files))
+	}
+	if err := cp.remove(); err != nil {
+		slog.Error("Error removing checkpoint", "err", err)
+	}
+	return cp.failures()
+}
+
+// Send one file in session, or on a connection of its own when session is
+// nil, reporting progress as it goes
+func trySend(cfg *clientConfig, session *uploadSession, filename string) error {
+	if err := cfg.ctx.Err(); err != nil {
+		return err
+	}
+	slog.Info("Sending", "file", filename)
+	send := sendRetrying
+	switch {
+	case cfg.preserveSymlinks && isSymlink(filename):
+		// A link takes a connection of its own even during a session
+		send = sendSymlink
+	case isDir(filename):
+		// So is an empty directory, which has nothing to send but its name
+		send = sendMkdir
+	case session != nil:
+		send = session.send
+	}
+	var moving os.FileInfo
+	if cfg.move {
+		moving = moveCandidate(filename)
+	}
+	err := send(cfg, filename)
+	if err != nil {
+		slog.Error("Error sending", "file", filename, "err", err)
+	} else {
+		cfg.stats.files.Add(1)
+		// Every upload ends with the server's digest matching the local one
+		if moving != nil {
+			removeSent(filename, moving)
+		}
+	}
+	cfg.events.finish(filename, err)
+	return err
+}
+
+// Send a single file to the server, reporting why it failed
+func sendSingleFile(cfg *clientConfig, filename string) error {
+	// Validate file existence; standard input and URLs are read as they come
+	stream := filename == stdinPath || isURL(filename)
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) && !stream {
+		return errors.New("file does not exist")
+	}
+
+	// Small edits to text files can go as a diff against the server's copy
+	if cfg.diff && !stream && err == nil && info.Mode().IsRegular() && info.Size() <= maxDiffFileSize {
+		done, err := sendDiff(cfg, filename)
+		if done {
+			return err
+		}
+		if err != nil {
+			slog.Info("Sending in full", "file", filename, "reason", err)
+		}
+	}
+
+	// Large files can go as byte ranges over several connections at once
+	if cfg.streams > 1 && !stream && err == nil && info.Mode().IsRegular() {
+		if offsets, lengths := splitRanges(info.Size(), cfg.streams); len(offsets) > 1 {
+			return sendStreamed(cfg, filename, info, offsets, lengths)
+		}
+	}
+
+	// Open the file, or fetch the URL, whose body is sent as it arrives
+	var file *os.File
+	var body io.Reader
+	var fileInfo os.FileInfo
+	if isURL(filename) {
+		resp, info, err := openURL(cfg, filename)
+		if err != nil {
+			return err
+		}
+		defer resp.Close()
+		body, fileInfo = resp, info
+	} else {
+		file = os.Stdin
+		if filename != stdinPath {
+			if file, err = os.Open(filename); err != nil {
+				return fmt.Errorf("opening file: %w", err)
+			}
+			defer file.Close()
+		}
+		if fileInfo, err = file.Stat(); err != nil {
+			return fmt.Errorf("reading file info: %w", err)
+		}
+		body = file
+	}
+	totalSize := sourceSize(file, fileInfo)
+	// Standard input and URLs can't be reopened, so anything that reads the
+	// file again by name treats them like a pipe even when stdin is
+	// redirected from a file
+	regular := fileInfo.Mode().IsRegular() && !stream
+
+	// Connect to the server
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Reuse the cached digest when the file is unchanged, otherwise hash while
+	// sending. The cache only holds SHA-256 digests.
+	var localSum string
+	cacheHit := false
+	cached := cfg.cache != nil && cfg.checksum == defaultChecksum
+	if cached && regular {
+		localSum, cacheHit = cfg.cache.lookup(filename, fileInfo)
+	}
+	var hasher hash.Hash
+	if !cacheHit {
+		hasher = checksumAlgorithms[cfg.checksum]()
+	}
+
+	req, err := uploadRequest(cfg, filename, fileInfo, stream)
+	if err != nil {
+		return err
+	}
+	if totalSize >= 0 {
+		req.attrs["size"] = strconv.FormatInt(totalSize, 10)
+	}
+	// Servers from protocol 1.1 say how much of the upload arrived, so
+	// success never rests on the stream just having ended
+	acked := conn.minor >= 1
+	if acked {
+		req.attrs["ack"] = "1"
+	}
+
+	// A resumable upload is bound to the digest of the whole file, and the
+	// server can only check a digest it's given up front, so in either case
+	// it has to be known before sending
+	resuming := cfg.resume != nil && regular && totalSize >= 0
+	// An append is checked against the digest of the whole file too, so a
+	// server copy that isn't a prefix of the file is refused
+	appending := cfg.appending && regular && totalSize >= 0
+	if resuming || appending || (cfg.verify && regular && totalSize >= 0) {
+		if !cacheHit {
+			if localSum, err = checksumFile(filename, totalSize, cfg.checksum); err != nil {
+				return fmt.Errorf("hashing file: %w", err)
+			}
+			hasher = nil
+		}
+		req.attrs[cfg.checksum] = localSum
+	}
+	if resuming {
+		req.attrs["resume"] = cfg.resume.token(filename, localSum)
+		if cfg.dirSession != "" {
+			req.attrs["dirsession"] = cfg.dirSession
+		}
+	}
+	if appending {
+		req.attrs["append"] = "1"
+	}
+
+	// Send file metadata
+	_, err = fmt.Fprintf(conn, "%s\n", req)
+	if err != nil {
+		return fmt.Errorf("sending file metadata: %w", err)
+	}
+	reader := conn.reader
+
+	// Learn which codec the server picked, when it was offered a choice
+	codec := req.attrs["compress"]
+	if _, ok := req.attrs["codecs"]; ok {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return errors.New("connection closed before the server accepted the upload")
+		}
+		line = strings.TrimSpace(line)
+		if reason, rejected := strings.CutPrefix(line, "REJECTED "); rejected {
+			return fmt.Errorf("transfer rejected by server: %s", reason)
+		}
+		picked, ok := strings.CutPrefix(line, "COMPRESS ")
+		if !ok || (picked != "none" && !knownCompression[picked]) {
+			return fmt.Errorf("unexpected server reply %q", line)
+		}
+		if picked != codec {
+			slog.Warn("Server doesn't support the compression, using another", "file", filename, "requested", codec, "codec", picked)
+		}
+		codec = picked
+	}
+
+	// Learn the upload token and how much of the file the server already holds
+	var sent int64
+	if resuming {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return errors.New("connection closed before the server accepted the upload")
+		}
+		line = strings.TrimSpace(line)
+		if reason, rejected := strings.CutPrefix(line, "REJECTED "); rejected {
+			cfg.resume.forget(filename)
+			return fmt.Errorf("transfer rejected by server: %s", reason)
+		}
+		token, offset, err := parseResume(line)
+		if err != nil || offset > totalSize {
+			return fmt.Errorf("unexpected server reply %q", line)
+		}
+		if err := cfg.resume.remember(filename, localSum, token); err != nil {
+			slog.Error("Error saving resume state", "err", err)
+		}
+		if offset > 0 {
+			if _, err := file.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("seeking file: %w", err)
+			}
+			slog.Info("Resuming", "file", filename, "offset", offset, "size", totalSize)
+		}
+		sent = offset
+	}
+
+	// Learn how much of the file the server holds already; only the rest is sent
+	if appending {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return errors.New("connection closed before the server accepted the upload")
+		}
+		line = strings.TrimSpace(line)
+		if reason, rejected := strings.CutPrefix(line, "REJECTED "); rejected {
+			return fmt.Errorf("transfer rejected by server: %s", reason)
+		}
+		offset, err := parseAppend(line)
+		if err != nil {
+			return fmt.Errorf("unexpected server reply %q", line)
+		}
+		if offset > totalSize {
+			abortConnection(conn)
+			return fmt.Errorf("server copy holds %d bytes, more than the file's %d; if it was rotated, send it without -append to replace the copy", offset, totalSize)
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("seeking file: %w", err)
+		}
+		if offset > 0 {
+			slog.Info("Appending", "file", filename, "offset", offset, "size", totalSize)
+		}
+		sent = offset
+	}
+
+	// Send file content, never more than the size seen at the start so a
+	// growing file is sent as a consistent snapshot
+	source := body
+	if totalSize >= 0 {
+		source = io.LimitReader(body, totalSize-sent)
+	}
+	var out io.Writer = conn
+	var compressor io.WriteCloser
+	if codec != "" && codec != "none" {
+		if compressor, err = compressWriter(codec, conn); err != nil {
+			return fmt.Errorf("compressing: %w", err)
+		}
+		out = compressor
+	}
+	if sent, err = sendData(cfg, filename, out, source, hasher, sent, totalSize); err != nil {
+		// The server mustn't take a cut-off stream for a whole file
+		if cfg.ctx.Err() != nil {
+			abortConnection(conn)
+			return err
+		}
+		if errors.Is(err, errSendingData) {
+			if reason := pendingRejection(conn, reader); reason != "" {
+				if cfg.liveProgress() {
+					breakProgress()
+				}
+				return fmt.Errorf("transfer rejected by server: %s", reason)
+			}
+		}
+		return err
+	}
+
+	// A file that shrank can't be completed; reset the connection so the
+	// server doesn't mistake the short stream for a finished upload
+	if totalSize >= 0 && sent < totalSize {
+		abortConnection(conn)
+		return fmt.Errorf("changed during transfer: expected %d bytes but only %d could be read", totalSize, sent)
+	}
+	changed := false
+	if regular {
+		if after, err := os.Stat(filename); err == nil && (after.Size() != fileInfo.Size() || !after.ModTime().Equal(fileInfo.ModTime())) {
+			changed = true
+			slog.Warn("File changed during transfer, sent a snapshot", "file", filename, "size", after.Size(), "sent", sent)
+		}
+	}
+
+	// Signal end of data and wait for the server's goodbye
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			if reason := pendingRejection(conn, reader); reason != "" {
+				return fmt.Errorf("transfer rejected by server: %s", reason)
+			}
+			return fmt.Errorf("sending file data: %w", err)
+		}
+	}
+	if err := conn.CloseWrite(); err != nil {
+		if reason := pendingRejection(conn, reader); reason != "" {
+			return fmt.Errorf("transfer rejected by server: %s", reason)
+		}
+		return fmt.Errorf("closing upload stream: %w", err)
+	}
+	if acked {
+		if err := readUploadAck(reader, sent); err != nil {
+			return err
+		}
+	}
+	serverSum, renamed, rejected, err := readUploadStatus(reader, localSum, cfg.checksum)
+	if rejected {
+		// The server discarded the upload; a stale cached digest may be why
+		if resuming {
+			cfg.resume.forget(filename)
+		}
+		if cacheHit && req.attrs[cfg.checksum] != "" {
+			cfg.cache.forget(filename)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if localSum, cacheHit, err = matchDigest(cfg, filename, hasher, localSum, cacheHit, sent, serverSum); err != nil {
+		return err
+	}
+	if resuming {
+		if err := cfg.resume.forget(filename); err != nil {
+			slog.Error("Error saving resume state", "err", err)
+		}
+	}
+	if cached && !cacheHit && !changed && regular {
+		cfg.cache.store(filename, fileInfo, localSum)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed without a goodbye from the server")
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("reading goodbye: %w", err)
+	}
+	slog.Debug("Session closed by server", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+
+	// Have the server read its copy back from storage before calling it done
+	if cfg.verifyRoundtrip {
+		if stats.Trace != "" {
+			req.attrs["trace"] = stats.Trace
+		}
+		if err := verifyRoundtrip(cfg, req, sent, localSum); err != nil {
+			return fmt.Errorf("round-trip verification failed: %w", err)
+		}
+		slog.Info("Round-trip verified", "file", filename)
+	}
+	if renamed != "" {
+		slog.Info("File exists on the server, stored under a new name", "file", filename, "as", renamed)
+	}
+	slog.Info("File sent successfully", "file", filename, "bytes", sent, "trace", stats.Trace)
+	return nil
+}
+
+// The upload request for a file, without its size, digest or resume token.
+// stream is set for standard input and URLs, which can't be reread by name.
+func uploadRequest(cfg *clientConfig, filename string, fileInfo os.FileInfo, stream bool) (request, error) {
+	regular := fileInfo.Mode().IsRegular() && !stream
+
+	// Devices are stored as a regular image file on the server
+	remoteName := cfg.remoteName(filename)
+	switch {
+	case cfg.as != "":
+	case filename == stdinPath:
+		remoteName = cfg.stdinName
+	case isURL(filename):
+		remoteName = fileInfo.Name()
+	case fileInfo.Mode()&os.ModeDevice != 0:
+		remoteName = filepath.Base(filename) + ".img"
+	}
+	if err := validRequestName(remoteName); err != nil {
+		return request{}, err
+	}
+	req := request{verb: "upload", name: remoteName, attrs: map[string]string{}}
+	if cfg.traceID != "" {
+		req.attrs["trace"] = cfg.traceID
+	}
+	if cfg.preserve && regular {
+		addFileMetadata(req.attrs, fileInfo)
+	}
+	req.attrs["checksum"] = cfg.checksum
+	if cfg.compress != "" {
+		req.attrs["compress"] = cfg.compress
+		// Every server knows gzip, so only other codecs are negotiated,
+		// which keeps servers that predate negotiation working
+		if cfg.compress != "gzip" {
+			req.attrs["codecs"] = strings.Join(offeredCompression, ",")
+		}
+	}
+	if cfg.preserveBtime && regular {
+		if btime, err := birthTime(filename); err == nil {
+			req.attrs["btime"] = strconv.FormatInt(btime.UnixNano(), 10)
+		}
+	}
+	return req, nil
+}
+
+// Writing file data to the server failed, as opposed to reading the file
+var errSendingData = errors.New("sending file data")
+
+// Copy file data from source to out, hashing it when hasher isn't nil and
+// reporting progress against totalSize, with sent bytes already delivered.
+// Files sent in parallel get a summary line instead of a live counter, which
+// would garble. Returns the new total sent.
+func sendData(cfg *clientConfig, filename string, out io.Writer, source io.Reader, hasher hash.Hash, sent, totalSize int64) (int64, error) {
+	start, resumedAt := time.Now(), sent
+	live := cfg.liveProgress()
+	progress := newProgressMeter(cfg.progress, live, "Sent", filename, totalSize, resumedAt)
+	events := cfg.events.start(filename, "sent", totalSize)
+
+	counter := &countingWriter{w: out, hasher: hasher, count: sent, gate: transferGate, ctx: cfg.ctx, keepalive: true,
+		written: func(count int64) {
+			progress.update(count)
+			events.update(count, false)
+		}}
+	err := copyBuffered(counter, source, cfg.bufferSize)
+	sent = counter.count
+	cfg.stats.bytes.Add(sent - resumedAt)
+	switch {
+	case counter.writeErr != nil:
+		return sent, fmt.Errorf("%w: %w", errSendingData, counter.writeErr)
+	case err != nil && cfg.ctx.Err() != nil:
+		return sent, cfg.ctx.Err()
+	case err != nil:
+		return sent, fmt.Errorf("reading file: %w", err)
+	}
+	events.update(sent, true)
+	progress.finish(sent)
+	if !live {
+		slog.Info("Sent", "file", filename, "bytes", sent, "rate", throughput(sent-resumedAt, start))
+	}
+	return sent, nil
+}
+
+// Read the server's acknowledgement that all sent bytes of an upload
+// arrived, counting those an earlier attempt delivered
+func readUploadAck(reader *bufio.Reader, sent int64) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed before the server acknowledged the file")
+	}
+	line = strings.TrimSpace(line)
+	if reason, ok := strings.CutPrefix(line, "REJECTED "); ok {
+		return fmt.Errorf("transfer rejected by server: %s", reason)
+	}
+	if counts, ok := strings.CutPrefix(line, "INCOMPLETE "); ok {
+		received, size, _ := strings.Cut(counts, " ")
+		return fmt.Errorf("transfer incomplete: the server received %s of %s bytes", received, size)
+	}
+	received, ok := strings.CutPrefix(line, "COMPLETE ")
+	if !ok {
+		return fmt.Errorf("unexpected server reply %q", line)
+	}
+	if n, err := strconv.ParseInt(received, 10, 64); err != nil || n != sent {
+		return fmt.Errorf("server received %s bytes, but %d were sent", received, sent)
+	}
+	return nil
+}
+
+// Read the server's verdict on an upload checked with algorithm. Returns the
+// digest of what it stored, or rejected with the reason when it discarded
+// the upload.
+func readUploadStatus(reader *bufio.Reader, localSum, algorithm string) (serverSum, renamed string, rejected bool, err error) {
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return "", "", false, errors.New("connection closed before the server confirmed the file")
+	}
+	status = strings.TrimSpace(status)
+	if reason, ok := strings.CutPrefix(status, "REJECTED "); ok {
+		return "", "", true, fmt.Errorf("transfer rejected by server: %s", reason)
+	}
+	if received, ok := strings.CutPrefix(status, "MISMATCH "); ok {
+		return "", "", true, fmt.Errorf("checksum mismatch: local %s, server received %s", localSum, received)
+	}
+	status, ok := strings.CutPrefix(status, "OK ")
+	if !ok {
+		return "", "", false, fmt.Errorf("unexpected server status %q", status)
+	}
+	// A server with -no-clobber names the file it stored when the name was
+	// taken, and servers that predate checksum algorithms don't name theirs
+	serverSum, attrs, _ := strings.Cut(status, "\t")
+	checked := defaultChecksum
+	for _, attr := range strings.Split(attrs, "\t") {
+		key, value, _ := strings.Cut(attr, "=")
+		switch key {
+		case "renamed":
+			renamed = value
+		case "checksum":
+			checked = value
+		}
+	}
+	if checked != algorithm {
+		return "", "", false, fmt.Errorf("server checked the upload with %s, not %s; it may not support -checksum-algo", checked, algorithm)
+	}
+	return serverSum, renamed, false, nil
+}
+
+// Check the digest of the sent bytes against the server's. The local digest
+// comes from hasher, or is localSum when hasher is nil. Returns it and
+// whether it still came from the checksum cache.
+func matchDigest(cfg *clientConfig, filename string, hasher hash.Hash, localSum string, cacheHit bool, sent int64, serverSum string) (string, bool, error) {
+	if hasher != nil {
+		localSum = hex.EncodeToString(hasher.Sum(nil))
+	}
+	if localSum != serverSum && cacheHit {
+		// The file changed without touching its size or mtime; drop the stale
+		// digest and hash what was actually sent
+		cfg.cache.forget(filename)
+		cacheHit = false
+		var err error
+		if localSum, err = hashFile(filename, sent); err != nil {
+			return "", false, fmt.Errorf("hashing file: %w", err)
+		}
+	}
+	if localSum != serverSum {
+		return "", false, fmt.Errorf("checksum mismatch: local %s, server %s", localSum, serverSum)
+	}
+	return localSum, cacheHit, nil
+}
+
+// Connect and authenticate to the server once
+func connectSession(cfg *clientConfig) (*clientConn, error) {
+	if err := cfg.ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Every connection would present the same rejected key
+	if cfg.keyRejected.Load() {
+		return nil, fmt.Errorf("%w earlier, not connecting again", ErrAuthFailed)
+	}
+	conn, err := dialServer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to server: %w", err)
+	}
+	slog.Debug("Connected", "server", conn.RemoteAddr().String())
+
+	// Send the banner and authentication key together, sparing a round trip
+	_, err = fmt.Fprintf(conn, "%s\n%s\n", protocolBanner, cfg.secretKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sending authentication key: %w", err)
+	}
+
+	// Read the server's banner and response; a server that rejects the
+	// client certificate only says so now, with TLS 1.3. Everything after
+	// it is read through the same buffer, so replies or data arriving in the
+	// same read as the response aren't lost.
+	lines := newLineConn(conn, bufferLen(cfg.bufferSize))
+	banner, err := lines.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server closed the connection: %w", err)
+	}
+	minor, reason := parseBanner(banner)
+	if reason != "" {
+		conn.Close()
+		// Servers that predate banners took the banner for a wrong key
+		if banner == "Authentication failed" {
+			reason = "no protocol version, it predates them"
+		}
+		return nil, fmt.Errorf("%w: the server speaks %s, this client %s", ErrVersionMismatch, reason, protocolBanner)
+	}
+	reply, err := lines.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("server closed the connection: %w", err)
+	}
+	if reason, ok := strings.CutPrefix(reply, "VERSION MISMATCH "); ok {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrVersionMismatch, reason)
+	}
+	if reply != "Authentication successful" {
+		conn.Close()
+		cfg.keyRejected.Store(true)
+		return nil, fmt.Errorf("%w. Server response: %s", ErrAuthFailed, strings.TrimSpace(reply))
+	}
+	slog.Debug("Authenticated")
+	return &clientConn{serverConn: conn, reader: lines.reader, minor: minor}, nil
+}
+
+// Send filename as a diff against the server's current copy. Returns false,
+// with the reason when there is one, if it has to be sent in full instead,
+// or true with an error if the diff was applied but couldn't be verified.
+func sendDiff(cfg *clientConfig, filename string) (bool, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil || len(data) > maxDiffFileSize || !isText(data) {
+		return false, nil
+	}
+	name := cfg.remoteName(filename)
+	if err := validRequestName(name); err != nil {
+		return false, err
+	}
+	base, err := downloadBytes(cfg, name, maxDiffFileSize)
+	if err != nil {
+		return false, fmt.Errorf("no server copy to diff against (%s)", err)
+	}
+	edits, ok := diffLines(splitLines(base), splitLines(data), maxDiffEdits)
+	if !ok {
+		return false, errors.New("too many changes for a diff")
+	}
+	patch := unifiedDiff(edits, diffContext)
+	if len(patch) >= len(data) {
+		return false, nil
+	}
+
+	baseSum := sha256.Sum256(base)
+	localSum := sha256.Sum256(data)
+	req := request{verb: "patch", name: name, attrs: map[string]string{
+		"base":   hex.EncodeToString(baseSum[:]),
+		"sha256": hex.EncodeToString(localSum[:]),
+		"size":   strconv.Itoa(len(patch)),
+	}}
+	if cfg.traceID != "" {
+		req.attrs["trace"] = cfg.traceID
+	}
+	if cfg.preserve {
+		if info, err := os.Stat(filename); err == nil {
+			addFileMetadata(req.attrs, info)
+		}
+	}
+
+	conn, err := openSession(cfg)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return false, err
+	}
+	reader := conn.reader
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return false, errors.New("connection closed before the server accepted the diff")
+	}
+	if status = strings.TrimSpace(status); status != "READY" {
+		return false, fmt.Errorf("server refused the diff: %s", strings.TrimPrefix(status, "REJECTED "))
+	}
+	counter := &countingWriter{w: conn, gate: transferGate, ctx: cfg.ctx, keepalive: true}
+	n, err := counter.Write(patch)
+	cfg.stats.bytes.Add(int64(n))
+	if err != nil {
+		return false, err
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return false, err
+	}
+	status, err = reader.ReadString('\n')
+	if err != nil {
+		return false, errors.New("connection closed before the server confirmed the diff")
+	}
+	status = strings.TrimSpace(status)
+	if serverSum, ok := strings.CutPrefix(status, "OK "); !ok || serverSum != req.attrs["sha256"] {
+		return false, fmt.Errorf("server did not apply the diff: %s", strings.TrimPrefix(status, "REJECTED "))
+	}
+	slog.Info("Sent as a diff", "file", filename, "diff_bytes", len(patch), "bytes", len(data))
+
+	if line, err := reader.ReadString('\n'); err == nil {
+		if stats, err := parseBye(strings.TrimSpace(line)); err == nil && stats.Trace != "" {
+			req.attrs["trace"] = stats.Trace
+		}
+	}
+	if cfg.verifyRoundtrip {
+		if err := verifyRoundtrip(cfg, req, int64(len(data)), req.attrs["sha256"]); err != nil {
+			return true, fmt.Errorf("round-trip verification failed: %w", err)
+		}
+		slog.Info("Round-trip verified", "file", filename)
+	}
+	slog.Info("File sent successfully", "file", filename, "trace", req.attrs["trace"])
+	return true, nil
+}
+
+// Fetch the server's copy of a file, refusing anything larger than limit
+func downloadBytes(cfg *clientConfig, name string, limit int64) ([]byte, error) {
+	conn, reader, size, err := openDownload(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if size > limit {
+		return nil, fmt.Errorf("server copy is %d bytes, more than %d", size, limit)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, fmt.Errorf("reading server copy: %w", err)
+	}
+	return data, nil
+}
+
+// Ask the server for a stored file. Returns the connection, positioned at the
+// start of the data, and the file's size.
+func openDownload(cfg *clientConfig, name string) (serverConn, *bufio.Reader, int64, error) {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", request{verb: "download", name: name}); err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+	reader := conn.reader
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, errors.New("connection closed before the server answered")
+	}
+	status = strings.TrimSpace(status)
+	if reason, rejected := strings.CutPrefix(status, "REJECTED "); rejected {
+		conn.Close()
+		return nil, nil, 0, errors.New(reason)
+	}
+	sizeStr, ok := strings.CutPrefix(status, "OK ")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if !ok || err != nil || size < 0 {
+		conn.Close()
+		return nil, nil, 0, fmt.Errorf("unexpected server status %q", status)
+	}
+	return conn, reader, size, nil
+}
+
+// Download a stored file from the server into dest, which must not exist yet
+func downloadFile(cfg *clientConfig, name, dest string) error {
+	if err := validRequestName(name); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	conn, reader, size, err := openDownload(cfg, name)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	file, err := createPartial(dest)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	slog.Info("Downloading", "file", name)
+	source := io.LimitReader(reader, size)
+	progress := newProgressMeter(cfg.progress, showProgress() && cfg.events == nil, "Received", name, size, 0)
+	events := cfg.events.start(name, "received", size)
+	counter := &countingWriter{w: file, gate: transferGate, ctx: cfg.ctx,
+		written: func(count int64) {
+			progress.update(count)
+			events.update(count, false)
+		}}
+	err = copyBuffered(counter, source, cfg.bufferSize)
+	if counter.writeErr != nil {
+		return fmt.Errorf("writing to file: %w", counter.writeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("reading from server: %w", err)
+	}
+	received := counter.count
+	events.update(received, true)
+	progress.finish(received)
+	if received != size {
+		return fmt.Errorf("connection closed after %d of %d bytes", received, size)
+	}
+	if err := closePartial(file); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	// Link rather than rename so an existing file is never replaced
+	if err := os.Link(file.Name(), dest); err != nil {
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed without a goodbye from the server")
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("reading goodbye: %w", err)
+	}
+	slog.Debug("Session closed by server", "bytes", stats.Bytes, "duration", stats.Duration)
+	slog.Info("File downloaded successfully", "file", dest)
+	return nil
+}
+
+// Ask the server for the SHA-256 of its stored copy of an upload, computed
+// from what it reads back from storage, and compare it with localSum
+func verifyRoundtrip(cfg *clientConfig, upload request, size int64, localSum string) error {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := request{verb: "checksum", name: upload.name, attrs: map[string]string{"size": strconv.FormatInt(size, 10)}}
+	if trace := upload.attrs["trace"]; trace != "" {
+		req.attrs["trace"] = trace
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return fmt.Errorf("sending checksum request: %w", err)
+	}
+	status, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed before the server answered")
+	}
+	status = strings.TrimSpace(status)
+	if reason, rejected := strings.CutPrefix(status, "REJECTED "); rejected {
+		return errors.New(reason)
+	}
+	storedSum, ok := strings.CutPrefix(status, "OK ")
+	if !ok {
+		return fmt.Errorf("unexpected server status %q", status)
+	}
+	if storedSum != localSum {
+		return fmt.Errorf("stored copy has SHA-256 %s, local %s", storedSum, localSum)
+	}
+	return nil
+}
+
+// A connection to the server: TLS, or a plain Unix socket. Uploads end
+// their stream with CloseWrite.
+type serverConn interface {
+	net.Conn
+	CloseWrite() error
+}
+
+// Connect to the server, holding a handshake slot until the TLS handshake is done
+func dialServer(cfg *clientConfig) (serverConn, error) {
+	if cfg.handshakes != nil {
+		cfg.handshakes <- struct{}{}
+		defer func() { <-cfg.handshakes }()
+	}
+	network, address, host := "tcp", cfg.address, "localhost"
+	if path, ok := unixSocketPath(cfg.address); ok {
+		network, address = "unix", path
+	} else {
+		var err error
+		if host, _, err = net.SplitHostPort(cfg.address); err != nil {
+			return nil, err
+		}
+	}
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(cfg.ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	raw = withContext(cfg.ctx, raw)
+	if cfg.noTLS || plainSocket(cfg.address, cfg.socketTLS) {
+		return throttle(raw, cfg.upLimit, cfg.downLimit).(serverConn), nil
+	}
+	tlsConfig := clientTLSConfig(cfg, host)
+	conn := tls.Client(throttle(raw, cfg.upLimit, cfg.downLimit), tlsConfig)
+	if err := conn.HandshakeContext(cfg.ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 && cfg.fingerprint.CompareAndSwap(false, true) {
+		slog.Info("Connected to server", "server", cfg.address, "fingerprint", hex.EncodeToString(publicKeyPin(certs[0])))
+	}
+	return conn, nil
+}
+
+// Read a rejection the server sent before dropping the connection, if any
+func pendingRejection(conn serverConn, reader *bufio.Reader) string {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, _ := reader.ReadString('\n')
+	reason, ok := strings.CutPrefix(strings.TrimSpace(line), "REJECTED ")
+	if !ok {
+		return ""
+	}
+	return reason
+}
+
+// Drop a connection with a TCP reset instead of a clean TLS close, so the
+// peer sees an error rather than end-of-stream
+func abortConnection(conn serverConn) {
+	raw := unwrapConn(conn)
+	if tlsConn, ok := raw.(*tls.Conn); ok {
+		raw = unwrapConn(tlsConn.NetConn())
+	}
+	if tcpConn, ok := raw.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	raw.Close()
+}
+
+// Determine how many bytes will be read from a file, asking the kernel for block devices.
+// Returns -1 when the size can't be known in advance (pseudo-files, pipes, character devices).
+func sourceSize(file *os.File, info os.FileInfo) int64 {
+	mode := info.Mode()
+	switch {
+	case mode.IsRegular():
+		// Pseudo-files such as those under /proc report 0 but have content
+		if info.Size() > 0 {
+			return info.Size()
+		}
+		return -1
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0:
+		size, err := blockDeviceSize(file)
+		if err != nil {
+			slog.Warn("Can't determine device size, sending until end of device", "err", err)
+			return -1
+		}
+		return size
+	default:
+		// Pipes, sockets and character devices
+		return -1
+	}
+}
@@ -0,0 +1,619 @@
+package shadowx
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsWithin(t *testing.T) {
+	root := filepath.Join("srv", "out")
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"file.txt", true},
+		{"dir/sub/file.txt", true},
+		{"/etc/passwd", true}, // joined under the root like any other name
+		{"../file.txt", false},
+		{"../../etc/cron.d/x", false},
+		{"dir/../../file.txt", false},
+		{"..file", true},
+		{".", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(root, tt.name)
+		if got := isWithin(root, path); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", root, path, got, tt.want)
+		}
+	}
+}
+
+func TestParseBye(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    sessionStats
+		wantErr bool
+	}{
+		{line: "BYE files=1 bytes=300000 duration=5ms", want: sessionStats{Files: 1, Bytes: 300000, Duration: 5 * time.Millisecond}},
+		{line: "BYE", want: sessionStats{}},
+		{line: "BYE files=2 future=field", want: sessionStats{Files: 2}},
+		{line: "BYE files=1 bytes=3 duration=1s trace=4bf92f35", want: sessionStats{Files: 1, Bytes: 3, Duration: time.Second, Trace: "4bf92f35"}},
+		{line: "BYE files=many", wantErr: true},
+		{line: "BYE bytes=-x", wantErr: true},
+		{line: "BYE duration=5", wantErr: true},
+		{line: "OK abc", wantErr: true},
+		{line: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBye(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBye(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseBye(%q) = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSourceSize(t *testing.T) {
+	dir := t.TempDir()
+	regular := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(regular, make([]byte, 1234), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.bin")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeReader.Close()
+	defer pipeWriter.Close()
+
+	open := func(name string) *os.File {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	tests := []struct {
+		name string
+		file *os.File
+		want int64
+	}{
+		{"regular", open(regular), 1234},
+		{"empty", open(empty), -1},
+		{"pipe", pipeReader, -1},
+	}
+	for _, tt := range tests {
+		info, err := tt.file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sourceSize(tt.file, info); got != tt.want {
+			t.Errorf("sourceSize(%s) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHashStored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stored.bin")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const helloSum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	for _, size := range []int64{-1, 5} {
+		sum, err := hashStored(&serverConfig{}, path, size)
+		if err != nil || sum != helloSum {
+			t.Errorf("hashStored(size %d) = %q, %v", size, sum, err)
+		}
+	}
+	if _, err := hashStored(&serverConfig{}, path, 4); err == nil {
+		t.Error("hashStored accepted a file of the wrong size")
+	}
+	if _, err := hashStored(&serverConfig{}, filepath.Dir(path), -1); err == nil {
+		t.Error("hashStored accepted a directory")
+	}
+	if _, err := hashStored(&serverConfig{}, path+".missing", -1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("hashStored(missing) = %v, want ErrNotExist", err)
+	}
+}
+
+func TestIsTLSFile(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"server.key", true},
+		{"./server.crt", true},
+		{filepath.Join("sub", "..", "server.key"), true},
+		{filepath.Join("sub", "server.key"), false},
+		{"server.key.bak", false},
+	}
+	for _, tt := range tests {
+		if got := (&serverConfig{}).isTLSFile(tt.path); got != tt.want {
+			t.Errorf("isTLSFile(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	// Given ones replace the defaults
+	cfg := &serverConfig{tlsCert: filepath.Join("certs", "a.crt"), tlsKey: filepath.Join("certs", "a.key")}
+	for path, want := range map[string]bool{"certs/a.crt": true, "./certs/a.key": true, "server.crt": false} {
+		if got := cfg.isTLSFile(filepath.FromSlash(path)); got != want {
+			t.Errorf("with -tls-cert isTLSFile(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+// Serve a single connection with handleConnection over loopback and return
+// the authenticated client side. done receives what the handler returned.
+func dialTestServer(t *testing.T, cfg *serverConfig) (conn *net.TCPConn, reader *bufio.Reader, done chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done = make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			err = handleConnection(conn, cfg)
+		}
+		done <- err
+	}()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = raw.(*net.TCPConn)
+	t.Cleanup(func() { conn.Close() })
+
+	if _, err := conn.Write([]byte(protocolBanner + "\n" + cfg.secretKey + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(conn)
+	banner, err := reader.ReadString('\n')
+	if err != nil || banner != protocolBanner+"\n" {
+		t.Fatalf("banner %q, %v", banner, err)
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil || reply != "Authentication successful\n" {
+		t.Fatalf("authentication reply %q, %v", reply, err)
+	}
+	return conn, reader, done
+}
+
+// Send payload in a single write after authenticating and return the
+// server's replies
+func testSession(t *testing.T, cfg *serverConfig, payload string) string {
+	t.Helper()
+	replies, _ := testSessionErr(t, cfg, payload)
+	return replies
+}
+
+// Like testSession, also returning the error the handler returned
+func testSessionErr(t *testing.T, cfg *serverConfig, payload string) (string, error) {
+	t.Helper()
+	conn, reader, done := dialTestServer(t, cfg)
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWrite()
+	replies, _ := io.ReadAll(reader)
+	return string(replies), <-done
+}
+
+// The client writes the request line and the start of the data together;
+// none of the data may be lost with the line
+func TestHandleConnectionMetadataWithData(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	testSession(t, cfg, "upload my report.txt\tsize=11\nhello world")
+
+	data, err := os.ReadFile(filepath.Join(dir, "my report.txt"))
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("stored %q, %v, want %q", data, err, "hello world")
+	}
+}
+
+// A stream that ends before the declared size is an incomplete upload, not
+// a stored file
+func TestHandleConnectionIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	replies, err := testSessionErr(t, cfg, "upload a.txt\tsize=11\nhello")
+	if err == nil || !strings.Contains(err.Error(), "5 of 11 bytes") {
+		t.Errorf("handleConnection = %v, want an incomplete upload error", err)
+	}
+	if replies != "REJECTED incomplete upload\n" {
+		t.Errorf("replies %q, want %q", replies, "REJECTED incomplete upload\n")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("output directory holds %d entries, want none", len(entries))
+	}
+}
+
+// A client that asks for acknowledgements hears INCOMPLETE for a stream
+// that ends before the declared size, and COMPLETE before the verdict for
+// one that doesn't
+func TestHandleConnectionAck(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	replies, err := testSessionErr(t, cfg, "upload a.txt\tack=1\tsize=11\nhello")
+	if err == nil || !strings.Contains(err.Error(), "5 of 11 bytes") {
+		t.Errorf("handleConnection = %v, want an incomplete upload error", err)
+	}
+	if replies != "INCOMPLETE 5 11\n" {
+		t.Errorf("dropped upload: replies %q, want %q", replies, "INCOMPLETE 5 11\n")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("output directory holds %d entries, want none", len(entries))
+	}
+
+	replies = testSession(t, cfg, "upload a.txt\tack=1\tsize=11\nhello world")
+	if !strings.HasPrefix(replies, "COMPLETE 11\nOK ") || !strings.Contains(replies, "BYE ") {
+		t.Errorf("whole upload: replies %q, want COMPLETE, OK and BYE", replies)
+	}
+}
+
+// The client only calls an upload sent once the server acknowledges every
+// byte of it
+func TestReadUploadAck(t *testing.T) {
+	for reply, want := range map[string]string{
+		"COMPLETE 5\n":            "",
+		"COMPLETE 4\n":            "server received 4 bytes, but 5 were sent",
+		"INCOMPLETE 3 5\n":        "transfer incomplete: the server received 3 of 5 bytes",
+		"REJECTED too large\n":    "transfer rejected by server: too large",
+		"OK 2cf24dba5fb0a30e26\n": "unexpected server reply",
+		"":                        "connection closed",
+	} {
+		err := readUploadAck(bufio.NewReader(strings.NewReader(reply)), 5)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("readUploadAck(%q) = %v, want %q", reply, err, want)
+		}
+	}
+}
+
+func TestHandleConnectionVerify(t *testing.T) {
+	const helloSum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	const otherSum = "0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		sha256 string
+		reply  string
+		stored bool
+	}{
+		{helloSum, "OK " + helloSum + "\n", true},
+		{otherSum, "MISMATCH " + helloSum + "\n", false},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+		replies := testSession(t, cfg, "upload greeting.txt\tsize=5\tsha256="+tt.sha256+"\nhello")
+		if !strings.HasPrefix(replies, tt.reply) || !strings.Contains(replies, "BYE ") {
+			t.Errorf("sha256 %.8s: replies %q, want %q then BYE", tt.sha256, replies, tt.reply)
+		}
+		// A mismatch leaves nothing behind, not even the partial file
+		entries, _ := os.ReadDir(dir)
+		if stored := len(entries) == 1 && entries[0].Name() == "greeting.txt"; stored != tt.stored || (!stored && len(entries) != 0) {
+			t.Errorf("sha256 %.8s: output directory holds %v, want stored %v", tt.sha256, entries, tt.stored)
+		}
+	}
+}
+
+// A client asking to write outside the root is refused and nothing lands
+// outside it
+func TestHandleConnectionTraversal(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "srv", "intake", "received")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &serverConfig{secretKey: "secret", outDir: root, uploads: newUploadStore(root)}
+	for _, name := range []string{"../../../tmp/pwn", "/tmp/pwn"} {
+		replies := testSession(t, cfg, "upload "+name+"\tsize=5\nowned")
+		if !strings.HasPrefix(replies, "REJECTED unsafe file name") {
+			t.Errorf("upload %s: replies %q", name, replies)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(base, "tmp", "pwn")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file written outside the root: %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("root holds %v, want nothing", entries)
+	}
+}
+
+func TestHandleConnectionDownload(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"report.txt": "hello", ".hidden": "secret"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"report.txt", "OK 5\nhelloBYE files=0 bytes=5 "},
+		{"missing.txt", "REJECTED no such file\nBYE files=0 bytes=0 "},
+		{".hidden", "REJECTED no such file\n"},
+		{"../report.txt", "REJECTED unsafe file name\n"},
+	}
+	for _, tt := range tests {
+		replies := testSession(t, cfg, "download "+tt.name+"\n")
+		if !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("download %s: replies %q, want prefix %q", tt.name, replies, tt.reply)
+		}
+	}
+}
+
+// An upload whose connection is reset halfway resumes from what the server
+// kept and ends up byte-identical
+func TestHandleConnectionResume(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	sum := sha256.Sum256(data)
+	attrs := fmt.Sprintf("\tsize=%d\tsha256=%x", len(data), sum)
+
+	// Send half the file, then reset the connection as a killed client would
+	conn, reader, done := dialTestServer(t, cfg)
+	fmt.Fprintf(conn, "upload big.bin%s\tresume=new\n", attrs)
+	token, offset, err := parseResume(strings.TrimSpace(readLine(t, reader)))
+	if err != nil || offset != 0 {
+		t.Fatalf("first session: token %q offset %d, %v", token, offset, err)
+	}
+	conn.Write(data[:len(data)/2])
+	time.Sleep(100 * time.Millisecond)
+	conn.SetLinger(0)
+	conn.Close()
+	<-done
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); err == nil {
+		t.Fatal("interrupted upload was stored")
+	}
+
+	conn, reader, done = dialTestServer(t, cfg)
+	fmt.Fprintf(conn, "upload big.bin%s\tresume=%s\n", attrs, token)
+	_, offset, err = parseResume(strings.TrimSpace(readLine(t, reader)))
+	if err != nil || offset == 0 || offset > int64(len(data)/2) {
+		t.Fatalf("second session: offset %d, %v", offset, err)
+	}
+	conn.Write(data[offset:])
+	conn.CloseWrite()
+	if status := readLine(t, reader); status != fmt.Sprintf("OK %x\n", sum) {
+		t.Errorf("second session: status %q", status)
+	}
+	<-done
+
+	stored, err := os.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Errorf("resumed upload differs from the original (%d of %d bytes, %v)", len(stored), len(data), err)
+	}
+}
+
+func readLine(t *testing.T, reader *bufio.Reader) string {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	return line
+}
+
+func TestRemoteName(t *testing.T) {
+	tests := []struct {
+		root, path, want string
+	}{
+		{"report.pdf", "report.pdf", "report.pdf"},
+		{"/home/user/report.pdf", "/home/user/report.pdf", "report.pdf"},
+		{"/home/user/project", "/home/user/project/src/main.go", "project/src/main.go"},
+		{"/home/user/project/", "/home/user/project/src/main.go", "project/src/main.go"},
+		{"project", "project/src/main.go", "project/src/main.go"},
+		{"../project", "../project/main.go", "project/main.go"},
+		{"", "/var/log/syslog", "var/log/syslog"},
+	}
+	for _, tt := range tests {
+		cfg := &clientConfig{root: filepath.FromSlash(tt.root)}
+		if got := cfg.remoteName(filepath.FromSlash(tt.path)); got != filepath.FromSlash(tt.want) {
+			t.Errorf("remoteName(%q) under %q = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
+
+// An executable script sent with -preserve keeps its 0755 bit
+func TestHandleConnectionPreserve(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	testSession(t, cfg, "upload deploy.sh\tsize=10\tmode=755\tmtime=1700000000000000000\n#!/bin/sh\n")
+
+	info, err := os.Stat(filepath.Join(dir, "deploy.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0755 || info.ModTime().Unix() != 1700000000 {
+		t.Errorf("stored with mode %v, mtime %v", info.Mode().Perm(), info.ModTime())
+	}
+}
+
+func TestHandleConnectionCompressed(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible "), 10000)
+	random := make([]byte, 100000)
+	rand.Read(random)
+	for name, data := range map[string][]byte{"text.log": text, "archive.bin": random} {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+		sum := sha256.Sum256(data)
+		request := fmt.Sprintf("upload %s\tsize=%d\tcompress=gzip\n", name, len(data))
+		replies := testSession(t, cfg, request+string(gzipped(t, data)))
+		if !strings.HasPrefix(replies, fmt.Sprintf("OK %x\n", sum)) {
+			t.Errorf("%s: replies %q", name, replies)
+		}
+		// The session summary counts the original bytes
+		if !strings.Contains(replies, fmt.Sprintf("bytes=%d ", len(data))) {
+			t.Errorf("%s: summary %q doesn't count %d bytes", name, replies, len(data))
+		}
+		stored, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(stored, data) {
+			t.Errorf("%s: stored copy differs (%d of %d bytes, %v)", name, len(stored), len(data), err)
+		}
+	}
+}
+
+// A session the server couldn't complete returns an error; a refused
+// request is the client's problem and returns nil
+func TestHandleConnectionErrors(t *testing.T) {
+	tests := []struct {
+		payload string
+		wantErr bool
+	}{
+		{"upload ok.txt\tsize=5\nhello", false},
+		{"upload short.txt\tsize=10\nhello", true},
+		{"upload ../escape.txt\tsize=1\nx", false},
+		{"download missing.txt\n", false},
+		{"rename ok.txt\n", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+		if _, err := testSessionErr(t, cfg, tt.payload); (err != nil) != tt.wantErr {
+			t.Errorf("session %q: error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+		}
+	}
+}
+
+// A server writing to an output takes one upload and refuses anything that
+// needs stored files
+func TestHandleConnectionOutput(t *testing.T) {
+	var out bytes.Buffer
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), output: &out}
+	tests := []struct {
+		payload string
+		reply   string
+	}{
+		{"download backup.tar\n", "REJECTED downloads are not supported when writing to the output\n"},
+		{"checksum backup.tar\n", "REJECTED checksums are not supported when writing to the output\n"},
+		{"upload backup.tar\nstreamed data", "OK "},
+		{"upload again.tar\nmore", "REJECTED output has already been written\n"},
+	}
+	for _, tt := range tests {
+		if replies := testSession(t, cfg, tt.payload); !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("session %q: replies %q, want prefix %q", tt.payload, replies, tt.reply)
+		}
+	}
+	if out.String() != "streamed data" {
+		t.Errorf("output holds %q, want %q", out.String(), "streamed data")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("output directory holds %v, want nothing", entries)
+	}
+}
+
+// Empty, one-byte and past-2GB files arrive whole, with counts and digests
+// that don't wrap. The large one is sparse and streamed to Output, so it
+// takes no disk space.
+func TestTransferSizes(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int64
+		large bool
+	}{
+		{"empty", 0, false},
+		{"one byte", 1, false},
+		{"past 2GB", 1<<31 + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.large && testing.Short() {
+				t.Skip("sends over 2GB")
+			}
+			t.Chdir(t.TempDir())
+			captureLog(t, slog.LevelInfo)
+			f, err := os.Create("data")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.large {
+				err = f.Truncate(tt.size)
+			} else {
+				_, err = f.Write(bytes.Repeat([]byte("x"), int(tt.size)))
+			}
+			if err == nil {
+				_, err = f.Seek(0, io.SeekStart)
+			}
+			want := sha256.New()
+			if err == nil {
+				_, err = io.Copy(want, f)
+			}
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			done := make(map[string]int64)
+			report := func(side string) func(string, int64, int64) {
+				return func(_ string, n, _ int64) {
+					mu.Lock()
+					defer mu.Unlock()
+					done[side] = n
+				}
+			}
+			srv := &Server{Key: "test-key", OutDir: DefaultOutDir, ProgressFunc: report("server")}
+			output := &countingWriter{w: io.Discard, hasher: sha256.New()}
+			if tt.large {
+				srv.Output = output
+			}
+			stop := startTestServer(t, srv)
+			client := &Client{Addr: srv.Addr, Key: srv.Key, Verify: true, ProgressFunc: report("client")}
+			if err := client.Send("data"); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if err := stop(); err != nil {
+				t.Fatalf("ListenAndServe: %v", err)
+			}
+
+			if !tt.large {
+				stored, err := os.ReadFile(filepath.Join(DefaultOutDir, "data"))
+				if err != nil {
+					t.Fatalf("file wasn't stored: %v", err)
+				}
+				output.Write(stored)
+			}
+			if output.count != tt.size || !bytes.Equal(output.hasher.Sum(nil), want.Sum(nil)) {
+				t.Errorf("stored %d bytes with a different digest, want %d", output.count, tt.size)
+			}
+			for side, n := range done {
+				if n != tt.size {
+					t.Errorf("%s reported %d bytes done, want %d", side, n, tt.size)
+				}
+			}
+			if len(done) != 2 {
+				t.Errorf("progress reported by %v, want client and server", done)
+			}
+		})
+	}
+}
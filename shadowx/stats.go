@@ -0,0 +1,43 @@
+package shadowx
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Totals of one Send, updated as files complete, for the summary at the end.
+// Files sent in parallel update it at once.
+type transferStats struct {
+	start time.Time
+	files atomic.Int64 // files, links and directories the server confirmed
+	bytes atomic.Int64 // file data written to the server, including attempts that failed
+}
+
+// Start counting afresh for another Send
+func (s *transferStats) reset() {
+	s.start = time.Now()
+	s.files.Store(0)
+	s.bytes.Store(0)
+}
+
+// Log the totals of a Send in which failed paths couldn't be sent, whatever
+// the level when always is set, and emit them as a summary event
+func (s *transferStats) report(events *eventWriter, failed int, always bool) {
+	elapsed := time.Since(s.start)
+	files, bytes := s.files.Load(), s.bytes.Load()
+	record := slog.NewRecord(time.Now(), slog.LevelInfo, "Transfer summary", 0)
+	record.Add("files", files, "failed", failed, "bytes", bytes,
+		"elapsed", elapsed.Round(time.Millisecond), "rate", throughput(bytes, s.start))
+	// The handler itself doesn't check the level, the logger does
+	if handler := slog.Default().Handler(); always || handler.Enabled(context.Background(), slog.LevelInfo) {
+		handler.Handle(context.Background(), record)
+	}
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(bytes) / elapsed.Seconds()
+	}
+	events.emit("summary", "", map[string]any{"files": files, "failed": failed, "bytes": bytes,
+		"elapsed_ms": elapsed.Milliseconds(), "bytes_per_second": int64(rate)})
+}
@@ -0,0 +1,100 @@
+package shadowx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Sending a directory ends with the totals of every file in it, in the log
+// and as the last event, and the server sums up the session it received
+func TestClientSendSummary(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	if err := os.MkdirAll("tree/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"tree/a.txt": 100, "tree/b.txt": 2000, "tree/sub/c.txt": 30000} {
+		if err := os.WriteFile(name, bytes.Repeat([]byte("x"), size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	var events bytes.Buffer
+	if err := (&Client{Addr: srv.Addr, Key: srv.Key, Events: &events}).Send("tree"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(events.String()), "\n")
+	var summary struct {
+		Event         string
+		Files, Failed int
+		Bytes         int64
+		Elapsed       int64 `json:"elapsed_ms"`
+		Rate          int64 `json:"bytes_per_second"`
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Event != "summary" || summary.Files != 3 || summary.Failed != 0 || summary.Bytes != 32100 {
+		t.Errorf("last event %s, want a summary of 3 files, 32100 bytes and no failures", lines[len(lines)-1])
+	}
+	for _, want := range []string{`msg="Transfer summary" files=3 failed=0 bytes=32100`, `msg="Session summary"`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %s:\n%s", want, logs)
+		}
+	}
+}
+
+// With QuietSuccess and only errors logged, a batch in which one file fails
+// logs that file and the summary, nothing for the files that were sent
+func TestClientQuietSuccess(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelError)
+	if err := os.Mkdir("batch", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 9 {
+		if err := os.WriteFile(fmt.Sprintf("batch/%d.txt", i), []byte("small"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile("batch/large.bin", bytes.Repeat([]byte("x"), 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MaxFileSize: 1000}
+	startTestServer(t, srv)
+
+	err := (&Client{Addr: srv.Addr, Key: srv.Key, QuietSuccess: true}).Send("batch")
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Failed) != 1 || filepath.Base(sendErr.Failed[0].Path) != "large.bin" {
+		t.Fatalf("Send = %v, want large.bin to fail", err)
+	}
+	var info, errs []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		switch {
+		case strings.Contains(line, "level=INFO"):
+			info = append(info, line)
+		case strings.Contains(line, "level=ERROR"):
+			errs = append(errs, line)
+		default:
+			t.Errorf("unexpected log line %s", line)
+		}
+	}
+	if len(info) != 1 || !strings.Contains(info[0], `msg="Transfer summary" files=9 failed=1 `) {
+		t.Errorf("info lines %q, want only the summary", info)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0], "large.bin") || !strings.Contains(errs[0], "file too large") {
+		t.Errorf("error lines %q, want one for large.bin", errs)
+	}
+	if len(info) == 1 && !strings.HasSuffix(strings.TrimSpace(logs.String()), info[0]) {
+		t.Error("the summary isn't the last line")
+	}
+}
@@ -0,0 +1,434 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Smallest byte range worth a connection of its own; files too small for
+// two go over a single stream
+const minStreamRange = 1 << 20
+
+// A file received over several connections at once. The connection that
+// started it waits for "commit" while "range" requests on the others write
+// their parts of the preallocated partial file in place.
+type chunkedUpload struct {
+	name     string   // the requested name, which range requests repeat
+	file     *os.File // the partial file, already its full size
+	size     int64
+	received atomic.Int64 // bytes the ranges have written
+	lastData atomic.Int64 // when a range last received data, in Unix nanoseconds
+	writing  sync.WaitGroup
+}
+
+// Note that a range just received data
+func (u *chunkedUpload) touch() {
+	u.lastData.Store(time.Now().UnixNano())
+}
+
+// Chunked uploads in progress, keyed by the token the server handed out
+type chunkedUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*chunkedUpload
+}
+
+func (c *chunkedUploads) add(upload *chunkedUpload) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads == nil {
+		c.uploads = make(map[string]*chunkedUpload)
+	}
+	token := newTraceID()
+	upload.touch()
+	c.uploads[token] = upload
+	return token
+}
+
+// Claim an upload for a range to write to; the caller calls writing.Done
+// when it's finished. Returns nil for an unknown token.
+func (c *chunkedUploads) claim(token string) *chunkedUpload {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	upload := c.uploads[token]
+	if upload != nil {
+		upload.writing.Add(1)
+	}
+	return upload
+}
+
+// Stop taking ranges for an upload and wait for those being written
+func (c *chunkedUploads) remove(token string) {
+	c.mu.Lock()
+	upload := c.uploads[token]
+	delete(c.uploads, token)
+	c.mu.Unlock()
+	if upload != nil {
+		upload.writing.Wait()
+	}
+}
+
+// Answer a "chunked <name>\tsize=<n>\tsha256=<hex>" request: create the
+// partial file at its full size, reply "READY <token>" and wait while the
+// client sends the byte ranges on other connections. On "commit" check the
+// assembled file's digest and store it as an upload would be, replying OK
+// or MISMATCH before BYE; if the connection drops instead, discard it.
+func receiveChunked(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	checked, reason := checkRequest(log, cfg, req)
+	switch {
+	case reason != "":
+	case cfg.sink() != "":
+		reason = "streams are not supported when writing to the " + cfg.sink()
+	case cfg.storage != nil:
+		reason = "streams are not supported with encryption at rest"
+	case checked.size < 0 || checked.declared == "":
+		reason = "streams require the file's size and sha256"
+	case req.attrs["compress"] != "" || req.attrs["resume"] != "" || req.attrs["append"] != "":
+		reason = "streams can't be compressed, resumed or appended"
+	case checked.algorithm != defaultChecksum:
+		reason = "streams only support sha256 checksums"
+	}
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return nil
+	}
+	file, err := createPartial(checked.stored)
+	if err != nil {
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	partial := file.Name()
+	if err := file.Truncate(checked.size); err != nil {
+		file.Close()
+		os.Remove(partial)
+		fmt.Fprintf(conn, "REJECTED could not allocate file\n")
+		return fmt.Errorf("allocating file: %w", err)
+	}
+	upload := &chunkedUpload{name: req.name, file: file, size: checked.size}
+	token := cfg.chunked.add(upload)
+	log.Info("Receiving in parallel streams", "file", checked.stored, "trace", checked.trace)
+	fmt.Fprintf(conn, "READY %s\n", token)
+
+	// The ranges arrive on other connections, so this one only idles out
+	// once they've all gone quiet
+	stop := make(chan struct{})
+	if cfg.idleTimeout > 0 {
+		go keepChunkedAlive(conn, upload, cfg.idleTimeout, stop)
+	}
+	line, err := conn.readLine()
+	close(stop)
+	cfg.chunked.remove(token)
+	closeErr := closePartial(file)
+	if err == nil && line != "commit" {
+		err = fmt.Errorf("unexpected request %q", line)
+	}
+	if err != nil || closeErr != nil {
+		os.Remove(partial)
+		if err != nil {
+			return fmt.Errorf("receiving file: %w", err)
+		}
+		fmt.Fprintf(conn, "REJECTED could not store file\n")
+		return fmt.Errorf("writing to file: %w", closeErr)
+	}
+
+	received := upload.received.Load()
+	if received < checked.size {
+		os.Remove(partial)
+		fmt.Fprintf(conn, "REJECTED incomplete upload\n")
+		return fmt.Errorf("upload incomplete: %s (%d of %d bytes)", checked.stored, received, checked.size)
+	}
+	checksum, err := hashFile(partial, checked.size)
+	if err != nil {
+		os.Remove(partial)
+		fmt.Fprintf(conn, "REJECTED could not read stored file\n")
+		return fmt.Errorf("computing checksum: %w", err)
+	}
+	files, protection, err := storeUpload(conn, log, cfg, checked, partial, "", checked.size, checksum)
+	if err != nil {
+		return err
+	}
+	var manifestErr error
+	if files > 0 {
+		manifestErr = recordUpload(conn, cfg, checked, checked.size, checksum, protection)
+	}
+	stats := sessionStats{Files: files, Bytes: received, Duration: time.Since(start).Round(time.Millisecond), Trace: checked.trace}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return errors.Join(manifestErr, fmt.Errorf("sending goodbye: %w", err))
+	}
+	log.Debug("Session closed", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+	return manifestErr
+}
+
+// Push back the read deadline of a chunked upload's waiting connection
+// while its ranges keep receiving data, until stop is closed
+func keepChunkedAlive(conn net.Conn, upload *chunkedUpload, timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			conn.SetReadDeadline(time.Unix(0, upload.lastData.Load()).Add(timeout))
+		}
+	}
+}
+
+// Answer a "range <name>\ttoken=<token>\toffset=<n>\tlength=<n>" request
+// by writing the length bytes that follow at offset in the chunked upload,
+// then replying OK and BYE
+func receiveRange(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	upload := cfg.chunked.claim(req.attrs["token"])
+	if upload == nil {
+		rejectUpload(conn, log, "unknown upload token")
+		return nil
+	}
+	defer upload.writing.Done()
+	offset, offsetErr := strconv.ParseInt(req.attrs["offset"], 10, 64)
+	length, lengthErr := strconv.ParseInt(req.attrs["length"], 10, 64)
+	switch {
+	case req.name != upload.name:
+		rejectUpload(conn, log, "upload token belongs to a different file")
+		return nil
+	case offsetErr != nil || lengthErr != nil || offset < 0 || length < 0 || offset > upload.size-length:
+		rejectUpload(conn, log, "malformed range")
+		return nil
+	}
+
+	log.Debug("Receiving range", "name", req.name, "offset", offset, "length", length)
+	dest := &touchingWriter{w: io.NewOffsetWriter(upload.file, offset), upload: upload}
+	received, err := receiveFile(io.LimitReader(conn, length), dest, nil, cfg.bufferSize, nil, cfg.metrics, 0)
+	if err != nil {
+		return fmt.Errorf("receiving range: %w", err)
+	}
+	upload.received.Add(received)
+	if received < length {
+		fmt.Fprintf(conn, "REJECTED incomplete range\n")
+		return fmt.Errorf("range incomplete: %s at %d (%d of %d bytes)", req.name, offset, received, length)
+	}
+	fmt.Fprintf(conn, "OK\n")
+	stats := sessionStats{Bytes: received, Duration: time.Since(start).Round(time.Millisecond), Trace: req.attrs["trace"]}
+	fmt.Fprintf(conn, "BYE %s\n", stats)
+	log.Debug("Session closed", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+	return nil
+}
+
+// Writes to a range of a chunked upload, keeping its waiting connection alive
+type touchingWriter struct {
+	w      io.Writer
+	upload *chunkedUpload
+}
+
+func (t *touchingWriter) Write(p []byte) (int, error) {
+	t.upload.touch()
+	return t.w.Write(p)
+}
+
+// Byte ranges splitting size bytes into at most streams parts of at least
+// minStreamRange each, the last taking any remainder
+func splitRanges(size int64, streams int) (offsets, lengths []int64) {
+	n := min(int64(streams), size/minStreamRange)
+	if n < 1 {
+		n = 1
+	}
+	part := size / n
+	for i := range n {
+		length := part
+		if i == n-1 {
+			length = size - part*(n-1)
+		}
+		offsets = append(offsets, part*i)
+		lengths = append(lengths, length)
+	}
+	return offsets, lengths
+}
+
+// Send a regular file over cfg.streams connections at once, each carrying
+// one byte range, with another connection starting the upload and
+// committing it once every range has arrived. The server checks the
+// reassembled file against the SHA-256 declared up front.
+func sendStreamed(cfg *clientConfig, filename string, info os.FileInfo, offsets, lengths []int64) error {
+	sum, err := localDigest(cfg, filename, info)
+	if err != nil {
+		return fmt.Errorf("hashing file: %w", err)
+	}
+	req, err := uploadRequest(cfg, filename, info, false)
+	if err != nil {
+		return err
+	}
+	req.verb = "chunked"
+	req.attrs["size"] = strconv.FormatInt(info.Size(), 10)
+	req.attrs["sha256"] = sum
+
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return fmt.Errorf("sending file metadata: %w", err)
+	}
+	reader := conn.reader
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed before the server accepted the upload")
+	}
+	line = strings.TrimSpace(line)
+	if reason, rejected := strings.CutPrefix(line, "REJECTED "); rejected {
+		return fmt.Errorf("transfer rejected by server: %s", reason)
+	}
+	token, ok := strings.CutPrefix(line, "READY ")
+	if !ok || !validUploadToken(token) {
+		return fmt.Errorf("unexpected server reply %q", line)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+	slog.Info("Sending in parallel streams", "file", filename, "streams", len(offsets), "size", info.Size())
+
+	// The ranges share one progress report
+	start := time.Now()
+	live := cfg.liveProgress()
+	progress := newProgressMeter(cfg.progress, live, "Sent", filename, info.Size(), 0)
+	events := cfg.events.start(filename, "sent", info.Size())
+	var mu sync.Mutex
+	var sent int64
+	report := func(n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent += n
+		cfg.stats.bytes.Add(n)
+		progress.update(sent)
+		events.update(sent, false)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(offsets))
+	for i := range offsets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			section := io.NewSectionReader(file, offsets[i], lengths[i])
+			rangeReq := request{verb: "range", name: req.name, attrs: map[string]string{"token": token,
+				"offset": strconv.FormatInt(offsets[i], 10), "length": strconv.FormatInt(lengths[i], 10)}}
+			if trace := req.attrs["trace"]; trace != "" {
+				rangeReq.attrs["trace"] = trace
+			}
+			errs[i] = sendRange(cfg, rangeReq, section, report)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		// Dropping the connection makes the server discard the partial file
+		abortConnection(conn)
+		return err
+	}
+	events.update(sent, true)
+	progress.finish(sent)
+	if !live {
+		slog.Info("Sent", "file", filename, "bytes", sent, "rate", throughput(sent, start))
+	}
+
+	if _, err := fmt.Fprintf(conn, "commit\n"); err != nil {
+		return fmt.Errorf("committing upload: %w", err)
+	}
+	serverSum, renamed, rejected, err := readUploadStatus(reader, sum, cfg.checksum)
+	if rejected && cfg.cache != nil {
+		cfg.cache.forget(filename)
+	}
+	if err != nil {
+		return err
+	}
+	if serverSum != sum {
+		return fmt.Errorf("checksum mismatch: local %s, server %s", sum, serverSum)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed without a goodbye from the server")
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("reading goodbye: %w", err)
+	}
+	slog.Debug("Session closed by server", "files", stats.Files, "bytes", stats.Bytes, "duration", stats.Duration)
+
+	if cfg.verifyRoundtrip {
+		if stats.Trace != "" {
+			req.attrs["trace"] = stats.Trace
+		}
+		if err := verifyRoundtrip(cfg, req, info.Size(), sum); err != nil {
+			return fmt.Errorf("round-trip verification failed: %w", err)
+		}
+		slog.Info("Round-trip verified", "file", filename)
+	}
+	if renamed != "" {
+		slog.Info("File exists on the server, stored under a new name", "file", filename, "as", renamed)
+	}
+	slog.Info("File sent successfully", "file", filename, "bytes", sent, "trace", stats.Trace)
+	return nil
+}
+
+// Send one byte range of a chunked upload on a connection of its own,
+// reporting each write's byte count
+func sendRange(cfg *clientConfig, req request, section *io.SectionReader, report func(n int64)) error {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return fmt.Errorf("sending range request: %w", err)
+	}
+	reader := conn.reader
+	var last int64
+	counter := &countingWriter{w: conn, gate: transferGate, ctx: cfg.ctx, keepalive: true,
+		written: func(count int64) {
+			report(count - last)
+			last = count
+		}}
+	err = copyBuffered(counter, section, cfg.bufferSize)
+	switch {
+	case counter.writeErr != nil:
+		if reason := pendingRejection(conn, reader); reason != "" {
+			return fmt.Errorf("transfer rejected by server: %s", reason)
+		}
+		return fmt.Errorf("%w: %w", errSendingData, counter.writeErr)
+	case err != nil && cfg.ctx.Err() != nil:
+		abortConnection(conn)
+		return cfg.ctx.Err()
+	case err != nil:
+		abortConnection(conn)
+		return fmt.Errorf("reading file: %w", err)
+	case counter.count < section.Size():
+		abortConnection(conn)
+		return fmt.Errorf("changed during transfer: expected %d bytes at %s but only %d could be read", section.Size(), req.attrs["offset"], counter.count)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return fmt.Errorf("closing upload stream: %w", err)
+	}
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return errors.New("connection closed before the server confirmed the range")
+	}
+	status = strings.TrimSpace(status)
+	if reason, ok := strings.CutPrefix(status, "REJECTED "); ok {
+		return fmt.Errorf("transfer rejected by server: %s", reason)
+	}
+	if status != "OK" {
+		return fmt.Errorf("unexpected server status %q", status)
+	}
+	if _, err := reader.ReadString('\n'); err != nil {
+		return errors.New("connection closed without a goodbye from the server")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package shadowx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitRanges(t *testing.T) {
+	const mib = minStreamRange
+	tests := []struct {
+		size    int64
+		streams int
+		want    string
+	}{
+		{0, 4, "0+0"},
+		{mib - 1, 4, fmt.Sprintf("0+%d", mib-1)},
+		{2*mib + 1, 4, fmt.Sprintf("0+%d %d+%d", mib, mib, mib+1)},
+		{8 * mib, 4, fmt.Sprintf("0+%d %d+%d %d+%d %d+%d", 2*mib, 2*mib, 2*mib, 4*mib, 2*mib, 6*mib, 2*mib)},
+		{10, 1, "0+10"},
+		{3*mib + 2, 3, fmt.Sprintf("0+%d %d+%d %d+%d", mib, mib, mib, 2*mib, mib+2)},
+	}
+	for _, tt := range tests {
+		offsets, lengths := splitRanges(tt.size, tt.streams)
+		var got []string
+		for i := range offsets {
+			got = append(got, fmt.Sprintf("%d+%d", offsets[i], lengths[i]))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("splitRanges(%d, %d) = %s, want %s", tt.size, tt.streams, strings.Join(got, " "), tt.want)
+		}
+	}
+}
+
+// A large file sent over four streams is reassembled byte for byte, and
+// servers that can't write ranges in place refuse it
+func TestStreamedSend(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelDebug)
+	content := make([]byte, 8*minStreamRange+12345)
+	rand.Read(content)
+	if err := os.WriteFile("big.bin", content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	stop := startTestServer(t, srv)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, Streams: 4, VerifyRoundtrip: true}
+	if err := client.Send("big.bin"); err != nil {
+		t.Fatalf("Send with 4 streams: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(DefaultOutDir, "big.bin")); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("stored copy differs from the original (%d of %d bytes), %v", len(got), len(content), err)
+	}
+	if n := strings.Count(logs.String(), `msg="Receiving range"`); n != 4 {
+		t.Errorf("server received %d ranges, want 4", n)
+	}
+	if entries, _ := os.ReadDir(DefaultOutDir); len(entries) != 1 {
+		t.Errorf("output directory holds %d entries, want only the file", len(entries))
+	}
+
+	encrypted := &Server{Key: "test-key", OutDir: "encrypted", CreateOutDir: true, EncryptAtRest: true}
+	startTestServer(t, encrypted)
+	client = &Client{Addr: encrypted.Addr, Key: encrypted.Key, Streams: 4}
+	if err := client.Send("big.bin"); err == nil || !strings.Contains(err.Error(), "not supported with encryption at rest") {
+		t.Errorf("Send to a server encrypting at rest = %v, want refused", err)
+	}
+}
+
+// Ranges outside the file or for unknown uploads are refused, and an upload
+// whose starting connection drops leaves nothing behind
+func TestChunkedUploadDropped(t *testing.T) {
+	captureLog(t, slog.LevelInfo)
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	starter, reader, done := dialTestServer(t, cfg)
+	fmt.Fprintf(starter, "chunked a.bin\tsize=10\tsha256=%s\n", strings.Repeat("0", 64))
+	line, err := reader.ReadString('\n')
+	token, ok := strings.CutPrefix(strings.TrimSpace(line), "READY ")
+	if err != nil || !ok {
+		t.Fatalf("chunked reply %q, %v", line, err)
+	}
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{fmt.Sprintf("range a.bin\ttoken=%s\toffset=0\tlength=5\nhello", token), "OK"},
+		{fmt.Sprintf("range a.bin\ttoken=%s\toffset=8\tlength=5\nworld", token), "REJECTED malformed range"},
+		{fmt.Sprintf("range b.bin\ttoken=%s\toffset=5\tlength=5\nworld", token), "REJECTED upload token belongs to a different file"},
+		{"range a.bin\ttoken=" + strings.Repeat("0", 32) + "\toffset=5\tlength=5\nworld", "REJECTED unknown upload token"},
+	}
+	for _, tt := range tests {
+		conn, reader, rangeDone := dialTestServer(t, cfg)
+		conn.Write([]byte(tt.request))
+		conn.CloseWrite()
+		if reply, _ := reader.ReadString('\n'); strings.TrimSpace(reply) != tt.want {
+			t.Errorf("%q: reply %q, want %q", tt.request, reply, tt.want)
+		}
+		if err := <-rangeDone; err != nil {
+			t.Errorf("%q: %v", tt.request, err)
+		}
+	}
+
+	starter.Close()
+	if err := <-done; err == nil {
+		t.Error("dropped chunked upload reported no error")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("output directory holds %d entries, want none", len(entries))
+	}
+}
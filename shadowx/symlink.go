@@ -0,0 +1,189 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Whether the file at path is itself a symbolic link
+func isSymlink(path string) bool {
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// Send the symbolic link filename as a link, for the server to recreate
+// pointing at the same relative target, instead of sending what it points to
+func sendSymlink(cfg *clientConfig, filename string) error {
+	target, err := os.Readlink(filename)
+	if err != nil {
+		return fmt.Errorf("reading symlink: %w", err)
+	}
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("symlink points to the absolute path %s, only relative links can be sent", target)
+	}
+	if strings.ContainsAny(target, "\t\r\n") {
+		return fmt.Errorf("unsupported symlink target %q", target)
+	}
+	name := cfg.remoteName(filename)
+	if err := validRequestName(name); err != nil {
+		return err
+	}
+	req := request{verb: "symlink", name: name, attrs: map[string]string{"target": filepath.ToSlash(target)}}
+	if cfg.traceID != "" {
+		req.attrs["trace"] = cfg.traceID
+	}
+
+	stats, err := sendRecord(cfg, req)
+	if err != nil {
+		return err
+	}
+	slog.Info("Symlink sent", "file", filename, "target", target, "trace", stats.Trace)
+	return nil
+}
+
+// Send a request that carries no data, such as a symlink or mkdir record,
+// on a connection of its own and wait for the server to confirm it
+func sendRecord(cfg *clientConfig, req request) (sessionStats, error) {
+	conn, err := openSession(cfg)
+	if err != nil {
+		return sessionStats{}, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", req); err != nil {
+		return sessionStats{}, fmt.Errorf("sending %s: %w", req.verb, err)
+	}
+	reader := conn.reader
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		// Servers that predate the verb close the connection without a word
+		return sessionStats{}, fmt.Errorf("connection closed before the server confirmed the %s; it may be too old to support it", req.verb)
+	}
+	status = strings.TrimSpace(status)
+	if reason, rejected := strings.CutPrefix(status, "REJECTED "); rejected {
+		return sessionStats{}, fmt.Errorf("%s rejected by server: %s", req.verb, reason)
+	}
+	if status != "OK" {
+		return sessionStats{}, fmt.Errorf("unexpected server status %q", status)
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return sessionStats{}, errors.New("connection closed without a goodbye from the server")
+	}
+	stats, err := parseBye(strings.TrimSpace(line))
+	if err != nil {
+		return sessionStats{}, fmt.Errorf("reading goodbye: %w", err)
+	}
+	return stats, nil
+}
+
+// Answer a "symlink <name>\ttarget=<path>" request by creating the link
+// under the output directory, replying OK and BYE. The target must be
+// relative and, following the links already on its way, stay below the
+// output directory. An existing file is only kept if it's the same link.
+func receiveSymlink(conn *lineConn, log *slog.Logger, cfg *serverConfig, req request, start time.Time) error {
+	checked, reason := checkRequest(log, cfg, req)
+	target := filepath.FromSlash(req.attrs["target"])
+	switch {
+	case reason != "":
+	case cfg.sink() != "":
+		reason = "symlinks are not supported when writing to the " + cfg.sink()
+	case cfg.hashNames:
+		reason = "symlinks are not supported with hashed names"
+	case target == "" || filepath.IsAbs(target):
+		reason = "symlink target must be a relative path"
+	}
+	var err error
+	if reason == "" {
+		reason, err = storeSymlink(cfg, checked.stored, target)
+	}
+	if reason != "" {
+		rejectUpload(conn, log, reason)
+		return err
+	}
+	log.Info("Symlink received", "file", checked.stored, "target", target, "trace", checked.trace)
+	fmt.Fprintf(conn, "OK\n")
+	stats := sessionStats{Files: 1, Duration: time.Since(start).Round(time.Millisecond), Trace: checked.trace}
+	if _, err := fmt.Fprintf(conn, "BYE %s\n", stats); err != nil {
+		return fmt.Errorf("sending goodbye: %w", err)
+	}
+	return nil
+}
+
+// Create a link at stored pointing to target. Returns the reason to refuse
+// it, and the error behind that when the server is at fault.
+func storeSymlink(cfg *serverConfig, stored, target string) (string, error) {
+	if existing, err := os.Readlink(stored); err == nil && existing == target {
+		return "", nil
+	}
+	if _, err := os.Lstat(stored); err == nil {
+		// Pointing an existing link elsewhere could let links made through
+		// it escape, so names are only ever linked once
+		return "file already exists", nil
+	}
+	dir := filepath.Dir(stored)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "could not store symlink", fmt.Errorf("creating directory: %w", err)
+	}
+	root, err := filepath.EvalSymlinks(cfg.outDir)
+	if err != nil {
+		return "could not store symlink", err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "could not store symlink", err
+	}
+	if !isWithinOrAt(root, realDir) {
+		return "file name escapes the output directory", nil
+	}
+	resolved := resolveLink(realDir, target)
+	if !isWithin(root, resolved) {
+		return "symlink target escapes the output directory", nil
+	}
+	certFile, keyFile := cfg.tlsFiles()
+	if isWithinOrAt(realPath(cfg.uploads.dir), resolved) || cfg.isTLSFile(resolved) ||
+		resolved == realPath(certFile) || resolved == realPath(keyFile) {
+		return "symlink target is reserved", nil
+	}
+	if err := os.Symlink(target, stored); err != nil {
+		return "could not store symlink", fmt.Errorf("creating symlink: %w", err)
+	}
+	return "", nil
+}
+
+// Where target leads when read from a link in the real directory dir,
+// following the links on its way that exist. Steps that don't exist yet
+// can't be links, so they're taken as written.
+func resolveLink(dir, target string) string {
+	path := dir
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			path = filepath.Dir(path)
+			continue
+		}
+		path = filepath.Join(path, part)
+		if real, err := filepath.EvalSymlinks(path); err == nil {
+			path = real
+		}
+	}
+	return path
+}
+
+// The absolute path of path with its links resolved, as far as it exists
+func realPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
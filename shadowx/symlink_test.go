@@ -0,0 +1,148 @@
+package shadowx
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveLink(t *testing.T) {
+	dir := t.TempDir()
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "a", "deep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(".", filepath.Join(root, "a", "here")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir, target, want string
+	}{
+		{"a", "deep", "a/deep"},
+		{"a", "../b.txt", "b.txt"},
+		{"a/deep", "../../missing/../c.txt", "c.txt"},
+		{"a", "here/here/deep", "a/deep"},
+		// Lexically this stays below a, but here is a itself
+		{"a", "here/../x", "x"},
+	}
+	for _, tt := range tests {
+		got := resolveLink(filepath.Join(root, filepath.FromSlash(tt.dir)), filepath.FromSlash(tt.target))
+		if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+			t.Errorf("resolveLink(%q, %q) = %q, want %q", tt.dir, tt.target, got, want)
+		}
+	}
+}
+
+// The server recreates links whose targets stay in the output directory,
+// even when reached through links it made before, and never repoints one
+func TestHandleConnectionSymlink(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	tests := []struct {
+		request string
+		reply   string
+	}{
+		{"symlink link.txt\ttarget=real.txt\n", "OK\n"},
+		{"symlink link.txt\ttarget=real.txt\n", "OK\n"},
+		{"symlink link.txt\ttarget=other.txt\n", "REJECTED file already exists\n"},
+		{"symlink a/b\ttarget=.\n", "OK\n"},
+		{"symlink a/b/c\ttarget=../../x\n", "REJECTED symlink target escapes the output directory\n"},
+		{"symlink up\ttarget=../outside\n", "REJECTED symlink target escapes the output directory\n"},
+		{"symlink root\ttarget=.\n", "REJECTED symlink target escapes the output directory\n"},
+		{"symlink abs\ttarget=/etc/passwd\n", "REJECTED symlink target must be a relative path\n"},
+		{"symlink none\n", "REJECTED symlink target must be a relative path\n"},
+		{"symlink ../escape\ttarget=a\n", "REJECTED unsafe file name\n"},
+	}
+	for _, tt := range tests {
+		if replies := testSession(t, cfg, tt.request); !strings.HasPrefix(replies, tt.reply) {
+			t.Errorf("%q: replies %q, want %q", tt.request, replies, tt.reply)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link.txt")); err != nil || target != "real.txt" {
+		t.Errorf("link.txt points to %q, %v", target, err)
+	}
+	for _, name := range []string{"a/b/c", "up", "root", "abs"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("refused link %s was created", name)
+		}
+	}
+}
+
+// Links in a tree are sent as links with -preserve-symlinks and followed
+// otherwise, walking into linked directories but not around a loop
+func TestClientSendSymlinks(t *testing.T) {
+	t.Chdir(t.TempDir())
+	logs := captureLog(t, slog.LevelInfo)
+	for _, d := range []string{"tree/sub", "other"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{"tree/real.txt": "real", "other/o.txt": "other"} {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"tree/link.txt":   "real.txt",
+		"tree/sub/up.txt": "../real.txt",
+		"tree/sub/loop":   "..",
+		"tree/other":      "../other",
+	} {
+		if err := os.Symlink(target, filepath.FromSlash(link)); err != nil {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+	}
+
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+	out := func(name string) string { return filepath.Join(DefaultOutDir, filepath.FromSlash(name)) }
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key, PreserveSymlinks: true}
+	for i := range 2 {
+		if err := client.Send("tree"); err != nil {
+			t.Fatalf("Send %d with links preserved: %v", i+1, err)
+		}
+	}
+	// Links are recreated as they are, even ones to directories outside the tree
+	for link, target := range map[string]string{
+		"tree/link.txt":   "real.txt",
+		"tree/sub/up.txt": "../real.txt",
+		"tree/sub/loop":   "..",
+		"tree/other":      "../other",
+	} {
+		if got, err := os.Readlink(out(link)); err != nil || got != filepath.FromSlash(target) {
+			t.Errorf("%s points to %q, %v; want %q", link, got, err, target)
+		}
+	}
+	if data, err := os.ReadFile(out("tree/sub/up.txt")); err != nil || string(data) != "real" {
+		t.Errorf("reading through the link: %q, %v", data, err)
+	}
+
+	os.RemoveAll(DefaultOutDir)
+	if err := (&Client{Addr: srv.Addr, Key: srv.Key}).Send("tree"); err != nil {
+		t.Fatalf("Send following links: %v", err)
+	}
+	for name, want := range map[string]string{"tree/link.txt": "real", "tree/sub/up.txt": "real", "tree/other/o.txt": "other"} {
+		info, err := os.Lstat(out(name))
+		data, _ := os.ReadFile(out(name))
+		if err != nil || !info.Mode().IsRegular() || !bytes.Equal(data, []byte(want)) {
+			t.Errorf("%s: %v, %q; want a regular file holding %q", name, err, data, want)
+		}
+	}
+	if _, err := os.Lstat(out("tree/sub/loop")); err == nil {
+		t.Error("looping link was walked into")
+	}
+	if !strings.Contains(logs.String(), "Skipping symlink that loops back") {
+		t.Errorf("loop not logged:\n%s", logs)
+	}
+}
@@ -0,0 +1,143 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Check the further keys of s and build the config of connections
+// authenticated with each, which shares base's settings but stores files
+// under the key's own directory
+func (s *Server) keyConfigs(base *serverConfig) ([]*serverConfig, error) {
+	if len(s.KeyDirs) == 0 {
+		return nil, nil
+	}
+	// A device or output takes a single upload, and HTTPS serves one directory
+	// under one key
+	if s.Device != "" || s.Output != nil || s.HTTPAddr != "" {
+		return nil, errors.New("-psk-dirs can't be combined with -dev, -o - or -http-addr")
+	}
+	keys := make([]string, 0, len(s.KeyDirs))
+	for key := range s.KeyDirs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dirs := []string{base.outDir}
+	var tenants []*serverConfig
+	for _, key := range keys {
+		dir := s.KeyDirs[key]
+		switch {
+		case key == "" || dir == "":
+			return nil, errors.New("-psk-dirs needs a key and a directory on every line")
+		case base.keyAccepted(key):
+			return nil, fmt.Errorf("-psk-dirs repeats the server's key, for %s", dir)
+		}
+		// One key must not reach another's files, or their partial uploads
+		for _, other := range dirs {
+			if overlaps(dir, other) {
+				return nil, fmt.Errorf("-psk-dirs directory %s overlaps %s", dir, other)
+			}
+		}
+		dirs = append(dirs, dir)
+		if s.HashNames {
+			if err := checkManifestPath(s.ManifestPath, dir); err != nil {
+				return nil, err
+			}
+		}
+		if err := prepareOutputDir(dir, s.CreateOutDir); err != nil {
+			return nil, err
+		}
+		storage := base.storage
+		if storage != nil && s.StorageKey == "" {
+			storage = storageKey(key)
+		}
+		tenants = append(tenants, base.withKey(key, dir, storage))
+	}
+	return tenants, nil
+}
+
+// Whether one of directories a and b is, or is inside, the other
+func overlaps(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return true
+	}
+	return isWithinOrAt(absA, absB) || isWithinOrAt(absB, absA)
+}
+
+// The config of connections authenticated with key, which store files under
+// outDir, encrypted with storage when that isn't nil. Authentication
+// failures, connection slots and metrics stay with cfg, which counts them for
+// the whole server.
+func (cfg *serverConfig) withKey(key, outDir string, storage storageKey) *serverConfig {
+	return &serverConfig{
+		address:         cfg.address,
+		secretKey:       key,
+		outDir:          outDir,
+		device:          cfg.device,
+		hashNames:       cfg.hashNames,
+		manifest:        cfg.manifest,
+		denyHashes:      cfg.denyHashes,
+		uploads:         newUploadStore(outDir),
+		upLimit:         cfg.upLimit,
+		downLimit:       cfg.downLimit,
+		httpAddr:        cfg.httpAddr,
+		metricsAddr:     cfg.metricsAddr,
+		immutable:       cfg.immutable,
+		noClobber:       cfg.noClobber,
+		allowDelete:     cfg.allowDelete,
+		chown:           cfg.chown,
+		minTLS:          cfg.minTLS,
+		ciphers:         cfg.ciphers,
+		clientCA:        cfg.clientCA,
+		certHosts:       cfg.certHosts,
+		tlsCert:         cfg.tlsCert,
+		tlsKey:          cfg.tlsKey,
+		socketTLS:       cfg.socketTLS,
+		noTLS:           cfg.noTLS,
+		output:          cfg.output,
+		bufferSize:      cfg.bufferSize,
+		readTimeout:     cfg.readTimeout,
+		idleTimeout:     cfg.idleTimeout,
+		maxFileSize:     cfg.maxFileSize,
+		maxDisk:         cfg.maxDisk,
+		reserve:         cfg.reserve,
+		maxAuthFailures: cfg.maxAuthFailures,
+		clients:         cfg.clients,
+		connSlots:       cfg.connSlots,
+		metrics:         cfg.metrics,
+		storage:         storage,
+		progress:        cfg.progress,
+		auth:            cfg.auth,
+	}
+}
+
+// The config of connections that presented key, nil when it's none of the
+// server's. Every key is compared in constant time, whichever matches, so
+// how long it takes doesn't tell which one did.
+func (cfg *serverConfig) authenticate(key string) *serverConfig {
+	var match *serverConfig
+	if cfg.keyAccepted(key) {
+		match = cfg
+	}
+	for _, tenant := range cfg.tenants {
+		if tenant.keyAccepted(key) {
+			match = tenant
+		}
+	}
+	return match
+}
+
+// The config of connections authenticated as identity: that of the -psk-dirs
+// key whose directory it names, or cfg's own
+func (cfg *serverConfig) tenant(identity string) *serverConfig {
+	for _, tenant := range cfg.tenants {
+		if tenant.outDir == identity {
+			return tenant
+		}
+	}
+	return cfg
+}
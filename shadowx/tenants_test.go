@@ -0,0 +1,94 @@
+package shadowx
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Each key stores what's sent with it in its own directory, the server's
+// key still in OutDir, and no key reaches another's files
+func TestClientSendKeyDirs(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("report.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"red", "blue"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, KeyDirs: map[string]string{"red-key": "red", "blue-key": "blue"}}
+	startTestServer(t, srv)
+
+	for key, dir := range map[string]string{"red-key": "red", "blue-key": "blue", "test-key": DefaultOutDir} {
+		client := &Client{Addr: srv.Addr, Key: key}
+		if err := client.Send("report.txt"); err != nil {
+			t.Fatalf("Send with %s: %v", key, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "report.txt")); err != nil {
+			t.Errorf("upload with %s not in %s: %v", key, dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join("red", "secret.txt"), []byte("red only"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Client{Addr: srv.Addr, Key: "blue-key"}).Download("secret.txt", "."); err == nil {
+		t.Error("blue key downloaded a file of the red key")
+	}
+	if err := (&Client{Addr: srv.Addr, Key: "green-key"}).Send("report.txt"); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Send with an unknown key = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	cfg := &serverConfig{secretKey: "base"}
+	red, blue := cfg.withKey("red", "red", nil), cfg.withKey("blue", "blue", nil)
+	cfg.tenants = []*serverConfig{red, blue}
+	for key, want := range map[string]*serverConfig{"base": cfg, "red": red, "blue": blue, "green": nil, "": nil, "re": nil} {
+		if got := cfg.authenticate(key); got != want {
+			t.Errorf("authenticate(%q) = %p, want %p", key, got, want)
+		}
+	}
+}
+
+// The config of a further key has every setting of the server's but those
+// tied to the key and its directory, so a new setting can't be forgotten
+func TestWithKeyCopiesSettings(t *testing.T) {
+	cfg := &serverConfig{
+		address: "127.0.0.1:8080", secretKey: "base", outDir: "base", device: "/dev/null", hashNames: true,
+		manifest: &manifest{path: "manifest.jsonl"}, denyHashes: map[string]bool{"x": true}, uploads: newUploadStore("base"),
+		upLimit: 1, downLimit: 1, httpAddr: "127.0.0.1:8443", metricsAddr: "127.0.0.1:9090", immutable: true, noClobber: true, allowDelete: true, chown: true,
+		minTLS: 1, ciphers: []uint16{1}, clientCA: "ca.pem", certHosts: []string{"example.com"}, tlsCert: "a.crt", tlsKey: "a.key", socketTLS: true, noTLS: true,
+		output: io.Discard, bufferSize: 1, readTimeout: time.Second, idleTimeout: time.Second, maxFileSize: 1, maxDisk: 1, reserve: 1,
+		maxAuthFailures: 1, clients: addressFilter{allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+		connSlots: make(chan struct{}, 1), metrics: &serverMetrics{}, storage: storageKey("base"),
+		progress: func(string, int64, int64) {}, auth: keyAuthenticator{},
+	}
+	tenant := cfg.withKey("red", "red", storageKey("red"))
+	if tenant.secretKey != "red" || tenant.outDir != "red" || string(tenant.storage) != "red" || tenant.uploads == cfg.uploads {
+		t.Errorf("config of the red key keeps the server's key, directory or uploads")
+	}
+	// Not settings: state of the server's own, or set for each key
+	perKey := map[string]bool{"secretKey": true, "keyHash": true, "outDir": true, "uploads": true, "storage": true,
+		"sinkMu": true, "sinkWritten": true, "authFailures": true, "chunked": true, "appending": true, "tenants": true}
+	base, copied := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(tenant).Elem()
+	for i := range base.NumField() {
+		name := base.Type().Field(i).Name
+		if perKey[name] {
+			continue
+		}
+		if base.Field(i).IsZero() {
+			t.Errorf("%s isn't set in the test's config", name)
+		} else if copied.Field(i).IsZero() {
+			t.Errorf("withKey doesn't copy %s", name)
+		}
+	}
+}
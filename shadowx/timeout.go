@@ -0,0 +1,21 @@
+package shadowx
+
+import (
+	"net"
+	"time"
+)
+
+// A connection whose reads fail once no data has arrived for timeout, so a
+// client that stalls mid-transfer can't hold its goroutine forever. Each
+// read, such as every chunk receiveFile takes, starts the clock again.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration // 0 leaves the connection's deadline alone
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,148 @@
+package shadowx
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A client that stops sending is dropped, and an upload it started leaves
+// no partial file behind
+func TestHandleConnectionTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		readTimeout time.Duration
+		idleTimeout time.Duration
+		payload     string // sent after authenticating; when empty the client never authenticates
+	}{
+		{name: "silent before the key", readTimeout: 50 * time.Millisecond},
+		{name: "stalled upload", idleTimeout: 50 * time.Millisecond, payload: "upload a.txt\tsize=10\nhello"},
+		{name: "stalled session", idleTimeout: 50 * time.Millisecond, payload: "session 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir), readTimeout: tt.readTimeout, idleTimeout: tt.idleTimeout}
+
+			var done chan error
+			if tt.payload == "" {
+				client, server := net.Pipe()
+				defer client.Close()
+				done = make(chan error, 1)
+				go func() { done <- handleConnection(server, cfg) }()
+			} else {
+				var conn *net.TCPConn
+				conn, _, done = dialTestServer(t, cfg)
+				if _, err := conn.Write([]byte(tt.payload)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("handleConnection: %v, want a timeout", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handleConnection still waiting for the stalled client")
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("output directory holds %d entries, want none", len(entries))
+			}
+		})
+	}
+}
+
+// Data that keeps arriving resets the idle timeout, so a slow transfer
+// longer than the timeout still completes
+func TestIdleConnResets(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	idle := &idleConn{Conn: server, timeout: 100 * time.Millisecond}
+	go func() {
+		for range 5 {
+			time.Sleep(40 * time.Millisecond)
+			client.Write([]byte("x"))
+		}
+	}()
+	buf := make([]byte, 1)
+	for i := range 5 {
+		if _, err := idle.Read(buf); err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+	}
+}
+
+// Connections that close at once, or never get past the handshake, don't
+// pile up: each is released, and past MaxConns further ones are refused
+// until the stalled ones time out
+func TestServerConnectionFlood(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, MaxConns: 4, ReadTimeout: 300 * time.Millisecond}
+	startTestServer(t, srv)
+	served := func() int {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.conns)
+	}
+	drained := func() bool {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if served() == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var wg sync.WaitGroup
+	for range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := net.Dial("tcp", srv.Addr); err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if !drained() {
+		t.Fatalf("%d connections still served after the clients closed", served())
+	}
+
+	var stalled []net.Conn
+	for range srv.MaxConns {
+		conn, err := net.Dial("tcp", srv.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		stalled = append(stalled, conn)
+	}
+	for deadline := time.Now().Add(5 * time.Second); served() < srv.MaxConns && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	if err := client.Send("a.txt"); err == nil {
+		t.Error("Send succeeded with MaxConns connections stalled in the handshake")
+	}
+	if !drained() {
+		t.Fatalf("%d stalled connections still served past the read timeout", served())
+	}
+	for _, conn := range stalled {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("stalled connection not closed by the server: %v", err)
+		}
+	}
+	if err := client.Send("a.txt"); err != nil {
+		t.Errorf("Send after the stalled connections timed out: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package shadowx
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// TLS versions a connection may be held to; older ones are never accepted
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// Parse a minimum TLS version, "1.2" or "1.3"
+func ParseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, want 1.2 or 1.3", s)
+	}
+	return version, nil
+}
+
+// Parse a comma-separated list of TLS 1.2 cipher suites by their Go names,
+// e.g. "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384". Suites Go considers
+// insecure are refused.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Check a configured minimum version and cipher suites, returning the
+// version to use: TLS 1.2 for 0
+func checkTLSPolicy(minVersion uint16, suites []uint16) (uint16, error) {
+	switch minVersion {
+	case 0:
+		minVersion = tls.VersionTLS12
+	case tls.VersionTLS12, tls.VersionTLS13:
+	default:
+		return 0, errors.New("-min-tls must be 1.2 or 1.3")
+	}
+	// TLS 1.3 suites aren't configurable, so the list would do nothing
+	if minVersion == tls.VersionTLS13 && len(suites) > 0 {
+		slog.Warn("-ciphers only applies to TLS 1.2 and is ignored with -min-tls 1.3")
+	}
+	return minVersion, nil
+}
@@ -0,0 +1,84 @@
+package shadowx
+
+import (
+	"crypto/tls"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", 0, true},
+		{"1.0", 0, true},
+		{"", 0, true},
+		{"TLS1.3", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTLSVersion(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseTLSVersion(%q) = %#x, %v; want %#x, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []uint16
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, false},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}, false},
+		{"TLS_RSA_WITH_RC4_128_SHA", nil, true}, // insecure
+		{"TLS_NOT_A_SUITE", nil, true},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCipherSuites(tt.in)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseCipherSuites(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// A server held to TLS 1.3 refuses clients that stop at 1.2, and a client
+// held to 1.3 still sends to it
+func TestMinTLS(t *testing.T) {
+	t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+	srv := &Server{Key: "test-key", OutDir: t.TempDir(), MinTLS: tls.VersionTLS13}
+	startTestServer(t, srv)
+
+	conn, err := tls.Dial("tcp", srv.Addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake with a 1.3-only server succeeded")
+	}
+	conn, err = tls.Dial("tcp", srv.Addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS 1.3 handshake: %v", err)
+	}
+	if version := conn.ConnectionState().Version; version != tls.VersionTLS13 {
+		t.Errorf("negotiated version %#x, want TLS 1.3", version)
+	}
+	conn.Close()
+
+	if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: srv.Addr, Key: srv.Key, MinTLS: tls.VersionTLS13}
+	if err := client.Send("a.txt"); err != nil {
+		t.Errorf("Send with a TLS 1.3 minimum: %v", err)
+	}
+	if _, err := (&Client{Addr: srv.Addr, Key: srv.Key, MinTLS: tls.VersionTLS10}).newConfig(); err == nil {
+		t.Error("client accepted a TLS 1.0 minimum")
+	}
+}
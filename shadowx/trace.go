@@ -0,0 +1,33 @@
+package shadowx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Environment variable the client reads a trace ID from when -trace-id isn't given
+const TraceIDEnv = "SHADOWX_TRACE_ID"
+
+// Generate a random trace ID in the W3C Trace Context format (32 hex digits)
+func newTraceID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Check that a trace ID is safe to carry in the protocol and logs: 1 to 128
+// letters, digits, '-', '_', '.' or ':'
+func validTraceID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package shadowx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidTraceID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"job-42_build.7:retry", true},
+		{"", false},
+		{"has space", false},
+		{"tab\there", false},
+		{"eq=sign", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		if got := validTraceID(tt.id); got != tt.want {
+			t.Errorf("validTraceID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+	if id := newTraceID(); len(id) != 32 || !validTraceID(id) {
+		t.Errorf("newTraceID() = %q", id)
+	}
+}
@@ -0,0 +1,55 @@
+package shadowx
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Addresses starting with this name a Unix domain socket, as in
+// "unix:/run/shadowx.sock"
+const unixPrefix = "unix:"
+
+// The socket path of a "unix:" address
+func unixSocketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, unixPrefix)
+}
+
+// Whether connections to addr go over a Unix socket without TLS
+func plainSocket(addr string, socketTLS bool) bool {
+	_, ok := unixSocketPath(addr)
+	return ok && !socketTLS
+}
+
+// Check the address given with -i: host:port, or unix: and a socket path
+func validServerAddress(addr string) error {
+	if path, ok := unixSocketPath(addr); ok {
+		if path == "" {
+			return errors.New(`-i "unix:": want a socket path, as in unix:/run/shadowx.sock`)
+		}
+		return nil
+	}
+	return validAddress("-i", addr)
+}
+
+// Listen on addr, a TCP address or a Unix socket. The socket file is removed
+// when the listener closes, and a stale one left by a server that crashed
+// is replaced.
+func listen(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", path)
+}
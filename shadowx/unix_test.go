@@ -0,0 +1,90 @@
+package shadowx
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Files go over a Unix socket, plain or with TLS, the PSK still guards it
+// and the socket file goes away when the server stops
+func TestUnixSocket(t *testing.T) {
+	for _, socketTLS := range []bool{false, true} {
+		name := "plain"
+		if socketTLS {
+			name = "tls"
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Chdir(t.TempDir()) // the server generates its certificate in the working directory
+			socket := filepath.Join(t.TempDir(), "shadowx.sock")
+			srv := &Server{Addr: unixPrefix + socket, Key: "test-key", OutDir: DefaultOutDir, SocketTLS: socketTLS}
+			stop := startTestServer(t, srv)
+			if _, err := os.Stat("server.crt"); (err == nil) != socketTLS {
+				t.Errorf("certificate generated: %v, want %v", err == nil, socketTLS)
+			}
+
+			if err := os.WriteFile("a.txt", []byte("hello"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{Addr: srv.Addr, Key: srv.Key, SocketTLS: socketTLS}
+			if err := client.Send("a.txt"); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(DefaultOutDir, "a.txt")); string(data) != "hello" {
+				t.Errorf("server stored %q, want hello", data)
+			}
+			wrongKey := &Client{Addr: srv.Addr, Key: "wrong-key", SocketTLS: socketTLS}
+			if err := wrongKey.Send("a.txt"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+				t.Errorf("Send with the wrong key = %v, want an authentication failure", err)
+			}
+
+			if err := stop(); err != nil {
+				t.Fatalf("ListenAndServe: %v", err)
+			}
+			if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+				t.Errorf("socket file left behind after shutdown: %v", err)
+			}
+		})
+	}
+}
+
+// A socket left by a server that crashed is replaced; one a running server
+// listens on isn't
+func TestListenUnixStale(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "shadowx.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix + socket); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listen on a socket in use = %v, want an in-use error", err)
+	}
+	// Leave the file behind as a crash would
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listen(unixPrefix + socket)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	listener.Close()
+}
+
+func TestValidServerAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"unix:/run/shadowx.sock", true},
+		{"unix:shadowx.sock", true},
+		{"unix:", false},
+		{"/run/shadowx.sock", false},
+	}
+	for _, tt := range tests {
+		if err := validServerAddress(tt.addr); (err == nil) != tt.ok {
+			t.Errorf("validServerAddress(%q) = %v, want ok %v", tt.addr, err, tt.ok)
+		}
+	}
+}
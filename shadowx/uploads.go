@@ -0,0 +1,131 @@
+package shadowx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Directory under the output root holding partial resumable uploads
+const uploadStateDir = ".shadowx-uploads"
+
+// Server-side record of a resumable upload, bound to the file it was started for
+type uploadState struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Resumable uploads keyed by server-assigned token
+type uploadStore struct {
+	mu     sync.Mutex
+	dir    string
+	active map[string]bool // tokens with a connection currently writing
+}
+
+// Create an upload store under outDir
+func newUploadStore(outDir string) *uploadStore {
+	return &uploadStore{dir: filepath.Join(outDir, uploadStateDir), active: make(map[string]bool)}
+}
+
+// Check that a token has the form the server hands out
+func validUploadToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// Check that a client-declared digest is a hex SHA-256
+func validSHA256(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+// Path of the partial data for a token
+func (s *uploadStore) partPath(token string) string {
+	return filepath.Join(s.dir, token+".part")
+}
+
+// Start a new upload, or claim an existing one for name with digest sum.
+// Returns the token, the partial file opened for appending and the number of
+// bytes it already holds. The caller must release the token when done.
+func (s *uploadStore) open(token, name, sum string) (string, *os.File, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token == "new" {
+		if err := os.MkdirAll(s.dir, 0700); err != nil {
+			return "", nil, 0, err
+		}
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return "", nil, 0, err
+		}
+		token = hex.EncodeToString(raw)
+		data, err := json.Marshal(uploadState{Name: name, SHA256: sum})
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if err := os.WriteFile(filepath.Join(s.dir, token+".json"), data, 0600); err != nil {
+			return "", nil, 0, err
+		}
+	} else {
+		if !validUploadToken(token) {
+			return "", nil, 0, errors.New("malformed upload token")
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, token+".json"))
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, 0, errors.New("unknown upload token")
+		}
+		if err != nil {
+			return "", nil, 0, err
+		}
+		var state uploadState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return "", nil, 0, fmt.Errorf("corrupt upload state: %w", err)
+		}
+		if state.Name != name || state.SHA256 != sum {
+			return "", nil, 0, errors.New("upload token belongs to a different file")
+		}
+		if s.active[token] {
+			return "", nil, 0, errors.New("upload is already in progress")
+		}
+	}
+
+	file, err := os.OpenFile(s.partPath(token), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return "", nil, 0, err
+	}
+	s.active[token] = true
+	return token, file, info.Size(), nil
+}
+
+// Let the token be resumed by another connection
+func (s *uploadStore) release(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.active, token)
+}
+
+// Forget a finished or discarded upload and remove whatever it left behind
+func (s *uploadStore) discard(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	os.Remove(s.partPath(token))
+	os.Remove(filepath.Join(s.dir, token+".json"))
+	delete(s.active, token)
+}
@@ -0,0 +1,85 @@
+package shadowx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUploadStore(t *testing.T) {
+	store := newUploadStore(t.TempDir())
+	sum := strings.Repeat("ab", 32)
+
+	token, file, offset, err := store.open("new", "a.txt", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validUploadToken(token) || offset != 0 {
+		t.Fatalf("open(new) = %q, %d", token, offset)
+	}
+	file.WriteString("hello")
+	file.Close()
+
+	if _, _, _, err := store.open(token, "a.txt", sum); err == nil {
+		t.Error("open accepted a token that is still in use")
+	}
+	store.release(token)
+
+	tests := []struct {
+		name, token, file, sum string
+	}{
+		{"unknown token", strings.Repeat("0", 32), "a.txt", sum},
+		{"malformed token", "../../etc/passwd", "a.txt", sum},
+		{"different name", token, "b.txt", sum},
+		{"different digest", token, "a.txt", strings.Repeat("cd", 32)},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := store.open(tt.token, tt.file, tt.sum); err == nil {
+			t.Errorf("%s: open succeeded", tt.name)
+		}
+	}
+
+	_, file, offset, err = store.open(token, "a.txt", sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if offset != 5 {
+		t.Errorf("resumed offset = %d, want 5", offset)
+	}
+
+	store.discard(token)
+	if _, _, _, err := store.open(token, "a.txt", sum); err == nil {
+		t.Error("open accepted a discarded token")
+	}
+}
+
+func TestResumeState(t *testing.T) {
+	path := t.TempDir() + "/resume.json"
+	state, err := loadResumeState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := state.token("f", "sum1"); got != "new" {
+		t.Errorf("token on empty state = %q", got)
+	}
+	if err := state.remember("f", "sum1", "tok"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := loadResumeState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.token("f", "sum1"); got != "tok" {
+		t.Errorf("token after reload = %q, want tok", got)
+	}
+	if got := reloaded.token("f", "sum2"); got != "new" {
+		t.Errorf("token for changed content = %q, want new", got)
+	}
+	if err := reloaded.forget("f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.token("f", "sum1"); got != "new" {
+		t.Errorf("token after forget = %q, want new", got)
+	}
+}
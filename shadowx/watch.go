@@ -0,0 +1,301 @@
+package shadowx
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long Watch waits for a file to stop changing before sending it, when
+// Client.WatchDelay isn't set
+const DefaultWatchDelay = 500 * time.Millisecond
+
+// How long Watch keeps its session open with nothing to send, well within
+// the time servers drop quiet connections after by default
+const watchIdle = time.Minute
+
+// Watch the directory dir and everything below it, sending each file that's
+// created or changed once it has gone WatchDelay without changing, until ctx
+// is done. Files that are there already aren't sent, so Send dir first to
+// start from a full copy. Uploads share one authenticated connection while
+// changes keep coming. With WatchDeletes, files removed from dir are deleted
+// from the server too. Returns nil once ctx is done, or the error that
+// stopped the watch.
+func (c *Client) Watch(ctx context.Context, dir string) error {
+	shared, err := c.config()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c.DryRun || c.VerifyOnly || c.As != "":
+		return errors.New("-watch can't be combined with -dry-run, -verify-only or -as")
+	case c.Move && c.WatchDeletes:
+		return errors.New("-watch-deletes can't be combined with -move, which would delete the server's copy of each file it sends")
+	case c.WatchDelay < 0:
+		return errors.New("-watch-delay can't be negative")
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("accessing directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory, only directories can be watched", dir)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("starting watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	cfg := shared.forCall(ctx, dir)
+	w := &dirWatcher{cfg: cfg, watcher: watcher, root: dir, delay: cmp.Or(c.WatchDelay, DefaultWatchDelay), deletes: c.WatchDeletes,
+		session: newUploadSession(cfg), pending: make(map[string]*pendingChange), ready: make(chan string), done: make(chan struct{}), known: make(map[string]bool)}
+	if err := w.addTree(); err != nil {
+		return err
+	}
+	slog.Info("Watching for changes", "dir", dir, "delay", w.delay)
+	err = w.run(ctx)
+	cfg.stats.report(cfg.events, w.failed, cfg.quietSuccess)
+	return err
+}
+
+// Sends the changes to a directory as they settle. Only run touches its
+// fields, apart from the timers that hand it the paths that are due.
+type dirWatcher struct {
+	cfg     *clientConfig
+	watcher *fsnotify.Watcher
+	root    string
+	delay   time.Duration
+	deletes bool // delete the server's copies of removed files
+	session *uploadSession
+
+	pending map[string]*pendingChange // paths that changed, by name
+	ready   chan string               // paths whose timer fired
+	done    chan struct{}             // closed when run returns, releasing the timers
+	known   map[string]bool           // files the server should hold: those there at the start and those sent since
+	failed  int                       // files that couldn't be sent or deleted
+}
+
+// A path that changed, to sync once it's been quiet for the delay
+type pendingChange struct {
+	timer *time.Timer
+	due   time.Time
+}
+
+// Watch the root and the directories below it, less ignored ones, and note
+// the files that are there already
+func (w *dirWatcher) addTree() error {
+	if err := w.watcher.Add(w.root); err != nil {
+		return fmt.Errorf("watching %s: %w", w.root, err)
+	}
+	return filepath.WalkDir(w.root, func(path string, d os.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			slog.Error("Error accessing file", "err", err)
+		case path == w.root:
+		case w.ignored(path, d.IsDir()):
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		case d.IsDir():
+			if err := w.watcher.Add(path); err != nil {
+				slog.Error("Error watching directory", "dir", path, "err", err)
+			}
+		default:
+			w.known[path] = true
+		}
+		return nil
+	})
+}
+
+// Handle events until ctx is done, sending each path once it's due
+func (w *dirWatcher) run(ctx context.Context) error {
+	defer w.stop()
+	idle := time.NewTimer(watchIdle)
+	idle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return nil
+			}
+			// Only changes of content or name need sending
+			if event.Op != fsnotify.Chmod {
+				w.schedule(event.Name)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("Error watching directory", "err", err)
+		case path := <-w.ready:
+			if !w.due(path) {
+				continue
+			}
+			if err := w.sync(path); err != nil {
+				return err
+			}
+			idle.Reset(watchIdle)
+		case <-idle.C:
+			w.session.close()
+		}
+	}
+}
+
+// Stop the timers and end the session
+func (w *dirWatcher) stop() {
+	close(w.done)
+	for _, p := range w.pending {
+		p.timer.Stop()
+	}
+	w.session.close()
+}
+
+// Sync path once it has gone the delay without changing again, so a burst
+// of writes is sent once
+func (w *dirWatcher) schedule(path string) {
+	due := time.Now().Add(w.delay)
+	if p := w.pending[path]; p != nil {
+		p.due = due
+		p.timer.Reset(w.delay)
+		return
+	}
+	w.pending[path] = &pendingChange{due: due, timer: time.AfterFunc(w.delay, func() {
+		select {
+		case w.ready <- path:
+		case <-w.done:
+		}
+	})}
+}
+
+// Whether path is due now. A timer that fired just before it was reset
+// hands the path over early, and the reset timer hands it over again.
+func (w *dirWatcher) due(path string) bool {
+	p := w.pending[path]
+	if p == nil || time.Now().Before(p.due) {
+		return false
+	}
+	delete(w.pending, path)
+	return true
+}
+
+// Bring the server's copy of path up to date with what's there now.
+// Returns an error only when the server rejected the key.
+func (w *dirWatcher) sync(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		w.removed(path)
+		return nil
+	}
+	if err != nil {
+		slog.Error("Error accessing file", "file", path, "err", err)
+		return nil
+	}
+	if w.ignored(path, info.IsDir()) {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 && !w.cfg.preserveSymlinks && isDir(path) {
+		slog.Info("Skipping symlink to a directory, which can't be watched", "file", path)
+		return nil
+	}
+	if info.IsDir() {
+		return w.syncDir(path)
+	}
+	if reason := w.cfg.filtered(info); reason != "" {
+		slog.Info("Skipping", "file", path, "reason", reason)
+		return nil
+	}
+	return w.send(path)
+}
+
+// Watch a directory that appeared and sync what it holds, which may have
+// been written before the watch was in place. An empty one is sent as it is.
+func (w *dirWatcher) syncDir(dir string) error {
+	if err := w.watcher.Add(dir); err != nil {
+		slog.Error("Error watching directory", "dir", dir, "err", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Error accessing directory", "dir", dir, "err", err)
+		return nil
+	}
+	if len(entries) == 0 {
+		return w.send(dir)
+	}
+	for _, entry := range entries {
+		w.schedule(filepath.Join(dir, entry.Name()))
+	}
+	return nil
+}
+
+// Send path in the session, opening it again once if the server dropped it
+// while it sat idle
+func (w *dirWatcher) send(path string) error {
+	reused := w.session != nil && w.session.conn != nil
+	err := trySend(w.cfg, w.session, path)
+	if err != nil && reused && w.session.conn == nil && w.cfg.ctx.Err() == nil && !w.cfg.keyRejected.Load() {
+		err = trySend(w.cfg, w.session, path)
+	}
+	switch {
+	case err == nil:
+		w.known[path] = true
+	case w.cfg.keyRejected.Load():
+		return err
+	default:
+		w.failed++
+	}
+	return nil
+}
+
+// Forget path, which is gone, and the files below it when it was a
+// directory, deleting the server's copies with WatchDeletes
+func (w *dirWatcher) removed(path string) {
+	var gone []string
+	for name := range w.known {
+		if name == path || isWithin(path, name) {
+			gone = append(gone, name)
+		}
+	}
+	slices.Sort(gone)
+	for _, name := range gone {
+		delete(w.known, name)
+		if !w.deletes {
+			continue
+		}
+		if err := sendDelete(w.cfg, name); err != nil {
+			slog.Error("Error sending deletion", "file", name, "err", err)
+			w.failed++
+		}
+	}
+}
+
+// Whether path is ignored by the .shadowxignore files from the root down to
+// its directory, or lies in an ignored directory
+func (w *dirWatcher) ignored(path string, isDir bool) bool {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	rules, _ := loadIgnoreRules(w.root, ".", nil)
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		dir := strings.Join(parts[:i], "/")
+		if rules.ignored(dir, true) {
+			return true
+		}
+		rules, _ = loadIgnoreRules(filepath.Join(w.root, filepath.FromSlash(dir)), dir, rules)
+	}
+	return rules.ignored(rel, isDir)
+}
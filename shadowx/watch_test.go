@@ -0,0 +1,186 @@
+package shadowx
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Wait up to five seconds for the server's copy of name to hold want, or to
+// be gone when want is empty
+func waitStored(t *testing.T, name, want string) {
+	t.Helper()
+	var got []byte
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		got, err = os.ReadFile(filepath.Join(DefaultOutDir, name))
+		if want == "" && os.IsNotExist(err) || err == nil && string(got) == want {
+			return
+		}
+	}
+	t.Fatalf("%s stored as %q, %v; want %q", name, got, err, want)
+}
+
+// Files created, changed, written in a burst, made in a new directory and
+// removed while the watcher runs reach the server, the burst as one upload
+func TestClientWatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.MkdirAll("src/logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir, AllowDelete: true}
+	startTestServer(t, srv)
+
+	var mu sync.Mutex
+	uploads := make(map[string]int)
+	client := &Client{Addr: srv.Addr, Key: srv.Key, WatchDelay: 300 * time.Millisecond, WatchDeletes: true,
+		ProgressFunc: func(file string, done, total int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if done == total {
+				uploads[filepath.Base(file)]++
+			}
+		}}
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan error, 1)
+	go func() { watched <- client.Watch(ctx, "src") }()
+
+	// The watch starts in the background, so write until it sees a change,
+	// leaving each write time to settle
+	for attempt := 0; ; attempt++ {
+		if attempt == 5 {
+			t.Fatal("a file created in the watched directory wasn't sent")
+		}
+		if err := os.WriteFile("src/a.txt", []byte("created"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		if got, _ := os.ReadFile(filepath.Join(DefaultOutDir, "src/a.txt")); string(got) == "created" {
+			break
+		}
+	}
+	if err := os.WriteFile("src/a.txt", []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitStored(t, "src/a.txt", "modified")
+
+	f, err := os.Create("src/logs/burst.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var burst strings.Builder
+	for i := range 10 {
+		line := strings.Repeat("x", i) + "\n"
+		f.WriteString(line)
+		burst.WriteString(line)
+		time.Sleep(5 * time.Millisecond)
+	}
+	f.Close()
+	waitStored(t, "src/logs/burst.log", burst.String())
+
+	if err := os.MkdirAll("src/new/deeper", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("src/new/deeper/b.txt", []byte("bravo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitStored(t, "src/new/deeper/b.txt", "bravo")
+
+	if err := os.Remove("src/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitStored(t, "src/a.txt", "")
+
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("Watch = %v, want nil once canceled", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if n := uploads["burst.log"]; n != 1 {
+		t.Errorf("a burst of writes was sent %d times, want once", n)
+	}
+}
+
+// A Send on a Client that's watching keeps its own root and context, so it
+// isn't stored under the watched directory or ended with the watch
+func TestClientWatchAlongsideSend(t *testing.T) {
+	t.Chdir(t.TempDir())
+	captureLog(t, slog.LevelInfo)
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("other.txt", []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Key: "test-key", OutDir: DefaultOutDir}
+	startTestServer(t, srv)
+
+	client := &Client{Addr: srv.Addr, Key: srv.Key}
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan error, 1)
+	go func() { watched <- client.Watch(ctx, "src") }()
+	if err := client.Send("other.txt"); err != nil {
+		t.Fatalf("Send during a watch: %v", err)
+	}
+	waitStored(t, "other.txt", "other")
+	cancel()
+	if err := <-watched; err != nil {
+		t.Errorf("Watch = %v, want nil once canceled", err)
+	}
+	if err := client.SendContext(context.Background(), "other.txt"); err != nil {
+		t.Errorf("Send after the watch ended: %v", err)
+	}
+}
+
+func TestClientWatchNeedsDirectory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("a.txt", []byte("alpha"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Addr: "127.0.0.1:8080", Key: "test-key"}
+	if err := client.Watch(context.Background(), "a.txt"); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("Watch of a file = %v, want it refused", err)
+	}
+}
+
+// A delete request only removes a stored file on a server that allows it,
+// and never a directory or anything outside the output directory
+func TestReceiveDelete(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &serverConfig{secretKey: "secret", outDir: dir, uploads: newUploadStore(dir)}
+	stored := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(stored, []byte("alpha"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if replies := testSession(t, cfg, "delete a.txt\n"); !strings.Contains(replies, "REJECTED deleting files is not allowed") {
+		t.Errorf("delete without -allow-delete: replies %q", replies)
+	}
+	if _, err := os.Stat(stored); err != nil {
+		t.Fatalf("refused delete removed the file: %v", err)
+	}
+
+	cfg.allowDelete = true
+	for request, want := range map[string]string{
+		"delete a.txt\n":       "OK",
+		"delete missing.txt\n": "OK",
+		"delete sub\n":         "REJECTED file is a directory",
+		"delete ../x.txt\n":    "REJECTED unsafe file name",
+	} {
+		if replies := testSession(t, cfg, request); !strings.Contains(replies, want) {
+			t.Errorf("%q: replies %q, want %q", request, replies, want)
+		}
+	}
+	if _, err := os.Stat(stored); !os.IsNotExist(err) {
+		t.Errorf("deleted file still stored: %v", err)
+	}
+}